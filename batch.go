@@ -0,0 +1,100 @@
+package joise
+
+import (
+	"context"
+	"sync"
+)
+
+// sharedListStore is an IndexStore for a batch of queries run one after
+// another, which keeps the posting lists read by a query in memory until
+// the last query of the batch needing them is done, so every posting list
+// needed by several queries is read from the store once.
+type sharedListStore struct {
+	IndexStore
+	mu sync.Mutex
+	// The tokens of every query in the batch
+	queryTokens [][]int64
+	// The number of queries not yet done that need the posting list of a
+	// token
+	refs map[int64]int
+	// The posting lists read and needed by the queries not yet done
+	lists map[int64][]ListEntry
+	// The number of posting lists read from memory instead of the store
+	numShared int
+}
+
+// Creates a store sharing the posting lists of the query tokens over the
+// underlying store.
+func newSharedListStore(store IndexStore, tb TokenTable,
+	queries []RawTokenSet) (*sharedListStore, error) {
+	s := &sharedListStore{
+		IndexStore:  store,
+		queryTokens: make([][]int64, len(queries)),
+		refs:        make(map[int64]int),
+		lists:       make(map[int64][]ListEntry),
+	}
+	for i, query := range queries {
+		tokens, _, _, err := tb.process(query)
+		if err != nil {
+			return nil, err
+		}
+		for _, token := range tokens {
+			s.refs[token]++
+		}
+		s.queryTokens[i] = tokens
+	}
+	return s, nil
+}
+
+func (s *sharedListStore) InvertedList(token int64) ([]ListEntry, error) {
+	return s.InvertedListContext(context.Background(), token)
+}
+
+// InvertedListContext reads the posting list of a token from memory if a
+// previous query has read it, and keeps the list read from the store in
+// memory if later queries need it.
+func (s *sharedListStore) InvertedListContext(ctx context.Context, token int64) ([]ListEntry, error) {
+	s.mu.Lock()
+	if entries, exists := s.lists[token]; exists {
+		s.numShared++
+		s.mu.Unlock()
+		return entries, nil
+	}
+	s.mu.Unlock()
+	entries, err := readInvertedList(ctx, s.IndexStore, token)
+	if err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	if s.refs[token] > 1 {
+		s.lists[token] = entries
+	}
+	s.mu.Unlock()
+	return entries, nil
+}
+
+func (s *sharedListStore) SetTokensContext(ctx context.Context, setID int64) ([]int64, error) {
+	return readSetTokens(ctx, s.IndexStore, setID)
+}
+
+func (s *sharedListStore) SetTokensSuffixContext(ctx context.Context, setID int64, startPos int) ([]int64, error) {
+	return readSetTokensSuffix(ctx, s.IndexStore, setID, startPos)
+}
+
+// Marks the query at index i of the batch done, and releases the posting
+// lists no longer needed by the remaining queries. Returns the number of
+// posting lists the query read from memory.
+func (s *sharedListStore) done(i int) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, token := range s.queryTokens[i] {
+		s.refs[token]--
+		if s.refs[token] <= 0 {
+			delete(s.refs, token)
+			delete(s.lists, token)
+		}
+	}
+	numShared := s.numShared
+	s.numShared = 0
+	return numShared
+}
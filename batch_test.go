@@ -0,0 +1,111 @@
+package joise
+
+import (
+	"context"
+	"math/rand"
+	"sync"
+	"testing"
+)
+
+// lockedListCountingStore counts the posting lists read concurrently
+type lockedListCountingStore struct {
+	IndexStore
+	lock        sync.Mutex
+	numListRead int
+}
+
+func (s *lockedListCountingStore) InvertedList(token int64) ([]ListEntry, error) {
+	s.lock.Lock()
+	s.numListRead++
+	s.lock.Unlock()
+	return s.IndexStore.InvertedList(token)
+}
+
+func TestBatchTopK(t *testing.T) {
+	r := rand.New(rand.NewSource(21))
+	sets := randomRawSets(r, 500, 300)
+	memStore := buildTestMemStore(t, sets)
+	tb, err := CreateTokenTableMem(memStore, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var queries []RawTokenSet
+	for q := 0; q < 30; q++ {
+		query := randomQuery(r, sets)
+		query.ID = int64(q)
+		queries = append(queries, query)
+	}
+	for _, algorithm := range []Algorithm{JOSIE, MergeListD, ProbeSetD} {
+		for _, prefetch := range []int{1, 4} {
+			store := &lockedListCountingStore{IndexStore: memStore}
+			searcher := NewSearcher(store, tb, DefaultCostParameters(), WithAlgorithm(algorithm),
+				WithPrefetch(prefetch))
+			results, stats, err := searcher.BatchTopK(context.Background(), queries, 10)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// The lists read by the queries are read once from the store
+			var numListRead, numListShared int
+			for i, query := range queries {
+				rs := make([]searchResult, len(results[i]))
+				for j, result := range results[i] {
+					rs[j] = searchResult{ID: result.ID, Overlap: result.Overlap}
+				}
+				checkTopK(t, algorithm.String(), rs, bruteForceOverlaps(sets, query.RawTokens), 10)
+				numListRead += stats[i].NumListRead
+				numListShared += stats[i].NumListShared
+			}
+			if numListShared == 0 || store.numListRead+numListShared != numListRead {
+				t.Fatalf("%v: read %d lists from the store, %d by the queries with %d shared",
+					algorithm, store.numListRead, numListRead, numListShared)
+			}
+		}
+	}
+}
+
+func TestStreamBatchTopK(t *testing.T) {
+	r := rand.New(rand.NewSource(22))
+	sets := randomRawSets(r, 500, 300)
+	memStore := buildTestMemStore(t, sets)
+	tb, err := CreateTokenTableMem(memStore, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var queries []RawTokenSet
+	for q := 0; q < 30; q++ {
+		queries = append(queries, randomQuery(r, sets))
+	}
+	store := &lockedListCountingStore{IndexStore: memStore}
+	searcher := NewSearcher(store, tb, DefaultCostParameters())
+	// The results of every query are streamed before its stats, and some
+	// before its last posting list is read
+	results := make([][]searchResult, len(queries))
+	emitListRead := make([]int, len(queries))
+	var numDone, numEarly int
+	err = searcher.StreamBatchTopK(context.Background(), queries, 10, func(i int, result Result) error {
+		if i != numDone {
+			t.Fatalf("got a result of query %d while running query %d", i, numDone)
+		}
+		if len(results[i]) == 0 {
+			emitListRead[i] = store.numListRead
+		}
+		results[i] = append(results[i], searchResult{ID: result.ID, Overlap: result.Overlap})
+		return nil
+	}, func(i int, stats Stats) error {
+		if i != numDone {
+			t.Fatalf("got the stats of query %d while running query %d", i, numDone)
+		}
+		checkTopK(t, "JOSIE", results[i], bruteForceOverlaps(sets, queries[i].RawTokens), 10)
+		if len(results[i]) > 0 && emitListRead[i] < store.numListRead {
+			numEarly++
+		}
+		numDone++
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if numDone != len(queries) || numEarly == 0 {
+		t.Fatalf("got the stats of %d queries, %d with early results", numDone, numEarly)
+	}
+}
@@ -0,0 +1,57 @@
+package joise
+
+// Budget limits the I/O of a top-k search. Once the next posting list or set
+// read would exceed the budget, the search stops and returns the best results
+// found so far. Zero fields are not limited.
+type Budget struct {
+	// MaxListReads is the maximum number of posting lists to read.
+	MaxListReads int
+	// MaxSetReads is the maximum number of sets to read.
+	MaxSetReads int
+	// MaxCost is the maximum I/O time in milliseconds, as estimated by the
+	// cost parameters of the search. Posting lists read concurrently with
+	// WithPrefetch are charged their full read costs.
+	MaxCost float64
+}
+
+func (b Budget) unlimited() bool {
+	return b.MaxListReads <= 0 && b.MaxSetReads <= 0 && b.MaxCost <= 0
+}
+
+// Reports whether a posting list with the estimated read cost can be read
+// after numListRead lists and the spent cost
+func (b Budget) allowsListRead(numListRead int, spentCost, readCost float64) bool {
+	if b.MaxListReads > 0 && numListRead >= b.MaxListReads {
+		return false
+	}
+	return b.MaxCost <= 0 || spentCost+readCost <= b.MaxCost
+}
+
+// Returns the number of distinct posting lists starting at query position i,
+// up to n, that can be read one after another after numListRead lists and
+// the spent cost, which bounds the lists prefetched
+func (b Budget) listReadWindow(cost CostParameters, tokens []int64, freqs []int, gids []int64,
+	i, n, numListRead int, spentCost float64) int {
+	if b.unlimited() {
+		return n
+	}
+	var window int
+	for j := i; j < len(tokens) && window < n; j, _ = nextDistinctList(tokens, gids, j) {
+		readCost := cost.readTokenListCost(tokens[j], freqs[j]+1)
+		if !b.allowsListRead(numListRead+window, spentCost, readCost) {
+			break
+		}
+		spentCost += readCost
+		window++
+	}
+	return window
+}
+
+// Reports whether a set with the estimated read cost can be read after
+// numSetRead sets and the spent cost
+func (b Budget) allowsSetRead(numSetRead int, spentCost, readCost float64) bool {
+	if b.MaxSetReads > 0 && numSetRead >= b.MaxSetReads {
+		return false
+	}
+	return b.MaxCost <= 0 || spentCost+readCost <= b.MaxCost
+}
@@ -0,0 +1,143 @@
+package joise
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"sync"
+	"testing"
+)
+
+// listCostStore counts the posting lists read concurrently and their
+// estimated read costs
+type listCostStore struct {
+	IndexStore
+	lock        sync.Mutex
+	numListRead int
+	listCost    float64
+}
+
+func (s *listCostStore) InvertedList(token int64) ([]ListEntry, error) {
+	entries, err := s.IndexStore.InvertedList(token)
+	s.lock.Lock()
+	s.numListRead++
+	s.listCost += DefaultCostParameters().readListCost(len(entries))
+	s.lock.Unlock()
+	return entries, err
+}
+
+// Checks the results of a top-k search with a budget against the
+// brute-force overlaps: the results of a complete search are exact, and the
+// results of an incomplete search have exact or lower bound overlaps, and no
+// set missing from them has an overlap above the unseen upper bound
+func checkBudgetTopK(t *testing.T, results []Result, stats Stats, overlaps map[int64]int, k int) {
+	t.Helper()
+	if !stats.Incomplete {
+		rs := make([]searchResult, len(results))
+		for i, r := range results {
+			rs[i] = searchResult{ID: r.ID, Overlap: r.Overlap}
+		}
+		checkTopK(t, "JOSIE", rs, overlaps, k)
+		return
+	}
+	found := make(map[int64]bool)
+	for i, r := range results {
+		found[r.ID] = true
+		if i > 0 && r.Overlap > results[i-1].Overlap {
+			t.Fatalf("results %v are not in decreasing overlap order", results)
+		}
+		if r.Overlap > overlaps[r.ID] || (!r.Partial && r.Overlap != overlaps[r.ID]) {
+			t.Fatalf("set %d with overlap %d (exact %d, partial %v)", r.ID, r.Overlap, overlaps[r.ID], r.Partial)
+		}
+	}
+	for id, overlap := range overlaps {
+		if !found[id] && float64(overlap) > stats.UnseenUpperbound {
+			t.Fatalf("set %d with overlap %d is above the unseen upper bound %v",
+				id, overlap, stats.UnseenUpperbound)
+		}
+	}
+}
+
+func TestBudget(t *testing.T) {
+	defer func(size int) { batchSize = size }(batchSize)
+	batchSize = 3
+	r := rand.New(rand.NewSource(18))
+	sets := randomRawSets(r, 500, 400)
+	store := buildTestMemStore(t, sets)
+	tb, err := CreateTokenTableMem(store, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	var numIncomplete int
+	for q := 0; q < 20; q++ {
+		query := randomQuery(r, sets)
+		overlaps := bruteForceOverlaps(sets, query.RawTokens)
+		for _, budget := range []Budget{{MaxListReads: 1}, {MaxListReads: 5}, {MaxSetReads: 1},
+			{MaxSetReads: 4}, {MaxCost: 5}, {MaxCost: 50}, {MaxListReads: 5, MaxSetReads: 2}} {
+			searcher := NewSearcher(store, tb, DefaultCostParameters(), WithBudget(budget))
+			for _, k := range []int{1, 5, 20} {
+				results, stats, err := searcher.TopK(ctx, query, k)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if (budget.MaxListReads > 0 && stats.NumListRead > budget.MaxListReads) ||
+					(budget.MaxSetReads > 0 && stats.NumSetRead > budget.MaxSetReads) {
+					t.Fatalf("budget %+v: read %d lists and %d sets", budget, stats.NumListRead, stats.NumSetRead)
+				}
+				if stats.Incomplete {
+					numIncomplete++
+				}
+				checkBudgetTopK(t, results, stats, overlaps, k)
+			}
+		}
+	}
+	if numIncomplete == 0 {
+		t.Fatal("no search runs out of budget")
+	}
+
+	searcher := NewSearcher(store, tb, DefaultCostParameters(), WithBudget(Budget{MaxSetReads: 1}),
+		WithAlgorithm(ProbeSetD))
+	if _, _, err := searcher.TopK(ctx, randomQuery(r, sets), 5); !errors.Is(err, ErrInvalidSearch) {
+		t.Fatalf("got error %v for a budget with ProbeSet-D", err)
+	}
+}
+
+func TestBudgetPrefetch(t *testing.T) {
+	r := rand.New(rand.NewSource(23))
+	sets := randomRawSets(r, 500, 400)
+	memStore := buildTestMemStore(t, sets)
+	tb, err := CreateTokenTableMem(memStore, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	for q := 0; q < 20; q++ {
+		query := randomQuery(r, sets)
+		overlaps := bruteForceOverlaps(sets, query.RawTokens)
+		for _, budget := range []Budget{{MaxListReads: 1}, {MaxListReads: 3}, {MaxListReads: 5},
+			{MaxCost: 1}, {MaxCost: 5}, {MaxListReads: 3, MaxSetReads: 2}} {
+			for _, prefetch := range []int{2, 4, 8} {
+				// The lists read ahead are within the budget, and are
+				// charged their full costs
+				store := &listCostStore{IndexStore: memStore}
+				searcher := NewSearcher(store, tb, DefaultCostParameters(), WithBudget(budget),
+					WithPrefetch(prefetch))
+				results, stats, err := searcher.TopK(ctx, query, 10)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if budget.MaxListReads > 0 && (stats.NumListRead > budget.MaxListReads ||
+					store.numListRead > budget.MaxListReads) {
+					t.Fatalf("budget %+v with prefetch %d: merged %d lists and read %d",
+						budget, prefetch, stats.NumListRead, store.numListRead)
+				}
+				if budget.MaxCost > 0 && store.listCost > budget.MaxCost {
+					t.Fatalf("budget %+v with prefetch %d: read lists costing %v",
+						budget, prefetch, store.listCost)
+				}
+				checkBudgetTopK(t, results, stats, overlaps, 10)
+			}
+		}
+	}
+}
@@ -0,0 +1,386 @@
+package joise
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"log"
+	"os"
+	"strconv"
+)
+
+// IndexWriter receives the posting lists and sets of an index created by
+// BuildIndex. Posting lists are added in increasing token order, followed
+// by the sets in increasing set ID order.
+type IndexWriter interface {
+	AddList(entry TokenEntry, list []ListEntry) error
+	AddSet(setID int64, tokens []int64) error
+	Close() error
+}
+
+// BuildOptions are the options for building an index.
+type BuildOptions struct {
+	// TempDir is the directory for the temporary files of external sorting,
+	// the default is the system temporary directory.
+	TempDir string
+	// MemoryLimit is the number of bytes of records to sort in memory before
+	// spilling to temporary files.
+	MemoryLimit int
+	// SkipTokens are the raw tokens left out of the index.
+	SkipTokens map[string]bool
+}
+
+// DefaultBuildOptions returns the options using the system temporary
+// directory and 1 GB of memory for sorting.
+func DefaultBuildOptions() BuildOptions {
+	return BuildOptions{
+		TempDir:     os.TempDir(),
+		MemoryLimit: 1 << 30,
+	}
+}
+
+// BuildIndex reads line-delimited sets of raw tokens, where each line is a
+// set ID followed by its tokens, all separated by spaces, and blank lines
+// are skipped. It creates the global token order, the duplicate groups, the
+// integer sets and the posting lists, and writes them to w. The caller is
+// responsible for closing w.
+//
+// Tokens are ordered by their frequency, then by the hash value of their
+// posting list, then by the posting list itself, so tokens with identical
+// posting lists are next to each other and form a duplicate group.
+// All intermediate data is sorted externally, so the input can be larger
+// than the memory limit.
+func BuildIndex(input io.Reader, w IndexWriter, opts BuildOptions) error {
+	if opts.TempDir == "" {
+		opts.TempDir = os.TempDir()
+	}
+	// At most two sorters hold records in memory at the same time
+	memLimit := max(opts.MemoryLimit/2, 1<<20)
+
+	// Stage 1: create the posting lists of raw tokens
+	log.Println("Reading raw token sets...")
+	pairs := newExternalSorter(opts.TempDir, memLimit)
+	defer pairs.close()
+	if err := readRawSets(input, opts.SkipTokens, pairs); err != nil {
+		return err
+	}
+
+	// Stage 2: create the global order and the duplicate groups
+	log.Println("Sorting posting lists to create the global token order...")
+	ordered := newExternalSorter(opts.TempDir, memLimit)
+	defer ordered.close()
+	if err := groupRawTokens(pairs, ordered); err != nil {
+		return err
+	}
+	tokenFile, err := os.CreateTemp(opts.TempDir, "josie-tokens-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tokenFile.Name())
+	defer tokenFile.Close()
+	setTokens := newExternalSorter(opts.TempDir, memLimit)
+	defer setTokens.close()
+	numTokens, err := assignTokens(ordered, tokenFile, setTokens)
+	if err != nil {
+		return err
+	}
+	log.Printf("Created global order of %d tokens", numTokens)
+
+	// Stage 3: create the integer sets
+	log.Println("Creating integer sets...")
+	setFile, err := os.CreateTemp(opts.TempDir, "josie-sets-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(setFile.Name())
+	defer setFile.Close()
+	entries := newExternalSorter(opts.TempDir, memLimit)
+	defer entries.close()
+	numSets, err := createIntegerSets(setTokens, setFile, entries)
+	if err != nil {
+		return err
+	}
+	log.Printf("Created %d integer sets", numSets)
+
+	// Stage 4: create the final posting lists and write the index
+	log.Println("Writing posting lists...")
+	if _, err := tokenFile.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	if err := writePostingLists(entries, bufio.NewReader(tokenFile), w); err != nil {
+		return err
+	}
+	log.Println("Writing integer sets...")
+	if _, err := setFile.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	return writeIntegerSets(bufio.NewReader(setFile), w)
+}
+
+// Read the sets and add (raw token, set ID) pairs to the sorter.
+// A pair record is the length of the raw token, the raw token and the set ID.
+func readRawSets(input io.Reader, skipTokens map[string]bool, pairs *externalSorter) error {
+	r := bufio.NewReaderSize(input, 1<<20)
+	var record []byte
+	var lineNum int
+	for {
+		line, err := r.ReadBytes('\n')
+		if len(line) > 0 {
+			lineNum++
+		}
+		line = bytes.TrimRight(line, "\r\n")
+		// Blank lines, such as a trailing empty line, have no set
+		if len(bytes.TrimSpace(line)) > 0 {
+			fields := bytes.Split(line, []byte(" "))
+			setID, perr := strconv.ParseInt(string(fields[0]), 10, 64)
+			if perr != nil {
+				return fmt.Errorf("line %d: invalid set ID: %w", lineNum, perr)
+			}
+			for _, rawToken := range fields[1:] {
+				if len(rawToken) == 0 || skipTokens[string(rawToken)] {
+					continue
+				}
+				record = append(record[:0], 0, 0, 0, 0)
+				binary.BigEndian.PutUint32(record, uint32(len(rawToken)))
+				record = append(record, rawToken...)
+				record = append(record, make([]byte, 8)...)
+				putKey(record[len(record)-8:], setID)
+				if err := pairs.add(record); err != nil {
+					return err
+				}
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// Group the pairs by raw token into posting lists, and add them to the
+// sorter for the global order. An ordering record is the frequency, the
+// hash value of the posting list, the posting list and the raw token.
+func groupRawTokens(pairs, ordered *externalSorter) error {
+	var rawToken []byte
+	var setIDs []int64
+	var record []byte
+	flush := func() error {
+		if len(setIDs) == 0 {
+			return nil
+		}
+		record = append(record[:0], make([]byte, 16+8*len(setIDs))...)
+		putKey(record, int64(len(setIDs)))
+		h := fnv.New64a()
+		for i, id := range setIDs {
+			putKey(record[16+8*i:], id)
+		}
+		h.Write(record[16:])
+		binary.BigEndian.PutUint64(record[8:], h.Sum64())
+		record = append(record, rawToken...)
+		return ordered.add(record)
+	}
+	err := pairs.each(func(pair []byte) error {
+		n := binary.BigEndian.Uint32(pair)
+		raw := pair[4 : 4+n]
+		setID := getKey(pair[4+n:])
+		if !bytes.Equal(raw, rawToken) || len(setIDs) == 0 {
+			if err := flush(); err != nil {
+				return err
+			}
+			rawToken = append(rawToken[:0], raw...)
+			setIDs = setIDs[:0]
+		} else if setIDs[len(setIDs)-1] == setID {
+			// Duplicate token in the same set
+			return nil
+		}
+		setIDs = append(setIDs, setID)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return flush()
+}
+
+// Assign tokens and duplicate group IDs following the global order. The
+// token metadata is written to the token file in token order, and the
+// (set ID, token) records are added to the set token sorter.
+func assignTokens(ordered *externalSorter, tokenFile io.Writer, setTokens *externalSorter) (int64, error) {
+	w := bufio.NewWriter(tokenFile)
+	var token, gid int64 = -1, -1
+	var prevList []byte
+	var record [16]byte
+	var buf [binary.MaxVarintLen64]byte
+	err := ordered.each(func(r []byte) error {
+		token++
+		frequency := getKey(r)
+		list := r[:16+8*frequency]
+		rawToken := r[16+8*frequency:]
+		if !bytes.Equal(list, prevList) {
+			gid++
+			prevList = append(prevList[:0], list...)
+		}
+		for _, v := range []uint64{uint64(len(rawToken)), uint64(gid), uint64(frequency)} {
+			n := binary.PutUvarint(buf[:], v)
+			if _, err := w.Write(buf[:n]); err != nil {
+				return err
+			}
+		}
+		if _, err := w.Write(rawToken); err != nil {
+			return err
+		}
+		for i := int64(0); i < frequency; i++ {
+			copy(record[:8], list[16+8*i:24+8*i])
+			putKey(record[8:], token)
+			if err := setTokens.add(record[:]); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return token + 1, w.Flush()
+}
+
+// Group the set tokens by set ID into integer sets and write them to the
+// set file, then add the (token, set ID, size, match position) records to
+// the posting list entry sorter.
+func createIntegerSets(setTokens *externalSorter, setFile io.Writer, entries *externalSorter) (int, error) {
+	w := bufio.NewWriter(setFile)
+	var numSets int
+	var setID int64
+	var tokens []int64
+	var record [32]byte
+	var buf [2 * binary.MaxVarintLen64]byte
+	flush := func() error {
+		if len(tokens) == 0 {
+			return nil
+		}
+		numSets++
+		n := binary.PutVarint(buf[:], setID)
+		n += binary.PutUvarint(buf[n:], uint64(len(tokens)))
+		if _, err := w.Write(buf[:n]); err != nil {
+			return err
+		}
+		var prev int64
+		for i, token := range tokens {
+			n = binary.PutUvarint(buf[:], uint64(token-prev))
+			if _, err := w.Write(buf[:n]); err != nil {
+				return err
+			}
+			prev = token
+			putKey(record[:], token)
+			putKey(record[8:], setID)
+			putKey(record[16:], int64(len(tokens)))
+			putKey(record[24:], int64(i))
+			if err := entries.add(record[:]); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	err := setTokens.each(func(r []byte) error {
+		id := getKey(r)
+		if id != setID || len(tokens) == 0 {
+			if err := flush(); err != nil {
+				return err
+			}
+			setID = id
+			tokens = tokens[:0]
+		}
+		tokens = append(tokens, getKey(r[8:]))
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	if err := flush(); err != nil {
+		return 0, err
+	}
+	return numSets, w.Flush()
+}
+
+// Group the posting list entries by token, join them with the token
+// metadata, and write the posting lists.
+func writePostingLists(entries *externalSorter, tokenFile *bufio.Reader, w IndexWriter) error {
+	var token int64 = -1
+	var list []ListEntry
+	flush := func() error {
+		if len(list) == 0 {
+			return nil
+		}
+		entry := TokenEntry{Token: token}
+		var meta [3]uint64
+		for i := range meta {
+			v, err := binary.ReadUvarint(tokenFile)
+			if err != nil {
+				return err
+			}
+			meta[i] = v
+		}
+		entry.RawToken = make([]byte, meta[0])
+		if _, err := io.ReadFull(tokenFile, entry.RawToken); err != nil {
+			return err
+		}
+		entry.GroupID = int64(meta[1])
+		entry.Frequency = int(meta[2])
+		return w.AddList(entry, list)
+	}
+	err := entries.each(func(r []byte) error {
+		t := getKey(r)
+		if t != token {
+			if err := flush(); err != nil {
+				return err
+			}
+			token = t
+			list = list[:0]
+		}
+		list = append(list, ListEntry{
+			ID:            getKey(r[8:]),
+			Size:          int(getKey(r[16:])),
+			MatchPosition: int(getKey(r[24:])),
+		})
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return flush()
+}
+
+// Read the integer sets from the set file and write them.
+func writeIntegerSets(setFile *bufio.Reader, w IndexWriter) error {
+	for {
+		setID, err := binary.ReadVarint(setFile)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		size, err := binary.ReadUvarint(setFile)
+		if err != nil {
+			return err
+		}
+		tokens := make([]int64, size)
+		var prev int64
+		for i := range tokens {
+			d, err := binary.ReadUvarint(setFile)
+			if err != nil {
+				return err
+			}
+			tokens[i] = prev + int64(d)
+			prev = tokens[i]
+		}
+		if err := w.AddSet(setID, tokens); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,120 @@
+package joise
+
+import (
+	"fmt"
+	"math/rand"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestBuildIndex(t *testing.T) {
+	r := rand.New(rand.NewSource(4))
+	// Enough sets for the external sorters to spill to temporary files
+	sets := randomRawSets(r, 5000, 3000)
+	var input strings.Builder
+	for id, tokens := range sets {
+		fmt.Fprintf(&input, "%d %s\n", id, strings.Join(tokens, " "))
+	}
+	opts := DefaultBuildOptions()
+	opts.TempDir = t.TempDir()
+	opts.MemoryLimit = 0
+	opts.SkipTokens = map[string]bool{"t0": true}
+	store := NewMemStore()
+	if err := BuildIndex(strings.NewReader(input.String()), memStoreWriter{store}, opts); err != nil {
+		t.Fatal(err)
+	}
+	var entries []TokenEntry
+	if err := store.ScanTokenEntries(func(entry TokenEntry) error {
+		entries = append(entries, entry)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	// Tokens are ordered by frequency and the tokens of a duplicate group
+	// are next to each other
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Token < entries[j].Token })
+	rawTokens := make(map[int64]string)
+	for i, entry := range entries {
+		rawTokens[entry.Token] = string(entry.RawToken)
+		if i > 0 && (entry.Frequency < entries[i-1].Frequency || entry.GroupID < entries[i-1].GroupID) {
+			t.Fatalf("token %v is ordered after %v", entry, entries[i-1])
+		}
+	}
+	for id, tokens := range sets {
+		var want []string
+		for _, rawToken := range distinctRawTokens(tokens) {
+			if !opts.SkipTokens[string(rawToken)] {
+				want = append(want, string(rawToken))
+			}
+		}
+		got, err := store.SetTokens(id)
+		if len(want) == 0 {
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		var gotRaw []string
+		for i, token := range got {
+			if i > 0 && token <= got[i-1] {
+				t.Fatalf("set %d: tokens %v are not sorted", id, got)
+			}
+			gotRaw = append(gotRaw, rawTokens[token])
+			list, err := store.InvertedList(token)
+			if err != nil {
+				t.Fatal(err)
+			}
+			j := sort.Search(len(list), func(j int) bool { return list[j].ID >= id })
+			if j == len(list) || list[j] != (ListEntry{ID: id, Size: len(got), MatchPosition: i}) {
+				t.Fatalf("set %d: no posting list entry at position %d of token %d", id, i, token)
+			}
+		}
+		sort.Strings(want)
+		sort.Strings(gotRaw)
+		if fmt.Sprint(gotRaw) != fmt.Sprint(want) {
+			t.Fatalf("set %d: got raw tokens %v, want %v", id, gotRaw, want)
+		}
+	}
+}
+
+func TestBuildIndexBlankLines(t *testing.T) {
+	input := "1 a b c\n\n2 b c\r\n   \n3 c d\n\n"
+	store := NewMemStore()
+	opts := DefaultBuildOptions()
+	opts.TempDir = t.TempDir()
+	if err := BuildIndex(strings.NewReader(input), memStoreWriter{store}, opts); err != nil {
+		t.Fatal(err)
+	}
+	if store.NumSets() != 3 {
+		t.Fatalf("got %d sets, want 3", store.NumSets())
+	}
+	tb, err := CreateTokenTableMem(store, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for id, rawTokens := range map[int64][]string{1: {"a", "b", "c"}, 2: {"b", "c"}, 3: {"c", "d"}} {
+		var query RawTokenSet
+		for _, rawToken := range rawTokens {
+			query.RawTokens = append(query.RawTokens, []byte(rawToken))
+		}
+		want, _, _, _ := tb.process(query)
+		got, err := store.SetTokens(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("set %d: got tokens %v, want %v", id, got, want)
+		}
+	}
+}
+
+func TestBuildIndexInvalidSetID(t *testing.T) {
+	opts := DefaultBuildOptions()
+	opts.TempDir = t.TempDir()
+	err := BuildIndex(strings.NewReader("1 a b\n\nx c d\n"), memStoreWriter{NewMemStore()}, opts)
+	if err == nil || !strings.HasPrefix(err.Error(), "line 3: invalid set ID") {
+		t.Fatalf("got error %v", err)
+	}
+}
@@ -0,0 +1,270 @@
+package joise
+
+import (
+	"container/list"
+	"context"
+	"sync"
+)
+
+// The approximate memory size in bytes of a cached item other than its
+// posting list entries or tokens
+const cacheItemOverhead = 64
+
+// CachedStore is an IndexStore that keeps the most recently read posting
+// lists and sets in memory, up to a total size in bytes, and evicts the
+// least recently used ones beyond that. Sets are cached from the start
+// position of the read, so a cached suffix also serves the reads of shorter
+// suffixes of the set. A Searcher over a CachedStore estimates near-zero
+// costs for reading cached posting lists and sets, and reports the cache
+// hits and misses of every search in its Stats.
+//
+// The cache is not invalidated when the underlying store is updated, so a
+// new CachedStore should be created after updating the index. The slices
+// returned by its read methods are shared with the cache and must not be
+// modified.
+type CachedStore struct {
+	IndexStore
+	maxBytes int64
+	mu       sync.Mutex
+	numBytes int64
+	lru      *list.List // the cached items, the most recently used first
+	lists    map[int64]*list.Element
+	sets     map[int64]*list.Element
+}
+
+type cachedItem struct {
+	isSet    bool
+	id       int64       // the token of a posting list or the ID of a set
+	entries  []ListEntry // the posting list
+	startPos int         // the position of the first cached token of a set
+	tokens   []int64     // the tokens of a set from startPos
+	numBytes int64
+}
+
+// NewCachedStore creates a cache of at most maxBytes bytes of posting lists
+// and sets read from the store.
+func NewCachedStore(store IndexStore, maxBytes int64) *CachedStore {
+	return &CachedStore{
+		IndexStore: store,
+		maxBytes:   maxBytes,
+		lru:        list.New(),
+		lists:      make(map[int64]*list.Element),
+		sets:       make(map[int64]*list.Element),
+	}
+}
+
+// NumBytes returns the memory size in bytes of the cached posting lists and
+// sets.
+func (c *CachedStore) NumBytes() int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.numBytes
+}
+
+// Reports whether the posting list of a token is cached
+func (c *CachedStore) hasList(token int64) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, exists := c.lists[token]
+	return exists
+}
+
+// Reports whether the tokens of a set from startPos are cached
+func (c *CachedStore) hasSet(setID int64, startPos int) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, exists := c.sets[setID]
+	return exists && e.Value.(*cachedItem).startPos <= startPos
+}
+
+func (c *CachedStore) InvertedList(token int64) ([]ListEntry, error) {
+	return c.InvertedListContext(context.Background(), token)
+}
+
+// InvertedListContext reads the posting list of a token from the cache, or
+// from the underlying store and caches it.
+func (c *CachedStore) InvertedListContext(ctx context.Context, token int64) ([]ListEntry, error) {
+	c.mu.Lock()
+	if e, exists := c.lists[token]; exists {
+		c.lru.MoveToFront(e)
+		c.mu.Unlock()
+		cacheStatsFrom(ctx).addList(true)
+		return e.Value.(*cachedItem).entries, nil
+	}
+	c.mu.Unlock()
+	cacheStatsFrom(ctx).addList(false)
+	entries, err := readInvertedList(ctx, c.IndexStore, token)
+	if err != nil {
+		return nil, err
+	}
+	c.add(&cachedItem{id: token, entries: entries,
+		numBytes: cacheItemOverhead + int64(len(entries))*24})
+	return entries, nil
+}
+
+func (c *CachedStore) SetTokens(setID int64) ([]int64, error) {
+	return c.SetTokensContext(context.Background(), setID)
+}
+
+// SetTokensContext reads all tokens of a set from the cache, or from the
+// underlying store and caches them.
+func (c *CachedStore) SetTokensContext(ctx context.Context, setID int64) ([]int64, error) {
+	return c.SetTokensSuffixContext(ctx, setID, 0)
+}
+
+func (c *CachedStore) SetTokensSuffix(setID int64, startPos int) ([]int64, error) {
+	return c.SetTokensSuffixContext(context.Background(), setID, startPos)
+}
+
+// SetTokensSuffixContext reads the tokens of a set starting from startPos
+// from the cache, or from the underlying store and caches them.
+func (c *CachedStore) SetTokensSuffixContext(ctx context.Context, setID int64, startPos int) ([]int64, error) {
+	if tokens, hit := c.getSet(setID, startPos, -1); hit {
+		cacheStatsFrom(ctx).addSet(true)
+		return tokens, nil
+	}
+	cacheStatsFrom(ctx).addSet(false)
+	var tokens []int64
+	var err error
+	if startPos == 0 {
+		tokens, err = readSetTokens(ctx, c.IndexStore, setID)
+	} else {
+		tokens, err = readSetTokensSuffix(ctx, c.IndexStore, setID, startPos)
+	}
+	if err != nil {
+		return nil, err
+	}
+	c.add(&cachedItem{isSet: true, id: setID, startPos: startPos, tokens: tokens,
+		numBytes: cacheItemOverhead + int64(len(tokens))*8})
+	return tokens, nil
+}
+
+// SetTokensSubset reads the tokens of a set from startPos (inclusive) to
+// endPos (non-inclusive) from the cache if cached, or from the underlying
+// store without caching them.
+func (c *CachedStore) SetTokensSubset(setID int64, startPos, endPos int) ([]int64, error) {
+	if tokens, hit := c.getSet(setID, startPos, endPos); hit {
+		return tokens, nil
+	}
+	return c.IndexStore.SetTokensSubset(setID, startPos, endPos)
+}
+
+// Returns the cached tokens of a set from startPos to endPos, or to the end
+// of the set if endPos is negative
+func (c *CachedStore) getSet(setID int64, startPos, endPos int) ([]int64, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, exists := c.sets[setID]
+	if !exists {
+		return nil, false
+	}
+	item := e.Value.(*cachedItem)
+	if item.startPos > startPos {
+		return nil, false
+	}
+	c.lru.MoveToFront(e)
+	start := min(startPos-item.startPos, len(item.tokens))
+	if endPos < 0 {
+		return item.tokens[start:], true
+	}
+	return item.tokens[start:max(start, min(endPos-item.startPos, len(item.tokens)))], true
+}
+
+// Adds an item to the cache, replacing the cached item of the same posting
+// list or set, and evicts the least recently used items beyond the maximum
+// size. Items larger than the maximum size are not cached.
+func (c *CachedStore) add(item *cachedItem) {
+	if item.numBytes > c.maxBytes {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	items := c.lists
+	if item.isSet {
+		items = c.sets
+	}
+	if e, exists := items[item.id]; exists {
+		old := e.Value.(*cachedItem)
+		// Keep the longer suffix of a set
+		if old.startPos <= item.startPos {
+			c.lru.MoveToFront(e)
+			return
+		}
+		c.remove(e)
+	}
+	items[item.id] = c.lru.PushFront(item)
+	c.numBytes += item.numBytes
+	for c.numBytes > c.maxBytes {
+		c.remove(c.lru.Back())
+	}
+}
+
+func (c *CachedStore) remove(e *list.Element) {
+	item := c.lru.Remove(e).(*cachedItem)
+	if item.isSet {
+		delete(c.sets, item.id)
+	} else {
+		delete(c.lists, item.id)
+	}
+	c.numBytes -= item.numBytes
+}
+
+// cacheStats counts the cache hits and misses of a search, which are
+// recorded through the context of the search.
+type cacheStats struct {
+	mu                      sync.Mutex
+	numListHit, numListMiss int
+	numSetHit, numSetMiss   int
+}
+
+type cacheStatsKey struct{}
+
+// Returns a context recording the cache hits and misses of the reads using
+// it in the returned stats
+func withCacheStats(ctx context.Context) (context.Context, *cacheStats) {
+	s := &cacheStats{}
+	return context.WithValue(ctx, cacheStatsKey{}, s), s
+}
+
+// Returns the stats recording the cache hits and misses of the context, or
+// nil
+func cacheStatsFrom(ctx context.Context) *cacheStats {
+	s, _ := ctx.Value(cacheStatsKey{}).(*cacheStats)
+	return s
+}
+
+func (s *cacheStats) addList(hit bool) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if hit {
+		s.numListHit++
+	} else {
+		s.numListMiss++
+	}
+}
+
+func (s *cacheStats) addSet(hit bool) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if hit {
+		s.numSetHit++
+	} else {
+		s.numSetMiss++
+	}
+}
+
+// Records the cache hits and misses in the experiment result
+func (s *cacheStats) record(expResult *experimentResult) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	expResult.NumListCacheHit = s.numListHit
+	expResult.NumListCacheMiss = s.numListMiss
+	expResult.NumSetCacheHit = s.numSetHit
+	expResult.NumSetCacheMiss = s.numSetMiss
+}
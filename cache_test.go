@@ -0,0 +1,114 @@
+package joise
+
+import (
+	"context"
+	"math/rand"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+func TestCachedStore(t *testing.T) {
+	r := rand.New(rand.NewSource(22))
+	sets := randomRawSets(r, 500, 400)
+	memStore := buildTestMemStore(t, sets)
+	tb, err := CreateTokenTableMem(memStore, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var queries []RawTokenSet
+	for q := 0; q < 20; q++ {
+		queries = append(queries, randomQuery(r, sets))
+	}
+	for _, maxBytes := range []int64{0, 4 << 10, 64 << 10, 64 << 20} {
+		store := NewCachedStore(memStore, maxBytes)
+		var numListCacheHit int
+		// The second round reads from the cache
+		for round := 0; round < 2; round++ {
+			for _, query := range queries {
+				overlaps := bruteForceOverlaps(sets, query.RawTokens)
+				for _, algorithm := range []Algorithm{JOSIE, MergeListD, ProbeSetD} {
+					searcher := NewSearcher(store, tb, DefaultCostParameters(), WithAlgorithm(algorithm))
+					results, stats, err := searcher.TopK(context.Background(), query, 10)
+					if err != nil {
+						t.Fatal(err)
+					}
+					rs := make([]searchResult, len(results))
+					for i, result := range results {
+						rs[i] = searchResult{ID: result.ID, Overlap: result.Overlap}
+					}
+					checkTopK(t, algorithm.String(), rs, overlaps, 10)
+					if stats.NumListCacheHit+stats.NumListCacheMiss != stats.NumListRead {
+						t.Fatalf("%v: %d list cache hits and %d misses for %d list reads", algorithm,
+							stats.NumListCacheHit, stats.NumListCacheMiss, stats.NumListRead)
+					}
+					if round == 1 {
+						numListCacheHit += stats.NumListCacheHit
+					}
+				}
+				if store.NumBytes() > maxBytes {
+					t.Fatalf("cache of %d bytes exceeds %d bytes", store.NumBytes(), maxBytes)
+				}
+			}
+		}
+		// Nothing is cached without memory, and every list read is cached
+		// with enough memory
+		if (maxBytes == 0 && numListCacheHit > 0) || (maxBytes == 64<<20 && numListCacheHit == 0) {
+			t.Fatalf("cache of %d bytes has %d list cache hits", maxBytes, numListCacheHit)
+		}
+	}
+
+	// A cached suffix of a set serves the reads of shorter suffixes
+	store := NewCachedStore(memStore, 1<<20)
+	for id := int64(0); id < 50; id++ {
+		want, err := memStore.SetTokens(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(want) < 3 {
+			continue
+		}
+		for _, startPos := range []int{1, 2, 1} {
+			got, err := store.SetTokensSuffix(id, startPos)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, want[startPos:]) {
+				t.Fatalf("set %d from %d: got %v, want %v", id, startPos, got, want[startPos:])
+			}
+		}
+		if !store.hasSet(id, 2) || store.hasSet(id, 0) {
+			t.Fatalf("set %d is not cached from position 1", id)
+		}
+		got, err := store.SetTokensSubset(id, 1, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, want[1:2]) {
+			t.Fatalf("set %d [1, 2): got %v, want %v", id, got, want[1:2])
+		}
+	}
+
+	// Concurrent searches share the cache
+	store = NewCachedStore(memStore, 32<<10)
+	searcher := NewSearcher(store, tb, DefaultCostParameters(), WithPrefetch(4), WithParallelProbes(4))
+	var wg sync.WaitGroup
+	for _, query := range queries {
+		wg.Add(1)
+		go func(query RawTokenSet) {
+			defer wg.Done()
+			results, _, err := searcher.TopK(context.Background(), query, 5)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			overlaps := bruteForceOverlaps(sets, query.RawTokens)
+			for _, result := range results {
+				if result.Overlap != overlaps[result.ID] {
+					t.Errorf("set %d with overlap %d (exact %d)", result.ID, result.Overlap, overlaps[result.ID])
+				}
+			}
+		}(query)
+	}
+	wg.Wait()
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"database/sql"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/ekzhu/josie"
+)
+
+var (
+	pgServer, pgPort          string
+	pgTableLists, pgTableSets string
+	input                     string
+	backend                   string
+	outputDir                 string
+	tempDir                   string
+	memoryLimitMB             int
+	skipTokens                string
+	compressLists             bool
+	compressSets              bool
+)
+
+func main() {
+	flag.StringVar(&input, "input", "", "Input file of line-delimited raw token sets, each line is a set ID followed by tokens separated by spaces")
+	flag.StringVar(&backend, "backend", "postgres", "Index backend to write: postgres or embedded")
+	flag.StringVar(&outputDir, "output-dir", "", "Output directory of the embedded index")
+	flag.StringVar(&pgServer, "pg-server", "localhost", "Postgres server addresss")
+	flag.StringVar(&pgPort, "pg-port", "5442", "Postgres server port")
+	flag.StringVar(&pgTableLists, "pg-table-lists", "canada_us_uk_inverted_lists", "Postgres table for inverted lists")
+	flag.StringVar(&pgTableSets, "pg-table-sets", "canada_us_uk_sets", "Postgres table for sets")
+	flag.StringVar(&tempDir, "temp-dir", os.TempDir(), "Directory for temporary files")
+	flag.IntVar(&memoryLimitMB, "memory-limit-mb", 1024, "Memory in MB for sorting before spilling to temporary files")
+	flag.StringVar(&skipTokens, "skip-tokens", "", "Comma-separated raw tokens to leave out of the index")
+	flag.BoolVar(&compressLists, "compress-lists", false, "Write the posting lists compressed")
+	flag.BoolVar(&compressSets, "compress-sets", false, "Write the sets compressed")
+	flag.Parse()
+	if input == "" {
+		panic("no input file given")
+	}
+
+	f, err := os.Open(input)
+	if err != nil {
+		panic(err)
+	}
+	defer f.Close()
+
+	var storeOpts []joise.StoreOption
+	if compressLists {
+		storeOpts = append(storeOpts, joise.WithCompressedLists())
+	}
+	if compressSets {
+		storeOpts = append(storeOpts, joise.WithCompressedSets())
+	}
+	var w joise.IndexWriter
+	switch backend {
+	case "postgres":
+		db, err := sql.Open("postgres", fmt.Sprintf("host=%s port=%s sslmode=disable", pgServer, pgPort))
+		if err != nil {
+			panic(err)
+		}
+		defer db.Close()
+		w, err = joise.NewPostgresIndexWriter(db, pgTableLists, pgTableSets, storeOpts...)
+		if err != nil {
+			panic(err)
+		}
+	case "embedded":
+		if outputDir == "" {
+			panic("no output directory given for the embedded index")
+		}
+		w, err = joise.CreateFileStore(outputDir, storeOpts...)
+		if err != nil {
+			panic(err)
+		}
+	default:
+		panic("unknown backend " + backend)
+	}
+
+	opts := joise.DefaultBuildOptions()
+	opts.TempDir = tempDir
+	opts.MemoryLimit = memoryLimitMB << 20
+	if skipTokens != "" {
+		opts.SkipTokens = make(map[string]bool)
+		for _, token := range strings.Split(skipTokens, ",") {
+			opts.SkipTokens[token] = true
+		}
+	}
+	if err := joise.BuildIndex(f, w, opts); err != nil {
+		panic(err)
+	}
+	if err := w.Close(); err != nil {
+		panic(err)
+	}
+}
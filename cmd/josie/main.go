@@ -0,0 +1,262 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"encoding/csv"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/ekzhu/josie"
+)
+
+const usage = `Usage: josie <command> [flags]
+
+Commands:
+  search    find the sets with the highest overlaps with a column of values
+
+Run "josie <command> -h" for the flags of a command.
+`
+
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+	switch os.Args[1] {
+	case "search":
+		search(os.Args[2:], os.Stdin, os.Stdout)
+	default:
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+}
+
+// Runs the search command, reading the query values from stdin if no CSV
+// file is given and writing the results to stdout
+func search(args []string, stdin io.Reader, stdout io.Writer) {
+	fs := flag.NewFlagSet("search", flag.ExitOnError)
+	csvFile := fs.String("csv", "", "CSV file with a header row to read the query values from, newline-separated values are read from stdin if not given")
+	column := fs.String("column", "", "Column of the CSV file with the query values")
+	k := fs.Int("k", 10, "Number of sets to find")
+	algorithm := fs.String("algorithm", "merge_probe_cost_model_greedy", "Search algorithm: merge_probe_cost_model_greedy, merge_distinct_list or probe_set_optimized")
+	scoring := fs.String("scoring", "overlap", "Scoring function ranking the sets: overlap, jaccard, containment or query_containment")
+	prefetch := fs.Int("prefetch", 1, "Number of posting lists read concurrently")
+	probe := fs.Int("probe", 1, "Number of candidate sets read concurrently")
+	timeout := fs.Duration("timeout", 0, "Time limit of the search, after which the best results found so far are printed, no limit if zero")
+	metadata := fs.String("metadata", "", "CSV file with a header row mapping set IDs in the first column to their source metadata in the other columns, which are printed with the results")
+	backend := fs.String("backend", "postgres", "Index backend to search: postgres or embedded")
+	indexDir := fs.String("index-dir", "", "Directory of the embedded index")
+	pgServer := fs.String("pg-server", "localhost", "Postgres server addresss")
+	pgPort := fs.String("pg-port", "5442", "Postgres server port")
+	pgTableLists := fs.String("pg-table-lists", "canada_us_uk_inverted_lists", "Postgres table for inverted lists")
+	pgTableSets := fs.String("pg-table-sets", "canada_us_uk_sets", "Postgres table for sets")
+	compressedLists := fs.Bool("compressed-lists", false, "Read the compressed posting lists of Postgres tables written with build_index -compress-lists")
+	tokenTableSnapshot := fs.String("token-table-snapshot", "", "Snapshot file of the token table, which is loaded instead of reading all tokens from the index and rewritten if stale")
+	compactTokenTable := fs.Bool("compact-token-table", false, "Keep the token table in a sorted array instead of a map, which takes less memory than a map for large indexes")
+	compressedSets := fs.Bool("compressed-sets", false, "Read the compressed sets of Postgres tables written with build_index -compress-sets")
+	fs.Parse(args)
+
+	a, err := joise.ParseAlgorithm(*algorithm)
+	if err != nil {
+		panic(err)
+	}
+	sc, err := joise.ParseScoring(*scoring)
+	if err != nil {
+		panic(err)
+	}
+
+	// Read the query values
+	var values [][]byte
+	if *csvFile != "" {
+		if *column == "" {
+			panic("no column given for the CSV file")
+		}
+		values, err = readCSVColumn(*csvFile, *column)
+	} else {
+		values, err = readLines(stdin)
+	}
+	if err != nil {
+		panic(err)
+	}
+
+	// Read the source metadata
+	var header []string
+	var sources map[int64][]string
+	if *metadata != "" {
+		header, sources, err = readMetadata(*metadata)
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	// Open the index
+	var store joise.IndexStore
+	switch *backend {
+	case "postgres":
+		db, err := sql.Open("postgres", fmt.Sprintf("host=%s port=%s sslmode=disable", *pgServer, *pgPort))
+		if err != nil {
+			panic(err)
+		}
+		defer db.Close()
+		var opts []joise.StoreOption
+		if *compressedLists {
+			opts = append(opts, joise.WithCompressedLists())
+		}
+		if *compressedSets {
+			opts = append(opts, joise.WithCompressedSets())
+		}
+		store = joise.NewPostgresStore(db, *pgTableLists, *pgTableSets, opts...)
+	case "embedded":
+		if *indexDir == "" {
+			panic("no index directory given for the embedded index")
+		}
+		s, err := joise.OpenFileStore(*indexDir)
+		if err != nil {
+			panic(err)
+		}
+		defer s.Close()
+		store = s
+	default:
+		panic("unknown backend " + *backend)
+	}
+	var tb joise.TokenTable
+	switch {
+	case *tokenTableSnapshot != "" && *compactTokenTable:
+		tb, err = joise.CreateTokenTableCompactSnapshot(*tokenTableSnapshot, store, false)
+	case *tokenTableSnapshot != "":
+		tb, err = joise.CreateTokenTableMemSnapshot(*tokenTableSnapshot, store, false)
+	case *compactTokenTable:
+		tb, err = joise.CreateTokenTableCompact(store, false)
+	default:
+		tb, err = joise.CreateTokenTableMem(store, false)
+	}
+	if err != nil {
+		panic(err)
+	}
+	if n := joise.TokenTableCollisions(tb); n > 0 {
+		fmt.Fprintf(os.Stderr, "%d raw tokens share their hash values with other raw tokens\n", n)
+	}
+
+	s := joise.NewSearcher(store, tb, joise.DefaultCostParameters(),
+		joise.WithAlgorithm(a), joise.WithScoring(sc), joise.WithPrefetch(*prefetch),
+		joise.WithParallelProbes(*probe))
+	ctx := context.Background()
+	if *timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, *timeout)
+		defer cancel()
+	}
+	results, stats, err := s.TopK(ctx, joise.RawTokenSet{RawTokens: values}, *k)
+	if err != nil {
+		panic(err)
+	}
+	if stats.Incomplete {
+		fmt.Fprintf(os.Stderr, "The search reached the time limit of %v, the results may be incomplete and their overlaps may be lower bounds\n", *timeout)
+	}
+
+	// Print the results as tab-separated values
+	w := bufio.NewWriter(stdout)
+	defer w.Flush()
+	fmt.Fprint(w, "set_id\toverlap\tscore")
+	if len(header) > 1 {
+		fmt.Fprint(w, "\t", strings.Join(header[1:], "\t"))
+	}
+	fmt.Fprintln(w)
+	for _, r := range results {
+		fmt.Fprintf(w, "%d\t%d\t%s", r.ID, r.Overlap, strconv.FormatFloat(r.Score, 'g', -1, 64))
+		if len(header) > 1 {
+			source := make([]string, len(header)-1)
+			copy(source, sources[r.ID])
+			fmt.Fprint(w, "\t", strings.Join(source, "\t"))
+		}
+		fmt.Fprintln(w)
+	}
+}
+
+// Reads the non-empty values of a column from a CSV file with a header row
+func readCSVColumn(filename, column string) ([][]byte, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	r := csv.NewReader(f)
+	r.FieldsPerRecord = -1
+	header, err := r.Read()
+	if err != nil {
+		return nil, err
+	}
+	index := -1
+	for i, name := range header {
+		if name == column {
+			index = i
+			break
+		}
+	}
+	if index < 0 {
+		return nil, fmt.Errorf("column %q not found in %s", column, filename)
+	}
+	var values [][]byte
+	for {
+		record, err := r.Read()
+		if err == io.EOF {
+			return values, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if index < len(record) && record[index] != "" {
+			values = append(values, []byte(record[index]))
+		}
+	}
+}
+
+// Reads the non-empty lines as values
+func readLines(r io.Reader) ([][]byte, error) {
+	var values [][]byte
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		if line := strings.TrimRight(scanner.Text(), "\r"); line != "" {
+			values = append(values, []byte(line))
+		}
+	}
+	return values, scanner.Err()
+}
+
+// Reads the source metadata of sets from a CSV file with a header row,
+// where the first column is the set ID
+func readMetadata(filename string) ([]string, map[int64][]string, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+	r := csv.NewReader(f)
+	r.FieldsPerRecord = -1
+	header, err := r.Read()
+	if err != nil {
+		return nil, nil, err
+	}
+	sources := make(map[int64][]string)
+	for {
+		record, err := r.Read()
+		if err == io.EOF {
+			return header, sources, nil
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		setID, err := strconv.ParseInt(record[0], 10, 64)
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid set ID %q in %s", record[0], filename)
+		}
+		sources[setID] = record[1:]
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/ekzhu/josie"
+)
+
+// Builds an embedded index of the sets in a temporary directory
+func buildTestIndex(t *testing.T, sets string) string {
+	t.Helper()
+	dir := t.TempDir()
+	w, err := joise.CreateFileStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := joise.DefaultBuildOptions()
+	opts.TempDir = t.TempDir()
+	if err := joise.BuildIndex(strings.NewReader(sets), w, opts); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func writeTestFile(t *testing.T, name, content string) string {
+	t.Helper()
+	name = filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(name, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return name
+}
+
+func TestSearch(t *testing.T) {
+	indexDir := buildTestIndex(t, "1 a b c d\n2 a b\n3 c d e\n4 x y\n5 b d e f g\n")
+	metadata := writeTestFile(t, "metadata.csv", "set_id,table,column\n1,t1,c1\n3,t3,c3\n")
+	query := writeTestFile(t, "query.csv", "name,value\nn1,a\nn2,\nn3,b\nn4,c\nn5,z\n")
+	for _, test := range []struct {
+		args  []string
+		stdin string
+		want  string
+	}{
+		{
+			args:  []string{"-k", "2"},
+			stdin: "a\nb\n\nc\r\nz\n",
+			want:  "set_id\toverlap\tscore\n1\t3\t3\n2\t2\t2\n",
+		},
+		{
+			args:  []string{"-k", "2", "-csv", query, "-column", "value", "-metadata", metadata},
+			stdin: "",
+			want:  "set_id\toverlap\tscore\ttable\tcolumn\n1\t3\t3\tt1\tc1\n2\t2\t2\t\t\n",
+		},
+		{
+			args:  []string{"-k", "2", "-scoring", "containment"},
+			stdin: "c\nd\ne\n",
+			want:  "set_id\toverlap\tscore\n3\t3\t1\n1\t2\t0.5\n",
+		},
+	} {
+		var stdout strings.Builder
+		args := append([]string{"-backend", "embedded", "-index-dir", indexDir}, test.args...)
+		search(args, strings.NewReader(test.stdin), &stdout)
+		if stdout.String() != test.want {
+			t.Fatalf("%v: got output\n%s\nwant\n%s", test.args, stdout.String(), test.want)
+		}
+	}
+}
+
+func TestReadLines(t *testing.T) {
+	values, err := readLines(strings.NewReader("a\r\n\nb c\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(values) != 2 || string(values[0]) != "a" || string(values[1]) != "b c" {
+		t.Fatalf("got values %q", values)
+	}
+}
+
+func TestReadCSVColumnMissing(t *testing.T) {
+	name := writeTestFile(t, "query.csv", "name,value\nn1,a\n")
+	if _, err := readCSVColumn(name, "other"); err == nil {
+		t.Fatal("no error for a missing column")
+	}
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"errors"
+
+	"github.com/ekzhu/josie"
+	"github.com/ekzhu/josie/josiepb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// grpcServer implements the Josie gRPC service over the same index and
+// token table as the HTTP endpoints.
+type grpcServer struct {
+	josiepb.UnimplementedJosieServer
+	s *server
+}
+
+func (g *grpcServer) TopK(req *josiepb.TopKRequest, stream grpc.ServerStreamingServer[josiepb.SearchResponse]) error {
+	searcher, err := g.searcher(req.Algorithm, req.Scoring, newBudget(req.Budget))
+	if err != nil {
+		return grpcError(stream.Context(), err)
+	}
+	ctx, cancel := searchContext(stream.Context(), req.TimeoutMs)
+	defer cancel()
+	stats, err := searcher.StreamTopK(ctx, newQuery(0, req.Tokens), int(req.K),
+		func(r joise.Result) error {
+			return stream.Send(&josiepb.SearchResponse{Results: []*josiepb.Result{newPBResult(r)}})
+		})
+	if err != nil {
+		return grpcError(stream.Context(), err)
+	}
+	return stream.Send(&josiepb.SearchResponse{Stats: newPBStats(stats)})
+}
+
+func (g *grpcServer) ThresholdSearch(req *josiepb.ThresholdSearchRequest, stream grpc.ServerStreamingServer[josiepb.SearchResponse]) error {
+	searcher, err := g.searcher("", "", joise.Budget{})
+	if err != nil {
+		return grpcError(stream.Context(), err)
+	}
+	ctx, cancel := searchContext(stream.Context(), req.TimeoutMs)
+	defer cancel()
+	stats, err := searcher.StreamThresholdSearch(ctx, newQuery(0, req.Tokens),
+		int(req.MinOverlap), func(r joise.Result) error {
+			return stream.Send(&josiepb.SearchResponse{Results: []*josiepb.Result{newPBResult(r)}})
+		})
+	if err != nil {
+		return grpcError(stream.Context(), err)
+	}
+	return stream.Send(&josiepb.SearchResponse{Stats: newPBStats(stats)})
+}
+
+func (g *grpcServer) BatchTopK(req *josiepb.BatchTopKRequest, stream grpc.ServerStreamingServer[josiepb.BatchTopKResponse]) error {
+	searcher, err := g.searcher(req.Algorithm, req.Scoring, newBudget(req.Budget))
+	if err != nil {
+		return grpcError(stream.Context(), err)
+	}
+	queries := make([]joise.RawTokenSet, len(req.Queries))
+	for i, q := range req.Queries {
+		queries[i] = newQuery(q.Id, q.Tokens)
+	}
+	ctx, cancel := searchContext(stream.Context(), req.TimeoutMs)
+	defer cancel()
+	err = searcher.StreamBatchTopK(ctx, queries, int(req.K),
+		func(i int, r joise.Result) error {
+			return stream.Send(&josiepb.BatchTopKResponse{
+				QueryId: req.Queries[i].Id,
+				Results: []*josiepb.Result{newPBResult(r)},
+			})
+		}, func(i int, stats joise.Stats) error {
+			return stream.Send(&josiepb.BatchTopKResponse{
+				QueryId: req.Queries[i].Id,
+				Stats:   newPBStats(stats),
+			})
+		})
+	if err != nil {
+		return grpcError(stream.Context(), err)
+	}
+	return nil
+}
+
+func (g *grpcServer) GetSet(ctx context.Context, req *josiepb.GetSetRequest) (*josiepb.GetSetResponse, error) {
+	if !g.s.isReady() {
+		return nil, status.Error(codes.Unavailable, "index is loading")
+	}
+	tokens, err := g.s.store.SetTokens(req.Id)
+	if errors.Is(err, joise.ErrSetNotFound) {
+		return nil, status.Error(codes.NotFound, err.Error())
+	}
+	if err != nil {
+		return nil, grpcError(ctx, err)
+	}
+	entries, err := g.s.store.TokenEntries(tokens)
+	if err != nil {
+		return nil, grpcError(ctx, err)
+	}
+	resp := &josiepb.GetSetResponse{
+		Id:     req.Id,
+		Tokens: make([][]byte, len(entries)),
+	}
+	for i, e := range entries {
+		resp.Tokens[i] = e.RawToken
+	}
+	return resp, nil
+}
+
+// Creates a searcher with the algorithm and scoring names, which use the
+// defaults if empty, and the budget
+func (g *grpcServer) searcher(algorithm, scoring string, budget joise.Budget) (*joise.Searcher, error) {
+	if !g.s.isReady() {
+		return nil, status.Error(codes.Unavailable, "index is loading")
+	}
+	return g.s.newSearcher(algorithm, scoring, budget)
+}
+
+func newQuery(id int64, tokens [][]byte) joise.RawTokenSet {
+	return joise.RawTokenSet{ID: id, RawTokens: tokens}
+}
+
+func newBudget(b *josiepb.Budget) joise.Budget {
+	return joise.Budget{
+		MaxListReads: int(b.GetMaxListReads()),
+		MaxSetReads:  int(b.GetMaxSetReads()),
+		MaxCost:      b.GetMaxCost(),
+	}
+}
+
+func newPBResult(r joise.Result) *josiepb.Result {
+	return &josiepb.Result{
+		Id:      r.ID,
+		Overlap: int32(r.Overlap),
+		Score:   r.Score,
+		Partial: r.Partial,
+	}
+}
+
+func newPBStats(stats joise.Stats) *josiepb.Stats {
+	return &josiepb.Stats{
+		Duration:         stats.Duration.Milliseconds(),
+		PreprocDuration:  stats.PreprocDuration.Milliseconds(),
+		QueryNumToken:    int32(stats.QueryNumToken),
+		NumListRead:      int32(stats.NumListRead),
+		NumSetRead:       int32(stats.NumSetRead),
+		MaxListSizeRead:  int32(stats.MaxListSizeRead),
+		MaxSetSizeRead:   int32(stats.MaxSetSizeRead),
+		MaxCounterSize:   int32(stats.MaxCounterSize),
+		NumListCacheHit:  int32(stats.NumListCacheHit),
+		NumListCacheMiss: int32(stats.NumListCacheMiss),
+		NumSetCacheHit:   int32(stats.NumSetCacheHit),
+		NumSetCacheMiss:  int32(stats.NumSetCacheMiss),
+		Incomplete:       stats.Incomplete,
+		UnseenUpperbound: stats.UnseenUpperbound,
+	}
+}
+
+// Converts a search error into a gRPC status error
+func grpcError(ctx context.Context, err error) error {
+	if _, ok := status.FromError(err); ok {
+		return err
+	}
+	switch {
+	case errors.Is(err, joise.ErrInvalidSearch):
+		return status.Error(codes.InvalidArgument, err.Error())
+	case ctx.Err() != nil:
+		return status.FromContextError(ctx.Err()).Err()
+	default:
+		return status.Error(codes.Internal, err.Error())
+	}
+}
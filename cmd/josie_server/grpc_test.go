@@ -0,0 +1,242 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+
+	"github.com/ekzhu/josie"
+	"github.com/ekzhu/josie/josiepb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+// Serves the gRPC service of the server over an in-memory connection and
+// returns a client
+func newTestGRPCClient(t *testing.T, s *server) josiepb.JosieClient {
+	t.Helper()
+	lis := bufconn.Listen(1 << 20)
+	grpcSrv := grpc.NewServer()
+	josiepb.RegisterJosieServer(grpcSrv, &grpcServer{s: s})
+	go grpcSrv.Serve(lis)
+	t.Cleanup(grpcSrv.Stop)
+	conn, err := grpc.NewClient("passthrough:///bufconn",
+		grpc.WithContextDialer(func(context.Context, string) (net.Conn, error) { return lis.Dial() }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return josiepb.NewJosieClient(conn)
+}
+
+// Receives the messages of a search response stream until it ends, and
+// returns the overlaps of the results and the number of messages
+func receiveOverlaps(t *testing.T, stream grpc.ServerStreamingClient[josiepb.SearchResponse]) ([]int, int) {
+	t.Helper()
+	var overlaps []int
+	var numMessages int
+	var stats *josiepb.Stats
+	for {
+		resp, err := stream.Recv()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stats != nil {
+			t.Fatal("got a message after the statistics")
+		}
+		numMessages++
+		for _, r := range resp.Results {
+			overlaps = append(overlaps, int(r.Overlap))
+		}
+		stats = resp.Stats
+	}
+	if stats == nil {
+		t.Fatal("got no statistics")
+	}
+	return overlaps, numMessages
+}
+
+func rawTokens(tokens []string) [][]byte {
+	rawTokens := make([][]byte, len(tokens))
+	for i, token := range tokens {
+		rawTokens[i] = []byte(token)
+	}
+	return rawTokens
+}
+
+func TestGRPCServer(t *testing.T) {
+	s, sets := newTestServer(t)
+	client := newTestGRPCClient(t, s)
+	ctx := context.Background()
+	query := []string{"t0", "t1", "t2", "t3", "t5", "t8", "t13", "t21", "t34", "t55"}
+	overlaps := bruteForceOverlaps(sets, query)
+
+	stream, err := client.TopK(ctx, &josiepb.TopKRequest{Tokens: rawTokens(query), K: 10})
+	if err == nil {
+		_, err = stream.Recv()
+	}
+	if status.Code(err) != codes.Unavailable {
+		t.Fatalf("got error %v while loading", err)
+	}
+	close(s.ready)
+
+	// The results of top-k searches are streamed in separate messages
+	stream, err = client.TopK(ctx, &josiepb.TopKRequest{Tokens: rawTokens(query), K: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, numMessages := receiveOverlaps(t, stream)
+	if fmt.Sprint(got) != fmt.Sprint(overlaps[:10]) || numMessages != 11 {
+		t.Fatalf("got overlaps %v in %d messages, want %v", got, numMessages, overlaps[:10])
+	}
+	stream, err = client.ThresholdSearch(ctx, &josiepb.ThresholdSearchRequest{Tokens: rawTokens(query), MinOverlap: 4})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, _ = receiveOverlaps(t, stream)
+	want := 0
+	for _, overlap := range overlaps {
+		if overlap >= 4 {
+			want++
+		}
+	}
+	if len(got) != want {
+		t.Fatalf("got %d threshold search results, want %d", len(got), want)
+	}
+
+	batch, err := client.BatchTopK(ctx, &josiepb.BatchTopKRequest{
+		Queries: []*josiepb.Query{{Id: 1, Tokens: rawTokens(query)}, {Id: 2, Tokens: rawTokens(query[5:])}},
+		K:       10,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	batchOverlaps := make(map[int64][]int)
+	for {
+		resp, err := batch.Recv()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, r := range resp.Results {
+			batchOverlaps[resp.QueryId] = append(batchOverlaps[resp.QueryId], int(r.Overlap))
+		}
+	}
+	if fmt.Sprint(batchOverlaps[1]) != fmt.Sprint(overlaps[:10]) ||
+		fmt.Sprint(batchOverlaps[2]) != fmt.Sprint(bruteForceOverlaps(sets, query[5:])[:10]) {
+		t.Fatalf("got batch overlaps %v", batchOverlaps)
+	}
+
+	set, err := client.GetSet(ctx, &josiepb.GetSetRequest{Id: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(set.Tokens) != len(sets[3]) {
+		t.Fatalf("got %d raw tokens of set 3, want %d", len(set.Tokens), len(sets[3]))
+	}
+	for _, token := range set.Tokens {
+		if !sets[3][string(token)] {
+			t.Fatalf("raw token %s is not in set 3", token)
+		}
+	}
+	if _, err := client.GetSet(ctx, &josiepb.GetSetRequest{Id: 1000}); status.Code(err) != codes.NotFound {
+		t.Fatalf("got error %v for a missing set", err)
+	}
+
+	stream, err = client.TopK(ctx, &josiepb.TopKRequest{Tokens: rawTokens(query), K: 0})
+	if err == nil {
+		_, err = stream.Recv()
+	}
+	if status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("got error %v for k of 0", err)
+	}
+}
+
+// listCountingStore counts the posting lists read from the store
+type listCountingStore struct {
+	joise.IndexStore
+	numListRead atomic.Int64
+}
+
+func (s *listCountingStore) InvertedList(token int64) ([]joise.ListEntry, error) {
+	s.numListRead.Add(1)
+	return s.IndexStore.InvertedList(token)
+}
+
+func TestGRPCBatchTopK(t *testing.T) {
+	s, sets := newTestServer(t)
+	store := &listCountingStore{IndexStore: s.store}
+	s.store = store
+	close(s.ready)
+	client := newTestGRPCClient(t, s)
+	ctx := context.Background()
+	query := []string{"t0", "t1", "t2", "t3", "t5", "t8", "t13", "t21", "t34", "t55"}
+
+	stream, err := client.TopK(ctx, &josiepb.TopKRequest{Tokens: rawTokens(query), K: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	receiveOverlaps(t, stream)
+	numListRead := store.numListRead.Swap(0)
+
+	// The posting lists of the repeated query are read once
+	batch, err := client.BatchTopK(ctx, &josiepb.BatchTopKRequest{
+		Queries: []*josiepb.Query{{Id: 1, Tokens: rawTokens(query)}, {Id: 2, Tokens: rawTokens(query)}},
+		K:       10,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The results of every query are streamed in separate messages, then
+	// its statistics
+	var queryIDs []int64
+	var overlaps []int
+	var current int64
+	for {
+		resp, err := batch.Recv()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(queryIDs) > 0 && resp.QueryId == queryIDs[len(queryIDs)-1] {
+			t.Fatalf("got a message of query %d after its statistics", resp.QueryId)
+		}
+		if overlaps != nil && resp.QueryId != current {
+			t.Fatalf("got a message of query %d before the statistics of query %d", resp.QueryId, current)
+		}
+		current = resp.QueryId
+		if resp.Stats == nil {
+			if len(resp.Results) != 1 {
+				t.Fatalf("query %d: got %d results in a message", resp.QueryId, len(resp.Results))
+			}
+			overlaps = append(overlaps, int(resp.Results[0].Overlap))
+			continue
+		}
+		if fmt.Sprint(overlaps) != fmt.Sprint(bruteForceOverlaps(sets, query)[:10]) {
+			t.Fatalf("query %d: got overlaps %v", resp.QueryId, overlaps)
+		}
+		queryIDs = append(queryIDs, resp.QueryId)
+		overlaps = nil
+	}
+	if fmt.Sprint(queryIDs) != "[1 2]" || overlaps != nil {
+		t.Fatalf("got statistics of queries %v, and results %v after them", queryIDs, overlaps)
+	}
+	if n := store.numListRead.Load(); n != numListRead {
+		t.Fatalf("batch read %d posting lists, want %d", n, numListRead)
+	}
+}
@@ -0,0 +1,470 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/ekzhu/josie"
+	"github.com/ekzhu/josie/josiepb"
+	"github.com/lib/pq"
+	"google.golang.org/grpc"
+)
+
+var (
+	addr                                                  string
+	grpcAddr                                              string
+	backend                                               string
+	indexDir                                              string
+	pgServer, pgPort                                      string
+	pgTableLists, pgTableSets                             string
+	pgTableReadListCostSamples, pgTableReadSetCostSamples string
+	searchTimeout, shutdownTimeout                        time.Duration
+	prefetch, probe                                       int
+	cacheSize                                             int64
+	compressedLists, compressedSets                       bool
+	tokenTableSnapshot                                    string
+	compactTokenTable                                     bool
+)
+
+// Maximum size of a search request body
+const maxRequestBytes = 64 << 20
+
+func main() {
+	flag.StringVar(&addr, "addr", ":8080", "HTTP listen address")
+	flag.StringVar(&grpcAddr, "grpc-addr", "", "gRPC listen address, the gRPC service is disabled if empty")
+	flag.StringVar(&backend, "backend", "postgres", "Index backend to search: postgres or embedded")
+	flag.StringVar(&indexDir, "index-dir", "", "Directory of the embedded index")
+	flag.StringVar(&pgServer, "pg-server", "localhost", "Postgres server addresss")
+	flag.StringVar(&pgPort, "pg-port", "5442", "Postgres server port")
+	flag.StringVar(&pgTableLists, "pg-table-lists", "canada_us_uk_inverted_lists", "Postgres table for inverted lists")
+	flag.StringVar(&pgTableSets, "pg-table-sets", "canada_us_uk_sets", "Postgres table for sets")
+	flag.StringVar(&pgTableReadSetCostSamples, "pg-table-read-set-cost-samples", "", "Postgres table for samples for read set cost estimation, the default costs are used if not given")
+	flag.StringVar(&pgTableReadListCostSamples, "pg-table-read-list-cost-samples", "", "Postgres table for samples for read list cost estimation, the default costs are used if not given")
+	flag.IntVar(&prefetch, "prefetch", 1, "Number of posting lists read concurrently by a search")
+	flag.IntVar(&probe, "probe", 1, "Number of candidate sets read concurrently by a search")
+	flag.Int64Var(&cacheSize, "cache-size", 0, "Maximum size in bytes of the posting lists and sets cached in memory, no cache if zero")
+	flag.BoolVar(&compressedLists, "compressed-lists", false, "Read the compressed posting lists of Postgres tables written with build_index -compress-lists")
+	flag.BoolVar(&compressedSets, "compressed-sets", false, "Read the compressed sets of Postgres tables written with build_index -compress-sets")
+	flag.StringVar(&tokenTableSnapshot, "token-table-snapshot", "", "Snapshot file of the token table, which is loaded instead of reading all tokens from the index and rewritten if stale")
+	flag.BoolVar(&compactTokenTable, "compact-token-table", false, "Keep the token table in a sorted array instead of a map, which takes less memory than a map for large indexes")
+	flag.DurationVar(&searchTimeout, "search-timeout", 0, "Default time limit of a search, after which the best results found so far are returned, no limit if zero")
+	flag.DurationVar(&shutdownTimeout, "shutdown-timeout", 30*time.Second, "Time to wait for running requests on shutdown")
+	flag.Parse()
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	lis, err := net.Listen("tcp", addr)
+	if err != nil {
+		panic(err)
+	}
+	var grpcLis net.Listener
+	if grpcAddr != "" {
+		if grpcLis, err = net.Listen("tcp", grpcAddr); err != nil {
+			panic(err)
+		}
+	}
+	if err := run(ctx, lis, grpcLis); err != nil {
+		panic(err)
+	}
+}
+
+// Serves HTTP requests on lis and gRPC requests on grpcLis if not nil until
+// ctx is done, or until the index fails to load or a listener fails, which
+// is returned after shutting down the other listeners
+func run(ctx context.Context, lis, grpcLis net.Listener) error {
+	s := &server{ready: make(chan struct{})}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/health", s.handleHealth)
+	mux.HandleFunc("/search", s.handleSearch)
+	httpServer := &http.Server{Handler: mux}
+
+	// The server starts accepting requests while the index is loaded, so
+	// the health endpoint can report the loading state
+	serveErr := make(chan error, 2)
+	go func() {
+		log.Printf("Listening on %s", lis.Addr())
+		serveErr <- httpServer.Serve(lis)
+	}()
+	var grpcSrv *grpc.Server
+	if grpcLis != nil {
+		grpcSrv = grpc.NewServer()
+		josiepb.RegisterJosieServer(grpcSrv, &grpcServer{s: s})
+		go func() {
+			log.Printf("Listening for gRPC on %s", grpcLis.Addr())
+			serveErr <- grpcSrv.Serve(grpcLis)
+		}()
+	}
+	// The index is loaded in the background, so a signal or a failed
+	// listener stops the server while loading
+	loaded := make(chan error, 1)
+	var closeIndex func()
+	go func() {
+		var err error
+		closeIndex, err = s.load()
+		loaded <- err
+	}()
+	for {
+		select {
+		case err := <-loaded:
+			if err != nil {
+				shutdown(httpServer, grpcSrv)
+				return err
+			}
+			defer closeIndex()
+			close(s.ready)
+			log.Println("Ready for search requests")
+			// A nil channel is never ready
+			loaded = nil
+		case err := <-serveErr:
+			if !errors.Is(err, http.ErrServerClosed) {
+				shutdown(httpServer, grpcSrv)
+				return err
+			}
+			return nil
+		case <-ctx.Done():
+			log.Println("Shutting down...")
+			shutdown(httpServer, grpcSrv)
+			return nil
+		}
+	}
+}
+
+// Stops accepting requests and waits for the running requests until
+// -shutdown-timeout, then cancels the running gRPC streams
+func shutdown(httpServer *http.Server, grpcSrv *grpc.Server) {
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if grpcSrv != nil {
+		go func() {
+			// Cancel the running streams after the timeout
+			<-shutdownCtx.Done()
+			grpcSrv.Stop()
+		}()
+	}
+	if err := httpServer.Shutdown(shutdownCtx); err != nil {
+		log.Printf("Shutdown failed: %v", err)
+	}
+	if grpcSrv != nil {
+		grpcSrv.GracefulStop()
+	}
+}
+
+// server holds the index and the token table shared by all requests, which
+// are set before ready is closed.
+type server struct {
+	ready   chan struct{}
+	store   joise.IndexStore
+	tb      joise.TokenTable
+	cost    joise.CostParameters
+	numSets int
+}
+
+// Opens the index and creates the token table, returns the function closing
+// the index
+func (s *server) load() (func(), error) {
+	s.cost = joise.DefaultCostParameters()
+	switch backend {
+	case "postgres":
+		db, err := sql.Open("postgres", fmt.Sprintf("host=%s port=%s sslmode=disable", pgServer, pgPort))
+		if err != nil {
+			return nil, err
+		}
+		var opts []joise.StoreOption
+		if compressedLists {
+			opts = append(opts, joise.WithCompressedLists())
+		}
+		if compressedSets {
+			opts = append(opts, joise.WithCompressedSets())
+		}
+		s.store = cached(joise.NewPostgresStore(db, pgTableLists, pgTableSets, opts...))
+		if err := db.QueryRow(fmt.Sprintf(`SELECT count(*) FROM %s;`,
+			pq.QuoteIdentifier(pgTableSets))).Scan(&s.numSets); err != nil {
+			db.Close()
+			return nil, err
+		}
+		// The deleted sets stay in the set table until compaction
+		deleted, err := s.store.DeletedSets()
+		if err != nil {
+			db.Close()
+			return nil, err
+		}
+		s.numSets -= len(deleted)
+		if pgTableReadListCostSamples != "" && pgTableReadSetCostSamples != "" {
+			if s.cost, err = joise.ReadCostParameters(db, pgTableReadListCostSamples,
+				pgTableReadSetCostSamples); err != nil {
+				db.Close()
+				return nil, err
+			}
+		}
+		s.tb, err = createTokenTable(s.store)
+		if err != nil {
+			db.Close()
+			return nil, err
+		}
+		return func() { db.Close() }, nil
+	case "embedded":
+		if indexDir == "" {
+			return nil, errors.New("no index directory given for the embedded index")
+		}
+		store, err := joise.OpenFileStore(indexDir)
+		if err != nil {
+			return nil, err
+		}
+		s.store = cached(store)
+		s.numSets = store.NumSets()
+		s.tb, err = createTokenTable(s.store)
+		if err != nil {
+			store.Close()
+			return nil, err
+		}
+		return func() { store.Close() }, nil
+	default:
+		return nil, fmt.Errorf("unknown backend %q", backend)
+	}
+}
+
+// Loads the token table from the snapshot file if -token-table-snapshot is
+// given, or reads all tokens from the index
+func createTokenTable(store joise.IndexStore) (joise.TokenTable, error) {
+	var tb joise.TokenTable
+	var err error
+	switch {
+	case tokenTableSnapshot != "" && compactTokenTable:
+		tb, err = joise.CreateTokenTableCompactSnapshot(tokenTableSnapshot, store, false)
+	case tokenTableSnapshot != "":
+		tb, err = joise.CreateTokenTableMemSnapshot(tokenTableSnapshot, store, false)
+	case compactTokenTable:
+		tb, err = joise.CreateTokenTableCompact(store, false)
+	default:
+		tb, err = joise.CreateTokenTableMem(store, false)
+	}
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("Token table has %d raw tokens sharing their hash values with other raw tokens",
+		joise.TokenTableCollisions(tb))
+	return tb, nil
+}
+
+// Caches the posting lists and sets read from the store if -cache-size is
+// positive
+func cached(store joise.IndexStore) joise.IndexStore {
+	if cacheSize <= 0 {
+		return store
+	}
+	return joise.NewCachedStore(store, cacheSize)
+}
+
+func (s *server) isReady() bool {
+	select {
+	case <-s.ready:
+		return true
+	default:
+		return false
+	}
+}
+
+func (s *server) handleHealth(w http.ResponseWriter, r *http.Request) {
+	if !s.isReady() {
+		writeJSON(w, http.StatusServiceUnavailable, map[string]string{"status": "loading"})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+// searchRequest is the body of a search request. A threshold search is run
+// if min_overlap is positive, a weighted top-k search if idf or
+// token_weights is given, and a top-k search otherwise. The search returns
+// the best results found so far after timeout_ms milliseconds, or the
+// default search timeout if zero.
+type searchRequest struct {
+	Tokens       []string           `json:"tokens"`
+	K            int                `json:"k"`
+	Algorithm    string             `json:"algorithm"`
+	Scoring      string             `json:"scoring"`
+	MinOverlap   int                `json:"min_overlap"`
+	IDF          bool               `json:"idf"`
+	TokenWeights map[string]float64 `json:"token_weights"`
+	TimeoutMs    int64              `json:"timeout_ms"`
+	Budget       searchBudget       `json:"budget"`
+}
+
+// searchBudget limits the I/O of a top-k search, zero fields are not
+// limited and max_cost is the estimated I/O time in milliseconds
+type searchBudget struct {
+	MaxListReads int     `json:"max_list_reads"`
+	MaxSetReads  int     `json:"max_set_reads"`
+	MaxCost      float64 `json:"max_cost"`
+}
+
+type searchResult struct {
+	ID      int64   `json:"id"`
+	Overlap int     `json:"overlap"`
+	Score   float64 `json:"score"`
+	Partial bool    `json:"partial"`
+}
+
+// searchStats are the statistics of a search, durations are in milliseconds
+type searchStats struct {
+	Duration         int64   `json:"duration"`
+	PreprocDuration  int64   `json:"preproc_duration"`
+	QueryNumToken    int     `json:"query_num_token"`
+	NumListRead      int     `json:"num_list_read"`
+	NumSetRead       int     `json:"num_set_read"`
+	MaxListSizeRead  int     `json:"max_list_size_read"`
+	MaxSetSizeRead   int     `json:"max_set_size_read"`
+	MaxCounterSize   int     `json:"max_counter_size"`
+	NumListCacheHit  int     `json:"num_list_cache_hit"`
+	NumListCacheMiss int     `json:"num_list_cache_miss"`
+	NumSetCacheHit   int     `json:"num_set_cache_hit"`
+	NumSetCacheMiss  int     `json:"num_set_cache_miss"`
+	Incomplete       bool    `json:"incomplete"`
+	UnseenUpperbound float64 `json:"unseen_upperbound"`
+}
+
+type searchResponse struct {
+	Results []searchResult `json:"results"`
+	Stats   searchStats    `json:"stats"`
+}
+
+func (s *server) handleSearch(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		writeError(w, http.StatusMethodNotAllowed, errors.New("search requires POST"))
+		return
+	}
+	if !s.isReady() {
+		writeError(w, http.StatusServiceUnavailable, errors.New("index is loading"))
+		return
+	}
+	var req searchRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxRequestBytes)).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	results, stats, err := s.search(r.Context(), req)
+	if err != nil {
+		switch {
+		case errors.Is(err, joise.ErrInvalidSearch):
+			writeError(w, http.StatusBadRequest, err)
+		case r.Context().Err() != nil:
+			// The client has gone away
+			log.Printf("Search canceled: %v", err)
+		default:
+			log.Printf("Search failed: %v", err)
+			writeError(w, http.StatusInternalServerError, err)
+		}
+		return
+	}
+	resp := searchResponse{
+		Results: make([]searchResult, len(results)),
+		Stats: searchStats{
+			Duration:         stats.Duration.Milliseconds(),
+			PreprocDuration:  stats.PreprocDuration.Milliseconds(),
+			QueryNumToken:    stats.QueryNumToken,
+			NumListRead:      stats.NumListRead,
+			NumSetRead:       stats.NumSetRead,
+			MaxListSizeRead:  stats.MaxListSizeRead,
+			MaxSetSizeRead:   stats.MaxSetSizeRead,
+			MaxCounterSize:   stats.MaxCounterSize,
+			NumListCacheHit:  stats.NumListCacheHit,
+			NumListCacheMiss: stats.NumListCacheMiss,
+			NumSetCacheHit:   stats.NumSetCacheHit,
+			NumSetCacheMiss:  stats.NumSetCacheMiss,
+			Incomplete:       stats.Incomplete,
+			UnseenUpperbound: stats.UnseenUpperbound,
+		},
+	}
+	for i, r := range results {
+		resp.Results[i] = searchResult{ID: r.ID, Overlap: r.Overlap, Score: r.Score,
+			Partial: r.Partial}
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+func (s *server) search(ctx context.Context, req searchRequest) ([]joise.Result, joise.Stats, error) {
+	searcher, err := s.newSearcher(req.Algorithm, req.Scoring, joise.Budget{
+		MaxListReads: req.Budget.MaxListReads,
+		MaxSetReads:  req.Budget.MaxSetReads,
+		MaxCost:      req.Budget.MaxCost,
+	})
+	if err != nil {
+		return nil, joise.Stats{}, err
+	}
+	query := joise.RawTokenSet{RawTokens: make([][]byte, len(req.Tokens))}
+	for i, token := range req.Tokens {
+		query.RawTokens[i] = []byte(token)
+	}
+	ctx, cancel := searchContext(ctx, req.TimeoutMs)
+	defer cancel()
+
+	switch {
+	case req.MinOverlap > 0:
+		return searcher.ThresholdSearch(ctx, query, req.MinOverlap)
+	case req.IDF:
+		return searcher.WeightedTopK(ctx, query, req.K, joise.IDFWeights(s.numSets))
+	case req.TokenWeights != nil:
+		return searcher.WeightedTopK(ctx, query, req.K, joise.UserWeights(req.TokenWeights, 1))
+	default:
+		return searcher.TopK(ctx, query, req.K)
+	}
+}
+
+// Creates a searcher with the algorithm and scoring names, which use the
+// defaults if empty, and the budget
+func (s *server) newSearcher(algorithm, scoring string, budget joise.Budget) (*joise.Searcher, error) {
+	opts := []joise.SearcherOption{joise.WithBudget(budget), joise.WithPrefetch(prefetch),
+		joise.WithParallelProbes(probe)}
+	if algorithm != "" {
+		a, err := joise.ParseAlgorithm(algorithm)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", joise.ErrInvalidSearch, err)
+		}
+		opts = append(opts, joise.WithAlgorithm(a))
+	}
+	if scoring != "" {
+		sc, err := joise.ParseScoring(scoring)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", joise.ErrInvalidSearch, err)
+		}
+		opts = append(opts, joise.WithScoring(sc))
+	}
+	return joise.NewSearcher(s.store, s.tb, s.cost, opts...), nil
+}
+
+// Returns the context of a search, which is done after the timeout in
+// milliseconds, or the default search timeout if zero
+func searchContext(ctx context.Context, timeoutMs int64) (context.Context, context.CancelFunc) {
+	timeout := searchTimeout
+	if timeoutMs > 0 {
+		timeout = time.Duration(timeoutMs) * time.Millisecond
+	}
+	if timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, timeout)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("Writing response failed: %v", err)
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ekzhu/josie"
+)
+
+// memStoreWriter adds the index created by BuildIndex to a MemStore
+type memStoreWriter struct {
+	store *joise.MemStore
+}
+
+func (w memStoreWriter) AddList(entry joise.TokenEntry, list []joise.ListEntry) error {
+	// BuildIndex reuses the list for the next token
+	w.store.AddList(entry, append([]joise.ListEntry(nil), list...))
+	return nil
+}
+
+func (w memStoreWriter) AddSet(setID int64, tokens []int64) error {
+	w.store.AddSet(setID, tokens)
+	return nil
+}
+
+func (w memStoreWriter) Close() error {
+	return nil
+}
+
+// Creates a server over a MemStore index of random sets, and returns the
+// sets as maps of raw tokens
+func newTestServer(t *testing.T) (*server, map[int64]map[string]bool) {
+	t.Helper()
+	r := rand.New(rand.NewSource(1))
+	sets := make(map[int64]map[string]bool)
+	var input strings.Builder
+	for id := int64(0); id < 200; id++ {
+		sets[id] = make(map[string]bool)
+		fmt.Fprintf(&input, "%d", id)
+		for i := 0; i < 1+r.Intn(30); i++ {
+			token := fmt.Sprintf("t%d", int(200*r.Float64()*r.Float64()))
+			sets[id][token] = true
+			fmt.Fprintf(&input, " %s", token)
+		}
+		fmt.Fprintln(&input)
+	}
+	store := joise.NewMemStore()
+	opts := joise.DefaultBuildOptions()
+	opts.TempDir = t.TempDir()
+	if err := joise.BuildIndex(strings.NewReader(input.String()), memStoreWriter{store}, opts); err != nil {
+		t.Fatal(err)
+	}
+	tb, err := joise.CreateTokenTableMem(store, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &server{
+		ready:   make(chan struct{}),
+		store:   store,
+		tb:      tb,
+		cost:    joise.DefaultCostParameters(),
+		numSets: store.NumSets(),
+	}
+	return s, sets
+}
+
+// Returns the overlaps of the query with the sets in decreasing order
+func bruteForceOverlaps(sets map[int64]map[string]bool, query []string) []int {
+	var overlaps []int
+	for _, set := range sets {
+		overlap := 0
+		for _, token := range query {
+			if set[token] {
+				overlap++
+			}
+		}
+		if overlap > 0 {
+			overlaps = append(overlaps, overlap)
+		}
+	}
+	sort.Sort(sort.Reverse(sort.IntSlice(overlaps)))
+	return overlaps
+}
+
+func postSearch(s *server, body string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	s.handleSearch(w, httptest.NewRequest(http.MethodPost, "/search", strings.NewReader(body)))
+	return w
+}
+
+func TestHandleHealth(t *testing.T) {
+	s, _ := newTestServer(t)
+	w := httptest.NewRecorder()
+	s.handleHealth(w, httptest.NewRequest(http.MethodGet, "/health", nil))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("got status %d while loading", w.Code)
+	}
+	if w := postSearch(s, `{"tokens": ["t1"], "k": 5}`); w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("got status %d for a search while loading", w.Code)
+	}
+	close(s.ready)
+	w = httptest.NewRecorder()
+	s.handleHealth(w, httptest.NewRequest(http.MethodGet, "/health", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("got status %d when ready", w.Code)
+	}
+}
+
+func TestHandleSearch(t *testing.T) {
+	s, sets := newTestServer(t)
+	close(s.ready)
+	query := []string{"t0", "t1", "t2", "t3", "t5", "t8", "t13", "t21", "t34", "t55", "t1", "unknown"}
+	overlaps := bruteForceOverlaps(sets, query[:10])
+	for _, body := range []string{
+		`{"tokens": %s, "k": 10}`,
+		`{"tokens": %s, "k": 10, "algorithm": "merge_distinct_list"}`,
+		`{"tokens": %s, "k": 10, "algorithm": "probe_set_optimized"}`,
+		`{"tokens": %s, "k": 10, "scoring": "query_containment"}`,
+		`{"tokens": %s, "min_overlap": 4}`,
+	} {
+		tokens, _ := json.Marshal(query)
+		body = fmt.Sprintf(body, tokens)
+		w := postSearch(s, body)
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: got status %d: %s", body, w.Code, w.Body)
+		}
+		var resp searchResponse
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+		want := overlaps[:10]
+		if strings.Contains(body, "min_overlap") {
+			want = overlaps[:sort.Search(len(overlaps), func(i int) bool { return overlaps[i] < 4 })]
+		}
+		var got []int
+		for _, result := range resp.Results {
+			got = append(got, result.Overlap)
+		}
+		if fmt.Sprint(got) != fmt.Sprint(want) {
+			t.Fatalf("%s: got overlaps %v, want %v", body, got, want)
+		}
+	}
+
+	for _, body := range []string{
+		`{"tokens": ["t1"], "k": 0}`,
+		`{"tokens": ["t1"], "k": 5, "algorithm": "unknown"}`,
+		`{"tokens": ["t1"], "k": 5, "scoring": "unknown"}`,
+		`{"tokens": ["t1"], "k": 5, "token_weights": {"t1": -1}}`,
+		`{"tokens": ["t1"], "k": 5`,
+	} {
+		if w := postSearch(s, body); w.Code != http.StatusBadRequest {
+			t.Fatalf("%s: got status %d, want %d", body, w.Code, http.StatusBadRequest)
+		}
+	}
+	w := httptest.NewRecorder()
+	s.handleSearch(w, httptest.NewRequest(http.MethodGet, "/search", nil))
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Fatalf("got status %d for GET", w.Code)
+	}
+}
+
+func TestHandleWeightedSearch(t *testing.T) {
+	s, sets := newTestServer(t)
+	close(s.ready)
+	body := `{"tokens": ["t1", "t2", "t3"], "k": 200, "token_weights": {"t1": 1, "t2": 10, "t3": 100}}`
+	w := postSearch(s, body)
+	if w.Code != http.StatusOK {
+		t.Fatalf("got status %d: %s", w.Code, w.Body)
+	}
+	var resp searchResponse
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	weights := map[string]float64{"t1": 1, "t2": 10, "t3": 100}
+	var want []float64
+	for _, set := range sets {
+		var score float64
+		for token, weight := range weights {
+			if set[token] {
+				score += weight
+			}
+		}
+		if score > 0 {
+			want = append(want, score)
+		}
+	}
+	sort.Sort(sort.Reverse(sort.Float64Slice(want)))
+	var got []float64
+	for _, result := range resp.Results {
+		got = append(got, result.Score)
+	}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Fatalf("got scores %v, want %v", got, want)
+	}
+}
+
+func TestRunLoadFailure(t *testing.T) {
+	defer func(b, dir string) { backend, indexDir = b, dir }(backend, indexDir)
+	backend, indexDir = "embedded", filepath.Join(t.TempDir(), "missing")
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	grpcLis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := run(context.Background(), lis, grpcLis); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("got error %v, want %v", err, os.ErrNotExist)
+	}
+	// Both listeners are closed once the index fails to load
+	for _, l := range []net.Listener{lis, grpcLis} {
+		if conn, err := net.Dial("tcp", l.Addr().String()); err == nil {
+			conn.Close()
+			t.Fatalf("listener on %s is not closed", l.Addr())
+		}
+	}
+}
+
+func TestRunShutdown(t *testing.T) {
+	defer func(b, server, port string) { backend, pgServer, pgPort = b, server, port }(backend, pgServer, pgPort)
+	// A Postgres server that never answers, so the index is still loading
+	pg, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pg.Close()
+	backend = "postgres"
+	pgServer, pgPort, err = net.SplitHostPort(pg.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- run(ctx, lis, nil) }()
+	resp, err := http.Get("http://" + lis.Addr().String() + "/health")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("health while loading: got status %d", resp.StatusCode)
+	}
+	cancel()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("server did not stop while loading the index")
+	}
+}
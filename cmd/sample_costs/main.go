@@ -21,6 +21,7 @@ var (
 	computeCostOnly                              bool
 	minListLength, maxListLength, listLengthStep int
 	samplePerStep                                int
+	compressedLists, compressedSets              bool
 )
 
 func main() {
@@ -35,17 +36,27 @@ func main() {
 	flag.IntVar(&maxListLength, "cost-max-list-size", 4000, "Minimum list length for cost estimation")
 	flag.IntVar(&listLengthStep, "cost-list-size-step", 100, "Step size for cost estimation")
 	flag.IntVar(&samplePerStep, "cost-sample-per-size", 10, "Number of samples per each step")
+	flag.BoolVar(&compressedLists, "compressed-lists", false, "Read the compressed posting lists written with -compress-lists")
+	flag.BoolVar(&compressedSets, "compressed-sets", false, "Read the compressed sets written with -compress-sets")
 	flag.Parse()
 	db, err := sql.Open("postgres", fmt.Sprintf("host=%s port=%s sslmode=disable", pgServer, pgPort))
 	if err != nil {
 		panic(err)
 	}
 	defer db.Close()
-	sampleReadSetCost(db, pgTableQueries, pgTableReadSetCostSamples)
-	sampleReadListCost(db, pgTableReadListCostSamples, minListLength, maxListLength, listLengthStep, samplePerStep)
+	var opts []joise.StoreOption
+	if compressedLists {
+		opts = append(opts, joise.WithCompressedLists())
+	}
+	if compressedSets {
+		opts = append(opts, joise.WithCompressedSets())
+	}
+	store := joise.NewPostgresStore(db, pgTableLists, pgTableSets, opts...)
+	sampleReadSetCost(db, store, pgTableQueries, pgTableReadSetCostSamples)
+	sampleReadListCost(db, store, pgTableReadListCostSamples, minListLength, maxListLength, listLengthStep, samplePerStep)
 }
 
-func sampleReadSetCost(db *sql.DB, pgTableQueries, pgTableReadSetCostSamples string) {
+func sampleReadSetCost(db *sql.DB, store *joise.PostgresStore, pgTableQueries, pgTableReadSetCostSamples string) {
 	// Create sample table
 	_, err := db.Exec(fmt.Sprintf(`DROP TABLE IF EXISTS %s;`,
 		pq.QuoteIdentifier(pgTableReadSetCostSamples)))
@@ -68,7 +79,10 @@ func sampleReadSetCost(db *sql.DB, pgTableQueries, pgTableReadSetCostSamples str
 	for i, id := range sampleSetIDs {
 		log.Printf("Read set id = %d, #%d/%d", id, i+1, len(sampleSetIDs))
 		start := time.Now()
-		s := joise.SetTokens(db, pgTableSets, id)
+		s, err := store.SetTokens(id)
+		if err != nil {
+			panic(err)
+		}
 		dur := time.Now().Sub(start)
 		// Cost is the duration in ns
 		_, err = db.Exec(fmt.Sprintf(`INSERT INTO %s (id, size, cost) VALUES ($1, $2, $3);`,
@@ -79,7 +93,7 @@ func sampleReadSetCost(db *sql.DB, pgTableQueries, pgTableReadSetCostSamples str
 	}
 }
 
-func sampleReadListCost(db *sql.DB, pgTableReadListCostSamples string, minLength, maxLength, step, sampleSizePerStep int) {
+func sampleReadListCost(db *sql.DB, store *joise.PostgresStore, pgTableReadListCostSamples string, minLength, maxLength, step, sampleSizePerStep int) {
 	// Create sample table
 	_, err := db.Exec(fmt.Sprintf(`DROP TABLE IF EXISTS %s;`,
 		pq.QuoteIdentifier(pgTableReadListCostSamples)))
@@ -132,7 +146,9 @@ func sampleReadListCost(db *sql.DB, pgTableReadListCostSamples string, minLength
 	for i, token := range sampleListTokens {
 		log.Printf("Read list token = %d, #%d/%d", token, i+1, len(sampleListTokens))
 		start := time.Now()
-		_ = joise.InvertedList(db, pgTableLists, token)
+		if _, err := store.InvertedList(token); err != nil {
+			panic(err)
+		}
 		dur := time.Now().Sub(start)
 		// Cost is the duration in ns
 		_, err = db.Exec(fmt.Sprintf(`UPDATE %s SET cost = $1 WHERE token = $2;`,
@@ -11,13 +11,30 @@ func init() {
 	totalNumberOfSets = 1.0
 }
 
+// Creates the set of sets to skip when reading posting lists: the sets
+// deleted from the index, and the query itself when ignoreSelf is true
+func newIgnores(store IndexStore, query RawTokenSet, ignoreSelf bool) (map[int64]bool, error) {
+	deleted, err := store.DeletedSets()
+	if err != nil {
+		return nil, err
+	}
+	ignores := make(map[int64]bool, len(deleted)+1)
+	for _, id := range deleted {
+		ignores[id] = true
+	}
+	if ignoreSelf {
+		ignores[query.ID] = true
+	}
+	return ignores, nil
+}
+
 func pruningPowerUb(freq, k int) float64 {
 	return math.Log((float64(min(k, freq)) + 0.5) * (totalNumberOfSets - float64(k) - float64(freq) + float64(min(k, freq)) + 0.5) /
 		((float64(max(0, k-freq)) + 0.5) * (float64(max(freq-k, 0)) + 0.5)))
 }
 
-func inverseSetFrequency(freq int) float64 {
-	return math.Log(totalNumberOfSets / float64(freq))
+func inverseSetFrequency(numSets, freq int) float64 {
+	return math.Log(float64(numSets) / float64(freq))
 }
 
 func nextDistinctList(tokens, gids []int64, currListIndex int) (listIndex, numSkipped int) {
@@ -53,6 +70,28 @@ func overlap(setTokens, queryTokens []int64) int {
 	return overlap
 }
 
+// Computes the overlap and the weighted overlap, the weights are the
+// weights of the query tokens
+func weightedOverlap(setTokens, queryTokens []int64, weights []float64) (int, float64) {
+	var i, j int
+	var overlap int
+	var weight float64
+	for i < len(queryTokens) && j < len(setTokens) {
+		switch d := queryTokens[i] - setTokens[j]; {
+		case d == 0:
+			overlap++
+			weight += weights[i]
+			i++
+			j++
+		case d < 0:
+			i++
+		case d > 0:
+			j++
+		}
+	}
+	return overlap, weight
+}
+
 func overlapAndUpdateCounts(setTokens, queryTokens []int64, counts []int) int {
 	var i, j int
 	var overlap int
@@ -8,56 +8,112 @@ import (
 	"github.com/lib/pq"
 )
 
-var (
-	minReadCost           = 1000000.0
-	readSetCostSlope      = 1253.19054300781
-	readSetCostIntercept  = -9423326.99507381
-	readListCostSlope     = 1661.93366983753
-	readListCostIntercept = 1007857.48225696
-)
+// CostParameters are the slopes and intercepts of the linear functions
+// that estimate the I/O time cost (in nanoseconds) of reading a posting list
+// given its length and reading a set given its size.
+type CostParameters struct {
+	MinReadCost           float64
+	ReadSetCostSlope      float64
+	ReadSetCostIntercept  float64
+	ReadListCostSlope     float64
+	ReadListCostIntercept float64
+	// The cache whose posting lists and sets are estimated to cost
+	// cachedReadCost to read
+	cache *CachedStore
+}
+
+// DefaultCostParameters returns the cost parameters used when no cost
+// samples are available.
+func DefaultCostParameters() CostParameters {
+	return CostParameters{
+		MinReadCost:           1000000.0,
+		ReadSetCostSlope:      1253.19054300781,
+		ReadSetCostIntercept:  -9423326.99507381,
+		ReadListCostSlope:     1661.93366983753,
+		ReadListCostIntercept: 1007857.48225696,
+	}
+}
+
+// The I/O time cost in milliseconds of reading a cached posting list or set
+const cachedReadCost = 0.001
 
-func readListCost(length int) float64 {
-	f := readListCostSlope*float64(length) + readListCostIntercept
-	if f < minReadCost {
-		f = minReadCost
+// The cost parameters used by the experiments
+var costParameters = DefaultCostParameters()
+
+func (c CostParameters) readListCost(length int) float64 {
+	f := c.ReadListCostSlope*float64(length) + c.ReadListCostIntercept
+	if f < c.MinReadCost {
+		f = c.MinReadCost
 	}
 	return f / 1000000.0
 }
 
-func readSetCost(size int) float64 {
-	f := readSetCostSlope*float64(size) + readSetCostIntercept
-	if f < minReadCost {
-		f = minReadCost
+// The I/O time cost of reading the posting list of a token, which is
+// near-zero if the list is cached
+func (c CostParameters) readTokenListCost(token int64, length int) float64 {
+	if c.cache != nil && c.cache.hasList(token) {
+		return cachedReadCost
+	}
+	return c.readListCost(length)
+}
+
+// The I/O time cost of reading the posting list of a token when the next
+// lists are prefetched by parallelism concurrent reads. The reads of a batch
+// of lists overlap, so each list only adds a fraction of its cost to the
+// time of reading the batch, while set reads are not overlapped.
+func (c CostParameters) readListCostPrefetched(token int64, length, parallelism int) float64 {
+	if parallelism <= 1 {
+		return c.readTokenListCost(token, length)
+	}
+	return c.readTokenListCost(token, length) / float64(parallelism)
+}
+
+func (c CostParameters) readSetCost(size int) float64 {
+	f := c.ReadSetCostSlope*float64(size) + c.ReadSetCostIntercept
+	if f < c.MinReadCost {
+		f = c.MinReadCost
 	}
 	return f / 1000000.0
 }
 
-func readSetCostReduction(size, truncation int) float64 {
-	return readSetCost(size) - readSetCost(size-truncation)
+// The I/O time cost of reading the suffix of a set from startPos, which is
+// near-zero if the suffix is cached
+func (c CostParameters) readSetSuffixCost(setID int64, startPos, length int) float64 {
+	if c.cache != nil && c.cache.hasSet(setID, startPos) {
+		return cachedReadCost
+	}
+	return c.readSetCost(length)
 }
 
-// resetCostFunctionParameters re-computes the slopes and intercepts of cost functions
-func resetCostFunctionParameters(db *sql.DB, pgTableReadListCostSamples, pgTableReadSetCostSamples string) {
-	var slope, intercept float64
+func (c CostParameters) readSetCostReduction(size, truncation int) float64 {
+	return c.readSetCost(size) - c.readSetCost(size-truncation)
+}
+
+// ReadCostParameters computes the slopes and intercepts of cost functions
+// from the read cost sample tables created by the sample_costs command.
+func ReadCostParameters(db *sql.DB, pgTableReadListCostSamples, pgTableReadSetCostSamples string) (CostParameters, error) {
+	c := DefaultCostParameters()
 	err := db.QueryRow(fmt.Sprintf(`
 	SELECT regr_slope(cost, frequency), regr_intercept(cost, frequency) from %s;`,
-		pq.QuoteIdentifier(pgTableReadListCostSamples))).Scan(&slope, &intercept)
+		pq.QuoteIdentifier(pgTableReadListCostSamples))).Scan(&c.ReadListCostSlope, &c.ReadListCostIntercept)
 	if err != nil {
-		panic(err)
+		return c, err
 	}
-	log.Printf("Reseting read list cost slope %.4f -> %.4f", readListCostSlope, slope)
-	log.Printf("Reseting read list cost intercept %.4f -> %.4f", readListCostIntercept, intercept)
-	readListCostSlope = slope
-	readListCostIntercept = intercept
-
 	err = db.QueryRow(fmt.Sprintf(`
 	SELECT regr_slope(cost, size), regr_intercept(cost, size) from %s;`,
-		pq.QuoteIdentifier(pgTableReadSetCostSamples))).Scan(&slope, &intercept)
+		pq.QuoteIdentifier(pgTableReadSetCostSamples))).Scan(&c.ReadSetCostSlope, &c.ReadSetCostIntercept)
+	return c, err
+}
+
+// resetCostFunctionParameters re-computes the slopes and intercepts of cost functions
+func resetCostFunctionParameters(db *sql.DB, pgTableReadListCostSamples, pgTableReadSetCostSamples string) {
+	c, err := ReadCostParameters(db, pgTableReadListCostSamples, pgTableReadSetCostSamples)
 	if err != nil {
 		panic(err)
 	}
-	log.Printf("Reseting read set cost slope %.4f -> %.4f", readSetCostSlope, slope)
-	log.Printf("Reseting read set cost intercept %.4f -> %.4f", readSetCostIntercept, intercept)
-	readSetCostSlope = slope
-	readSetCostIntercept = intercept
+	log.Printf("Reseting read list cost slope %.4f -> %.4f", costParameters.ReadListCostSlope, c.ReadListCostSlope)
+	log.Printf("Reseting read list cost intercept %.4f -> %.4f", costParameters.ReadListCostIntercept, c.ReadListCostIntercept)
+	log.Printf("Reseting read set cost slope %.4f -> %.4f", costParameters.ReadSetCostSlope, c.ReadSetCostSlope)
+	log.Printf("Reseting read set cost intercept %.4f -> %.4f", costParameters.ReadSetCostIntercept, c.ReadSetCostIntercept)
+	costParameters = c
 }
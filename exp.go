@@ -1,6 +1,7 @@
 package joise
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
 	"io/ioutil"
@@ -122,7 +123,7 @@ var (
 	// Use 20 for canada_us_uk and 5 for webtable
 	batchSize = 20
 	// The algorithms to run
-	algorithms = map[string]func(db *sql.DB, listTable, setTable string, tb tokenTable, q rawTokenSet, k int, ignoreSelf bool) ([]searchResult, experimentResult){
+	algorithms = map[string]func(ctx context.Context, store IndexStore, tb TokenTable, q RawTokenSet, k int, ignoreSelf bool) ([]searchResult, experimentResult, error){
 		// MergeList
 		// "merge_list":                    searchMergeList,
 
@@ -133,12 +134,12 @@ var (
 		// "probe_set_suffix":              searchProbeSetSuffix,
 
 		// ProbeSet-D
-		"probe_set_optimized":           searchProbeSetOptimized,
+		"probe_set_optimized": searchProbeSetOptimized,
 
 		// JOSIE
-		"merge_probe_cost_model_greedy": searchMergeProbeCostModelGreedy,
+		"merge_probe_cost_model_greedy": searchMergeProbeCostModelGreedyExperiment,
 	}
-	lshAlgorithms = map[string]func(db *sql.DB, setTable string, lsh *lshensemble.LshEnsemble, tb tokenTable, q rawTokenSet, k int, ignoreSelf bool, groundTruth []searchResult) ([]searchResult, experimentResult){
+	lshAlgorithms = map[string]func(ctx context.Context, store IndexStore, lsh *lshensemble.LshEnsemble, tb TokenTable, q RawTokenSet, k int, ignoreSelf bool, groundTruth []searchResult) ([]searchResult, experimentResult, error){
 		"lsh_ensemble_precision_90": searchLSHEnsemblePrecision90,
 		"lsh_ensemble_precision_60": searchLSHEnsemblePrecision60,
 	}
@@ -159,6 +160,7 @@ type experimentResult struct {
 	MaxListSizeRead int    `csv:"max_list_size_read"`
 	MaxCounterSize  int    `csv:"max_counter_size"`
 	IgnoreSize      int    `csv:"max_ignore_size"`
+	Incomplete      bool   `csv:"incomplete"`
 	Actions         string `csv:"actions"` // "l" means read a list, "s" means read a set, "o" means overlap size
 	Results         string `csv:"results"` // "s" means a set, "o" means overlap size
 	// These properties are for merge probe algorithm only
@@ -166,6 +168,15 @@ type experimentResult struct {
 	// These properties are for LSH Ensemble algorithm only
 	LSHDuration  int     `csv:"lsh_duration"`
 	LSHPrecision float64 `csv:"lsh_precision"`
+	// The upper bound overlap of the sets not in the results of an
+	// incomplete search, for the merge probe algorithm only
+	UnseenUpperbound int `csv:"unseen_upperbound"`
+	// The cache hits and misses of the posting list and set reads, for
+	// searches over a CachedStore only
+	NumListCacheHit  int `csv:"num_list_cache_hit"`
+	NumListCacheMiss int `csv:"num_list_cache_miss"`
+	NumSetCacheHit   int `csv:"num_set_cache_hit"`
+	NumSetCacheMiss  int `csv:"num_set_cache_miss"`
 }
 
 func init() {
@@ -212,21 +223,29 @@ func RunWebTableExperiments(db *sql.DB, outputDir string, cpuProfile bool, useMe
 
 func runExperiments(db *sql.DB, listTable, setTable, minhashTable string, queryTables [][]string, ks []int, outputDir string, cpuProfile bool, useMemTokenTable bool, queryIgnoreSelf bool) {
 	var lsh *lshensemble.LshEnsemble
-	var tb tokenTable
+	var tb TokenTable
+	store := NewPostgresStore(db, listTable, setTable)
 	log.Println("Counting total number of sets")
 	totalNumberOfSets = float64(countTotalNumberOfSets(db, setTable))
 	log.Printf("Total number of sets is %.0f", totalNumberOfSets)
 	log.Println("Creating token table...")
 	if useMemTokenTable {
-		tb = createTokenTableMem(db, listTable, queryIgnoreSelf)
+		var err error
+		tb, err = CreateTokenTableMem(store, queryIgnoreSelf)
+		if err != nil {
+			panic(err)
+		}
 	} else {
-		tb = createTokenTableDisk(db, listTable, queryIgnoreSelf)
+		tb = CreateTokenTableDisk(store, queryIgnoreSelf)
 	}
 	for _, t := range queryTables {
 		scale := t[0]
 		queryTable := t[1]
 		log.Printf("=== Begin experiments for scale [%s] using queries in %s", scale, queryTable)
-		queries := querySets(db, listTable, queryTable)
+		queries, err := querySets(db, listTable, queryTable)
+		if err != nil {
+			panic(err)
+		}
 		for _, k := range ks {
 			log.Printf("==== Begin experiments for k = %d", k)
 			for name, searchFunc := range algorithms {
@@ -247,7 +266,7 @@ func runExperiments(db *sql.DB, listTable, setTable, minhashTable string, queryT
 						fmt.Sprintf("%s_%d.prof", scale, k))
 				}
 				log.Printf("Running algorithm [%s], output to %s", name, outputFilename)
-				runExperiment(db, listTable, setTable, tb, queries, k, queryIgnoreSelf, searchFunc, outputFilename, cpuProfileFilename)
+				runExperiment(store, tb, queries, k, queryIgnoreSelf, searchFunc, outputFilename, cpuProfileFilename)
 				log.Printf("Finished running algorithm [%s]", name)
 			}
 			var groundTruths map[int64][]searchResult
@@ -276,7 +295,7 @@ func runExperiments(db *sql.DB, listTable, setTable, minhashTable string, queryT
 				}
 				// Running the algorithm
 				log.Printf("Running algorithm [%s], output to %s", name, outputFilename)
-				runLSHExperiment(db, setTable, lsh, tb, queries, k, queryIgnoreSelf,
+				runLSHExperiment(store, lsh, tb, queries, k, queryIgnoreSelf,
 					groundTruths, searchFunc, outputFilename, cpuProfileFilename)
 				log.Printf("Finished running algorithm [%s]", name)
 			}
@@ -288,13 +307,12 @@ func runExperiments(db *sql.DB, listTable, setTable, minhashTable string, queryT
 }
 
 func runExperiment(
-	db *sql.DB,
-	listTable, setTable string,
-	tb tokenTable,
-	queries []rawTokenSet,
+	store IndexStore,
+	tb TokenTable,
+	queries []RawTokenSet,
 	k int,
 	queryIgnoreSelf bool,
-	searchFunc func(db *sql.DB, listTable, setTable string, tb tokenTable, q rawTokenSet, k int, queryIgnoreSelf bool) ([]searchResult, experimentResult),
+	searchFunc func(ctx context.Context, store IndexStore, tb TokenTable, q RawTokenSet, k int, queryIgnoreSelf bool) ([]searchResult, experimentResult, error),
 	outputFilename, cpuProfileFilename string,
 ) {
 	log.Println("Dropping system file cache...")
@@ -315,7 +333,10 @@ func runExperiment(
 	for i, j := range rand.Perm(len(queries)) {
 		query := queries[j]
 		// log.Printf("Running query (ID: %v, size: %v, #%v/%v)", query.ID, len(query.RawTokens), i+1, len(queries))
-		_, expResult := searchFunc(db, listTable, setTable, tb, query, k, queryIgnoreSelf)
+		_, expResult, err := searchFunc(context.Background(), store, tb, query, k, queryIgnoreSelf)
+		if err != nil {
+			panic(err)
+		}
 		// log.Printf("Finished query in %v ms, %v set I/Os, %v list I/Os", expResult.Duration, expResult.NumSetRead, expResult.NumListRead)
 		// log.Printf("Results: %v", results)
 		perfs = append(perfs, &expResult)
@@ -330,15 +351,14 @@ func runExperiment(
 }
 
 func runLSHExperiment(
-	db *sql.DB,
-	setTable string,
+	store IndexStore,
 	lsh *lshensemble.LshEnsemble,
-	tb tokenTable,
-	queries []rawTokenSet,
+	tb TokenTable,
+	queries []RawTokenSet,
 	k int,
 	queryIgnoreSelf bool,
 	groundTruths map[int64][]searchResult,
-	searchFunc func(db *sql.DB, setTable string, lsh *lshensemble.LshEnsemble, tb tokenTable, q rawTokenSet, k int, queryIgnoreSelf bool, groundTruth []searchResult) ([]searchResult, experimentResult),
+	searchFunc func(ctx context.Context, store IndexStore, lsh *lshensemble.LshEnsemble, tb TokenTable, q RawTokenSet, k int, queryIgnoreSelf bool, groundTruth []searchResult) ([]searchResult, experimentResult, error),
 	outputFilename, cpuProfileFilename string,
 ) {
 	log.Println("Dropping system file cache...")
@@ -358,7 +378,10 @@ func runLSHExperiment(
 	for i, j := range rand.Perm(len(queries)) {
 		query := queries[j]
 		// log.Printf("Running query (ID: %v, size: %v, #%v/%v)", query.ID, len(query.RawTokens), i+1, len(queries))
-		_, expResult := searchFunc(db, setTable, lsh, tb, query, k, queryIgnoreSelf, groundTruths[query.ID])
+		_, expResult, err := searchFunc(context.Background(), store, lsh, tb, query, k, queryIgnoreSelf, groundTruths[query.ID])
+		if err != nil {
+			panic(err)
+		}
 		// log.Printf("Finished query in %v ms, %v set I/Os, %v list I/Os", expResult.Duration, expResult.NumSetRead, expResult.NumListRead)
 		// log.Printf("Results: %v", results)
 		perfs = append(perfs, &expResult)
@@ -371,6 +394,11 @@ func runLSHExperiment(
 	writeExperimentResults(perfs, outputFilename)
 }
 
+// JOSIE using the cost parameters reset for the current experiment
+func searchMergeProbeCostModelGreedyExperiment(ctx context.Context, store IndexStore, tb TokenTable, query RawTokenSet, k int, ignoreSelf bool) ([]searchResult, experimentResult, error) {
+	return searchMergeProbeCostModelGreedy(ctx, store, tb, costParameters, query, k, Budget{}, 1, 1, ignoreSelf, nil)
+}
+
 func countTotalNumberOfSets(db *sql.DB, setTable string) int {
 	if c, exists := setTableSizeCounts[setTable]; exists {
 		return c
@@ -420,7 +448,7 @@ func readResultString(resultStr string) []searchResult {
 		if err != nil {
 			panic(err)
 		}
-		result = append(result, searchResult{int64(id), overlap})
+		result = append(result, searchResult{ID: int64(id), Overlap: overlap})
 	}
 	return result
 }
@@ -0,0 +1,171 @@
+package joise
+
+import (
+	"bufio"
+	"bytes"
+	"container/heap"
+	"encoding/binary"
+	"io"
+	"os"
+	"sort"
+)
+
+// externalSorter sorts byte records in bytes.Compare order using sorted
+// runs spilled to temporary files once the buffered records exceed the
+// memory limit.
+type externalSorter struct {
+	tempDir  string
+	memLimit int
+	records  [][]byte
+	size     int
+	runs     []*os.File
+}
+
+func newExternalSorter(tempDir string, memLimit int) *externalSorter {
+	return &externalSorter{
+		tempDir:  tempDir,
+		memLimit: memLimit,
+	}
+}
+
+// add copies the record into the sorter.
+func (s *externalSorter) add(record []byte) error {
+	r := make([]byte, len(record))
+	copy(r, record)
+	s.records = append(s.records, r)
+	s.size += len(r) + 24
+	if s.size >= s.memLimit {
+		return s.spill()
+	}
+	return nil
+}
+
+func (s *externalSorter) sortRecords() {
+	sort.Slice(s.records, func(i, j int) bool {
+		return bytes.Compare(s.records[i], s.records[j]) < 0
+	})
+}
+
+// Write the buffered records as a sorted run
+func (s *externalSorter) spill() error {
+	s.sortRecords()
+	f, err := os.CreateTemp(s.tempDir, "josie-run-")
+	if err != nil {
+		return err
+	}
+	s.runs = append(s.runs, f)
+	w := bufio.NewWriter(f)
+	var buf [binary.MaxVarintLen64]byte
+	for _, r := range s.records {
+		n := binary.PutUvarint(buf[:], uint64(len(r)))
+		if _, err := w.Write(buf[:n]); err != nil {
+			return err
+		}
+		if _, err := w.Write(r); err != nil {
+			return err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	s.records = s.records[:0]
+	s.size = 0
+	return nil
+}
+
+// close removes the temporary files of the sorted runs.
+func (s *externalSorter) close() {
+	for _, f := range s.runs {
+		f.Close()
+		os.Remove(f.Name())
+	}
+	s.runs = nil
+}
+
+type runReader struct {
+	r      *bufio.Reader
+	record []byte
+}
+
+func (rr *runReader) next() error {
+	n, err := binary.ReadUvarint(rr.r)
+	if err != nil {
+		return err
+	}
+	rr.record = make([]byte, n)
+	_, err = io.ReadFull(rr.r, rr.record)
+	return err
+}
+
+type runHeap []*runReader
+
+func (h runHeap) Len() int            { return len(h) }
+func (h runHeap) Less(i, j int) bool  { return bytes.Compare(h[i].record, h[j].record) < 0 }
+func (h runHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *runHeap) Push(x interface{}) { *h = append(*h, x.(*runReader)) }
+func (h *runHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	x := old[n-1]
+	*h = old[0 : n-1]
+	return x
+}
+
+// each calls fn with every record in sorted order, and removes the
+// temporary files afterwards.
+func (s *externalSorter) each(fn func(record []byte) error) error {
+	defer s.close()
+	if len(s.runs) == 0 {
+		s.sortRecords()
+		for _, r := range s.records {
+			if err := fn(r); err != nil {
+				return err
+			}
+		}
+		s.records = nil
+		return nil
+	}
+	if len(s.records) > 0 {
+		if err := s.spill(); err != nil {
+			return err
+		}
+	}
+	h := make(runHeap, 0, len(s.runs))
+	for _, f := range s.runs {
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		rr := &runReader{r: bufio.NewReader(f)}
+		if err := rr.next(); err == io.EOF {
+			continue
+		} else if err != nil {
+			return err
+		}
+		h = append(h, rr)
+	}
+	heap.Init(&h)
+	for h.Len() > 0 {
+		rr := h[0]
+		if err := fn(rr.record); err != nil {
+			return err
+		}
+		if err := rr.next(); err == io.EOF {
+			heap.Pop(&h)
+			continue
+		} else if err != nil {
+			return err
+		}
+		heap.Fix(&h, 0)
+	}
+	return nil
+}
+
+// putKey encodes an int64 so that the encoded bytes sort in the same order
+// as the integers.
+func putKey(b []byte, v int64) {
+	binary.BigEndian.PutUint64(b, uint64(v)^(1<<63))
+}
+
+func getKey(b []byte) int64 {
+	return int64(binary.BigEndian.Uint64(b) ^ (1 << 63))
+}
@@ -0,0 +1,670 @@
+package joise
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+// The embedded index is a directory of files, each starts with a header
+// followed by the payload:
+//
+//	tokens      token records sorted by token: token, duplicate group id,
+//	            frequency, posting list offset and length, raw token offset
+//	            and length, each an int64
+//	raw_tokens  the raw tokens concatenated
+//	lists       for each posting list, the set IDs (int64), followed by the
+//	            set sizes (uint32) and the match positions (uint32), or
+//	            the delta and varint encoded entries if the payload
+//	            encoding is 1, see appendEncodedList
+//	set_offsets set records sorted by set ID: set ID, offset of the set
+//	            tokens and the set size, each an int64
+//	sets        for each set, its sorted tokens (uint32), or the blocks of
+//	            delta and varint encoded tokens if the payload encoding
+//	            is 1, see appendEncodedSet
+//
+// The header is: magic (8 bytes), format version (uint32), file kind
+// (uint32), number of records (uint64), CRC-32C checksum of the
+// payload (uint32) and the payload encoding (uint32). All integers are
+// little-endian.
+// Because every token of a set has the same width, or every block of an
+// encoded set has a skip pointer, a suffix of a set can be read without
+// touching its prefix.
+
+const (
+	fileStoreVersion    = 1
+	fileHeaderSize      = 32
+	tokenRecordSize     = 7 * 8
+	setRecordSize       = 3 * 8
+	listEntrySize       = 8 + 4 + 4
+	setTokenSize        = 4
+	fileStoreTokens     = "tokens"
+	fileStoreRawTokens  = "raw_tokens"
+	fileStoreLists      = "lists"
+	fileStoreSetOffsets = "set_offsets"
+	fileStoreSets       = "sets"
+)
+
+var (
+	fileStoreMagic = [8]byte{'J', 'O', 'S', 'I', 'E', 'I', 'D', 'X'}
+	fileStoreKinds = map[string]uint32{
+		fileStoreTokens:     1,
+		fileStoreRawTokens:  2,
+		fileStoreLists:      3,
+		fileStoreSetOffsets: 4,
+		fileStoreSets:       5,
+	}
+	crc32c = crc32.MakeTable(crc32.Castagnoli)
+	// ErrCorruptFileStore is returned when the files of an embedded index
+	// are truncated, have unexpected headers or fail checksum verification.
+	ErrCorruptFileStore = errors.New("corrupt file store")
+)
+
+type fileHeader struct {
+	Magic    [8]byte
+	Version  uint32
+	Kind     uint32
+	Count    uint64
+	Checksum uint32
+	Encoding uint32
+}
+
+// fileWriter writes the payload of a file and fills in the header on close.
+type fileWriter struct {
+	f      *os.File
+	w      *bufio.Writer
+	crc    hash.Hash32
+	header fileHeader
+	offset int64 // the number of payload bytes written
+	buf    [8]byte
+}
+
+func createFileWriter(dir, name string) (*fileWriter, error) {
+	f, err := os.Create(filepath.Join(dir, name))
+	if err != nil {
+		return nil, err
+	}
+	// Reserve space for the header
+	if _, err := f.Write(make([]byte, fileHeaderSize)); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &fileWriter{
+		f:   f,
+		w:   bufio.NewWriterSize(f, 1<<20),
+		crc: crc32.New(crc32c),
+		header: fileHeader{
+			Magic:   fileStoreMagic,
+			Version: fileStoreVersion,
+			Kind:    fileStoreKinds[name],
+		},
+	}, nil
+}
+
+func (fw *fileWriter) Write(p []byte) (int, error) {
+	n, err := fw.w.Write(p)
+	fw.crc.Write(p[:n])
+	fw.offset += int64(n)
+	return n, err
+}
+
+func (fw *fileWriter) writeInt64(v int64) error {
+	binary.LittleEndian.PutUint64(fw.buf[:], uint64(v))
+	_, err := fw.Write(fw.buf[:8])
+	return err
+}
+
+func (fw *fileWriter) writeUint32(v uint32) error {
+	binary.LittleEndian.PutUint32(fw.buf[:], v)
+	_, err := fw.Write(fw.buf[:4])
+	return err
+}
+
+func (fw *fileWriter) close() error {
+	err := fw.w.Flush()
+	if err == nil {
+		fw.header.Checksum = fw.crc.Sum32()
+		var b bytes.Buffer
+		binary.Write(&b, binary.LittleEndian, &fw.header)
+		_, err = fw.f.WriteAt(b.Bytes(), 0)
+	}
+	if err == nil {
+		err = fw.f.Sync()
+	}
+	if closeErr := fw.f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// FileStoreWriter writes an embedded index to a directory. Posting lists
+// must be added in increasing token order and sets in increasing set ID
+// order.
+type FileStoreWriter struct {
+	opts       storeOptions
+	buf        []byte
+	tokens     *fileWriter
+	rawTokens  *fileWriter
+	lists      *fileWriter
+	setOffsets *fileWriter
+	sets       *fileWriter
+	lastToken  int64
+	lastSetID  int64
+}
+
+// CreateFileStore creates the directory of an embedded index and returns a
+// writer for adding posting lists and sets to it. With WithCompressedLists
+// or WithCompressedSets, the posting lists or the sets are written
+// compressed.
+func CreateFileStore(dir string, opts ...StoreOption) (*FileStoreWriter, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	w := &FileStoreWriter{
+		opts:      newStoreOptions(opts),
+		lastToken: math.MinInt64,
+		lastSetID: math.MinInt64,
+	}
+	var err error
+	for name, fw := range map[string]**fileWriter{
+		fileStoreTokens:     &w.tokens,
+		fileStoreRawTokens:  &w.rawTokens,
+		fileStoreLists:      &w.lists,
+		fileStoreSetOffsets: &w.setOffsets,
+		fileStoreSets:       &w.sets,
+	} {
+		if *fw, err = createFileWriter(dir, name); err != nil {
+			w.abort()
+			return nil, err
+		}
+	}
+	if w.opts.compressLists {
+		w.lists.header.Encoding = listEncodingVarint
+	}
+	if w.opts.compressSets {
+		w.sets.header.Encoding = setEncodingBlocks
+	}
+	return w, nil
+}
+
+func (w *FileStoreWriter) files() []*fileWriter {
+	return []*fileWriter{w.tokens, w.rawTokens, w.lists, w.setOffsets, w.sets}
+}
+
+func (w *FileStoreWriter) abort() {
+	for _, fw := range w.files() {
+		if fw != nil {
+			fw.f.Close()
+		}
+	}
+}
+
+// AddList writes a token and its posting list.
+func (w *FileStoreWriter) AddList(entry TokenEntry, list []ListEntry) error {
+	if entry.Token <= w.lastToken {
+		return fmt.Errorf("token %d added after token %d", entry.Token, w.lastToken)
+	}
+	w.lastToken = entry.Token
+	listOffset := w.lists.offset
+	if err := w.writeList(list); err != nil {
+		return err
+	}
+	rawOffset := w.rawTokens.offset
+	if _, err := w.rawTokens.Write(entry.RawToken); err != nil {
+		return err
+	}
+	for _, v := range []int64{entry.Token, entry.GroupID, int64(entry.Frequency),
+		listOffset, int64(len(list)), rawOffset, int64(len(entry.RawToken))} {
+		if err := w.tokens.writeInt64(v); err != nil {
+			return err
+		}
+	}
+	w.tokens.header.Count++
+	w.lists.header.Count++
+	return nil
+}
+
+func (w *FileStoreWriter) writeList(list []ListEntry) error {
+	if w.opts.compressLists {
+		w.buf = appendEncodedList(w.buf[:0], list)
+		_, err := w.lists.Write(w.buf)
+		return err
+	}
+	for _, e := range list {
+		if err := w.lists.writeInt64(e.ID); err != nil {
+			return err
+		}
+	}
+	for _, e := range list {
+		if err := w.lists.writeUint32(uint32(e.Size)); err != nil {
+			return err
+		}
+	}
+	for _, e := range list {
+		if err := w.lists.writeUint32(uint32(e.MatchPosition)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// AddSet writes a set, its tokens must be sorted in increasing order.
+func (w *FileStoreWriter) AddSet(setID int64, tokens []int64) error {
+	if setID <= w.lastSetID {
+		return fmt.Errorf("set %d added after set %d", setID, w.lastSetID)
+	}
+	w.lastSetID = setID
+	offset := w.sets.offset
+	for _, token := range tokens {
+		if token < 0 || token > math.MaxUint32 {
+			return fmt.Errorf("token %d of set %d out of range", token, setID)
+		}
+	}
+	if w.opts.compressSets {
+		w.buf = appendEncodedSet(w.buf[:0], tokens)
+		if _, err := w.sets.Write(w.buf); err != nil {
+			return err
+		}
+	} else {
+		for _, token := range tokens {
+			if err := w.sets.writeUint32(uint32(token)); err != nil {
+				return err
+			}
+		}
+	}
+	for _, v := range []int64{setID, offset, int64(len(tokens))} {
+		if err := w.setOffsets.writeInt64(v); err != nil {
+			return err
+		}
+	}
+	w.setOffsets.header.Count++
+	w.sets.header.Count++
+	return nil
+}
+
+// Close writes the headers and closes all files.
+func (w *FileStoreWriter) Close() error {
+	w.rawTokens.header.Count = uint64(w.rawTokens.offset)
+	var firstErr error
+	for _, fw := range w.files() {
+		if err := fw.close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// FileStore is an IndexStore reading an embedded index from memory-mapped
+// files. It is safe for concurrent use, and must not be used after Close.
+type FileStore struct {
+	dir        string
+	files      map[string][]byte // memory-mapped files
+	headers    map[string]fileHeader
+	tokens     []byte
+	rawTokens  []byte
+	lists      []byte
+	setOffsets []byte
+	sets       []byte
+	maxGroupID struct {
+		once sync.Once
+		gid  int64
+	}
+}
+
+// OpenFileStore memory-maps the files of an embedded index and checks their
+// headers. Use Verify to check the payload checksums.
+func OpenFileStore(dir string) (*FileStore, error) {
+	s := &FileStore{
+		dir:     dir,
+		files:   make(map[string][]byte),
+		headers: make(map[string]fileHeader),
+	}
+	for name := range fileStoreKinds {
+		data, err := mmapFile(filepath.Join(dir, name))
+		if err != nil {
+			s.Close()
+			return nil, err
+		}
+		s.files[name] = data
+		header, err := readFileHeader(name, data)
+		if err != nil {
+			s.Close()
+			return nil, err
+		}
+		s.headers[name] = header
+	}
+	s.tokens = s.files[fileStoreTokens][fileHeaderSize:]
+	s.rawTokens = s.files[fileStoreRawTokens][fileHeaderSize:]
+	s.lists = s.files[fileStoreLists][fileHeaderSize:]
+	s.setOffsets = s.files[fileStoreSetOffsets][fileHeaderSize:]
+	s.sets = s.files[fileStoreSets][fileHeaderSize:]
+	if uint64(len(s.tokens)) != s.headers[fileStoreTokens].Count*tokenRecordSize ||
+		uint64(len(s.setOffsets)) != s.headers[fileStoreSetOffsets].Count*setRecordSize ||
+		uint64(len(s.rawTokens)) != s.headers[fileStoreRawTokens].Count {
+		s.Close()
+		return nil, fmt.Errorf("%w: unexpected file sizes in %s", ErrCorruptFileStore, dir)
+	}
+	if encoding := s.headers[fileStoreLists].Encoding; encoding != listEncodingFixed &&
+		encoding != listEncodingVarint {
+		s.Close()
+		return nil, fmt.Errorf("%w: %s has unsupported encoding %d", ErrCorruptFileStore,
+			fileStoreLists, encoding)
+	}
+	if encoding := s.headers[fileStoreSets].Encoding; encoding != setEncodingFixed &&
+		encoding != setEncodingBlocks {
+		s.Close()
+		return nil, fmt.Errorf("%w: %s has unsupported encoding %d", ErrCorruptFileStore,
+			fileStoreSets, encoding)
+	}
+	return s, nil
+}
+
+func readFileHeader(name string, data []byte) (fileHeader, error) {
+	var header fileHeader
+	if len(data) < fileHeaderSize {
+		return header, fmt.Errorf("%w: %s is truncated", ErrCorruptFileStore, name)
+	}
+	if err := binary.Read(bytes.NewReader(data[:fileHeaderSize]), binary.LittleEndian, &header); err != nil {
+		return header, err
+	}
+	if header.Magic != fileStoreMagic || header.Kind != fileStoreKinds[name] {
+		return header, fmt.Errorf("%w: %s has an unexpected header", ErrCorruptFileStore, name)
+	}
+	if header.Version != fileStoreVersion {
+		return header, fmt.Errorf("%w: %s has unsupported version %d", ErrCorruptFileStore, name, header.Version)
+	}
+	return header, nil
+}
+
+// Verify checks the checksums of all files, which reads the whole index.
+func (s *FileStore) Verify() error {
+	for name, data := range s.files {
+		if crc32.Checksum(data[fileHeaderSize:], crc32c) != s.headers[name].Checksum {
+			return fmt.Errorf("%w: checksum mismatch in %s", ErrCorruptFileStore, name)
+		}
+	}
+	return nil
+}
+
+// Close unmaps all files.
+func (s *FileStore) Close() error {
+	var firstErr error
+	for name, data := range s.files {
+		if err := munmapFile(data); err != nil && firstErr == nil {
+			firstErr = err
+		}
+		delete(s.files, name)
+	}
+	return firstErr
+}
+
+func getInt64(b []byte, i int) int64 {
+	return int64(binary.LittleEndian.Uint64(b[i*8:]))
+}
+
+func (s *FileStore) numTokens() int {
+	return len(s.tokens) / tokenRecordSize
+}
+
+func (s *FileStore) tokenRecord(i int) []byte {
+	return s.tokens[i*tokenRecordSize : (i+1)*tokenRecordSize]
+}
+
+// Finds the index of the token record, or -1 if not found
+func (s *FileStore) findToken(token int64) int {
+	n := s.numTokens()
+	i := sort.Search(n, func(i int) bool {
+		return getInt64(s.tokenRecord(i), 0) >= token
+	})
+	if i < n && getInt64(s.tokenRecord(i), 0) == token {
+		return i
+	}
+	return -1
+}
+
+// Reports whether n records of recordSize bytes starting at offset are
+// within data of the given length, offset and n are read from the index
+// files and may be negative or overflow if the files are corrupt
+func inFileRange(offset, n, recordSize int64, length int) bool {
+	return offset >= 0 && n >= 0 && offset <= int64(length) && n <= (int64(length)-offset)/recordSize
+}
+
+func (s *FileStore) tokenEntry(i int) (TokenEntry, error) {
+	r := s.tokenRecord(i)
+	rawOffset, rawLength := getInt64(r, 5), getInt64(r, 6)
+	if !inFileRange(rawOffset, rawLength, 1, len(s.rawTokens)) {
+		return TokenEntry{}, fmt.Errorf("%w: raw token out of range", ErrCorruptFileStore)
+	}
+	rawToken := make([]byte, rawLength)
+	copy(rawToken, s.rawTokens[rawOffset:])
+	return TokenEntry{
+		Token:     getInt64(r, 0),
+		GroupID:   getInt64(r, 1),
+		Frequency: int(getInt64(r, 2)),
+		RawToken:  rawToken,
+	}, nil
+}
+
+// InvertedList reads the posting list of a token.
+func (s *FileStore) InvertedList(token int64) ([]ListEntry, error) {
+	i := s.findToken(token)
+	if i < 0 {
+		return nil, fmt.Errorf("%w: token %d", ErrListNotFound, token)
+	}
+	r := s.tokenRecord(i)
+	offset, n := getInt64(r, 3), int(getInt64(r, 4))
+	if s.headers[fileStoreLists].Encoding == listEncodingVarint {
+		if !inFileRange(offset, int64(n), 1, len(s.lists)) {
+			return nil, fmt.Errorf("%w: posting list of token %d out of range", ErrCorruptFileStore, token)
+		}
+		entries, err := decodeList(s.lists[offset:])
+		if err != nil || len(entries) != n {
+			return nil, fmt.Errorf("%w: posting list of token %d cannot be decoded", ErrCorruptFileStore, token)
+		}
+		return entries, nil
+	}
+	if !inFileRange(offset, int64(n), listEntrySize, len(s.lists)) {
+		return nil, fmt.Errorf("%w: posting list of token %d out of range", ErrCorruptFileStore, token)
+	}
+	ids := s.lists[offset:]
+	sizes := ids[n*8:]
+	positions := sizes[n*4:]
+	entries := make([]ListEntry, n)
+	for j := range entries {
+		entries[j] = ListEntry{
+			ID:            getInt64(ids, j),
+			Size:          int(binary.LittleEndian.Uint32(sizes[j*4:])),
+			MatchPosition: int(binary.LittleEndian.Uint32(positions[j*4:])),
+		}
+	}
+	return entries, nil
+}
+
+// Finds the offset and size of a set
+func (s *FileStore) findSet(setID int64) (offset int64, size int, err error) {
+	n := len(s.setOffsets) / setRecordSize
+	i := sort.Search(n, func(i int) bool {
+		return getInt64(s.setOffsets[i*setRecordSize:], 0) >= setID
+	})
+	if i == n || getInt64(s.setOffsets[i*setRecordSize:], 0) != setID {
+		return 0, 0, fmt.Errorf("%w: set %d", ErrSetNotFound, setID)
+	}
+	r := s.setOffsets[i*setRecordSize:]
+	offset, size = getInt64(r, 1), int(getInt64(r, 2))
+	if s.headers[fileStoreSets].Encoding == setEncodingBlocks {
+		// Every token takes at least a byte, which bounds the size before
+		// computing the header size
+		if !inFileRange(offset, int64(size), 1, len(s.sets)) ||
+			offset+int64(encodedSetHeaderSize(size)) > int64(len(s.sets)) {
+			return 0, 0, fmt.Errorf("%w: set %d out of range", ErrCorruptFileStore, setID)
+		}
+		return offset, size, nil
+	}
+	if !inFileRange(offset, int64(size), setTokenSize, len(s.sets)) {
+		return 0, 0, fmt.Errorf("%w: set %d out of range", ErrCorruptFileStore, setID)
+	}
+	return offset, size, nil
+}
+
+// SetTokens reads all tokens of a set.
+func (s *FileStore) SetTokens(setID int64) ([]int64, error) {
+	return s.SetTokensSubset(setID, 0, math.MaxInt32)
+}
+
+// SetTokensSuffix reads the tokens of a set starting from startPos.
+func (s *FileStore) SetTokensSuffix(setID int64, startPos int) ([]int64, error) {
+	return s.SetTokensSubset(setID, startPos, math.MaxInt32)
+}
+
+// SetTokensSubset reads the tokens of a set from startPos to endPos, only
+// the pages containing the requested tokens are read.
+func (s *FileStore) SetTokensSubset(setID int64, startPos, endPos int) ([]int64, error) {
+	offset, size, err := s.findSet(setID)
+	if err != nil {
+		return nil, err
+	}
+	if s.headers[fileStoreSets].Encoding == setEncodingBlocks {
+		tokens, err := decodeSetTokens(s.sets[offset:], startPos, endPos)
+		if err != nil || binary.LittleEndian.Uint32(s.sets[offset:]) != uint32(size) {
+			return nil, fmt.Errorf("%w: set %d cannot be decoded", ErrCorruptFileStore, setID)
+		}
+		return tokens, nil
+	}
+	endPos = min(endPos, size)
+	startPos = min(startPos, endPos)
+	data := s.sets[offset+int64(startPos*setTokenSize):]
+	tokens := make([]int64, endPos-startPos)
+	for i := range tokens {
+		tokens[i] = int64(binary.LittleEndian.Uint32(data[i*setTokenSize:]))
+	}
+	return tokens, nil
+}
+
+// TokenEntries reads the metadata of the given tokens.
+func (s *FileStore) TokenEntries(tokens []int64) ([]TokenEntry, error) {
+	entries := make([]TokenEntry, 0, len(tokens))
+	for _, token := range tokens {
+		i := s.findToken(token)
+		if i < 0 {
+			continue
+		}
+		entry, err := s.tokenEntry(i)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Token < entries[j].Token
+	})
+	return entries, nil
+}
+
+// ScanTokenEntries calls fn with the metadata of every token in increasing
+// token order.
+func (s *FileStore) ScanTokenEntries(fn func(entry TokenEntry) error) error {
+	for i := 0; i < s.numTokens(); i++ {
+		entry, err := s.tokenEntry(i)
+		if err != nil {
+			return err
+		}
+		if err := fn(entry); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// NumTokens returns the number of tokens.
+func (s *FileStore) NumTokens() (int, error) {
+	return s.numTokens(), nil
+}
+
+// MaxGroupID returns the maximum duplicate group id.
+func (s *FileStore) MaxGroupID() (int64, error) {
+	s.maxGroupID.once.Do(func() {
+		for i := 0; i < s.numTokens(); i++ {
+			if gid := getInt64(s.tokenRecord(i), 1); gid > s.maxGroupID.gid {
+				s.maxGroupID.gid = gid
+			}
+		}
+	})
+	return s.maxGroupID.gid, nil
+}
+
+// DeletedSets returns no sets, as an embedded index is read-only.
+func (s *FileStore) DeletedSets() ([]int64, error) {
+	return nil, nil
+}
+
+// The checksums of the token files change with the metadata or the raw
+// token of any token
+func (s *FileStore) tokenChecksum() (uint64, error) {
+	return uint64(s.headers[fileStoreTokens].Checksum)<<32 |
+		uint64(s.headers[fileStoreRawTokens].Checksum), nil
+}
+
+// NumSets returns the number of sets.
+func (s *FileStore) NumSets() int {
+	return len(s.setOffsets) / setRecordSize
+}
+
+// WriteFileStore writes all posting lists and sets of an in-memory index
+// to a directory as an embedded index created with the options. Deleted
+// sets must be compacted before writing.
+func WriteFileStore(dir string, src *MemStore, opts ...StoreOption) error {
+	src.lock.RLock()
+	defer src.lock.RUnlock()
+	if len(src.deleted) > 0 {
+		return fmt.Errorf("%d deleted sets are not compacted", len(src.deleted))
+	}
+	w, err := CreateFileStore(dir, opts...)
+	if err != nil {
+		return err
+	}
+	tokens := make([]int64, 0, len(src.tokens))
+	for token := range src.tokens {
+		tokens = append(tokens, token)
+	}
+	sort.Sort(byTokenOrderSingular(tokens))
+	for _, token := range tokens {
+		list, err := src.list(token)
+		if err != nil {
+			w.abort()
+			return err
+		}
+		if err := w.AddList(src.tokens[token], list); err != nil {
+			w.abort()
+			return err
+		}
+	}
+	setIDs := make([]int64, 0, len(src.sets)+len(src.encodedSets))
+	for id := range src.sets {
+		setIDs = append(setIDs, id)
+	}
+	for id := range src.encodedSets {
+		setIDs = append(setIDs, id)
+	}
+	sort.Slice(setIDs, func(i, j int) bool { return setIDs[i] < setIDs[j] })
+	for _, id := range setIDs {
+		tokens, err := src.set(id, 0, math.MaxInt32)
+		if err != nil {
+			w.abort()
+			return err
+		}
+		if err := w.AddSet(id, tokens); err != nil {
+			w.abort()
+			return err
+		}
+	}
+	return w.Close()
+}
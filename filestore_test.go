@@ -0,0 +1,160 @@
+package joise
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestFileStore(t *testing.T) {
+	r := rand.New(rand.NewSource(2))
+	sets := randomRawSets(r, 200, 300)
+	src := buildTestMemStore(t, sets)
+	for _, opts := range [][]StoreOption{nil, {WithCompressedLists(), WithCompressedSets()}} {
+		dir := t.TempDir()
+		if err := WriteFileStore(dir, src, opts...); err != nil {
+			t.Fatal(err)
+		}
+		store, err := OpenFileStore(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := store.Verify(); err != nil {
+			t.Fatal(err)
+		}
+		if store.NumSets() != src.NumSets() {
+			t.Fatalf("got %d sets, want %d", store.NumSets(), src.NumSets())
+		}
+		for id := range sets {
+			want, _ := src.SetTokens(id)
+			got, err := store.SetTokens(id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Fatalf("set %d: got %v, want %v", id, got, want)
+			}
+			got, err = store.SetTokensSubset(id, 1, 3)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, want[min(1, len(want)):min(3, len(want))]) {
+				t.Fatalf("set %d [1, 3): got %v, want %v", id, got, want)
+			}
+		}
+		err = src.ScanTokenEntries(func(entry TokenEntry) error {
+			want, _ := src.InvertedList(entry.Token)
+			got, err := store.InvertedList(entry.Token)
+			if err != nil {
+				return err
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Fatalf("token %d: got %v, want %v", entry.Token, got, want)
+			}
+			entries, err := store.TokenEntries([]int64{entry.Token})
+			if err != nil {
+				return err
+			}
+			if len(entries) != 1 || !reflect.DeepEqual(entries[0], entry) {
+				t.Fatalf("token %d: got entries %v, want %v", entry.Token, entries, entry)
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		tb, err := CreateTokenTableMem(store, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkSearchAlgorithms(t, r, store, tb, sets)
+		if err := store.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestFileStoreVerify(t *testing.T) {
+	r := rand.New(rand.NewSource(3))
+	src := buildTestMemStore(t, randomRawSets(r, 50, 100))
+	dir := t.TempDir()
+	if err := WriteFileStore(dir, src); err != nil {
+		t.Fatal(err)
+	}
+	name := filepath.Join(dir, fileStoreSets)
+	data, err := os.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[len(data)-1]++
+	if err := os.WriteFile(name, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	store, err := OpenFileStore(dir)
+	if err == nil {
+		defer store.Close()
+		err = store.Verify()
+	}
+	if !errors.Is(err, ErrCorruptFileStore) {
+		t.Fatalf("got error %v, want %v", err, ErrCorruptFileStore)
+	}
+}
+
+func TestFileStoreCorruptRecords(t *testing.T) {
+	r := rand.New(rand.NewSource(16))
+	src := buildTestMemStore(t, randomRawSets(r, 50, 100))
+	for _, opts := range [][]StoreOption{nil, {WithCompressedLists(), WithCompressedSets()}} {
+		// The fields of the first token and set records holding offsets and
+		// sizes: list offset, list length, raw token offset and raw token
+		// length, then set offset and set size
+		for _, field := range []struct {
+			name  string
+			index int
+		}{
+			{fileStoreTokens, 3}, {fileStoreTokens, 4}, {fileStoreTokens, 5}, {fileStoreTokens, 6},
+			{fileStoreSetOffsets, 1}, {fileStoreSetOffsets, 2},
+		} {
+			for _, value := range []int64{-1, math.MinInt64, math.MaxInt64, 1 << 40} {
+				dir := t.TempDir()
+				if err := WriteFileStore(dir, src, opts...); err != nil {
+					t.Fatal(err)
+				}
+				name := filepath.Join(dir, field.name)
+				data, err := os.ReadFile(name)
+				if err != nil {
+					t.Fatal(err)
+				}
+				record := data[fileHeaderSize:]
+				id := getInt64(record, 0)
+				binary.LittleEndian.PutUint64(record[field.index*8:], uint64(value))
+				if err := os.WriteFile(name, data, 0644); err != nil {
+					t.Fatal(err)
+				}
+				store, err := OpenFileStore(dir)
+				if err != nil {
+					t.Fatal(err)
+				}
+				switch {
+				case field.name == fileStoreSetOffsets:
+					_, err = store.SetTokens(id)
+				case field.index < 5:
+					_, err = store.InvertedList(id)
+				default:
+					_, err = store.TokenEntries([]int64{id})
+				}
+				if !errors.Is(err, ErrCorruptFileStore) {
+					t.Fatalf("%s field %d of %d: got error %v, want %v", field.name, field.index, value,
+						err, ErrCorruptFileStore)
+				}
+				if err := store.Close(); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+	}
+}
@@ -1,10 +1,14 @@
 package joise
 
-import "container/heap"
+import (
+	"container/heap"
+	"math"
+)
 
 type searchResult struct {
 	ID      int64
 	Overlap int
+	Partial bool // the overlap is a lower bound found by an incomplete search
 }
 
 type searchResultHeap []searchResult
@@ -41,7 +45,7 @@ func pushCandidate(h *searchResultHeap, k int, id int64, overlap int) bool {
 		}
 		heap.Pop(h)
 	}
-	heap.Push(h, searchResult{id, overlap})
+	heap.Push(h, searchResult{ID: id, Overlap: overlap})
 	return true
 }
 
@@ -84,3 +88,76 @@ func copyHeap(h *searchResultHeap) *searchResultHeap {
 	copy(h2, *h)
 	return &h2
 }
+
+// scoredResult is a search result ranked by a score derived from the overlap
+type scoredResult struct {
+	ID      int64
+	Overlap int
+	Score   float64
+}
+
+type scoredResultHeap []scoredResult
+
+func (h scoredResultHeap) Len() int           { return len(h) }
+func (h scoredResultHeap) Less(i, j int) bool { return h[i].Score < h[j].Score }
+func (h scoredResultHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+
+func (h *scoredResultHeap) Push(x interface{}) {
+	*h = append(*h, x.(scoredResult))
+}
+
+func (h *scoredResultHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	x := old[n-1]
+	*h = old[0 : n-1]
+	return x
+}
+
+func kthScore(h *scoredResultHeap, k int) float64 {
+	if h.Len() < k {
+		return 0
+	}
+	return (*h)[0].Score
+}
+
+func pushScoredCandidate(h *scoredResultHeap, k int, r scoredResult) bool {
+	if h.Len() == k {
+		if (*h)[0].Score >= r.Score {
+			return false
+		}
+		heap.Pop(h)
+	}
+	heap.Push(h, r)
+	return true
+}
+
+func orderedScoredResults(h *scoredResultHeap) []scoredResult {
+	r := make([]scoredResult, h.Len())
+	for i := len(r) - 1; i >= 0; i-- {
+		r[i] = heap.Pop(h).(scoredResult)
+	}
+	return r
+}
+
+// Without actually performing the push, check what is the kth score
+// after pushing a candidate with the score value.
+func kthScoreAfterPush(h *scoredResultHeap, k int, score float64) float64 {
+	if h.Len() < k-1 {
+		return 0
+	}
+	kth := (*h)[0].Score
+	if score <= kth {
+		return kth
+	}
+	if k == 1 {
+		return score
+	}
+	var jth float64
+	if k == 2 {
+		jth = (*h)[1].Score
+	} else {
+		jth = math.Min((*h)[1].Score, (*h)[2].Score)
+	}
+	return math.Min(jth, score)
+}
@@ -1,13 +1,39 @@
 package joise
 
 import (
+	"context"
 	"database/sql"
+	"errors"
 	"fmt"
 
 	"github.com/lib/pq"
 )
 
-type rawTokenSet struct {
+var (
+	// ErrSetNotFound is returned when reading a set that is not in the index.
+	ErrSetNotFound = errors.New("set not found")
+	// ErrListNotFound is returned when reading the posting list of a token
+	// that is not in the index.
+	ErrListNotFound = errors.New("posting list not found")
+)
+
+func setError(setID int64, err error) error {
+	if errors.Is(err, sql.ErrNoRows) {
+		return fmt.Errorf("%w: set %d", ErrSetNotFound, setID)
+	}
+	return fmt.Errorf("reading set %d: %w", setID, err)
+}
+
+func listError(token int64, err error) error {
+	if errors.Is(err, sql.ErrNoRows) {
+		return fmt.Errorf("%w: token %d", ErrListNotFound, token)
+	}
+	return fmt.Errorf("reading posting list of token %d: %w", token, err)
+}
+
+// RawTokenSet is a query set of raw tokens. Tokens are the integer tokens
+// of the set in the index, which are only required by the disk token table.
+type RawTokenSet struct {
 	ID        int64
 	Tokens    []int64
 	RawTokens [][]byte
@@ -44,57 +70,114 @@ func (l bySuffixLength) Less(i, j int) bool {
 }
 
 // SetTokens read tokens from a given set.
-func SetTokens(db *sql.DB, table string, setID int64) []int64 {
+func SetTokens(db *sql.DB, table string, setID int64) ([]int64, error) {
+	return SetTokensContext(context.Background(), db, table, setID)
+}
+
+// SetTokensContext read tokens from a given set, the read is canceled when
+// ctx is done.
+func SetTokensContext(ctx context.Context, db *sql.DB, table string, setID int64) ([]int64, error) {
 	s := fmt.Sprintf(`
 	SELECT tokens FROM %s WHERE id = $1;`, table)
 	var tokens []int64
-	if err := db.QueryRow(s, setID).Scan(pq.Array(&tokens)); err != nil {
-		panic(err)
+	if err := db.QueryRowContext(ctx, s, setID).Scan(pq.Array(&tokens)); err != nil {
+		return nil, setError(setID, err)
 	}
-	return tokens
+	return tokens, nil
 }
 
-func setTokensPrefix(db *sql.DB, table string, setID int64, endPos int) []int64 {
+func setTokensPrefix(ctx context.Context, db *sql.DB, table string, setID int64, endPos int) ([]int64, error) {
 	s := fmt.Sprintf(`
 	SELECT tokens[1:$1] FROM %s WHERE id = $2;`, table)
 	var tokens []int64
-	if err := db.QueryRow(s, endPos+1, setID).Scan(pq.Array(&tokens)); err != nil {
-		panic(err)
+	if err := db.QueryRowContext(ctx, s, endPos+1, setID).Scan(pq.Array(&tokens)); err != nil {
+		return nil, setError(setID, err)
 	}
-	return tokens
+	return tokens, nil
 }
 
-func setTokensSuffix(db *sql.DB, table string, setID int64, startPos int) []int64 {
+func setTokensSuffix(ctx context.Context, db *sql.DB, table string, setID int64, startPos int) ([]int64, error) {
 	s := fmt.Sprintf(`
 	SELECT tokens[$1:size] FROM %s WHERE id = $2;`, table)
 	var tokens []int64
-	if err := db.QueryRow(s, startPos+1, setID).Scan(pq.Array(&tokens)); err != nil {
-		panic(err)
+	if err := db.QueryRowContext(ctx, s, startPos+1, setID).Scan(pq.Array(&tokens)); err != nil {
+		return nil, setError(setID, err)
 	}
-	return tokens
+	return tokens, nil
 }
 
 // startPos is an inclusive zero-start index
 // endPos is a non-inclusive zero-start index
-func setTokensSubset(db *sql.DB, table string, setID int64, startPos, endPos int) []int64 {
+func setTokensSubset(ctx context.Context, db *sql.DB, table string, setID int64, startPos, endPos int) ([]int64, error) {
 	s := fmt.Sprintf(`
 	SELECT tokens[$1:$2] FROM %s WHERE id = $3;`, pq.QuoteIdentifier(table))
 	var tokens []int64
-	if err := db.QueryRow(s, startPos+1, endPos, setID).Scan(pq.Array(&tokens)); err != nil {
-		panic(err)
+	if err := db.QueryRowContext(ctx, s, startPos+1, endPos, setID).Scan(pq.Array(&tokens)); err != nil {
+		return nil, setError(setID, err)
+	}
+	return tokens, nil
+}
+
+// The SQL expression of the 1-based byte position in the encoded_tokens
+// column of the block with the given index, computed from the skip pointer
+// of the block, which is read as a 4-byte range
+func setBlockPositionSQL(block string) string {
+	return fmt.Sprintf(`(SELECT 4 * ((size + %[2]d) / %[3]d) + 5 +
+		get_byte(p, 0) + (get_byte(p, 1) << 8) + (get_byte(p, 2) << 16) + (get_byte(p, 3) << 24)
+		FROM substring(encoded_tokens FROM 5 + 4 * %[1]s FOR 4) AS p)`,
+		block, setBlockSize-1, setBlockSize)
+}
+
+// Reads the tokens of a set from startPos to endPos from the encoded_tokens
+// column written with WithCompressedSets. Only the skip pointers and the
+// blocks containing the tokens are read from the column, the read is
+// canceled when ctx is done.
+func encodedSetTokens(ctx context.Context, db *sql.DB, table string, setID int64, startPos, endPos int) ([]int64, error) {
+	startBlock := startPos / setBlockSize
+	// The block after the last block containing the tokens, computed from
+	// endPos clamped to the set size, so reading a suffix with a very large
+	// endPos does not overflow the integer arithmetic of Postgres
+	endBlock := fmt.Sprintf("((least($3, size) + %d) / %d)", setBlockSize-1, setBlockSize)
+	s := fmt.Sprintf(`
+	SELECT size, CASE WHEN $2 < least(size, $3) THEN
+		substring(encoded_tokens FROM %[2]s FOR CASE WHEN %[4]s * %[5]d < size
+			THEN %[3]s - %[2]s ELSE length(encoded_tokens) END)
+		ELSE ''::bytea END
+	FROM %[1]s WHERE id = $1`, pq.QuoteIdentifier(table),
+		setBlockPositionSQL("$4"), setBlockPositionSQL(endBlock), endBlock, setBlockSize)
+	var size int
+	var b []byte
+	if err := db.QueryRowContext(ctx, s, setID, startPos, endPos,
+		startBlock).Scan(&size, &b); err != nil {
+		return nil, setError(setID, err)
 	}
-	return tokens
+	endPos = min(endPos, size)
+	startPos = min(startPos, endPos)
+	if startPos == endPos {
+		return []int64{}, nil
+	}
+	tokens, err := decodeSetBlocks(b, startBlock*setBlockSize, startPos, endPos)
+	if err != nil {
+		return nil, setError(setID, err)
+	}
+	return tokens, nil
 }
 
 // InvertedList reads an inverted list from the database
-func InvertedList(db *sql.DB, table string, token int64) (entries []ListEntry) {
+func InvertedList(db *sql.DB, table string, token int64) ([]ListEntry, error) {
+	return InvertedListContext(context.Background(), db, table, token)
+}
+
+// InvertedListContext reads an inverted list from the database, the read is
+// canceled when ctx is done.
+func InvertedListContext(ctx context.Context, db *sql.DB, table string, token int64) ([]ListEntry, error) {
 	var setIDs, sizes, matchPositions []int64
 	s := fmt.Sprintf(`
 	SELECT set_ids, set_sizes, match_positions FROM %s WHERE token = $1`, pq.QuoteIdentifier(table))
-	if err := db.QueryRow(s, token).Scan(pq.Array(&setIDs), pq.Array(&sizes), pq.Array(&matchPositions)); err != nil {
-		panic(err)
+	if err := db.QueryRowContext(ctx, s, token).Scan(pq.Array(&setIDs), pq.Array(&sizes), pq.Array(&matchPositions)); err != nil {
+		return nil, listError(token, err)
 	}
-	entries = make([]ListEntry, len(setIDs))
+	entries := make([]ListEntry, len(setIDs))
 	for i := range entries {
 		entries[i] = ListEntry{
 			ID:            setIDs[i],
@@ -102,10 +185,26 @@ func InvertedList(db *sql.DB, table string, token int64) (entries []ListEntry) {
 			MatchPosition: int(matchPositions[i]),
 		}
 	}
-	return
+	return entries, nil
 }
 
-func querySets(db *sql.DB, listTable, queryTable string) []rawTokenSet {
+// Reads a posting list from the encoded_list column written with
+// WithCompressedLists, the read is canceled when ctx is done.
+func encodedInvertedList(ctx context.Context, db *sql.DB, table string, token int64) ([]ListEntry, error) {
+	var b []byte
+	s := fmt.Sprintf(`
+	SELECT encoded_list FROM %s WHERE token = $1`, pq.QuoteIdentifier(table))
+	if err := db.QueryRowContext(ctx, s, token).Scan(&b); err != nil {
+		return nil, listError(token, err)
+	}
+	entries, err := decodeList(b)
+	if err != nil {
+		return nil, listError(token, err)
+	}
+	return entries, nil
+}
+
+func querySets(db *sql.DB, listTable, queryTable string) ([]RawTokenSet, error) {
 	rows, err := db.Query(fmt.Sprintf(`
 		SELECT id, (
 			SELECT array_agg(raw_token)
@@ -113,20 +212,18 @@ func querySets(db *sql.DB, listTable, queryTable string) []rawTokenSet {
 			WHERE token = any(tokens)
 		), tokens FROM %s`, pq.QuoteIdentifier(listTable), pq.QuoteIdentifier(queryTable)))
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
-	queries := make([]rawTokenSet, 0)
+	defer rows.Close()
+	queries := make([]RawTokenSet, 0)
 	for rows.Next() {
-		var query rawTokenSet
+		var query RawTokenSet
 		var ba pq.ByteaArray
 		if err := rows.Scan(&query.ID, &ba, pq.Array(&query.Tokens)); err != nil {
-			panic(err)
+			return nil, err
 		}
 		query.RawTokens = ba
 		queries = append(queries, query)
 	}
-	if err := rows.Err(); err != nil {
-		panic(err)
-	}
-	return queries
+	return queries, rows.Err()
 }
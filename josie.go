@@ -1,31 +1,54 @@
 package joise
 
 import (
-	"database/sql"
+	"container/heap"
+	"context"
 	"sort"
 	"time"
 )
 
 // This is the JOSIE algorithm presented in the SIGMOD paper.
+// If emit is not nil, it is called with every result as soon as the result
+// is final, in decreasing overlap order.
+// If prefetch is greater than 1, up to prefetch posting lists are read
+// concurrently, and the costs of reading lists are reduced accordingly in the
+// cost model, while the budget is charged their full costs.
+// If probe is greater than 1, the next qualified candidates are read
+// concurrently with the candidate chosen to read, up to probe sets at a time,
+// and the exact overlaps of the ones not chosen afterwards are merged into
+// the running top-k once the candidates of the batch are processed.
+// If ctx is done before the search completes, or the next posting list or
+// set read would exceed the budget, the search stops and returns the best
+// results found so far with Incomplete set in the experiment result, see
+// bestSoFar. The results not yet emitted are emitted at the end in this
+// case.
 func searchMergeProbeCostModelGreedy(
-	db *sql.DB,
-	listTable,
-	setTable string,
-	tb tokenTable,
-	query rawTokenSet,
+	ctx context.Context,
+	store IndexStore,
+	tb TokenTable,
+	cost CostParameters,
+	query RawTokenSet,
 	k int,
+	budget Budget,
+	prefetch int,
+	probe int,
 	ignoreSelf bool,
-) ([]searchResult, experimentResult) {
+	emit func(searchResult) error,
+) ([]searchResult, experimentResult, error) {
 	var expResult experimentResult
 
 	start := time.Now()
-	tokens, freqs, gids := tb.process(query)
+	tokens, freqs, gids, err := tb.process(query)
+	if err != nil {
+		return nil, expResult, err
+	}
 	readListCosts := make([]float64, len(freqs))
 	for i := 0; i < len(freqs); i++ {
 		if i == 0 {
-			readListCosts[i] = readListCost(freqs[i] + 1)
+			readListCosts[i] = cost.readListCostPrefetched(tokens[i], freqs[i]+1, prefetch)
 		} else {
-			readListCosts[i] = readListCosts[i-1] + readListCost(freqs[i]+1)
+			readListCosts[i] = readListCosts[i-1] +
+				cost.readListCostPrefetched(tokens[i], freqs[i]+1, prefetch)
 		}
 	}
 	expResult.PreprocDuration = int(time.Now().Sub(start) / time.Millisecond)
@@ -33,22 +56,36 @@ func searchMergeProbeCostModelGreedy(
 
 	querySize := len(tokens)
 	counter := make(map[int64]*candidateEntry)
-	var ignores map[int64]bool
-	if ignoreSelf {
-		ignores = map[int64]bool{query.ID: true}
-	} else {
-		ignores = make(map[int64]bool)
+	ignores, err := newIgnores(store, query, ignoreSelf)
+	if err != nil {
+		return nil, expResult, err
 	}
 	h := &searchResultHeap{}
+	stream := newResultStream(emit)
+	lists := newListPrefetcher(ctx, store, tokens, gids, prefetch)
+	defer lists.stop()
+	sets := newSetPrefetcher(ctx, store, probe)
+	defer sets.stop()
 	var numSkipped int
+	// The estimated cost of the reads so far
+	var spentCost float64
+	// The upper bound overlap of the sets not in the counter, and the last
+	// query position of the merged posting lists
+	var unseenUpperbound, mergedPosition int
 
 	currBatchLists := batchSize
 
 	for i := 0; i < querySize; i, numSkipped = nextDistinctList(tokens, gids, i) {
-		token := tokens[i]
 		skippedOverlap := numSkipped
 		maxOverlapUnseenCandidate := upperboundOverlapUknownCandidate(querySize,
 			i, skippedOverlap)
+		unseenUpperbound, mergedPosition = maxOverlapUnseenCandidate, i-skippedOverlap-1
+
+		// Emit the results that are final after reading the previous lists
+		if err := stream.flush(h, maxOverlapUnseenCandidate, counter, querySize,
+			i-skippedOverlap-1); err != nil {
+			return nil, expResult, err
+		}
 
 		// Early terminates once the threshold index has reached and
 		// there is no remaining sets in the counter
@@ -56,8 +93,26 @@ func searchMergeProbeCostModelGreedy(
 			break
 		}
 
-		// Read the list
-		entries := InvertedList(db, listTable, token)
+		// Read the list, or stop with the best results so far if it would
+		// exceed the budget or the context is done. The budget is charged
+		// the full cost of the list even if its read is overlapped, and
+		// only the lists it allows are prefetched.
+		readCost := cost.readTokenListCost(tokens[i], freqs[i]+1)
+		if !budget.allowsListRead(expResult.NumListRead, spentCost, readCost) {
+			expResult.Incomplete = true
+			break
+		}
+		window := budget.listReadWindow(cost, tokens, freqs, gids, i, prefetch,
+			expResult.NumListRead, spentCost)
+		entries, err := lists.get(i, window)
+		if ctx.Err() != nil {
+			expResult.Incomplete = true
+			break
+		}
+		if err != nil {
+			return nil, expResult, err
+		}
+		spentCost += readCost
 		expResult.NumListRead++
 		expResult.MaxListSizeRead = max(expResult.MaxListSizeRead, len(entries))
 
@@ -81,6 +136,9 @@ func searchMergeProbeCostModelGreedy(
 				entry.MatchPosition, i, skippedOverlap)
 		}
 
+		unseenUpperbound, mergedPosition = upperboundOverlapUknownCandidate(querySize,
+			i+1, 0), i
+
 		// Terminates as we are at the last list, no need to read set
 		if i == querySize-1 {
 			break
@@ -108,7 +166,7 @@ func searchMergeProbeCostModelGreedy(
 		// posting lists and obtain qualified candidates
 		mergeListsBenefit, numWithBenefit, candidates := processCandidatesInit(
 			querySize, i, nextBatchEndIndex, kthOverlap(h, k), batchSize,
-			counter, ignores)
+			counter, ignores, cost)
 		// Record the counter size
 		expResult.MaxCounterSize = max(expResult.MaxCounterSize, len(counter))
 		// Continue reading posting lists if no qualified candidate found
@@ -129,7 +187,7 @@ func searchMergeProbeCostModelGreedy(
 		// Greedily determine the next best candidate until the qualified
 		// candidates exhausted or when reading the next batch of lists yield
 		// better net benefit
-		for _, candidate := range candidates {
+		for j, candidate := range candidates {
 			// Skip ones that has already been eliminated.
 			if candidate == nil {
 				continue
@@ -157,7 +215,7 @@ func searchMergeProbeCostModelGreedy(
 					// Estimate the benefit of reading the next batch of lists
 					// (expensive)
 					mergeListsBenefit = processCandidatesUpdate(kth, candidates,
-						counter, ignores)
+						counter, ignores, cost)
 				}
 				// Estimate the benefit of reading this set
 				// (expensive if fastEstimate is false)
@@ -182,7 +240,7 @@ func searchMergeProbeCostModelGreedy(
 				(numCandidateExpensive+1)*len(candidates) >
 					expensiveEstimationBudget {
 				mergeListsBenefit -= readListsBenenfitForCandidate(candidate,
-					fastEstimateKthOverlap)
+					fastEstimateKthOverlap, cost)
 			}
 			// Mark this candidate as read.
 			candidate.read = true
@@ -198,8 +256,48 @@ func searchMergeProbeCostModelGreedy(
 			// Compute the total overlap
 			var totalOverlap int
 			if candidate.suffixLength() > 0 {
-				s := setTokensSuffix(db, setTable, candidate.id,
-					candidate.latestMatchPosition+1)
+				// Stop with the best results so far, including this
+				// candidate, if reading the set would exceed the budget or
+				// the context is done
+				numPending, pendingCost := sets.pendingReads()
+				if !sets.isPending(candidate) {
+					if !budget.allowsSetRead(expResult.NumSetRead+numPending,
+						spentCost+pendingCost, candidate.estimatedCost) {
+						counter[candidate.id] = candidate
+						expResult.Incomplete = true
+						break
+					}
+					if sets.tryStart(candidate) {
+						numPending++
+						pendingCost += candidate.estimatedCost
+					}
+				}
+				// Start reading the next qualified candidates concurrently,
+				// which are still sorted by estimated overlaps
+				for _, next := range candidates[j+1:] {
+					if next == nil || next.read || sets.isPending(next) ||
+						next.suffixLength() == 0 || next.maximumOverlap <= kth {
+						continue
+					}
+					if next.estimatedOverlap <= kth ||
+						!budget.allowsSetRead(expResult.NumSetRead+numPending,
+							spentCost+pendingCost, next.estimatedCost) ||
+						!sets.tryStart(next) {
+						break
+					}
+					numPending++
+					pendingCost += next.estimatedCost
+				}
+				s, err := sets.get(candidate)
+				if ctx.Err() != nil {
+					counter[candidate.id] = candidate
+					expResult.Incomplete = true
+					break
+				}
+				if err != nil {
+					return nil, expResult, err
+				}
+				spentCost += candidate.estimatedCost
 				expResult.NumSetRead++
 				expResult.MaxSetSizeRead = max(expResult.MaxSetSizeRead, len(s))
 				suffixOverlap := overlap(s, tokens[i+1:])
@@ -212,12 +310,48 @@ func searchMergeProbeCostModelGreedy(
 			// Push the candidate to the heap
 			pushCandidate(h, k, candidate.id, totalOverlap)
 		}
+		if expResult.Incomplete {
+			break
+		}
+		// Merge the exact overlaps of the candidates read concurrently but
+		// not chosen, the overlaps do not exceed the kth overlap for the ones
+		// eliminated already
+		for _, candidate := range sets.pendingCandidates() {
+			s, err := sets.get(candidate)
+			if ctx.Err() != nil {
+				expResult.Incomplete = true
+				break
+			}
+			if err != nil {
+				return nil, expResult, err
+			}
+			candidate.read = true
+			ignores[candidate.id] = true
+			delete(counter, candidate.id)
+			spentCost += candidate.estimatedCost
+			expResult.NumSetRead++
+			expResult.MaxSetSizeRead = max(expResult.MaxSetSizeRead, len(s))
+			pushCandidate(h, k, candidate.id,
+				overlap(s, tokens[i+1:])+candidate.partialOverlap)
+		}
+		if expResult.Incomplete {
+			break
+		}
 	}
 
 	// Handle the remaining sets in the counter that has the full overlaps
-	// computed through merging all lists
-	for _, ce := range counter {
-		pushCandidate(h, k, ce.id, ce.partialOverlap)
+	// computed through merging all lists, the overlaps are partial if the
+	// search is incomplete
+	if expResult.Incomplete {
+		expResult.UnseenUpperbound = bestSoFar(h, k, counter, unseenUpperbound,
+			querySize, mergedPosition)
+	} else {
+		for _, ce := range counter {
+			pushCandidate(h, k, ce.id, ce.partialOverlap)
+		}
+	}
+	if err := stream.flush(h, 0, nil, querySize, querySize-1); err != nil {
+		return nil, expResult, err
 	}
 	results := orderedResults(h)
 
@@ -228,5 +362,42 @@ func searchMergeProbeCostModelGreedy(
 	expResult.NumResult = len(results)
 	expResult.IgnoreSize = len(ignores)
 	expResult.QueryNumToken = len(tokens)
-	return results, expResult
+	return results, expResult, nil
+}
+
+// Replaces the running top-k with the best results found so far when the
+// search stops early. The candidates in the counter are ranked by their
+// partial overlaps, which are lower bounds of their overlaps, together with
+// the exact results in the running top-k, and the candidates in the results
+// are marked partial. Returns the upper bound overlap of the sets not in
+// the results, given the upper bound overlap of the sets not in the counter
+// and the last query position of the merged posting lists.
+func bestSoFar(h *searchResultHeap, k int, counter map[int64]*candidateEntry,
+	unseenUpperbound, querySize, queryCurrentPosition int) int {
+	results := make([]searchResult, 0, h.Len()+len(counter))
+	results = append(results, *h...)
+	for _, ce := range counter {
+		results = append(results, searchResult{ID: ce.id,
+			Overlap: ce.partialOverlap, Partial: true})
+	}
+	// Prefer exact overlaps over partial overlaps of the same value
+	sort.Slice(results, func(i, j int) bool {
+		if results[i].Overlap == results[j].Overlap {
+			return !results[i].Partial && results[j].Partial
+		}
+		return results[i].Overlap > results[j].Overlap
+	})
+	n := min(k, len(results))
+	upperbound := unseenUpperbound
+	for _, r := range results[n:] {
+		if r.Partial {
+			upperbound = max(upperbound,
+				counter[r.ID].upperboundOverlap(querySize, queryCurrentPosition))
+		} else {
+			upperbound = max(upperbound, r.Overlap)
+		}
+	}
+	*h = searchResultHeap(results[:n])
+	heap.Init(h)
+	return upperbound
 }
@@ -0,0 +1,306 @@
+package joise
+
+import (
+	"context"
+	"sort"
+	"time"
+)
+
+// The JOSIE algorithm ranking sets by a score derived from the overlap and
+// the set size, such as Jaccard or containment of the set.
+//
+// The running kth overlap is replaced by the running kth score, and every
+// overlap upper bound is turned into a score upper bound using the set size.
+// For a candidate found in the counter the size is known, so its score upper
+// bound is the score of its upper bound overlap. A set first seen at a
+// posting list has an upper bound overlap of the skipped overlap plus the
+// length of its suffix starting at the match position, which gives its score
+// upper bound from ListEntry.Size. Sets not yet seen in any posting list
+// have unknown sizes, so the prefix filter uses the score upper bound over
+// all sizes: for Jaccard the union is at least the query size, while for
+// containment a small set can always be fully contained, and all posting
+// lists are read unless the kth score reaches 1.
+//
+// If ctx is done before the search completes, the running top-k is returned
+// as in searchMergeProbeCostModelGreedy.
+func searchMergeProbeCostModelGreedyScore(
+	ctx context.Context,
+	store IndexStore,
+	tb TokenTable,
+	cost CostParameters,
+	query RawTokenSet,
+	k int,
+	sc scorer,
+	ignoreSelf bool,
+) ([]scoredResult, experimentResult, error) {
+	var expResult experimentResult
+
+	start := time.Now()
+	tokens, freqs, gids, err := tb.process(query)
+	if err != nil {
+		return nil, expResult, err
+	}
+	readListCosts := make([]float64, len(freqs))
+	for i := 0; i < len(freqs); i++ {
+		if i == 0 {
+			readListCosts[i] = cost.readTokenListCost(tokens[i], freqs[i]+1)
+		} else {
+			readListCosts[i] = readListCosts[i-1] + cost.readTokenListCost(tokens[i], freqs[i]+1)
+		}
+	}
+	expResult.PreprocDuration = int(time.Now().Sub(start) / time.Millisecond)
+	start = time.Now()
+
+	querySize := len(tokens)
+	counter := make(map[int64]*candidateEntry)
+	ignores, err := newIgnores(store, query, ignoreSelf)
+	if err != nil {
+		return nil, expResult, err
+	}
+	h := &scoredResultHeap{}
+	var numSkipped int
+
+	currBatchLists := batchSize
+
+	for i := 0; i < querySize; i, numSkipped = nextDistinctList(tokens, gids, i) {
+		token := tokens[i]
+		skippedOverlap := numSkipped
+		maxOverlapUnseenCandidate := upperboundOverlapUknownCandidate(querySize,
+			i, skippedOverlap)
+		maxScoreUnseenCandidate := sc.unseenUpperbound(maxOverlapUnseenCandidate)
+
+		// Early terminates once the threshold index has reached and
+		// there is no remaining sets in the counter
+		if kthScore(h, k) >= maxScoreUnseenCandidate && len(counter) == 0 {
+			break
+		}
+
+		// Read the list
+		entries, err := readInvertedList(ctx, store, token)
+		if ctx.Err() != nil {
+			// Stop with the results found so far
+			expResult.Incomplete = true
+			break
+		}
+		if err != nil {
+			return nil, expResult, err
+		}
+		expResult.NumListRead++
+		expResult.MaxListSizeRead = max(expResult.MaxListSizeRead, len(entries))
+
+		// Merge this list and compute counter entries
+		// Skip sets that has been computed for exact overlap previously
+		for _, entry := range entries {
+			if _, skip := ignores[entry.ID]; skip {
+				continue
+			}
+			// Process seen candidates
+			if ce, seen := counter[entry.ID]; seen {
+				ce.update(entry.MatchPosition, skippedOverlap)
+				continue
+			}
+			// No need to process unseen candidate if we have reached this point
+			kth := kthScore(h, k)
+			if kth >= maxScoreUnseenCandidate {
+				continue
+			}
+			// The tokens of the set before the match position are not in
+			// the query, except for the skipped tokens. The set can be
+			// ignored for good if it cannot beat the kth score, which only
+			// increases.
+			maxOverlap := min(maxOverlapUnseenCandidate,
+				skippedOverlap+entry.Size-entry.MatchPosition)
+			if kth >= sc.score(maxOverlap, entry.Size) {
+				ignores[entry.ID] = true
+				continue
+			}
+			// Process new candidate
+			counter[entry.ID] = newCandidateEntry(entry.ID, entry.Size,
+				entry.MatchPosition, i, skippedOverlap)
+		}
+
+		// Terminates as we are at the last list, no need to read set
+		if i == querySize-1 {
+			break
+		}
+
+		// Continue reading the next list when there is no candidates
+		if len(counter) == 0 ||
+			// Do not start reading sets until we have seen at least k
+			// candidates
+			(len(counter) < k && h.Len() < k) ||
+			// Continue reading the next list when we are still in the
+			// current batch
+			currBatchLists > 0 {
+			currBatchLists--
+			continue
+		}
+		// Reset counter
+		currBatchLists = batchSize
+
+		// Find the end index of the next batch of posting lists
+		nextBatchEndIndex := nextBatchDistinctLists(tokens, gids, i, batchSize)
+		// Compute the cost of reading the next batch of posting lists
+		mergeListsCost := readListCosts[nextBatchEndIndex] - readListCosts[i]
+		// Disqualify candidates that cannot beat the kth score
+		kth := kthScore(h, k)
+		for _, ce := range counter {
+			if kth >= sc.score(ce.upperboundOverlap(querySize, i), ce.size) {
+				delete(counter, ce.id)
+				ignores[ce.id] = true
+			}
+		}
+		// Obtain qualified candidates with estimations, the overlap based
+		// pruning is disabled by a zero kth overlap
+		_, _, candidates := processCandidatesInit(
+			querySize, i, nextBatchEndIndex, 0, batchSize,
+			counter, ignores, cost)
+		// Record the counter size
+		expResult.MaxCounterSize = max(expResult.MaxCounterSize, len(counter))
+		// Compute the benefit of reading the next batch of lists
+		var mergeListsBenefit float64
+		var numWithBenefit int
+		estimatedScores := make(map[int64]float64, len(candidates))
+		for _, ce := range candidates {
+			mergeListsBenefit += readListsBenefitForScoredCandidate(ce, kth, sc, cost)
+			estimatedScores[ce.id] = sc.score(ce.estimatedOverlap, ce.size)
+			if estimatedScores[ce.id] > kth {
+				numWithBenefit++
+			}
+		}
+		// Continue reading posting lists if no qualified candidate found
+		// or no candidates can bring positive benefit.
+		if numWithBenefit == 0 || len(candidates) == 0 {
+			continue
+		}
+		// Sort the candidates by estimated scores
+		sort.Slice(candidates, func(i, j int) bool {
+			return estimatedScores[candidates[i].id] >
+				estimatedScores[candidates[j].id]
+		})
+		// Greedily determine the next best candidate until the qualified
+		// candidates exhausted or when reading the next batch of lists yield
+		// better net benefit
+		for _, candidate := range candidates {
+			// The current kth score before reading the current candidate
+			kth := kthScore(h, k)
+			estimatedScore := estimatedScores[candidate.id]
+			// Stop when the current candidate is no longer expected
+			// to bring positive benefit.
+			if estimatedScore <= kth {
+				break
+			}
+			// Always read candidate when we have not had running top-k yet
+			if h.Len() >= k {
+				probeSetBenefit := readScoredSetBenefit(querySize, kth,
+					kthScoreAfterPush(h, k, estimatedScore), sc,
+					candidates, readListCosts)
+				probeSetCost := candidate.estimatedCost
+				if probeSetBenefit-probeSetCost <
+					mergeListsBenefit-mergeListsCost {
+					break
+				}
+			}
+			// Now read this candidate
+			mergeListsBenefit -= readListsBenefitForScoredCandidate(candidate,
+				kth, sc, cost)
+			// Mark this candidate as read.
+			candidate.read = true
+			// Ingore this candidate in future encounters
+			ignores[candidate.id] = true
+			// Remove this candidate from counter
+			delete(counter, candidate.id)
+			// We are done if this candidate can be pruned
+			if kth >= sc.score(candidate.maximumOverlap, candidate.size) {
+				continue
+			}
+			// Compute the total overlap
+			var totalOverlap int
+			if candidate.suffixLength() > 0 {
+				s, err := readSetTokensSuffix(ctx, store, candidate.id,
+					candidate.latestMatchPosition+1)
+				if ctx.Err() != nil {
+					expResult.Incomplete = true
+					break
+				}
+				if err != nil {
+					return nil, expResult, err
+				}
+				expResult.NumSetRead++
+				expResult.MaxSetSizeRead = max(expResult.MaxSetSizeRead, len(s))
+				suffixOverlap := overlap(s, tokens[i+1:])
+				totalOverlap = suffixOverlap + candidate.partialOverlap
+			} else {
+				totalOverlap = candidate.partialOverlap
+			}
+			// Push the candidate to the heap
+			pushScoredCandidate(h, k, scoredResult{candidate.id, totalOverlap,
+				sc.score(totalOverlap, candidate.size)})
+		}
+		if expResult.Incomplete {
+			break
+		}
+	}
+
+	// Handle the remaining sets in the counter that has the full overlaps
+	// computed through merging all lists, the overlaps are partial if the
+	// search is incomplete
+	if !expResult.Incomplete {
+		for _, ce := range counter {
+			pushScoredCandidate(h, k, scoredResult{ce.id, ce.partialOverlap,
+				sc.score(ce.partialOverlap, ce.size)})
+		}
+	}
+	results := orderedScoredResults(h)
+
+	overlapResults := make([]searchResult, len(results))
+	for i, r := range results {
+		overlapResults[i] = searchResult{ID: r.ID, Overlap: r.Overlap}
+	}
+	expResult.Duration = int(time.Now().Sub(start) / time.Millisecond)
+	expResult.Results = writeResultString(overlapResults)
+	expResult.QueryID = query.ID
+	expResult.QuerySize = len(query.RawTokens)
+	expResult.NumResult = len(results)
+	expResult.IgnoreSize = len(ignores)
+	expResult.QueryNumToken = len(tokens)
+	return results, expResult, nil
+}
+
+// The set read cost saved on a candidate by reading the next batch of
+// posting lists: the whole cost if the candidate is expected to be pruned,
+// otherwise the cost of the truncated suffix.
+func readListsBenefitForScoredCandidate(ce *candidateEntry, kth float64, sc scorer, cost CostParameters) float64 {
+	if kth >= sc.score(ce.estimatedNextUpperbound, ce.size) {
+		return ce.estimatedCost
+	}
+	return ce.estimatedCost -
+		cost.readSetSuffixCost(ce.id, ce.latestMatchPosition+1,
+			ce.suffixLength()-ce.estimatedNextTruncation)
+}
+
+// Compute the benefit of reading a candidate set that produces a new kth
+// score: the posting lists no longer needed for unseen sets, and the
+// candidates eliminated by the new kth score.
+func readScoredSetBenefit(querySize int, kth, kthAfterPush float64, sc scorer,
+	candidates []*candidateEntry,
+	readListCosts []float64,
+) float64 {
+	var b float64
+	if kthAfterPush <= kth {
+		return b
+	}
+	p0 := min(max(prefixLength(querySize, sc.unseenOverlapThreshold(kth)), 1), querySize)
+	p1 := min(max(prefixLength(querySize, sc.unseenOverlapThreshold(kthAfterPush)), 1), querySize)
+	b += readListCosts[p0-1] - readListCosts[p1-1]
+	for _, ce := range candidates {
+		if ce == nil || ce.read {
+			continue
+		}
+		if sc.score(ce.maximumOverlap, ce.size) <= kthAfterPush {
+			// Add benefit from eliminating the candidate.
+			b += ce.estimatedCost
+		}
+	}
+	return b
+}
@@ -0,0 +1,77 @@
+package joise
+
+import (
+	"context"
+	"math"
+	"math/rand"
+	"sort"
+	"testing"
+)
+
+func TestScoringTopK(t *testing.T) {
+	defer func(size int) { batchSize = size }(batchSize)
+	batchSize = 3
+	r := rand.New(rand.NewSource(12))
+	sets := randomRawSets(r, 300, 400)
+	store := buildTestMemStore(t, sets)
+	tb, err := CreateTokenTableMem(store, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, scoring := range []Scoring{OverlapScoring, JaccardScoring, ContainmentScoring, QueryContainmentScoring} {
+		searcher := NewSearcher(store, tb, DefaultCostParameters(), WithScoring(scoring))
+		for q := 0; q < 20; q++ {
+			query := randomQuery(r, sets)
+			overlaps := bruteForceOverlaps(sets, query.RawTokens)
+			// The brute-force scores of the sets overlapping the query
+			scores := make(map[int64]float64)
+			var want []float64
+			for id, overlap := range overlaps {
+				size := len(distinctRawTokens(sets[id]))
+				switch scoring {
+				case OverlapScoring:
+					scores[id] = float64(overlap)
+				case JaccardScoring:
+					scores[id] = float64(overlap) / float64(len(query.RawTokens)+size-overlap)
+				case ContainmentScoring:
+					scores[id] = float64(overlap) / float64(size)
+				case QueryContainmentScoring:
+					scores[id] = float64(overlap) / float64(len(query.RawTokens))
+				}
+				want = append(want, scores[id])
+			}
+			sort.Sort(sort.Reverse(sort.Float64Slice(want)))
+			for _, k := range []int{1, 5, 20} {
+				results, _, err := searcher.TopK(context.Background(), query, k)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(results) != min(k, len(want)) {
+					t.Fatalf("%v: got %d results, want %d", scoring, len(results), min(k, len(want)))
+				}
+				for i, result := range results {
+					if math.Abs(result.Score-want[i]) > 1e-9 || math.Abs(result.Score-scores[result.ID]) > 1e-9 ||
+						result.Overlap != overlaps[result.ID] {
+						t.Fatalf("%v: result %d is set %d with score %v and overlap %d, want score %v (exact %v, %d)",
+							scoring, i, result.ID, result.Score, result.Overlap, want[i], scores[result.ID], overlaps[result.ID])
+					}
+				}
+			}
+		}
+	}
+	searcher := NewSearcher(store, tb, DefaultCostParameters(), WithScoring(JaccardScoring), WithAlgorithm(MergeListD))
+	if _, _, err := searcher.TopK(context.Background(), randomQuery(r, sets), 5); err == nil {
+		t.Fatal("no error for Jaccard scoring with MergeList-D")
+	}
+}
+
+func TestParseScoring(t *testing.T) {
+	for _, scoring := range []Scoring{OverlapScoring, JaccardScoring, ContainmentScoring, QueryContainmentScoring} {
+		if parsed, err := ParseScoring(scoring.String()); err != nil || parsed != scoring {
+			t.Fatalf("%v: got %v, %v", scoring, parsed, err)
+		}
+	}
+	if _, err := ParseScoring("cosine"); err == nil {
+		t.Fatal("no error for an unknown scoring")
+	}
+}
@@ -0,0 +1,235 @@
+package joise
+
+import (
+	"context"
+	"sort"
+	"time"
+)
+
+// The threshold variant of the JOSIE algorithm, which finds all sets with
+// overlaps of at least minOverlap with the query. Instead of the running
+// kth overlap, the prefix filter and the candidate pruning use the fixed
+// threshold, so a set is a result if its overlap is greater than
+// minOverlap-1.
+//
+// With a fixed threshold, probing a candidate set does not tighten the
+// bound for other candidates. A qualified candidate is probed when the
+// expected net benefit of reading the next batch of posting lists, which
+// may prune candidates or truncate their suffixes, is lower than the cost
+// saved on the candidate by waiting for those lists.
+//
+// If emit is not nil, it is called with every result once it is found, which
+// is not in overlap order. If ctx is done before the search completes, the
+// results found so far are returned with Incomplete set in the experiment
+// result.
+func searchMergeProbeCostModelGreedyThreshold(
+	ctx context.Context,
+	store IndexStore,
+	tb TokenTable,
+	cost CostParameters,
+	query RawTokenSet,
+	minOverlap int,
+	ignoreSelf bool,
+	emit func(searchResult) error,
+) ([]searchResult, experimentResult, error) {
+	var expResult experimentResult
+
+	start := time.Now()
+	tokens, freqs, gids, err := tb.process(query)
+	if err != nil {
+		return nil, expResult, err
+	}
+	readListCosts := make([]float64, len(freqs))
+	for i := 0; i < len(freqs); i++ {
+		if i == 0 {
+			readListCosts[i] = cost.readTokenListCost(tokens[i], freqs[i]+1)
+		} else {
+			readListCosts[i] = readListCosts[i-1] + cost.readTokenListCost(tokens[i], freqs[i]+1)
+		}
+	}
+	expResult.PreprocDuration = int(time.Now().Sub(start) / time.Millisecond)
+	start = time.Now()
+
+	querySize := len(tokens)
+	counter := make(map[int64]*candidateEntry)
+	ignores, err := newIgnores(store, query, ignoreSelf)
+	if err != nil {
+		return nil, expResult, err
+	}
+	// A set qualifies if its overlap is greater than the bound
+	bound := minOverlap - 1
+	var results []searchResult
+	var numSkipped int
+
+	currBatchLists := batchSize
+
+	for i := 0; i < querySize; i, numSkipped = nextDistinctList(tokens, gids, i) {
+		token := tokens[i]
+		skippedOverlap := numSkipped
+		maxOverlapUnseenCandidate := upperboundOverlapUknownCandidate(querySize,
+			i, skippedOverlap)
+
+		// Early terminates once the prefix filter has been reached and
+		// there is no remaining sets in the counter
+		if bound >= maxOverlapUnseenCandidate && len(counter) == 0 {
+			break
+		}
+
+		// Read the list
+		entries, err := readInvertedList(ctx, store, token)
+		if ctx.Err() != nil {
+			// Stop with the results found so far
+			expResult.Incomplete = true
+			break
+		}
+		if err != nil {
+			return nil, expResult, err
+		}
+		expResult.NumListRead++
+		expResult.MaxListSizeRead = max(expResult.MaxListSizeRead, len(entries))
+
+		// Merge this list and compute counter entries
+		// Skip sets that has been computed for exact overlap previously
+		for _, entry := range entries {
+			if _, skip := ignores[entry.ID]; skip {
+				continue
+			}
+			// Process seen candidates
+			if ce, seen := counter[entry.ID]; seen {
+				ce.update(entry.MatchPosition, skippedOverlap)
+				continue
+			}
+			// No need to process unseen candidate if we have passed the
+			// prefix filter
+			if bound >= maxOverlapUnseenCandidate {
+				continue
+			}
+			// Process new candidate
+			counter[entry.ID] = newCandidateEntry(entry.ID, entry.Size,
+				entry.MatchPosition, i, skippedOverlap)
+		}
+
+		// Terminates as we are at the last list, no need to read set
+		if i == querySize-1 {
+			break
+		}
+
+		// Continue reading the next list when there is no candidates
+		if len(counter) == 0 ||
+			// Continue reading the next list when we are still in the
+			// current batch
+			currBatchLists > 0 {
+			currBatchLists--
+			continue
+		}
+		// Reset counter
+		currBatchLists = batchSize
+
+		// Find the end index of the next batch of posting lists
+		nextBatchEndIndex := nextBatchDistinctLists(tokens, gids, i, batchSize)
+		// Compute the cost of reading the next batch of posting lists
+		mergeListsCost := readListCosts[nextBatchEndIndex] - readListCosts[i]
+		// Process candidates to estimate benefit of reading the next batch of
+		// posting lists and obtain qualified candidates
+		mergeListsBenefit, numWithBenefit, candidates := processCandidatesInit(
+			querySize, i, nextBatchEndIndex, bound, batchSize,
+			counter, ignores, cost)
+		// Record the counter size
+		expResult.MaxCounterSize = max(expResult.MaxCounterSize, len(counter))
+		// Continue reading posting lists if no qualified candidate found
+		// or no candidates are expected to pass the threshold.
+		if numWithBenefit == 0 || len(candidates) == 0 {
+			continue
+		}
+		// Sort the candidates by estimated overlaps
+		sort.Slice(candidates, func(i, j int) bool {
+			return candidates[i].estimatedOverlap >
+				candidates[j].estimatedOverlap
+		})
+		// Greedily probe the candidates expected to pass the threshold until
+		// reading the next batch of lists yields better net benefit
+		for _, candidate := range candidates {
+			// Stop when the current candidate is expected to be pruned by
+			// reading more posting lists
+			if candidate.estimatedOverlap <= bound {
+				break
+			}
+			// The set read cost saved on this candidate by reading the next
+			// batch of lists first
+			waitBenefit := readListsBenenfitForCandidate(candidate, bound, cost)
+			if -waitBenefit < mergeListsBenefit-mergeListsCost {
+				break
+			}
+			mergeListsBenefit -= waitBenefit
+			// Mark this candidate as read.
+			candidate.read = true
+			// Ingore this candidate in future encounters
+			ignores[candidate.id] = true
+			// Remove this candidate from counter
+			delete(counter, candidate.id)
+			// Compute the total overlap
+			var totalOverlap int
+			if candidate.suffixLength() > 0 {
+				s, err := readSetTokensSuffix(ctx, store, candidate.id,
+					candidate.latestMatchPosition+1)
+				if ctx.Err() != nil {
+					expResult.Incomplete = true
+					break
+				}
+				if err != nil {
+					return nil, expResult, err
+				}
+				expResult.NumSetRead++
+				expResult.MaxSetSizeRead = max(expResult.MaxSetSizeRead, len(s))
+				suffixOverlap := overlap(s, tokens[i+1:])
+				totalOverlap = suffixOverlap + candidate.partialOverlap
+			} else {
+				totalOverlap = candidate.partialOverlap
+			}
+			if totalOverlap > bound {
+				r := searchResult{ID: candidate.id, Overlap: totalOverlap}
+				if emit != nil {
+					if err := emit(r); err != nil {
+						return nil, expResult, err
+					}
+				}
+				results = append(results, r)
+			}
+		}
+		if expResult.Incomplete {
+			break
+		}
+	}
+
+	// Handle the remaining sets in the counter that has the full overlaps
+	// computed through merging all lists, the overlaps are partial if the
+	// search is incomplete
+	if !expResult.Incomplete {
+		for _, ce := range counter {
+			if ce.partialOverlap > bound {
+				r := searchResult{ID: ce.id, Overlap: ce.partialOverlap}
+				if emit != nil {
+					if err := emit(r); err != nil {
+						return nil, expResult, err
+					}
+				}
+				results = append(results, r)
+			}
+		}
+	}
+	sort.Slice(results, func(i, j int) bool {
+		if results[i].Overlap == results[j].Overlap {
+			return results[i].ID < results[j].ID
+		}
+		return results[i].Overlap > results[j].Overlap
+	})
+
+	expResult.Duration = int(time.Now().Sub(start) / time.Millisecond)
+	expResult.Results = writeResultString(results)
+	expResult.QueryID = query.ID
+	expResult.QuerySize = len(query.RawTokens)
+	expResult.NumResult = len(results)
+	expResult.IgnoreSize = len(ignores)
+	expResult.QueryNumToken = len(tokens)
+	return results, expResult, nil
+}
@@ -0,0 +1,56 @@
+package joise
+
+import (
+	"context"
+	"math/rand"
+	"testing"
+)
+
+func TestThresholdSearch(t *testing.T) {
+	defer func(size int) { batchSize = size }(batchSize)
+	batchSize = 3
+	r := rand.New(rand.NewSource(11))
+	sets := randomRawSets(r, 300, 300)
+	store := buildTestMemStore(t, sets)
+	tb, err := CreateTokenTableMem(store, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Deleted sets are not returned
+	if err := NewIndexUpdater(store, tb).DeleteSets([]int64{0, 1, 2}); err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []int64{0, 1, 2} {
+		delete(sets, id)
+	}
+	searcher := NewSearcher(store, tb, DefaultCostParameters())
+	for q := 0; q < 20; q++ {
+		query := randomQuery(r, sets)
+		overlaps := bruteForceOverlaps(sets, query.RawTokens)
+		for _, minOverlap := range []int{1, 3, 10, 30} {
+			results, _, err := searcher.ThresholdSearch(context.Background(), query, minOverlap)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := 0
+			for _, overlap := range overlaps {
+				if overlap >= minOverlap {
+					want++
+				}
+			}
+			if len(results) != want {
+				t.Fatalf("minimum overlap %d: got %d results, want %d", minOverlap, len(results), want)
+			}
+			for i, result := range results {
+				if result.Overlap != overlaps[result.ID] || result.Overlap < minOverlap ||
+					(i > 0 && result.Overlap > results[i-1].Overlap) {
+					t.Fatalf("minimum overlap %d: result %d is set %d with overlap %d (exact %d)",
+						minOverlap, i, result.ID, result.Overlap, overlaps[result.ID])
+				}
+			}
+		}
+	}
+	if _, _, err := searcher.ThresholdSearch(context.Background(), randomQuery(r, sets), 0); err == nil {
+		t.Fatal("no error for a minimum overlap of 0")
+	}
+}
@@ -55,8 +55,9 @@ func (ce *candidateEntry) estOverlap(querySize, queryCurrentPosition int) int {
 }
 
 // Estimate the I/O time cost of reading this candidate set
-func (ce *candidateEntry) estCost() float64 {
-	ce.estimatedCost = readSetCost(ce.suffixLength())
+func (ce *candidateEntry) estCost(cost CostParameters) float64 {
+	ce.estimatedCost = cost.readSetSuffixCost(ce.id, ce.latestMatchPosition+1,
+		ce.suffixLength())
 	return ce.estimatedCost
 }
 
@@ -147,12 +148,13 @@ func prefixLength(querySize, kthOverlap int) int {
 	return querySize - kthOverlap + 1
 }
 
-func readListsBenenfitForCandidate(ce *candidateEntry, kthOverlap int) float64 {
+func readListsBenenfitForCandidate(ce *candidateEntry, kthOverlap int, cost CostParameters) float64 {
 	if kthOverlap >= ce.estimatedNextUpperbound {
 		return ce.estimatedCost
 	}
 	return ce.estimatedCost -
-		readSetCost(ce.suffixLength()-ce.estimatedNextTruncation)
+		cost.readSetSuffixCost(ce.id, ce.latestMatchPosition+1,
+			ce.suffixLength()-ce.estimatedNextTruncation)
 }
 
 // Process unread candidates from the counter to obtain the sorted list of
@@ -160,7 +162,7 @@ func readListsBenenfitForCandidate(ce *candidateEntry, kthOverlap int) float64 {
 // of lists.
 func processCandidatesInit(querySize, queryCurrentPosition, nextBatchEndIndex,
 	kthOverlap, minSampleSize int, candidates map[int64]*candidateEntry,
-	ignores map[int64]bool,
+	ignores map[int64]bool, cost CostParameters,
 ) (readListsBenefit float64,
 	numWithBenefit int,
 	qualified []*candidateEntry) {
@@ -179,13 +181,13 @@ func processCandidatesInit(querySize, queryCurrentPosition, nextBatchEndIndex,
 			continue
 		}
 		// Compute estimation
-		ce.estCost()
+		ce.estCost(cost)
 		ce.estOverlap(querySize, queryCurrentPosition)
 		ce.estTruncation(querySize, queryCurrentPosition, nextBatchEndIndex)
 		ce.estNextOverlapUpperbound(querySize, queryCurrentPosition,
 			nextBatchEndIndex)
 		// Compute read list benefit
-		readListsBenefit += readListsBenenfitForCandidate(ce, kthOverlap)
+		readListsBenefit += readListsBenenfitForCandidate(ce, kthOverlap, cost)
 		// Add qualified candidate good for reading
 		qualified = append(qualified, ce)
 		if ce.estimatedOverlap > kthOverlap {
@@ -199,7 +201,7 @@ func processCandidatesInit(querySize, queryCurrentPosition, nextBatchEndIndex,
 // batch of posting lists.
 func processCandidatesUpdate(kthOverlap int, candidates []*candidateEntry,
 	counter map[int64]*candidateEntry,
-	ignores map[int64]bool) (readListsBenefit float64) {
+	ignores map[int64]bool, cost CostParameters) (readListsBenefit float64) {
 	for j, ce := range candidates {
 		if ce == nil || ce.read {
 			continue
@@ -211,7 +213,7 @@ func processCandidatesUpdate(kthOverlap int, candidates []*candidateEntry,
 			ignores[ce.id] = true
 		}
 		// Compute read list benefit for qualified candidate.
-		readListsBenefit += readListsBenenfitForCandidate(ce, kthOverlap)
+		readListsBenefit += readListsBenenfitForCandidate(ce, kthOverlap, cost)
 	}
 	return
 }
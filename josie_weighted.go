@@ -0,0 +1,434 @@
+package joise
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sort"
+	"time"
+)
+
+// weightedCandidate keeps track of the matched weight of an unread candidate
+// set, the positions and the cost estimations are kept by the candidate
+// entry.
+type weightedCandidate struct {
+	*candidateEntry
+	partialWeight       float64 // the weight of the overlapping tokens seen so far
+	maximumWeight       float64 // the upperbound weighted overlap
+	estimatedWeight     float64 // the estimated weighted overlap
+	estimatedNextWeight float64 // the estimated next upperbound weighted overlap
+}
+
+// queryWeights holds the weights of the query tokens in token order, and
+// their suffix sums and suffix maximums used for upper bounds.
+type queryWeights struct {
+	weights       []float64
+	suffixWeights []float64 // suffixWeights[i] is the sum of weights[i:]
+	maxWeights    []float64 // maxWeights[i] is the maximum of weights[i:]
+}
+
+func newQueryWeights(rawTokens [][]byte, counts []int, weightFunc TokenWeightFunc) (queryWeights, error) {
+	n := len(rawTokens)
+	qw := queryWeights{
+		weights:       make([]float64, n),
+		suffixWeights: make([]float64, n+1),
+		maxWeights:    make([]float64, n+1),
+	}
+	for i, rawToken := range rawTokens {
+		// The counts are the frequencies minus one
+		w := weightFunc(rawToken, counts[i]+1)
+		if w < 0 || math.IsNaN(w) || math.IsInf(w, 0) {
+			return qw, fmt.Errorf("%w: invalid weight %v of token %q", ErrInvalidSearch, w, rawToken)
+		}
+		qw.weights[i] = w
+	}
+	for i := n - 1; i >= 0; i-- {
+		qw.suffixWeights[i] = qw.suffixWeights[i+1] + qw.weights[i]
+		qw.maxWeights[i] = math.Max(qw.maxWeights[i+1], qw.weights[i])
+	}
+	return qw, nil
+}
+
+// The weight of the query tokens from start (inclusive) to end
+// (non-inclusive)
+func (qw queryWeights) rangeWeight(start, end int) float64 {
+	return qw.suffixWeights[start] - qw.suffixWeights[end]
+}
+
+// The upper bound weight of matching at most n tokens of the query starting
+// from start
+func (qw queryWeights) upperbound(start, n int) float64 {
+	if n <= 0 {
+		return 0
+	}
+	return math.Min(qw.suffixWeights[start], float64(n)*qw.maxWeights[start])
+}
+
+// The number of posting lists to read so that unseen sets cannot beat the
+// kth weighted overlap
+func (qw queryWeights) prefixLength(kth float64) int {
+	n := len(qw.weights)
+	p := sort.Search(n, func(i int) bool { return qw.suffixWeights[i] <= kth })
+	return min(max(p, 1), n)
+}
+
+// The weighted variant of the JOSIE algorithm, which ranks sets by the sum
+// of the weights of the overlapping tokens.
+//
+// The overlap upper bounds are replaced by weight upper bounds. A set not
+// yet seen at the current posting list can only match the current and the
+// remaining query tokens, including the skipped tokens of the current
+// duplicate group, so its upper bound is the weight of that query suffix.
+// For a candidate whose remaining set suffix has m tokens, the matched
+// weight of the remaining query suffix is bounded by the smaller of the
+// weight of the query suffix and m times its maximum weight. Sets with zero
+// weighted overlap are not results.
+//
+// If ctx is done before the search completes, the running top-k is returned
+// as in searchMergeProbeCostModelGreedy.
+func searchMergeProbeCostModelGreedyWeighted(
+	ctx context.Context,
+	store IndexStore,
+	tb TokenTable,
+	cost CostParameters,
+	query RawTokenSet,
+	k int,
+	weightFunc TokenWeightFunc,
+	ignoreSelf bool,
+) ([]scoredResult, experimentResult, error) {
+	var expResult experimentResult
+
+	start := time.Now()
+	tokens, freqs, gids, rawTokens, err := tb.processWithRawTokens(query)
+	if err != nil {
+		return nil, expResult, err
+	}
+	qw, err := newQueryWeights(rawTokens, freqs, weightFunc)
+	if err != nil {
+		return nil, expResult, err
+	}
+	readListCosts := make([]float64, len(freqs))
+	for i := 0; i < len(freqs); i++ {
+		if i == 0 {
+			readListCosts[i] = cost.readTokenListCost(tokens[i], freqs[i]+1)
+		} else {
+			readListCosts[i] = readListCosts[i-1] + cost.readTokenListCost(tokens[i], freqs[i]+1)
+		}
+	}
+	expResult.PreprocDuration = int(time.Now().Sub(start) / time.Millisecond)
+	start = time.Now()
+
+	querySize := len(tokens)
+	counter := make(map[int64]*weightedCandidate)
+	ignores, err := newIgnores(store, query, ignoreSelf)
+	if err != nil {
+		return nil, expResult, err
+	}
+	h := &scoredResultHeap{}
+	var numSkipped int
+
+	currBatchLists := batchSize
+
+	for i := 0; i < querySize; i, numSkipped = nextDistinctList(tokens, gids, i) {
+		token := tokens[i]
+		skippedOverlap := numSkipped
+		// The weight of the current token and the skipped tokens of its
+		// duplicate group
+		matchWeight := qw.rangeWeight(i-skippedOverlap, i+1)
+		maxWeightUnseenCandidate := qw.suffixWeights[i-skippedOverlap]
+
+		// Early terminates once the threshold index has reached and
+		// there is no remaining sets in the counter
+		if kthScore(h, k) >= maxWeightUnseenCandidate && len(counter) == 0 {
+			break
+		}
+
+		// Read the list
+		entries, err := readInvertedList(ctx, store, token)
+		if ctx.Err() != nil {
+			// Stop with the results found so far
+			expResult.Incomplete = true
+			break
+		}
+		if err != nil {
+			return nil, expResult, err
+		}
+		expResult.NumListRead++
+		expResult.MaxListSizeRead = max(expResult.MaxListSizeRead, len(entries))
+
+		// Merge this list and compute counter entries
+		// Skip sets that has been computed for exact overlap previously
+		for _, entry := range entries {
+			if _, skip := ignores[entry.ID]; skip {
+				continue
+			}
+			// Process seen candidates
+			if wc, seen := counter[entry.ID]; seen {
+				wc.update(entry.MatchPosition, skippedOverlap)
+				wc.partialWeight += matchWeight
+				continue
+			}
+			// No need to process unseen candidate if we have reached this point
+			kth := kthScore(h, k)
+			if kth >= maxWeightUnseenCandidate {
+				continue
+			}
+			// The set can be ignored for good if the weight of its
+			// remaining tokens cannot beat the kth weighted overlap
+			maxWeight := matchWeight + qw.upperbound(i+1,
+				min(querySize-i-1, entry.Size-entry.MatchPosition-1))
+			if kth >= maxWeight {
+				ignores[entry.ID] = true
+				continue
+			}
+			// Process new candidate
+			counter[entry.ID] = &weightedCandidate{
+				candidateEntry: newCandidateEntry(entry.ID, entry.Size,
+					entry.MatchPosition, i, skippedOverlap),
+				partialWeight: matchWeight,
+			}
+		}
+
+		// Terminates as we are at the last list, no need to read set
+		if i == querySize-1 {
+			break
+		}
+
+		// Continue reading the next list when there is no candidates
+		if len(counter) == 0 ||
+			// Do not start reading sets until we have seen at least k
+			// candidates
+			(len(counter) < k && h.Len() < k) ||
+			// Continue reading the next list when we are still in the
+			// current batch
+			currBatchLists > 0 {
+			currBatchLists--
+			continue
+		}
+		// Reset counter
+		currBatchLists = batchSize
+
+		// Find the end index of the next batch of posting lists
+		nextBatchEndIndex := nextBatchDistinctLists(tokens, gids, i, batchSize)
+		// Compute the cost of reading the next batch of posting lists
+		mergeListsCost := readListCosts[nextBatchEndIndex] - readListCosts[i]
+		// Process candidates to estimate benefit of reading the next batch of
+		// posting lists and obtain qualified candidates
+		kth := kthScore(h, k)
+		mergeListsBenefit, numWithBenefit, candidates := processWeightedCandidatesInit(
+			qw, i, nextBatchEndIndex, kth, batchSize, counter, ignores, cost)
+		// Record the counter size
+		expResult.MaxCounterSize = max(expResult.MaxCounterSize, len(counter))
+		// Continue reading posting lists if no qualified candidate found
+		// or no candidates can bring positive benefit.
+		if numWithBenefit == 0 || len(candidates) == 0 {
+			continue
+		}
+		// Sort the candidates by estimated weighted overlaps
+		sort.Slice(candidates, func(i, j int) bool {
+			return candidates[i].estimatedWeight > candidates[j].estimatedWeight
+		})
+		// Greedily determine the next best candidate until the qualified
+		// candidates exhausted or when reading the next batch of lists yield
+		// better net benefit
+		for _, candidate := range candidates {
+			// The current kth weighted overlap before reading the current
+			// candidate
+			kth := kthScore(h, k)
+			// Stop when the current candidate is no longer expected
+			// to bring positive benefit.
+			if candidate.estimatedWeight <= kth {
+				break
+			}
+			// Always read candidate when we have not had running top-k yet
+			if h.Len() >= k {
+				probeSetBenefit := readWeightedSetBenefit(qw, kth,
+					kthScoreAfterPush(h, k, candidate.estimatedWeight),
+					candidates, readListCosts)
+				probeSetCost := candidate.estimatedCost
+				if probeSetBenefit-probeSetCost <
+					mergeListsBenefit-mergeListsCost {
+					break
+				}
+			}
+			// Now read this candidate
+			mergeListsBenefit -= readListsBenefitForWeightedCandidate(candidate,
+				kth, cost)
+			// Mark this candidate as read.
+			candidate.read = true
+			// Ingore this candidate in future encounters
+			ignores[candidate.id] = true
+			// Remove this candidate from counter
+			delete(counter, candidate.id)
+			// We are done if this candidate can be pruned
+			if kth >= candidate.maximumWeight {
+				continue
+			}
+			// Compute the total overlap and weight
+			totalOverlap := candidate.partialOverlap
+			totalWeight := candidate.partialWeight
+			if candidate.suffixLength() > 0 {
+				s, err := readSetTokensSuffix(ctx, store, candidate.id,
+					candidate.latestMatchPosition+1)
+				if ctx.Err() != nil {
+					expResult.Incomplete = true
+					break
+				}
+				if err != nil {
+					return nil, expResult, err
+				}
+				expResult.NumSetRead++
+				expResult.MaxSetSizeRead = max(expResult.MaxSetSizeRead, len(s))
+				suffixOverlap, suffixWeight := weightedOverlap(s, tokens[i+1:],
+					qw.weights[i+1:])
+				totalOverlap += suffixOverlap
+				totalWeight += suffixWeight
+			}
+			// Push the candidate to the heap
+			if totalWeight > 0 {
+				pushScoredCandidate(h, k, scoredResult{candidate.id, totalOverlap,
+					totalWeight})
+			}
+		}
+		if expResult.Incomplete {
+			break
+		}
+	}
+
+	// Handle the remaining sets in the counter that has the full overlaps
+	// computed through merging all lists, the overlaps are partial if the
+	// search is incomplete
+	if !expResult.Incomplete {
+		for _, wc := range counter {
+			if wc.partialWeight > 0 {
+				pushScoredCandidate(h, k, scoredResult{wc.id, wc.partialOverlap,
+					wc.partialWeight})
+			}
+		}
+	}
+	results := orderedScoredResults(h)
+
+	overlapResults := make([]searchResult, len(results))
+	for i, r := range results {
+		overlapResults[i] = searchResult{ID: r.ID, Overlap: r.Overlap}
+	}
+	expResult.Duration = int(time.Now().Sub(start) / time.Millisecond)
+	expResult.Results = writeResultString(overlapResults)
+	expResult.QueryID = query.ID
+	expResult.QuerySize = len(query.RawTokens)
+	expResult.NumResult = len(results)
+	expResult.IgnoreSize = len(ignores)
+	expResult.QueryNumToken = len(tokens)
+	return results, expResult, nil
+}
+
+// Process unread candidates from the counter to obtain the qualified
+// candidates, and compute the benefit of reading the next batch of lists,
+// the same as processCandidatesInit with weighted overlaps.
+func processWeightedCandidatesInit(qw queryWeights, queryCurrentPosition,
+	nextBatchEndIndex int, kth float64, minSampleSize int,
+	candidates map[int64]*weightedCandidate,
+	ignores map[int64]bool, cost CostParameters,
+) (readListsBenefit float64,
+	numWithBenefit int,
+	qualified []*weightedCandidate) {
+	querySize := len(qw.weights)
+	qualified = make([]*weightedCandidate, 0, len(candidates))
+	for _, wc := range candidates {
+		// Compute upper bound weighted overlap
+		wc.maximumWeight = wc.partialWeight + qw.upperbound(queryCurrentPosition+1,
+			min(querySize-queryCurrentPosition-1, wc.suffixLength()))
+		// Disqualify candidates and remove it for future reads
+		if kth >= wc.maximumWeight {
+			delete(candidates, wc.id)
+			ignores[wc.id] = true
+			continue
+		}
+		// Candidate does not qualify if the estimation std err is too high
+		if !wc.checkMinSampleSize(queryCurrentPosition, minSampleSize) {
+			continue
+		}
+		// Compute estimation
+		wc.estCost(cost)
+		wc.estWeight(qw, queryCurrentPosition)
+		wc.estTruncation(querySize, queryCurrentPosition, nextBatchEndIndex)
+		wc.estNextWeightUpperbound(qw, queryCurrentPosition, nextBatchEndIndex)
+		// Compute read list benefit
+		readListsBenefit += readListsBenefitForWeightedCandidate(wc, kth, cost)
+		// Add qualified candidate good for reading
+		qualified = append(qualified, wc)
+		if wc.estimatedWeight > kth {
+			numWithBenefit++
+		}
+	}
+	return
+}
+
+// Estimate the total weighted overlap by extrapolating the ratio of the
+// matched weight to the weight of the query tokens read since the first
+// match
+func (wc *weightedCandidate) estWeight(qw queryWeights, queryCurrentPosition int) float64 {
+	readWeight := qw.rangeWeight(wc.queryFirstMatchPosition, queryCurrentPosition+1)
+	wc.estimatedWeight = wc.partialWeight
+	if readWeight > 0 {
+		wc.estimatedWeight = wc.partialWeight / readWeight *
+			qw.suffixWeights[wc.queryFirstMatchPosition]
+	}
+	wc.estimatedWeight = math.Min(wc.estimatedWeight, wc.maximumWeight)
+	return wc.estimatedWeight
+}
+
+// Estimate the next weighted overlap upper bound after reading the posting
+// lists from queryCurrentPosition+1 to queryNextPosition
+func (wc *weightedCandidate) estNextWeightUpperbound(qw queryWeights,
+	queryCurrentPosition, queryNextPosition int) float64 {
+	querySize := len(qw.weights)
+	readWeight := qw.rangeWeight(wc.queryFirstMatchPosition, queryCurrentPosition+1)
+	var additionalWeight float64
+	if readWeight > 0 {
+		additionalWeight = wc.partialWeight / readWeight *
+			qw.rangeWeight(queryCurrentPosition+1, queryNextPosition+1)
+	}
+	// Estimate the next latest matching position for candidate
+	queryJumpLength := queryNextPosition - queryCurrentPosition
+	nextLatestMatchingPosition := int(float64(queryJumpLength)/float64(querySize-wc.queryFirstMatchPosition)*float64(wc.size-wc.firstMatchPosition)) + wc.latestMatchPosition
+	// Compute the upper bound of weighted overlap for this candidate
+	wc.estimatedNextWeight = wc.partialWeight + additionalWeight +
+		qw.upperbound(queryNextPosition+1, min(querySize-queryNextPosition-1,
+			wc.size-nextLatestMatchingPosition-1))
+	return wc.estimatedNextWeight
+}
+
+func readListsBenefitForWeightedCandidate(wc *weightedCandidate, kth float64, cost CostParameters) float64 {
+	if kth >= wc.estimatedNextWeight {
+		return wc.estimatedCost
+	}
+	return wc.estimatedCost -
+		cost.readSetSuffixCost(wc.id, wc.latestMatchPosition+1,
+			wc.suffixLength()-wc.estimatedNextTruncation)
+}
+
+// Compute the benefit of reading a candidate set that produces a new kth
+// weighted overlap.
+func readWeightedSetBenefit(qw queryWeights, kth, kthAfterPush float64,
+	candidates []*weightedCandidate,
+	readListCosts []float64,
+) float64 {
+	var b float64
+	if kthAfterPush <= kth {
+		return b
+	}
+	p0 := qw.prefixLength(kth)
+	p1 := qw.prefixLength(kthAfterPush)
+	b += readListCosts[p0-1] - readListCosts[p1-1]
+	for _, wc := range candidates {
+		if wc.read {
+			continue
+		}
+		if wc.maximumWeight <= kthAfterPush {
+			// Add benefit from eliminating the candidate.
+			b += wc.estimatedCost
+		}
+	}
+	return b
+}
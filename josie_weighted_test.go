@@ -0,0 +1,78 @@
+package joise
+
+import (
+	"context"
+	"math"
+	"math/rand"
+	"sort"
+	"testing"
+)
+
+func TestWeightedTopK(t *testing.T) {
+	defer func(size int) { batchSize = size }(batchSize)
+	batchSize = 3
+	r := rand.New(rand.NewSource(13))
+	sets := randomRawSets(r, 300, 400)
+	store := buildTestMemStore(t, sets)
+	tb, err := CreateTokenTableMem(store, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	frequencies := make(map[string]int)
+	for _, tokens := range sets {
+		for _, token := range distinctRawTokens(tokens) {
+			frequencies[string(token)]++
+		}
+	}
+	userWeights := make(map[string]float64)
+	for token := range frequencies {
+		userWeights[token] = float64(r.Intn(5))
+	}
+	searcher := NewSearcher(store, tb, DefaultCostParameters())
+	for _, weights := range []TokenWeightFunc{IDFWeights(store.NumSets()), UserWeights(userWeights, 1)} {
+		for q := 0; q < 20; q++ {
+			query := randomQuery(r, sets)
+			overlaps := bruteForceOverlaps(sets, query.RawTokens)
+			queryTokens := make(map[string]bool)
+			for _, token := range query.RawTokens {
+				queryTokens[string(token)] = true
+			}
+			// The brute-force weighted overlaps of the sets
+			scores := make(map[int64]float64)
+			var want []float64
+			for id, tokens := range sets {
+				var score float64
+				for _, token := range distinctRawTokens(tokens) {
+					if queryTokens[string(token)] {
+						score += weights(token, frequencies[string(token)])
+					}
+				}
+				if score > 0 {
+					scores[id] = score
+					want = append(want, score)
+				}
+			}
+			sort.Sort(sort.Reverse(sort.Float64Slice(want)))
+			for _, k := range []int{1, 5, 20} {
+				results, _, err := searcher.WeightedTopK(context.Background(), query, k, weights)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(results) != min(k, len(want)) {
+					t.Fatalf("got %d results, want %d", len(results), min(k, len(want)))
+				}
+				for i, result := range results {
+					if math.Abs(result.Score-want[i]) > 1e-9 || math.Abs(result.Score-scores[result.ID]) > 1e-9 ||
+						result.Overlap != overlaps[result.ID] {
+						t.Fatalf("result %d is set %d with score %v and overlap %d, want score %v (exact %v, %d)",
+							i, result.ID, result.Score, result.Overlap, want[i], scores[result.ID], overlaps[result.ID])
+					}
+				}
+			}
+		}
+	}
+	negative := func(rawToken []byte, frequency int) float64 { return -1 }
+	if _, _, err := searcher.WeightedTopK(context.Background(), randomQuery(r, sets), 5, negative); err == nil {
+		t.Fatal("no error for negative weights")
+	}
+}
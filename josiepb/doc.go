@@ -0,0 +1,5 @@
+// Package josiepb contains the gRPC service definition of JOSIE search and
+// the code generated from it.
+package josiepb
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative josie.proto
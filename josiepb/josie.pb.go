@@ -0,0 +1,966 @@
+// Code generated by protoc-gen-go. DO NOT EDIT.
+// versions:
+// 	protoc-gen-go v1.36.9
+// 	protoc        (unknown)
+// source: josie.proto
+
+package josiepb
+
+import (
+	protoreflect "google.golang.org/protobuf/reflect/protoreflect"
+	protoimpl "google.golang.org/protobuf/runtime/protoimpl"
+	reflect "reflect"
+	sync "sync"
+	unsafe "unsafe"
+)
+
+const (
+	// Verify that this generated code is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(20 - protoimpl.MinVersion)
+	// Verify that runtime/protoimpl is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(protoimpl.MaxVersion - 20)
+)
+
+type TopKRequest struct {
+	state  protoimpl.MessageState `protogen:"open.v1"`
+	Tokens [][]byte               `protobuf:"bytes,1,rep,name=tokens,proto3" json:"tokens,omitempty"`
+	K      int32                  `protobuf:"varint,2,opt,name=k,proto3" json:"k,omitempty"`
+	// The search algorithm, JOSIE if empty.
+	Algorithm string `protobuf:"bytes,3,opt,name=algorithm,proto3" json:"algorithm,omitempty"`
+	// The scoring function ranking the results, overlap if empty.
+	Scoring string `protobuf:"bytes,4,opt,name=scoring,proto3" json:"scoring,omitempty"`
+	// The time limit of a search in milliseconds, after which the best
+	// results found so far are returned. The server default is used if zero.
+	TimeoutMs int64 `protobuf:"varint,5,opt,name=timeout_ms,json=timeoutMs,proto3" json:"timeout_ms,omitempty"`
+	// The I/O budget of a search, after which the best results found so far
+	// are returned. Only supported by JOSIE with overlap or
+	// query_containment scoring.
+	Budget        *Budget `protobuf:"bytes,6,opt,name=budget,proto3" json:"budget,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *TopKRequest) Reset() {
+	*x = TopKRequest{}
+	mi := &file_josie_proto_msgTypes[0]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *TopKRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*TopKRequest) ProtoMessage() {}
+
+func (x *TopKRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_josie_proto_msgTypes[0]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use TopKRequest.ProtoReflect.Descriptor instead.
+func (*TopKRequest) Descriptor() ([]byte, []int) {
+	return file_josie_proto_rawDescGZIP(), []int{0}
+}
+
+func (x *TopKRequest) GetTokens() [][]byte {
+	if x != nil {
+		return x.Tokens
+	}
+	return nil
+}
+
+func (x *TopKRequest) GetK() int32 {
+	if x != nil {
+		return x.K
+	}
+	return 0
+}
+
+func (x *TopKRequest) GetAlgorithm() string {
+	if x != nil {
+		return x.Algorithm
+	}
+	return ""
+}
+
+func (x *TopKRequest) GetScoring() string {
+	if x != nil {
+		return x.Scoring
+	}
+	return ""
+}
+
+func (x *TopKRequest) GetTimeoutMs() int64 {
+	if x != nil {
+		return x.TimeoutMs
+	}
+	return 0
+}
+
+func (x *TopKRequest) GetBudget() *Budget {
+	if x != nil {
+		return x.Budget
+	}
+	return nil
+}
+
+type ThresholdSearchRequest struct {
+	state      protoimpl.MessageState `protogen:"open.v1"`
+	Tokens     [][]byte               `protobuf:"bytes,1,rep,name=tokens,proto3" json:"tokens,omitempty"`
+	MinOverlap int32                  `protobuf:"varint,2,opt,name=min_overlap,json=minOverlap,proto3" json:"min_overlap,omitempty"`
+	// The time limit of the search in milliseconds, after which the results
+	// found so far are returned. The server default is used if zero.
+	TimeoutMs     int64 `protobuf:"varint,3,opt,name=timeout_ms,json=timeoutMs,proto3" json:"timeout_ms,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *ThresholdSearchRequest) Reset() {
+	*x = ThresholdSearchRequest{}
+	mi := &file_josie_proto_msgTypes[1]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *ThresholdSearchRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ThresholdSearchRequest) ProtoMessage() {}
+
+func (x *ThresholdSearchRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_josie_proto_msgTypes[1]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ThresholdSearchRequest.ProtoReflect.Descriptor instead.
+func (*ThresholdSearchRequest) Descriptor() ([]byte, []int) {
+	return file_josie_proto_rawDescGZIP(), []int{1}
+}
+
+func (x *ThresholdSearchRequest) GetTokens() [][]byte {
+	if x != nil {
+		return x.Tokens
+	}
+	return nil
+}
+
+func (x *ThresholdSearchRequest) GetMinOverlap() int32 {
+	if x != nil {
+		return x.MinOverlap
+	}
+	return 0
+}
+
+func (x *ThresholdSearchRequest) GetTimeoutMs() int64 {
+	if x != nil {
+		return x.TimeoutMs
+	}
+	return 0
+}
+
+type Query struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Id            int64                  `protobuf:"varint,1,opt,name=id,proto3" json:"id,omitempty"`
+	Tokens        [][]byte               `protobuf:"bytes,2,rep,name=tokens,proto3" json:"tokens,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *Query) Reset() {
+	*x = Query{}
+	mi := &file_josie_proto_msgTypes[2]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *Query) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Query) ProtoMessage() {}
+
+func (x *Query) ProtoReflect() protoreflect.Message {
+	mi := &file_josie_proto_msgTypes[2]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Query.ProtoReflect.Descriptor instead.
+func (*Query) Descriptor() ([]byte, []int) {
+	return file_josie_proto_rawDescGZIP(), []int{2}
+}
+
+func (x *Query) GetId() int64 {
+	if x != nil {
+		return x.Id
+	}
+	return 0
+}
+
+func (x *Query) GetTokens() [][]byte {
+	if x != nil {
+		return x.Tokens
+	}
+	return nil
+}
+
+type BatchTopKRequest struct {
+	state   protoimpl.MessageState `protogen:"open.v1"`
+	Queries []*Query               `protobuf:"bytes,1,rep,name=queries,proto3" json:"queries,omitempty"`
+	K       int32                  `protobuf:"varint,2,opt,name=k,proto3" json:"k,omitempty"`
+	// The search algorithm, JOSIE if empty.
+	Algorithm string `protobuf:"bytes,3,opt,name=algorithm,proto3" json:"algorithm,omitempty"`
+	// The scoring function ranking the results, overlap if empty.
+	Scoring string `protobuf:"bytes,4,opt,name=scoring,proto3" json:"scoring,omitempty"`
+	// The time limit of the batch in milliseconds, after which the best
+	// results found so far are returned for the remaining queries. The server
+	// default is used if zero.
+	TimeoutMs int64 `protobuf:"varint,5,opt,name=timeout_ms,json=timeoutMs,proto3" json:"timeout_ms,omitempty"`
+	// The I/O budget of a search, after which the best results found so far
+	// are returned. Only supported by JOSIE with overlap or
+	// query_containment scoring.
+	Budget        *Budget `protobuf:"bytes,6,opt,name=budget,proto3" json:"budget,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *BatchTopKRequest) Reset() {
+	*x = BatchTopKRequest{}
+	mi := &file_josie_proto_msgTypes[3]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *BatchTopKRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*BatchTopKRequest) ProtoMessage() {}
+
+func (x *BatchTopKRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_josie_proto_msgTypes[3]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use BatchTopKRequest.ProtoReflect.Descriptor instead.
+func (*BatchTopKRequest) Descriptor() ([]byte, []int) {
+	return file_josie_proto_rawDescGZIP(), []int{3}
+}
+
+func (x *BatchTopKRequest) GetQueries() []*Query {
+	if x != nil {
+		return x.Queries
+	}
+	return nil
+}
+
+func (x *BatchTopKRequest) GetK() int32 {
+	if x != nil {
+		return x.K
+	}
+	return 0
+}
+
+func (x *BatchTopKRequest) GetAlgorithm() string {
+	if x != nil {
+		return x.Algorithm
+	}
+	return ""
+}
+
+func (x *BatchTopKRequest) GetScoring() string {
+	if x != nil {
+		return x.Scoring
+	}
+	return ""
+}
+
+func (x *BatchTopKRequest) GetTimeoutMs() int64 {
+	if x != nil {
+		return x.TimeoutMs
+	}
+	return 0
+}
+
+func (x *BatchTopKRequest) GetBudget() *Budget {
+	if x != nil {
+		return x.Budget
+	}
+	return nil
+}
+
+// Budget limits the posting list reads, the set reads and the estimated I/O
+// time in milliseconds of a search, zero fields are not limited.
+type Budget struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	MaxListReads  int32                  `protobuf:"varint,1,opt,name=max_list_reads,json=maxListReads,proto3" json:"max_list_reads,omitempty"`
+	MaxSetReads   int32                  `protobuf:"varint,2,opt,name=max_set_reads,json=maxSetReads,proto3" json:"max_set_reads,omitempty"`
+	MaxCost       float64                `protobuf:"fixed64,3,opt,name=max_cost,json=maxCost,proto3" json:"max_cost,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *Budget) Reset() {
+	*x = Budget{}
+	mi := &file_josie_proto_msgTypes[4]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *Budget) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Budget) ProtoMessage() {}
+
+func (x *Budget) ProtoReflect() protoreflect.Message {
+	mi := &file_josie_proto_msgTypes[4]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Budget.ProtoReflect.Descriptor instead.
+func (*Budget) Descriptor() ([]byte, []int) {
+	return file_josie_proto_rawDescGZIP(), []int{4}
+}
+
+func (x *Budget) GetMaxListReads() int32 {
+	if x != nil {
+		return x.MaxListReads
+	}
+	return 0
+}
+
+func (x *Budget) GetMaxSetReads() int32 {
+	if x != nil {
+		return x.MaxSetReads
+	}
+	return 0
+}
+
+func (x *Budget) GetMaxCost() float64 {
+	if x != nil {
+		return x.MaxCost
+	}
+	return 0
+}
+
+type Result struct {
+	state   protoimpl.MessageState `protogen:"open.v1"`
+	Id      int64                  `protobuf:"varint,1,opt,name=id,proto3" json:"id,omitempty"`
+	Overlap int32                  `protobuf:"varint,2,opt,name=overlap,proto3" json:"overlap,omitempty"`
+	Score   float64                `protobuf:"fixed64,3,opt,name=score,proto3" json:"score,omitempty"`
+	// True if the overlap and the score are lower bounds found by an
+	// incomplete search.
+	Partial       bool `protobuf:"varint,4,opt,name=partial,proto3" json:"partial,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *Result) Reset() {
+	*x = Result{}
+	mi := &file_josie_proto_msgTypes[5]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *Result) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Result) ProtoMessage() {}
+
+func (x *Result) ProtoReflect() protoreflect.Message {
+	mi := &file_josie_proto_msgTypes[5]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Result.ProtoReflect.Descriptor instead.
+func (*Result) Descriptor() ([]byte, []int) {
+	return file_josie_proto_rawDescGZIP(), []int{5}
+}
+
+func (x *Result) GetId() int64 {
+	if x != nil {
+		return x.Id
+	}
+	return 0
+}
+
+func (x *Result) GetOverlap() int32 {
+	if x != nil {
+		return x.Overlap
+	}
+	return 0
+}
+
+func (x *Result) GetScore() float64 {
+	if x != nil {
+		return x.Score
+	}
+	return 0
+}
+
+func (x *Result) GetPartial() bool {
+	if x != nil {
+		return x.Partial
+	}
+	return false
+}
+
+// Stats are the statistics of a search, durations are in milliseconds.
+type Stats struct {
+	state           protoimpl.MessageState `protogen:"open.v1"`
+	Duration        int64                  `protobuf:"varint,1,opt,name=duration,proto3" json:"duration,omitempty"`
+	PreprocDuration int64                  `protobuf:"varint,2,opt,name=preproc_duration,json=preprocDuration,proto3" json:"preproc_duration,omitempty"`
+	QueryNumToken   int32                  `protobuf:"varint,3,opt,name=query_num_token,json=queryNumToken,proto3" json:"query_num_token,omitempty"`
+	NumListRead     int32                  `protobuf:"varint,4,opt,name=num_list_read,json=numListRead,proto3" json:"num_list_read,omitempty"`
+	NumSetRead      int32                  `protobuf:"varint,5,opt,name=num_set_read,json=numSetRead,proto3" json:"num_set_read,omitempty"`
+	MaxListSizeRead int32                  `protobuf:"varint,6,opt,name=max_list_size_read,json=maxListSizeRead,proto3" json:"max_list_size_read,omitempty"`
+	MaxSetSizeRead  int32                  `protobuf:"varint,7,opt,name=max_set_size_read,json=maxSetSizeRead,proto3" json:"max_set_size_read,omitempty"`
+	MaxCounterSize  int32                  `protobuf:"varint,8,opt,name=max_counter_size,json=maxCounterSize,proto3" json:"max_counter_size,omitempty"`
+	// True if the search was stopped by its time limit or budget, in which
+	// case the results are the best found so far.
+	Incomplete bool `protobuf:"varint,9,opt,name=incomplete,proto3" json:"incomplete,omitempty"`
+	// The upper bound score of the sets not in the results of an incomplete
+	// JOSIE top-k search.
+	UnseenUpperbound float64 `protobuf:"fixed64,10,opt,name=unseen_upperbound,json=unseenUpperbound,proto3" json:"unseen_upperbound,omitempty"`
+	// The cache hits and misses of the posting list and set reads, if the
+	// server caches them.
+	NumListCacheHit  int32 `protobuf:"varint,11,opt,name=num_list_cache_hit,json=numListCacheHit,proto3" json:"num_list_cache_hit,omitempty"`
+	NumListCacheMiss int32 `protobuf:"varint,12,opt,name=num_list_cache_miss,json=numListCacheMiss,proto3" json:"num_list_cache_miss,omitempty"`
+	NumSetCacheHit   int32 `protobuf:"varint,13,opt,name=num_set_cache_hit,json=numSetCacheHit,proto3" json:"num_set_cache_hit,omitempty"`
+	NumSetCacheMiss  int32 `protobuf:"varint,14,opt,name=num_set_cache_miss,json=numSetCacheMiss,proto3" json:"num_set_cache_miss,omitempty"`
+	unknownFields    protoimpl.UnknownFields
+	sizeCache        protoimpl.SizeCache
+}
+
+func (x *Stats) Reset() {
+	*x = Stats{}
+	mi := &file_josie_proto_msgTypes[6]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *Stats) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Stats) ProtoMessage() {}
+
+func (x *Stats) ProtoReflect() protoreflect.Message {
+	mi := &file_josie_proto_msgTypes[6]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Stats.ProtoReflect.Descriptor instead.
+func (*Stats) Descriptor() ([]byte, []int) {
+	return file_josie_proto_rawDescGZIP(), []int{6}
+}
+
+func (x *Stats) GetDuration() int64 {
+	if x != nil {
+		return x.Duration
+	}
+	return 0
+}
+
+func (x *Stats) GetPreprocDuration() int64 {
+	if x != nil {
+		return x.PreprocDuration
+	}
+	return 0
+}
+
+func (x *Stats) GetQueryNumToken() int32 {
+	if x != nil {
+		return x.QueryNumToken
+	}
+	return 0
+}
+
+func (x *Stats) GetNumListRead() int32 {
+	if x != nil {
+		return x.NumListRead
+	}
+	return 0
+}
+
+func (x *Stats) GetNumSetRead() int32 {
+	if x != nil {
+		return x.NumSetRead
+	}
+	return 0
+}
+
+func (x *Stats) GetMaxListSizeRead() int32 {
+	if x != nil {
+		return x.MaxListSizeRead
+	}
+	return 0
+}
+
+func (x *Stats) GetMaxSetSizeRead() int32 {
+	if x != nil {
+		return x.MaxSetSizeRead
+	}
+	return 0
+}
+
+func (x *Stats) GetMaxCounterSize() int32 {
+	if x != nil {
+		return x.MaxCounterSize
+	}
+	return 0
+}
+
+func (x *Stats) GetIncomplete() bool {
+	if x != nil {
+		return x.Incomplete
+	}
+	return false
+}
+
+func (x *Stats) GetUnseenUpperbound() float64 {
+	if x != nil {
+		return x.UnseenUpperbound
+	}
+	return 0
+}
+
+func (x *Stats) GetNumListCacheHit() int32 {
+	if x != nil {
+		return x.NumListCacheHit
+	}
+	return 0
+}
+
+func (x *Stats) GetNumListCacheMiss() int32 {
+	if x != nil {
+		return x.NumListCacheMiss
+	}
+	return 0
+}
+
+func (x *Stats) GetNumSetCacheHit() int32 {
+	if x != nil {
+		return x.NumSetCacheHit
+	}
+	return 0
+}
+
+func (x *Stats) GetNumSetCacheMiss() int32 {
+	if x != nil {
+		return x.NumSetCacheMiss
+	}
+	return 0
+}
+
+// SearchResponse is a message of a search response stream, which carries
+// either new results or the statistics in the last message.
+type SearchResponse struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Results       []*Result              `protobuf:"bytes,1,rep,name=results,proto3" json:"results,omitempty"`
+	Stats         *Stats                 `protobuf:"bytes,2,opt,name=stats,proto3" json:"stats,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *SearchResponse) Reset() {
+	*x = SearchResponse{}
+	mi := &file_josie_proto_msgTypes[7]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *SearchResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*SearchResponse) ProtoMessage() {}
+
+func (x *SearchResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_josie_proto_msgTypes[7]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use SearchResponse.ProtoReflect.Descriptor instead.
+func (*SearchResponse) Descriptor() ([]byte, []int) {
+	return file_josie_proto_rawDescGZIP(), []int{7}
+}
+
+func (x *SearchResponse) GetResults() []*Result {
+	if x != nil {
+		return x.Results
+	}
+	return nil
+}
+
+func (x *SearchResponse) GetStats() *Stats {
+	if x != nil {
+		return x.Stats
+	}
+	return nil
+}
+
+type BatchTopKResponse struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	// The ID of the query in the request.
+	QueryId       int64     `protobuf:"varint,1,opt,name=query_id,json=queryId,proto3" json:"query_id,omitempty"`
+	Results       []*Result `protobuf:"bytes,2,rep,name=results,proto3" json:"results,omitempty"`
+	Stats         *Stats    `protobuf:"bytes,3,opt,name=stats,proto3" json:"stats,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *BatchTopKResponse) Reset() {
+	*x = BatchTopKResponse{}
+	mi := &file_josie_proto_msgTypes[8]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *BatchTopKResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*BatchTopKResponse) ProtoMessage() {}
+
+func (x *BatchTopKResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_josie_proto_msgTypes[8]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use BatchTopKResponse.ProtoReflect.Descriptor instead.
+func (*BatchTopKResponse) Descriptor() ([]byte, []int) {
+	return file_josie_proto_rawDescGZIP(), []int{8}
+}
+
+func (x *BatchTopKResponse) GetQueryId() int64 {
+	if x != nil {
+		return x.QueryId
+	}
+	return 0
+}
+
+func (x *BatchTopKResponse) GetResults() []*Result {
+	if x != nil {
+		return x.Results
+	}
+	return nil
+}
+
+func (x *BatchTopKResponse) GetStats() *Stats {
+	if x != nil {
+		return x.Stats
+	}
+	return nil
+}
+
+type GetSetRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Id            int64                  `protobuf:"varint,1,opt,name=id,proto3" json:"id,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *GetSetRequest) Reset() {
+	*x = GetSetRequest{}
+	mi := &file_josie_proto_msgTypes[9]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *GetSetRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*GetSetRequest) ProtoMessage() {}
+
+func (x *GetSetRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_josie_proto_msgTypes[9]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use GetSetRequest.ProtoReflect.Descriptor instead.
+func (*GetSetRequest) Descriptor() ([]byte, []int) {
+	return file_josie_proto_rawDescGZIP(), []int{9}
+}
+
+func (x *GetSetRequest) GetId() int64 {
+	if x != nil {
+		return x.Id
+	}
+	return 0
+}
+
+type GetSetResponse struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Id            int64                  `protobuf:"varint,1,opt,name=id,proto3" json:"id,omitempty"`
+	Tokens        [][]byte               `protobuf:"bytes,2,rep,name=tokens,proto3" json:"tokens,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *GetSetResponse) Reset() {
+	*x = GetSetResponse{}
+	mi := &file_josie_proto_msgTypes[10]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *GetSetResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*GetSetResponse) ProtoMessage() {}
+
+func (x *GetSetResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_josie_proto_msgTypes[10]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use GetSetResponse.ProtoReflect.Descriptor instead.
+func (*GetSetResponse) Descriptor() ([]byte, []int) {
+	return file_josie_proto_rawDescGZIP(), []int{10}
+}
+
+func (x *GetSetResponse) GetId() int64 {
+	if x != nil {
+		return x.Id
+	}
+	return 0
+}
+
+func (x *GetSetResponse) GetTokens() [][]byte {
+	if x != nil {
+		return x.Tokens
+	}
+	return nil
+}
+
+var File_josie_proto protoreflect.FileDescriptor
+
+const file_josie_proto_rawDesc = "" +
+	"\n" +
+	"\vjosie.proto\x12\x05josie\"\xb1\x01\n" +
+	"\vTopKRequest\x12\x16\n" +
+	"\x06tokens\x18\x01 \x03(\fR\x06tokens\x12\f\n" +
+	"\x01k\x18\x02 \x01(\x05R\x01k\x12\x1c\n" +
+	"\talgorithm\x18\x03 \x01(\tR\talgorithm\x12\x18\n" +
+	"\ascoring\x18\x04 \x01(\tR\ascoring\x12\x1d\n" +
+	"\n" +
+	"timeout_ms\x18\x05 \x01(\x03R\ttimeoutMs\x12%\n" +
+	"\x06budget\x18\x06 \x01(\v2\r.josie.BudgetR\x06budget\"p\n" +
+	"\x16ThresholdSearchRequest\x12\x16\n" +
+	"\x06tokens\x18\x01 \x03(\fR\x06tokens\x12\x1f\n" +
+	"\vmin_overlap\x18\x02 \x01(\x05R\n" +
+	"minOverlap\x12\x1d\n" +
+	"\n" +
+	"timeout_ms\x18\x03 \x01(\x03R\ttimeoutMs\"/\n" +
+	"\x05Query\x12\x0e\n" +
+	"\x02id\x18\x01 \x01(\x03R\x02id\x12\x16\n" +
+	"\x06tokens\x18\x02 \x03(\fR\x06tokens\"\xc6\x01\n" +
+	"\x10BatchTopKRequest\x12&\n" +
+	"\aqueries\x18\x01 \x03(\v2\f.josie.QueryR\aqueries\x12\f\n" +
+	"\x01k\x18\x02 \x01(\x05R\x01k\x12\x1c\n" +
+	"\talgorithm\x18\x03 \x01(\tR\talgorithm\x12\x18\n" +
+	"\ascoring\x18\x04 \x01(\tR\ascoring\x12\x1d\n" +
+	"\n" +
+	"timeout_ms\x18\x05 \x01(\x03R\ttimeoutMs\x12%\n" +
+	"\x06budget\x18\x06 \x01(\v2\r.josie.BudgetR\x06budget\"m\n" +
+	"\x06Budget\x12$\n" +
+	"\x0emax_list_reads\x18\x01 \x01(\x05R\fmaxListReads\x12\"\n" +
+	"\rmax_set_reads\x18\x02 \x01(\x05R\vmaxSetReads\x12\x19\n" +
+	"\bmax_cost\x18\x03 \x01(\x01R\amaxCost\"b\n" +
+	"\x06Result\x12\x0e\n" +
+	"\x02id\x18\x01 \x01(\x03R\x02id\x12\x18\n" +
+	"\aoverlap\x18\x02 \x01(\x05R\aoverlap\x12\x14\n" +
+	"\x05score\x18\x03 \x01(\x01R\x05score\x12\x18\n" +
+	"\apartial\x18\x04 \x01(\bR\apartial\"\xbf\x04\n" +
+	"\x05Stats\x12\x1a\n" +
+	"\bduration\x18\x01 \x01(\x03R\bduration\x12)\n" +
+	"\x10preproc_duration\x18\x02 \x01(\x03R\x0fpreprocDuration\x12&\n" +
+	"\x0fquery_num_token\x18\x03 \x01(\x05R\rqueryNumToken\x12\"\n" +
+	"\rnum_list_read\x18\x04 \x01(\x05R\vnumListRead\x12 \n" +
+	"\fnum_set_read\x18\x05 \x01(\x05R\n" +
+	"numSetRead\x12+\n" +
+	"\x12max_list_size_read\x18\x06 \x01(\x05R\x0fmaxListSizeRead\x12)\n" +
+	"\x11max_set_size_read\x18\a \x01(\x05R\x0emaxSetSizeRead\x12(\n" +
+	"\x10max_counter_size\x18\b \x01(\x05R\x0emaxCounterSize\x12\x1e\n" +
+	"\n" +
+	"incomplete\x18\t \x01(\bR\n" +
+	"incomplete\x12+\n" +
+	"\x11unseen_upperbound\x18\n" +
+	" \x01(\x01R\x10unseenUpperbound\x12+\n" +
+	"\x12num_list_cache_hit\x18\v \x01(\x05R\x0fnumListCacheHit\x12-\n" +
+	"\x13num_list_cache_miss\x18\f \x01(\x05R\x10numListCacheMiss\x12)\n" +
+	"\x11num_set_cache_hit\x18\r \x01(\x05R\x0enumSetCacheHit\x12+\n" +
+	"\x12num_set_cache_miss\x18\x0e \x01(\x05R\x0fnumSetCacheMiss\"]\n" +
+	"\x0eSearchResponse\x12'\n" +
+	"\aresults\x18\x01 \x03(\v2\r.josie.ResultR\aresults\x12\"\n" +
+	"\x05stats\x18\x02 \x01(\v2\f.josie.StatsR\x05stats\"{\n" +
+	"\x11BatchTopKResponse\x12\x19\n" +
+	"\bquery_id\x18\x01 \x01(\x03R\aqueryId\x12'\n" +
+	"\aresults\x18\x02 \x03(\v2\r.josie.ResultR\aresults\x12\"\n" +
+	"\x05stats\x18\x03 \x01(\v2\f.josie.StatsR\x05stats\"\x1f\n" +
+	"\rGetSetRequest\x12\x0e\n" +
+	"\x02id\x18\x01 \x01(\x03R\x02id\"8\n" +
+	"\x0eGetSetResponse\x12\x0e\n" +
+	"\x02id\x18\x01 \x01(\x03R\x02id\x12\x16\n" +
+	"\x06tokens\x18\x02 \x03(\fR\x06tokens2\x80\x02\n" +
+	"\x05Josie\x123\n" +
+	"\x04TopK\x12\x12.josie.TopKRequest\x1a\x15.josie.SearchResponse0\x01\x12I\n" +
+	"\x0fThresholdSearch\x12\x1d.josie.ThresholdSearchRequest\x1a\x15.josie.SearchResponse0\x01\x12@\n" +
+	"\tBatchTopK\x12\x17.josie.BatchTopKRequest\x1a\x18.josie.BatchTopKResponse0\x01\x125\n" +
+	"\x06GetSet\x12\x14.josie.GetSetRequest\x1a\x15.josie.GetSetResponseB Z\x1egithub.com/ekzhu/josie/josiepbb\x06proto3"
+
+var (
+	file_josie_proto_rawDescOnce sync.Once
+	file_josie_proto_rawDescData []byte
+)
+
+func file_josie_proto_rawDescGZIP() []byte {
+	file_josie_proto_rawDescOnce.Do(func() {
+		file_josie_proto_rawDescData = protoimpl.X.CompressGZIP(unsafe.Slice(unsafe.StringData(file_josie_proto_rawDesc), len(file_josie_proto_rawDesc)))
+	})
+	return file_josie_proto_rawDescData
+}
+
+var file_josie_proto_msgTypes = make([]protoimpl.MessageInfo, 11)
+var file_josie_proto_goTypes = []any{
+	(*TopKRequest)(nil),            // 0: josie.TopKRequest
+	(*ThresholdSearchRequest)(nil), // 1: josie.ThresholdSearchRequest
+	(*Query)(nil),                  // 2: josie.Query
+	(*BatchTopKRequest)(nil),       // 3: josie.BatchTopKRequest
+	(*Budget)(nil),                 // 4: josie.Budget
+	(*Result)(nil),                 // 5: josie.Result
+	(*Stats)(nil),                  // 6: josie.Stats
+	(*SearchResponse)(nil),         // 7: josie.SearchResponse
+	(*BatchTopKResponse)(nil),      // 8: josie.BatchTopKResponse
+	(*GetSetRequest)(nil),          // 9: josie.GetSetRequest
+	(*GetSetResponse)(nil),         // 10: josie.GetSetResponse
+}
+var file_josie_proto_depIdxs = []int32{
+	4,  // 0: josie.TopKRequest.budget:type_name -> josie.Budget
+	2,  // 1: josie.BatchTopKRequest.queries:type_name -> josie.Query
+	4,  // 2: josie.BatchTopKRequest.budget:type_name -> josie.Budget
+	5,  // 3: josie.SearchResponse.results:type_name -> josie.Result
+	6,  // 4: josie.SearchResponse.stats:type_name -> josie.Stats
+	5,  // 5: josie.BatchTopKResponse.results:type_name -> josie.Result
+	6,  // 6: josie.BatchTopKResponse.stats:type_name -> josie.Stats
+	0,  // 7: josie.Josie.TopK:input_type -> josie.TopKRequest
+	1,  // 8: josie.Josie.ThresholdSearch:input_type -> josie.ThresholdSearchRequest
+	3,  // 9: josie.Josie.BatchTopK:input_type -> josie.BatchTopKRequest
+	9,  // 10: josie.Josie.GetSet:input_type -> josie.GetSetRequest
+	7,  // 11: josie.Josie.TopK:output_type -> josie.SearchResponse
+	7,  // 12: josie.Josie.ThresholdSearch:output_type -> josie.SearchResponse
+	8,  // 13: josie.Josie.BatchTopK:output_type -> josie.BatchTopKResponse
+	10, // 14: josie.Josie.GetSet:output_type -> josie.GetSetResponse
+	11, // [11:15] is the sub-list for method output_type
+	7,  // [7:11] is the sub-list for method input_type
+	7,  // [7:7] is the sub-list for extension type_name
+	7,  // [7:7] is the sub-list for extension extendee
+	0,  // [0:7] is the sub-list for field type_name
+}
+
+func init() { file_josie_proto_init() }
+func file_josie_proto_init() {
+	if File_josie_proto != nil {
+		return
+	}
+	type x struct{}
+	out := protoimpl.TypeBuilder{
+		File: protoimpl.DescBuilder{
+			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
+			RawDescriptor: unsafe.Slice(unsafe.StringData(file_josie_proto_rawDesc), len(file_josie_proto_rawDesc)),
+			NumEnums:      0,
+			NumMessages:   11,
+			NumExtensions: 0,
+			NumServices:   1,
+		},
+		GoTypes:           file_josie_proto_goTypes,
+		DependencyIndexes: file_josie_proto_depIdxs,
+		MessageInfos:      file_josie_proto_msgTypes,
+	}.Build()
+	File_josie_proto = out.File
+	file_josie_proto_goTypes = nil
+	file_josie_proto_depIdxs = nil
+}
@@ -0,0 +1,273 @@
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.5.1
+// - protoc             (unknown)
+// source: josie.proto
+
+package josiepb
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.64.0 or later.
+const _ = grpc.SupportPackageIsVersion9
+
+const (
+	Josie_TopK_FullMethodName            = "/josie.Josie/TopK"
+	Josie_ThresholdSearch_FullMethodName = "/josie.Josie/ThresholdSearch"
+	Josie_BatchTopK_FullMethodName       = "/josie.Josie/BatchTopK"
+	Josie_GetSet_FullMethodName          = "/josie.Josie/GetSet"
+)
+
+// JosieClient is the client API for Josie service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+//
+// Josie searches an index for the sets with the highest overlaps with a
+// query set of raw tokens.
+type JosieClient interface {
+	// TopK streams the k sets with the highest scores in decreasing score
+	// order. Results are sent as soon as they are final, and the last message
+	// carries the statistics of the search.
+	TopK(ctx context.Context, in *TopKRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[SearchResponse], error)
+	// ThresholdSearch streams all sets with overlaps of at least min_overlap
+	// as soon as they are found, which is not in overlap order. The last
+	// message carries the statistics of the search.
+	ThresholdSearch(ctx context.Context, in *ThresholdSearchRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[SearchResponse], error)
+	// BatchTopK runs a top-k search for every query, reading the posting lists
+	// needed by several queries once. The results of every query are streamed
+	// as soon as they are final like TopK, followed by a message carrying the
+	// statistics of the query once its search is done.
+	BatchTopK(ctx context.Context, in *BatchTopKRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[BatchTopKResponse], error)
+	// GetSet returns the raw tokens of a set in the index.
+	GetSet(ctx context.Context, in *GetSetRequest, opts ...grpc.CallOption) (*GetSetResponse, error)
+}
+
+type josieClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewJosieClient(cc grpc.ClientConnInterface) JosieClient {
+	return &josieClient{cc}
+}
+
+func (c *josieClient) TopK(ctx context.Context, in *TopKRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[SearchResponse], error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	stream, err := c.cc.NewStream(ctx, &Josie_ServiceDesc.Streams[0], Josie_TopK_FullMethodName, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &grpc.GenericClientStream[TopKRequest, SearchResponse]{ClientStream: stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type Josie_TopKClient = grpc.ServerStreamingClient[SearchResponse]
+
+func (c *josieClient) ThresholdSearch(ctx context.Context, in *ThresholdSearchRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[SearchResponse], error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	stream, err := c.cc.NewStream(ctx, &Josie_ServiceDesc.Streams[1], Josie_ThresholdSearch_FullMethodName, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &grpc.GenericClientStream[ThresholdSearchRequest, SearchResponse]{ClientStream: stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type Josie_ThresholdSearchClient = grpc.ServerStreamingClient[SearchResponse]
+
+func (c *josieClient) BatchTopK(ctx context.Context, in *BatchTopKRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[BatchTopKResponse], error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	stream, err := c.cc.NewStream(ctx, &Josie_ServiceDesc.Streams[2], Josie_BatchTopK_FullMethodName, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &grpc.GenericClientStream[BatchTopKRequest, BatchTopKResponse]{ClientStream: stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type Josie_BatchTopKClient = grpc.ServerStreamingClient[BatchTopKResponse]
+
+func (c *josieClient) GetSet(ctx context.Context, in *GetSetRequest, opts ...grpc.CallOption) (*GetSetResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(GetSetResponse)
+	err := c.cc.Invoke(ctx, Josie_GetSet_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// JosieServer is the server API for Josie service.
+// All implementations must embed UnimplementedJosieServer
+// for forward compatibility.
+//
+// Josie searches an index for the sets with the highest overlaps with a
+// query set of raw tokens.
+type JosieServer interface {
+	// TopK streams the k sets with the highest scores in decreasing score
+	// order. Results are sent as soon as they are final, and the last message
+	// carries the statistics of the search.
+	TopK(*TopKRequest, grpc.ServerStreamingServer[SearchResponse]) error
+	// ThresholdSearch streams all sets with overlaps of at least min_overlap
+	// as soon as they are found, which is not in overlap order. The last
+	// message carries the statistics of the search.
+	ThresholdSearch(*ThresholdSearchRequest, grpc.ServerStreamingServer[SearchResponse]) error
+	// BatchTopK runs a top-k search for every query, reading the posting lists
+	// needed by several queries once. The results of every query are streamed
+	// as soon as they are final like TopK, followed by a message carrying the
+	// statistics of the query once its search is done.
+	BatchTopK(*BatchTopKRequest, grpc.ServerStreamingServer[BatchTopKResponse]) error
+	// GetSet returns the raw tokens of a set in the index.
+	GetSet(context.Context, *GetSetRequest) (*GetSetResponse, error)
+	mustEmbedUnimplementedJosieServer()
+}
+
+// UnimplementedJosieServer must be embedded to have
+// forward compatible implementations.
+//
+// NOTE: this should be embedded by value instead of pointer to avoid a nil
+// pointer dereference when methods are called.
+type UnimplementedJosieServer struct{}
+
+func (UnimplementedJosieServer) TopK(*TopKRequest, grpc.ServerStreamingServer[SearchResponse]) error {
+	return status.Errorf(codes.Unimplemented, "method TopK not implemented")
+}
+func (UnimplementedJosieServer) ThresholdSearch(*ThresholdSearchRequest, grpc.ServerStreamingServer[SearchResponse]) error {
+	return status.Errorf(codes.Unimplemented, "method ThresholdSearch not implemented")
+}
+func (UnimplementedJosieServer) BatchTopK(*BatchTopKRequest, grpc.ServerStreamingServer[BatchTopKResponse]) error {
+	return status.Errorf(codes.Unimplemented, "method BatchTopK not implemented")
+}
+func (UnimplementedJosieServer) GetSet(context.Context, *GetSetRequest) (*GetSetResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetSet not implemented")
+}
+func (UnimplementedJosieServer) mustEmbedUnimplementedJosieServer() {}
+func (UnimplementedJosieServer) testEmbeddedByValue()               {}
+
+// UnsafeJosieServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to JosieServer will
+// result in compilation errors.
+type UnsafeJosieServer interface {
+	mustEmbedUnimplementedJosieServer()
+}
+
+func RegisterJosieServer(s grpc.ServiceRegistrar, srv JosieServer) {
+	// If the following call pancis, it indicates UnimplementedJosieServer was
+	// embedded by pointer and is nil.  This will cause panics if an
+	// unimplemented method is ever invoked, so we test this at initialization
+	// time to prevent it from happening at runtime later due to I/O.
+	if t, ok := srv.(interface{ testEmbeddedByValue() }); ok {
+		t.testEmbeddedByValue()
+	}
+	s.RegisterService(&Josie_ServiceDesc, srv)
+}
+
+func _Josie_TopK_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(TopKRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(JosieServer).TopK(m, &grpc.GenericServerStream[TopKRequest, SearchResponse]{ServerStream: stream})
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type Josie_TopKServer = grpc.ServerStreamingServer[SearchResponse]
+
+func _Josie_ThresholdSearch_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(ThresholdSearchRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(JosieServer).ThresholdSearch(m, &grpc.GenericServerStream[ThresholdSearchRequest, SearchResponse]{ServerStream: stream})
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type Josie_ThresholdSearchServer = grpc.ServerStreamingServer[SearchResponse]
+
+func _Josie_BatchTopK_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(BatchTopKRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(JosieServer).BatchTopK(m, &grpc.GenericServerStream[BatchTopKRequest, BatchTopKResponse]{ServerStream: stream})
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type Josie_BatchTopKServer = grpc.ServerStreamingServer[BatchTopKResponse]
+
+func _Josie_GetSet_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetSetRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(JosieServer).GetSet(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Josie_GetSet_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(JosieServer).GetSet(ctx, req.(*GetSetRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+// Josie_ServiceDesc is the grpc.ServiceDesc for Josie service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var Josie_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "josie.Josie",
+	HandlerType: (*JosieServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "GetSet",
+			Handler:    _Josie_GetSet_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "TopK",
+			Handler:       _Josie_TopK_Handler,
+			ServerStreams: true,
+		},
+		{
+			StreamName:    "ThresholdSearch",
+			Handler:       _Josie_ThresholdSearch_Handler,
+			ServerStreams: true,
+		},
+		{
+			StreamName:    "BatchTopK",
+			Handler:       _Josie_BatchTopK_Handler,
+			ServerStreams: true,
+		},
+	},
+	Metadata: "josie.proto",
+}
@@ -0,0 +1,95 @@
+package joise
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// The encodings of the posting lists in the lists file of an embedded index
+const (
+	// Fixed-width set IDs, followed by the set sizes and the match positions
+	listEncodingFixed = 0
+	// Delta and varint encoded entries, see appendEncodedList
+	listEncodingVarint = 1
+)
+
+// errCorruptEncodedList is returned when an encoded posting list is
+// truncated or has invalid varints
+var errCorruptEncodedList = errors.New("corrupt encoded posting list")
+
+// StoreOption configures how an index store or index writer stores the
+// index.
+type StoreOption func(o *storeOptions)
+
+type storeOptions struct {
+	compressLists bool
+	compressSets  bool
+}
+
+func newStoreOptions(opts []StoreOption) storeOptions {
+	var o storeOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
+
+// WithCompressedLists stores the posting lists compressed: the set IDs are
+// delta encoded and all integers are varints, which makes long posting lists
+// several times smaller to read. MemStore keeps the posting lists compressed
+// in memory, the embedded index writes them compressed to the lists file,
+// and the Postgres index writer adds an encoded_list bytea column, which
+// PostgresStore reads instead of the integer array columns.
+func WithCompressedLists() StoreOption {
+	return func(o *storeOptions) {
+		o.compressLists = true
+	}
+}
+
+// Appends the encoded posting list to dst: the number of entries, then for
+// every entry the difference of its set ID from the previous one, its set
+// size and its match position, all as varints. The differences of set IDs
+// sorted in increasing order are small, and are signed so that posting
+// lists in any order can be encoded.
+func appendEncodedList(dst []byte, list []ListEntry) []byte {
+	dst = binary.AppendUvarint(dst, uint64(len(list)))
+	var prev int64
+	for _, e := range list {
+		dst = binary.AppendVarint(dst, e.ID-prev)
+		dst = binary.AppendUvarint(dst, uint64(e.Size))
+		dst = binary.AppendUvarint(dst, uint64(e.MatchPosition))
+		prev = e.ID
+	}
+	return dst
+}
+
+// Decodes a posting list encoded by appendEncodedList from the start of b.
+func decodeList(b []byte) ([]ListEntry, error) {
+	n, i := binary.Uvarint(b)
+	// Every entry takes at least 3 bytes
+	if i <= 0 || n > uint64(len(b)-i)/3 {
+		return nil, errCorruptEncodedList
+	}
+	entries := make([]ListEntry, n)
+	var prev int64
+	for j := range entries {
+		delta, k := binary.Varint(b[i:])
+		if k <= 0 {
+			return nil, errCorruptEncodedList
+		}
+		i += k
+		size, k := binary.Uvarint(b[i:])
+		if k <= 0 {
+			return nil, errCorruptEncodedList
+		}
+		i += k
+		position, k := binary.Uvarint(b[i:])
+		if k <= 0 {
+			return nil, errCorruptEncodedList
+		}
+		i += k
+		prev += delta
+		entries[j] = ListEntry{ID: prev, Size: int(size), MatchPosition: int(position)}
+	}
+	return entries, nil
+}
@@ -0,0 +1,44 @@
+package joise
+
+import (
+	"errors"
+	"math/rand"
+	"reflect"
+	"testing"
+)
+
+func TestEncodedListRoundTrip(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	lists := [][]ListEntry{
+		{},
+		{{ID: 0, Size: 1, MatchPosition: 0}},
+		// Decreasing set IDs have negative differences
+		{{ID: 1 << 40, Size: 5, MatchPosition: 4}, {ID: 3, Size: 1 << 30, MatchPosition: 0}},
+	}
+	for _, n := range []int{127, 128, 1000} {
+		list := make([]ListEntry, n)
+		var id int64
+		for i := range list {
+			id += 1 + r.Int63n(1000)
+			size := 1 + r.Intn(10000)
+			list[i] = ListEntry{ID: id, Size: size, MatchPosition: r.Intn(size)}
+		}
+		lists = append(lists, list)
+	}
+	var b []byte
+	for _, list := range lists {
+		b = appendEncodedList(b[:0], list)
+		got, err := decodeList(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, list) {
+			t.Fatalf("decoded list of %d entries differs", len(list))
+		}
+		if len(list) > 0 {
+			if _, err := decodeList(b[:len(b)-1]); !errors.Is(err, errCorruptEncodedList) {
+				t.Fatalf("truncated list of %d entries: got error %v", len(list), err)
+			}
+		}
+	}
+}
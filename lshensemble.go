@@ -1,6 +1,7 @@
 package joise
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
 	"log"
@@ -58,7 +59,7 @@ func createLSHEnsemble(db *sql.DB, minhashTable string) *lshensemble.LshEnsemble
 			if err != nil {
 				panic(err)
 			}
-			records <- &lshensemble.DomainRecord{id, size, signature}
+			records <- &lshensemble.DomainRecord{Key: id, Size: size, Signature: signature}
 			count++
 			if count%1000 == 0 {
 				fmt.Printf("\r%d sets inserted", count)
@@ -77,21 +78,28 @@ func createLSHEnsemble(db *sql.DB, minhashTable string) *lshensemble.LshEnsemble
 	return lsh
 }
 
-func searchLSHEnsemble(db *sql.DB, setTable string, lsh *lshensemble.LshEnsemble, tb tokenTable, query rawTokenSet, k int, ignoreSelf bool, groundTruth []searchResult) ([]searchResult, experimentResult) {
+func searchLSHEnsemble(ctx context.Context, store IndexStore, lsh *lshensemble.LshEnsemble, tb TokenTable, query RawTokenSet, k int, ignoreSelf bool, groundTruth []searchResult) ([]searchResult, experimentResult, error) {
 	var expResult experimentResult
 	ac := newActionCollecter(len(query.RawTokens))
 
 	start := time.Now()
-	tokens, querySig := tb.processAndMinhashSignature(query)
+	tokens, querySig, err := tb.processAndMinhashSignature(query)
+	if err != nil {
+		return nil, expResult, err
+	}
 	expResult.PreprocDuration = int(time.Now().Sub(start) / time.Millisecond)
 	start = time.Now()
 
+	ignores, err := newIgnores(store, query, ignoreSelf)
+	if err != nil {
+		return nil, expResult, err
+	}
 	// First find candidates using LSH Ensemble by decreasing thresholds
 	candidates := make(map[int64]bool)
 	for _, threshold := range thresholds {
 		IDs, _ := lsh.QueryTimed(querySig, len(tokens), threshold)
 		for _, ID := range IDs {
-			if ignoreSelf && ID == query.ID {
+			if ignores[ID.(int64)] {
 				continue
 			}
 			candidates[ID.(int64)] = true
@@ -106,7 +114,16 @@ func searchLSHEnsemble(db *sql.DB, setTable string, lsh *lshensemble.LshEnsemble
 	ac.start()
 	h := &searchResultHeap{}
 	for ID := range candidates {
-		s := SetTokens(db, setTable, ID)
+		s, err := readSetTokens(ctx, store, ID)
+		if ctx.Err() != nil {
+			// Stop with the results found so far
+			expResult.Incomplete = true
+			break
+		}
+		if err != nil {
+			ac.done()
+			return nil, expResult, err
+		}
 		expResult.NumSetRead++
 		o := overlap(s, tokens)
 		pushCandidate(h, k, ID, o)
@@ -123,41 +140,42 @@ func searchLSHEnsemble(db *sql.DB, setTable string, lsh *lshensemble.LshEnsemble
 	expResult.NumResult = len(results)
 	expResult.QueryNumToken = len(tokens)
 	expResult.Actions = ac.collect()
-	return results, expResult
+	return results, expResult, nil
 }
 
-func searchLSHEnsemblePrecision90(db *sql.DB, setTable string, lsh *lshensemble.LshEnsemble, tb tokenTable, query rawTokenSet, k int, ignoreSelf bool, groundTruth []searchResult) ([]searchResult, experimentResult) {
-	return searchLSHEnsemblePrecision(db, setTable, lsh, tb, query, k, ignoreSelf, groundTruth, 0.9)
+func searchLSHEnsemblePrecision90(ctx context.Context, store IndexStore, lsh *lshensemble.LshEnsemble, tb TokenTable, query RawTokenSet, k int, ignoreSelf bool, groundTruth []searchResult) ([]searchResult, experimentResult, error) {
+	return searchLSHEnsemblePrecision(ctx, store, lsh, tb, query, k, ignoreSelf, groundTruth, 0.9)
 }
 
-func searchLSHEnsemblePrecision80(db *sql.DB, setTable string, lsh *lshensemble.LshEnsemble, tb tokenTable, query rawTokenSet, k int, ignoreSelf bool, groundTruth []searchResult) ([]searchResult, experimentResult) {
-	return searchLSHEnsemblePrecision(db, setTable, lsh, tb, query, k, ignoreSelf, groundTruth, 0.8)
+func searchLSHEnsemblePrecision80(ctx context.Context, store IndexStore, lsh *lshensemble.LshEnsemble, tb TokenTable, query RawTokenSet, k int, ignoreSelf bool, groundTruth []searchResult) ([]searchResult, experimentResult, error) {
+	return searchLSHEnsemblePrecision(ctx, store, lsh, tb, query, k, ignoreSelf, groundTruth, 0.8)
 }
 
-func searchLSHEnsemblePrecision70(db *sql.DB, setTable string, lsh *lshensemble.LshEnsemble, tb tokenTable, query rawTokenSet, k int, ignoreSelf bool, groundTruth []searchResult) ([]searchResult, experimentResult) {
-	return searchLSHEnsemblePrecision(db, setTable, lsh, tb, query, k, ignoreSelf, groundTruth, 0.7)
+func searchLSHEnsemblePrecision70(ctx context.Context, store IndexStore, lsh *lshensemble.LshEnsemble, tb TokenTable, query RawTokenSet, k int, ignoreSelf bool, groundTruth []searchResult) ([]searchResult, experimentResult, error) {
+	return searchLSHEnsemblePrecision(ctx, store, lsh, tb, query, k, ignoreSelf, groundTruth, 0.7)
 }
 
-func searchLSHEnsemblePrecision60(db *sql.DB, setTable string, lsh *lshensemble.LshEnsemble, tb tokenTable, query rawTokenSet, k int, ignoreSelf bool, groundTruth []searchResult) ([]searchResult, experimentResult) {
-	return searchLSHEnsemblePrecision(db, setTable, lsh, tb, query, k, ignoreSelf, groundTruth, 0.6)
+func searchLSHEnsemblePrecision60(ctx context.Context, store IndexStore, lsh *lshensemble.LshEnsemble, tb TokenTable, query RawTokenSet, k int, ignoreSelf bool, groundTruth []searchResult) ([]searchResult, experimentResult, error) {
+	return searchLSHEnsemblePrecision(ctx, store, lsh, tb, query, k, ignoreSelf, groundTruth, 0.6)
 }
 
-func searchLSHEnsemblePrecision(db *sql.DB, setTable string, lsh *lshensemble.LshEnsemble, tb tokenTable, query rawTokenSet, k int, ignoreSelf bool, groundTruth []searchResult, minPrecision float64) ([]searchResult, experimentResult) {
+func searchLSHEnsemblePrecision(ctx context.Context, store IndexStore, lsh *lshensemble.LshEnsemble, tb TokenTable, query RawTokenSet, k int, ignoreSelf bool, groundTruth []searchResult, minPrecision float64) ([]searchResult, experimentResult, error) {
 	var expResult experimentResult
 	ac := newActionCollecter(len(query.RawTokens))
 
 	start := time.Now()
-	tokens, querySig := tb.processAndMinhashSignature(query)
+	tokens, querySig, err := tb.processAndMinhashSignature(query)
+	if err != nil {
+		return nil, expResult, err
+	}
 	expResult.PreprocDuration = int(time.Now().Sub(start) / time.Millisecond)
 	start = time.Now()
 
-	ac.start()
-	var ignores map[int64]bool
-	if ignoreSelf {
-		ignores = map[int64]bool{query.ID: true}
-	} else {
-		ignores = make(map[int64]bool)
+	ignores, err := newIgnores(store, query, ignoreSelf)
+	if err != nil {
+		return nil, expResult, err
 	}
+	ac.start()
 	h := &searchResultHeap{}
 	for _, threshold := range thresholds {
 		// Get candidate sets from LSH
@@ -170,13 +188,25 @@ func searchLSHEnsemblePrecision(db *sql.DB, setTable string, lsh *lshensemble.Ls
 			}
 			ignores[ID] = true
 			// Compute the exact overlap
-			s := SetTokens(db, setTable, ID)
+			s, err := readSetTokens(ctx, store, ID)
+			if ctx.Err() != nil {
+				// Stop with the results found so far
+				expResult.Incomplete = true
+				break
+			}
+			if err != nil {
+				ac.done()
+				return nil, expResult, err
+			}
 			expResult.NumSetRead++
 			expResult.MaxSetSizeRead = max(expResult.MaxSetSizeRead, len(s))
 			o := overlap(s, tokens)
 			pushCandidate(h, k, ID, o)
 			ac.addReadSet(len(s), o)
 		}
+		if expResult.Incomplete {
+			break
+		}
 		p := precision(orderedResults(copyHeap(h)), groundTruth)
 		if p >= minPrecision {
 			break
@@ -194,7 +224,7 @@ func searchLSHEnsemblePrecision(db *sql.DB, setTable string, lsh *lshensemble.Ls
 	expResult.IgnoreSize = len(ignores)
 	expResult.QueryNumToken = len(tokens)
 	expResult.Actions = ac.collect()
-	return results, expResult
+	return results, expResult, nil
 }
 
 func precision(results, groundTruth []searchResult) float64 {
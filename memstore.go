@@ -0,0 +1,322 @@
+package joise
+
+import (
+	"database/sql"
+	"encoding/binary"
+	"fmt"
+	"hash/fnv"
+	"math"
+	"sort"
+	"sync"
+
+	"github.com/lib/pq"
+)
+
+// MemStore is an IndexStore that keeps all posting lists and sets in memory.
+// The slices returned by its read methods are shared with the store and
+// must not be modified.
+type MemStore struct {
+	lock         sync.RWMutex
+	opts         storeOptions
+	tokens       map[int64]TokenEntry
+	rawTokens    map[string]int64
+	lists        map[int64][]ListEntry
+	encodedLists map[int64][]byte // the posting lists if compressed
+	sets         map[int64][]int64
+	encodedSets  map[int64][]byte // the sets if compressed
+	deleted      map[int64]bool
+	maxGroupID   int64
+	maxToken     int64
+}
+
+// NewMemStore creates an empty in-memory index store. With
+// WithCompressedLists or WithCompressedSets, the posting lists or the sets
+// are kept compressed and decoded on every read.
+func NewMemStore(opts ...StoreOption) *MemStore {
+	return &MemStore{
+		opts:         newStoreOptions(opts),
+		tokens:       make(map[int64]TokenEntry),
+		rawTokens:    make(map[string]int64),
+		lists:        make(map[int64][]ListEntry),
+		encodedLists: make(map[int64][]byte),
+		sets:         make(map[int64][]int64),
+		encodedSets:  make(map[int64][]byte),
+		deleted:      make(map[int64]bool),
+		maxToken:     -1,
+	}
+}
+
+// AddList adds a token and its posting list, which must be sorted by set ID.
+func (s *MemStore) AddList(entry TokenEntry, list []ListEntry) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.addList(entry, list)
+}
+
+func (s *MemStore) addList(entry TokenEntry, list []ListEntry) {
+	s.tokens[entry.Token] = entry
+	s.rawTokens[string(entry.RawToken)] = entry.Token
+	if s.opts.compressLists {
+		s.encodedLists[entry.Token] = appendEncodedList(nil, list)
+	} else {
+		s.lists[entry.Token] = list
+	}
+	if entry.GroupID > s.maxGroupID {
+		s.maxGroupID = entry.GroupID
+	}
+	if entry.Token > s.maxToken {
+		s.maxToken = entry.Token
+	}
+}
+
+// AddSet adds a set, its tokens must be sorted in increasing order.
+func (s *MemStore) AddSet(setID int64, tokens []int64) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.addSet(setID, tokens)
+}
+
+func (s *MemStore) addSet(setID int64, tokens []int64) {
+	if s.opts.compressSets {
+		s.encodedSets[setID] = appendEncodedSet(nil, tokens)
+	} else {
+		s.sets[setID] = tokens
+	}
+}
+
+func (s *MemStore) rawTokenEntries(rawTokens [][]byte) ([]TokenEntry, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	entries := make([]TokenEntry, 0, len(rawTokens))
+	for _, rawToken := range rawTokens {
+		if token, exists := s.rawTokens[string(rawToken)]; exists {
+			entries = append(entries, s.tokens[token])
+		}
+	}
+	return entries, nil
+}
+
+func (s *MemStore) nextToken() (int64, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.maxToken + 1, nil
+}
+
+func (s *MemStore) deleteSets(setIDs []int64) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, setID := range setIDs {
+		s.deleted[setID] = true
+	}
+	return nil
+}
+
+func (s *MemStore) applyUpdate(u *indexUpdate) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for i, entry := range u.tokens {
+		s.addList(entry, u.lists[i])
+	}
+	for _, token := range u.deletedTokens {
+		delete(s.rawTokens, string(s.tokens[token].RawToken))
+		delete(s.tokens, token)
+		delete(s.lists, token)
+		delete(s.encodedLists, token)
+	}
+	for i, setID := range u.setIDs {
+		s.addSet(setID, u.sets[i])
+	}
+	for _, setID := range u.deletedSets {
+		delete(s.sets, setID)
+		delete(s.encodedSets, setID)
+		delete(s.deleted, setID)
+	}
+	return nil
+}
+
+// LoadMemStore reads all posting lists and sets from the Postgres tables
+// into a new MemStore created with the options.
+func LoadMemStore(db *sql.DB, listTable, setTable string, opts ...StoreOption) (*MemStore, error) {
+	s := NewMemStore(opts...)
+	rows, err := db.Query(fmt.Sprintf(`
+		SELECT token, raw_token, frequency, duplicate_group_id,
+		set_ids, set_sizes, match_positions FROM %s;`, pq.QuoteIdentifier(listTable)))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var entry TokenEntry
+		var setIDs, sizes, matchPositions []int64
+		if err := rows.Scan(&entry.Token, &entry.RawToken, &entry.Frequency, &entry.GroupID,
+			pq.Array(&setIDs), pq.Array(&sizes), pq.Array(&matchPositions)); err != nil {
+			return nil, err
+		}
+		list := make([]ListEntry, len(setIDs))
+		for i := range list {
+			list[i] = ListEntry{
+				ID:            setIDs[i],
+				Size:          int(sizes[i]),
+				MatchPosition: int(matchPositions[i]),
+			}
+		}
+		s.AddList(entry, list)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	setRows, err := db.Query(fmt.Sprintf(`
+		SELECT id, tokens FROM %s;`, pq.QuoteIdentifier(setTable)))
+	if err != nil {
+		return nil, err
+	}
+	defer setRows.Close()
+	for setRows.Next() {
+		var id int64
+		var tokens []int64
+		if err := setRows.Scan(&id, pq.Array(&tokens)); err != nil {
+			return nil, err
+		}
+		s.AddSet(id, tokens)
+	}
+	return s, setRows.Err()
+}
+
+// InvertedList returns the posting list of a token.
+func (s *MemStore) InvertedList(token int64) ([]ListEntry, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.list(token)
+}
+
+// Returns the posting list of a token, decoding it if compressed
+func (s *MemStore) list(token int64) ([]ListEntry, error) {
+	if s.opts.compressLists {
+		b, exists := s.encodedLists[token]
+		if !exists {
+			return nil, fmt.Errorf("%w: token %d", ErrListNotFound, token)
+		}
+		return decodeList(b)
+	}
+	list, exists := s.lists[token]
+	if !exists {
+		return nil, fmt.Errorf("%w: token %d", ErrListNotFound, token)
+	}
+	return list, nil
+}
+
+// SetTokens returns all tokens of a set.
+func (s *MemStore) SetTokens(setID int64) ([]int64, error) {
+	return s.SetTokensSubset(setID, 0, math.MaxInt32)
+}
+
+// SetTokensSuffix returns the tokens of a set starting from startPos.
+func (s *MemStore) SetTokensSuffix(setID int64, startPos int) ([]int64, error) {
+	return s.SetTokensSubset(setID, startPos, math.MaxInt32)
+}
+
+// SetTokensSubset returns the tokens of a set from startPos to endPos.
+func (s *MemStore) SetTokensSubset(setID int64, startPos, endPos int) ([]int64, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.set(setID, startPos, endPos)
+}
+
+// Returns the tokens of a set from startPos to endPos, decoding only the
+// blocks containing them if compressed
+func (s *MemStore) set(setID int64, startPos, endPos int) ([]int64, error) {
+	if s.opts.compressSets {
+		b, exists := s.encodedSets[setID]
+		if !exists {
+			return nil, fmt.Errorf("%w: set %d", ErrSetNotFound, setID)
+		}
+		return decodeSetTokens(b, startPos, endPos)
+	}
+	tokens, exists := s.sets[setID]
+	if !exists {
+		return nil, fmt.Errorf("%w: set %d", ErrSetNotFound, setID)
+	}
+	endPos = min(endPos, len(tokens))
+	return tokens[min(startPos, endPos):endPos], nil
+}
+
+// TokenEntries returns the metadata of the given tokens.
+func (s *MemStore) TokenEntries(tokens []int64) ([]TokenEntry, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	entries := make([]TokenEntry, 0, len(tokens))
+	for _, token := range tokens {
+		if entry, exists := s.tokens[token]; exists {
+			entries = append(entries, entry)
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Token < entries[j].Token
+	})
+	return entries, nil
+}
+
+// ScanTokenEntries calls fn with the metadata of every token.
+func (s *MemStore) ScanTokenEntries(fn func(entry TokenEntry) error) error {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	for _, entry := range s.tokens {
+		if err := fn(entry); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// NumTokens returns the number of tokens.
+func (s *MemStore) NumTokens() (int, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return len(s.tokens), nil
+}
+
+// MaxGroupID returns the maximum duplicate group id.
+func (s *MemStore) MaxGroupID() (int64, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.maxGroupID, nil
+}
+
+// DeletedSets returns the sets that are deleted but not yet compacted.
+func (s *MemStore) DeletedSets() ([]int64, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	setIDs := make([]int64, 0, len(s.deleted))
+	for setID := range s.deleted {
+		setIDs = append(setIDs, setID)
+	}
+	return setIDs, nil
+}
+
+// Sums the hash values of the metadata and the raw token of every token, so
+// the checksum does not depend on the order of the tokens
+func (s *MemStore) tokenChecksum() (uint64, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	var sum uint64
+	var buf [24]byte
+	h := fnv.New64a()
+	for _, e := range s.tokens {
+		binary.LittleEndian.PutUint64(buf[0:], uint64(e.Token))
+		binary.LittleEndian.PutUint64(buf[8:], uint64(e.Frequency))
+		binary.LittleEndian.PutUint64(buf[16:], uint64(e.GroupID))
+		h.Reset()
+		h.Write(buf[:])
+		h.Write(e.RawToken)
+		sum += h.Sum64()
+	}
+	return sum, nil
+}
+
+// NumSets returns the number of sets, excluding the deleted sets that are
+// not yet compacted.
+func (s *MemStore) NumSets() int {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return len(s.sets) + len(s.encodedSets) - len(s.deleted)
+}
@@ -0,0 +1,245 @@
+package joise
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// memStoreWriter adds the index created by BuildIndex to a MemStore
+type memStoreWriter struct {
+	store *MemStore
+}
+
+func (w memStoreWriter) AddList(entry TokenEntry, list []ListEntry) error {
+	// BuildIndex reuses the list for the next token
+	w.store.AddList(entry, append([]ListEntry(nil), list...))
+	return nil
+}
+
+func (w memStoreWriter) AddSet(setID int64, tokens []int64) error {
+	w.store.AddSet(setID, tokens)
+	return nil
+}
+
+func (w memStoreWriter) Close() error {
+	return nil
+}
+
+// Returns random sets of raw tokens with a skewed token frequency
+// distribution, so there are long posting lists and duplicate groups.
+func randomRawSets(r *rand.Rand, numSets, vocabulary int) map[int64][]string {
+	sets := make(map[int64][]string, numSets)
+	for id := 0; id < numSets; id++ {
+		n := 1 + r.Intn(60)
+		tokens := make([]string, n)
+		for i := range tokens {
+			tokens[i] = fmt.Sprintf("t%d", int(float64(vocabulary)*r.Float64()*r.Float64()))
+		}
+		sets[int64(id)] = tokens
+	}
+	return sets
+}
+
+// Builds a MemStore index of the raw sets with BuildIndex
+func buildTestMemStore(t *testing.T, sets map[int64][]string, opts ...StoreOption) *MemStore {
+	t.Helper()
+	var input strings.Builder
+	for id, tokens := range sets {
+		fmt.Fprintf(&input, "%d %s\n", id, strings.Join(tokens, " "))
+	}
+	store := NewMemStore(opts...)
+	buildOpts := DefaultBuildOptions()
+	buildOpts.TempDir = t.TempDir()
+	if err := BuildIndex(strings.NewReader(input.String()), memStoreWriter{store}, buildOpts); err != nil {
+		t.Fatal(err)
+	}
+	return store
+}
+
+// Returns the distinct raw tokens of a set
+func distinctRawTokens(tokens []string) [][]byte {
+	seen := make(map[string]bool)
+	var rawTokens [][]byte
+	for _, token := range tokens {
+		if !seen[token] {
+			seen[token] = true
+			rawTokens = append(rawTokens, []byte(token))
+		}
+	}
+	return rawTokens
+}
+
+// Computes the overlap of the query with every set by brute force
+func bruteForceOverlaps(sets map[int64][]string, query [][]byte) map[int64]int {
+	queryTokens := make(map[string]bool)
+	for _, token := range query {
+		queryTokens[string(token)] = true
+	}
+	overlaps := make(map[int64]int)
+	for id, tokens := range sets {
+		for _, token := range distinctRawTokens(tokens) {
+			if queryTokens[string(token)] {
+				overlaps[id]++
+			}
+		}
+	}
+	return overlaps
+}
+
+// Checks the top-k results against the brute-force overlaps: the overlaps
+// must be the k highest ones in decreasing order, and be the exact overlaps
+// of the result sets. The set IDs are not compared as sets with equal
+// overlaps are returned in any order.
+func checkTopK(t *testing.T, name string, results []searchResult, overlaps map[int64]int, k int) {
+	t.Helper()
+	var want []int
+	for _, overlap := range overlaps {
+		want = append(want, overlap)
+	}
+	sort.Sort(sort.Reverse(sort.IntSlice(want)))
+	if len(want) > k {
+		want = want[:k]
+	}
+	if len(results) != len(want) {
+		t.Fatalf("%s: got %d results, want %d", name, len(results), len(want))
+	}
+	for i, r := range results {
+		if r.Overlap != want[i] || overlaps[r.ID] != r.Overlap {
+			t.Fatalf("%s: result %d is set %d with overlap %d, want overlap %d (exact %d)",
+				name, i, r.ID, r.Overlap, want[i], overlaps[r.ID])
+		}
+	}
+}
+
+// Returns a query made of the raw tokens of a random set and a raw token
+// not in the index
+func randomQuery(r *rand.Rand, sets map[int64][]string) RawTokenSet {
+	ids := make([]int64, 0, len(sets))
+	for id := range sets {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	query := RawTokenSet{RawTokens: distinctRawTokens(sets[ids[r.Intn(len(ids))]])}
+	query.RawTokens = append(query.RawTokens, []byte("not-indexed"))
+	return query
+}
+
+// Checks the results of MergeList-D, ProbeSet-D and JOSIE against the
+// brute-force overlaps for random queries
+func checkSearchAlgorithms(t *testing.T, r *rand.Rand, store IndexStore, tb TokenTable, sets map[int64][]string) {
+	t.Helper()
+	ctx := context.Background()
+	for q := 0; q < 20; q++ {
+		query := randomQuery(r, sets)
+		overlaps := bruteForceOverlaps(sets, query.RawTokens)
+		for _, k := range []int{1, 5, 20} {
+			results, _, err := searchMergeDistinctList(ctx, store, tb, query, k, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			checkTopK(t, "MergeList-D", results, overlaps, k)
+			results, _, err = searchProbeSetOptimized(ctx, store, tb, query, k, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			checkTopK(t, "ProbeSet-D", results, overlaps, k)
+			results, _, err = searchMergeProbeCostModelGreedy(ctx, store, tb,
+				DefaultCostParameters(), query, k, Budget{}, 1, 1, false, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			checkTopK(t, "JOSIE", results, overlaps, k)
+		}
+	}
+}
+
+func TestSearchAlgorithms(t *testing.T) {
+	defer func(size int) { batchSize = size }(batchSize)
+	// Small batches so JOSIE runs the cost model many times
+	batchSize = 3
+	r := rand.New(rand.NewSource(1))
+	for _, opts := range [][]StoreOption{nil, {WithCompressedLists(), WithCompressedSets()}} {
+		sets := randomRawSets(r, 300, 400)
+		store := buildTestMemStore(t, sets, opts...)
+		tb, err := CreateTokenTableMem(store, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkSearchAlgorithms(t, r, store, tb, sets)
+	}
+}
+
+func TestSearchDuplicateQueryTokens(t *testing.T) {
+	r := rand.New(rand.NewSource(14))
+	sets := randomRawSets(r, 300, 400)
+	store := buildTestMemStore(t, sets)
+	tb, err := CreateTokenTableMem(store, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	for q := 0; q < 20; q++ {
+		query := randomQuery(r, sets)
+		// Repeat some raw tokens of the query, which are counted once
+		for _, rawToken := range query.RawTokens[:len(query.RawTokens)/2+1] {
+			query.RawTokens = append(query.RawTokens, rawToken)
+		}
+		r.Shuffle(len(query.RawTokens), func(i, j int) {
+			query.RawTokens[i], query.RawTokens[j] = query.RawTokens[j], query.RawTokens[i]
+		})
+		overlaps := bruteForceOverlaps(sets, query.RawTokens)
+		for _, k := range []int{1, 5, 20} {
+			results, _, err := searchMergeDistinctList(ctx, store, tb, query, k, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			checkTopK(t, "MergeList-D", results, overlaps, k)
+			results, _, err = searchProbeSetOptimized(ctx, store, tb, query, k, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			checkTopK(t, "ProbeSet-D", results, overlaps, k)
+			results, _, err = searchMergeProbeCostModelGreedy(ctx, store, tb,
+				DefaultCostParameters(), query, k, Budget{}, 1, 1, false, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			checkTopK(t, "JOSIE", results, overlaps, k)
+		}
+	}
+}
+
+func TestMemStoreSetTokens(t *testing.T) {
+	tokens := make([]int64, 300)
+	for i := range tokens {
+		tokens[i] = int64(3 * i)
+	}
+	for _, store := range []*MemStore{NewMemStore(), NewMemStore(WithCompressedSets())} {
+		store.AddSet(1, tokens)
+		got, err := store.SetTokens(1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fmt.Sprint(got) != fmt.Sprint(tokens) {
+			t.Fatalf("SetTokens: got %v", got)
+		}
+		for _, pos := range [][2]int{{0, 1}, {127, 129}, {128, 300}, {200, 1000}, {300, 300}} {
+			got, err := store.SetTokensSubset(1, pos[0], pos[1])
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := tokens[pos[0]:min(pos[1], len(tokens))]
+			if fmt.Sprint(got) != fmt.Sprint(want) {
+				t.Fatalf("SetTokensSubset(%d, %d): got %v, want %v", pos[0], pos[1], got, want)
+			}
+		}
+		if _, err := store.SetTokens(2); !errors.Is(err, ErrSetNotFound) {
+			t.Fatalf("SetTokens of a missing set: got error %v", err)
+		}
+	}
+}
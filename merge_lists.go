@@ -1,29 +1,47 @@
 package joise
 
 import (
-	"database/sql"
+	"context"
 	"time"
 )
 
 // The baseline MergeList algorithm without distinct posting list optimization.
-func searchMergeList(db *sql.DB, listTable, setTable string, tb tokenTable, query rawTokenSet, k int, ignoreSelf bool) ([]searchResult, experimentResult) {
+// If ctx is done before all lists are read, the sets with the highest
+// partial overlaps are returned with Incomplete set in the experiment result.
+func searchMergeList(ctx context.Context, store IndexStore, tb TokenTable, query RawTokenSet, k int, ignoreSelf bool) ([]searchResult, experimentResult, error) {
 	var expResult experimentResult
 
 	start := time.Now()
-	tokens, _, _ := tb.process(query)
+	tokens, _, _, err := tb.process(query)
+	if err != nil {
+		return nil, expResult, err
+	}
 	expResult.PreprocDuration = int(time.Now().Sub(start) / time.Millisecond)
 	ac := newActionCollecter(len(tokens))
 	start = time.Now()
 
+	ignores, err := newIgnores(store, query, ignoreSelf)
+	if err != nil {
+		return nil, expResult, err
+	}
 	ac.start()
 	counter := make(map[int64]int)
 	for _, token := range tokens {
-		entries := InvertedList(db, listTable, token)
+		entries, err := readInvertedList(ctx, store, token)
+		if ctx.Err() != nil {
+			// Stop with the partial overlaps of the lists read so far
+			expResult.Incomplete = true
+			break
+		}
+		if err != nil {
+			ac.done()
+			return nil, expResult, err
+		}
 		expResult.NumListRead++
 		expResult.MaxListSizeRead = max(expResult.MaxListSizeRead, len(entries))
 		ac.addReadList(len(entries))
 		for _, entry := range entries {
-			if ignoreSelf && entry.ID == query.ID {
+			if ignores[entry.ID] {
 				continue
 			}
 			if _, seen := counter[entry.ID]; seen {
@@ -39,6 +57,11 @@ func searchMergeList(db *sql.DB, listTable, setTable string, tb tokenTable, quer
 		pushCandidate(h, k, id, overlap)
 	}
 	results := orderedResults(h)
+	if expResult.Incomplete {
+		for i := range results {
+			results[i].Partial = true
+		}
+	}
 	ac.done()
 
 	expResult.Duration = int(time.Now().Sub(start) / time.Millisecond)
@@ -48,19 +71,28 @@ func searchMergeList(db *sql.DB, listTable, setTable string, tb tokenTable, quer
 	expResult.QuerySize = len(query.RawTokens)
 	expResult.NumResult = len(results)
 	expResult.QueryNumToken = len(tokens)
-	return results, expResult
+	return results, expResult, nil
 }
 
 // The baseline MergeList-D algorithm with distinct posting list optimization.
-func searchMergeDistinctList(db *sql.DB, listTable, setTable string, tb tokenTable, query rawTokenSet, k int, ignoreSelf bool) ([]searchResult, experimentResult) {
+// If ctx is done before all lists are read, the sets with the highest
+// partial overlaps are returned with Incomplete set in the experiment result.
+func searchMergeDistinctList(ctx context.Context, store IndexStore, tb TokenTable, query RawTokenSet, k int, ignoreSelf bool) ([]searchResult, experimentResult, error) {
 	var expResult experimentResult
 
 	start := time.Now()
-	tokens, _, gids := tb.process(query)
+	tokens, _, gids, err := tb.process(query)
+	if err != nil {
+		return nil, expResult, err
+	}
 	expResult.PreprocDuration = int(time.Now().Sub(start) / time.Millisecond)
 	ac := newActionCollecter(len(tokens))
 	start = time.Now()
 
+	ignores, err := newIgnores(store, query, ignoreSelf)
+	if err != nil {
+		return nil, expResult, err
+	}
 	ac.start()
 	counter := make(map[int64]int)
 	var numSkipped int
@@ -70,12 +102,21 @@ func searchMergeDistinctList(db *sql.DB, listTable, setTable string, tb tokenTab
 		token := tokens[i]
 		skippedOverlap := numSkipped
 
-		entries := InvertedList(db, listTable, token)
+		entries, err := readInvertedList(ctx, store, token)
+		if ctx.Err() != nil {
+			// Stop with the partial overlaps of the lists read so far
+			expResult.Incomplete = true
+			break
+		}
+		if err != nil {
+			ac.done()
+			return nil, expResult, err
+		}
 		expResult.NumListRead++
 		expResult.MaxListSizeRead = max(expResult.MaxListSizeRead, len(entries))
 		ac.addReadList(len(entries))
 		for _, entry := range entries {
-			if ignoreSelf && entry.ID == query.ID {
+			if ignores[entry.ID] {
 				continue
 			}
 			if _, seen := counter[entry.ID]; seen {
@@ -91,6 +132,11 @@ func searchMergeDistinctList(db *sql.DB, listTable, setTable string, tb tokenTab
 		pushCandidate(h, k, id, overlap)
 	}
 	results := orderedResults(h)
+	if expResult.Incomplete {
+		for i := range results {
+			results[i].Partial = true
+		}
+	}
 	ac.done()
 
 	expResult.Duration = int(time.Now().Sub(start) / time.Millisecond)
@@ -100,5 +146,5 @@ func searchMergeDistinctList(db *sql.DB, listTable, setTable string, tb tokenTab
 	expResult.QuerySize = len(query.RawTokens)
 	expResult.NumResult = len(results)
 	expResult.QueryNumToken = len(tokens)
-	return results, expResult
+	return results, expResult, nil
 }
@@ -0,0 +1,14 @@
+//go:build !unix
+
+package joise
+
+import "os"
+
+// mmapFile reads the whole file into memory on platforms without mmap.
+func mmapFile(filename string) ([]byte, error) {
+	return os.ReadFile(filename)
+}
+
+func munmapFile(data []byte) error {
+	return nil
+}
@@ -0,0 +1,183 @@
+package joise
+
+import (
+	"database/sql"
+	"fmt"
+
+	"github.com/lib/pq"
+)
+
+// PostgresIndexWriter is an IndexWriter that loads the posting lists and
+// sets into Postgres tables in the layout read by PostgresStore.
+// All rows are copied in a single transaction, which is committed with the
+// indexes on the token and set ID columns when the writer is closed.
+type PostgresIndexWriter struct {
+	opts        storeOptions
+	buf         []byte
+	tx          *sql.Tx
+	listTable   string
+	setTable    string
+	listStmt    *sql.Stmt
+	setStmt     *sql.Stmt
+	nonSingular []bool // whether a token has frequency greater than 1
+}
+
+// NewPostgresIndexWriter creates the posting list table and the set table,
+// which must not exist yet, and returns a writer for them. With
+// WithCompressedLists, the posting list table has an additional
+// encoded_list column with the compressed posting lists, and with
+// WithCompressedSets, the set table has an additional encoded_tokens column
+// with the compressed sets.
+func NewPostgresIndexWriter(db *sql.DB, listTable, setTable string, opts ...StoreOption) (*PostgresIndexWriter, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	w := &PostgresIndexWriter{
+		opts:      newStoreOptions(opts),
+		tx:        tx,
+		listTable: listTable,
+		setTable:  setTable,
+	}
+	if err := w.init(); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	return w, nil
+}
+
+func (w *PostgresIndexWriter) init() error {
+	if _, err := w.tx.Exec(fmt.Sprintf(`
+		CREATE TABLE %s (token integer, frequency integer, duplicate_group_id integer,
+		raw_token bytea, set_ids integer[], set_sizes integer[], match_positions integer[]);`,
+		pq.QuoteIdentifier(w.listTable))); err != nil {
+		return err
+	}
+	columns := []string{"token", "frequency", "duplicate_group_id", "raw_token",
+		"set_ids", "set_sizes", "match_positions"}
+	if w.opts.compressLists {
+		if _, err := w.tx.Exec(fmt.Sprintf(`
+			ALTER TABLE %s ADD COLUMN encoded_list bytea;`,
+			pq.QuoteIdentifier(w.listTable))); err != nil {
+			return err
+		}
+		columns = append(columns, "encoded_list")
+	}
+	if _, err := w.tx.Exec(fmt.Sprintf(`
+		CREATE TABLE %s (id integer, size integer, num_non_singular_token integer,
+		tokens integer[]);`, pq.QuoteIdentifier(w.setTable))); err != nil {
+		return err
+	}
+	if w.opts.compressSets {
+		// Uncompressed out-of-line storage lets Postgres read byte ranges of
+		// the encoded sets without reading the whole values
+		if _, err := w.tx.Exec(fmt.Sprintf(`
+			ALTER TABLE %s ADD COLUMN encoded_tokens bytea,
+			ALTER COLUMN encoded_tokens SET STORAGE EXTERNAL;`,
+			pq.QuoteIdentifier(w.setTable))); err != nil {
+			return err
+		}
+	}
+	var err error
+	w.listStmt, err = w.tx.Prepare(pq.CopyIn(w.listTable, columns...))
+	return err
+}
+
+// AddList adds a token and its posting list. All posting lists must be
+// added before the sets.
+func (w *PostgresIndexWriter) AddList(entry TokenEntry, list []ListEntry) error {
+	if w.listStmt == nil {
+		return fmt.Errorf("posting list of token %d added after sets", entry.Token)
+	}
+	setIDs := make([]int64, len(list))
+	sizes := make([]int64, len(list))
+	matchPositions := make([]int64, len(list))
+	for i, e := range list {
+		setIDs[i] = e.ID
+		sizes[i] = int64(e.Size)
+		matchPositions[i] = int64(e.MatchPosition)
+	}
+	for int64(len(w.nonSingular)) <= entry.Token {
+		w.nonSingular = append(w.nonSingular, false)
+	}
+	w.nonSingular[entry.Token] = entry.Frequency > 1
+	values := []interface{}{entry.Token, entry.Frequency, entry.GroupID, entry.RawToken,
+		pq.Array(setIDs), pq.Array(sizes), pq.Array(matchPositions)}
+	if w.opts.compressLists {
+		w.buf = appendEncodedList(w.buf[:0], list)
+		values = append(values, w.buf)
+	}
+	_, err := w.listStmt.Exec(values...)
+	return err
+}
+
+// Flush the buffered posting lists and start copying sets
+func (w *PostgresIndexWriter) startSets() error {
+	if _, err := w.listStmt.Exec(); err != nil {
+		return err
+	}
+	if err := w.listStmt.Close(); err != nil {
+		return err
+	}
+	w.listStmt = nil
+	columns := []string{"id", "size", "num_non_singular_token", "tokens"}
+	if w.opts.compressSets {
+		columns = append(columns, "encoded_tokens")
+	}
+	var err error
+	w.setStmt, err = w.tx.Prepare(pq.CopyIn(w.setTable, columns...))
+	return err
+}
+
+// AddSet adds a set, its tokens must be sorted in increasing order.
+func (w *PostgresIndexWriter) AddSet(setID int64, tokens []int64) error {
+	if w.setStmt == nil {
+		if err := w.startSets(); err != nil {
+			return err
+		}
+	}
+	var numNonSingular int
+	for _, token := range tokens {
+		if token < int64(len(w.nonSingular)) && w.nonSingular[token] {
+			numNonSingular++
+		}
+	}
+	values := []interface{}{setID, len(tokens), numNonSingular, pq.Array(tokens)}
+	if w.opts.compressSets {
+		w.buf = appendEncodedSet(w.buf[:0], tokens)
+		values = append(values, w.buf)
+	}
+	_, err := w.setStmt.Exec(values...)
+	return err
+}
+
+// Close finishes copying, creates the indexes and commits the transaction.
+// The transaction is rolled back if any step fails.
+func (w *PostgresIndexWriter) Close() error {
+	if err := w.finish(); err != nil {
+		w.tx.Rollback()
+		return err
+	}
+	return w.tx.Commit()
+}
+
+func (w *PostgresIndexWriter) finish() error {
+	if w.setStmt == nil {
+		if err := w.startSets(); err != nil {
+			return err
+		}
+	}
+	if _, err := w.setStmt.Exec(); err != nil {
+		return err
+	}
+	if err := w.setStmt.Close(); err != nil {
+		return err
+	}
+	if _, err := w.tx.Exec(fmt.Sprintf(`CREATE INDEX %s ON %s(id);`,
+		pq.QuoteIdentifier(w.setTable+"_id_idx"), pq.QuoteIdentifier(w.setTable))); err != nil {
+		return err
+	}
+	_, err := w.tx.Exec(fmt.Sprintf(`CREATE INDEX %s ON %s(token);`,
+		pq.QuoteIdentifier(w.listTable+"_token_idx"), pq.QuoteIdentifier(w.listTable)))
+	return err
+}
@@ -0,0 +1,183 @@
+package joise
+
+import (
+	"context"
+	"sync"
+)
+
+type prefetchedList struct {
+	entries []ListEntry
+	err     error
+}
+
+// listPrefetcher reads the distinct posting lists of a query in the order
+// the search algorithms merge them, with up to parallelism reads running
+// concurrently, so the next lists are read while the current one is merged.
+type listPrefetcher struct {
+	ctx         context.Context
+	cancel      context.CancelFunc
+	store       IndexStore
+	tokens      []int64
+	parallelism int
+	order       []int       // the query positions of the distinct lists
+	orderIndex  map[int]int // the index in order of a query position
+	started     int         // the number of lists whose reads are started
+	pending     map[int]chan prefetchedList
+	wg          sync.WaitGroup
+}
+
+// Creates a prefetcher of the distinct posting lists of the query tokens,
+// the lists are read one at a time on get if parallelism is at most 1.
+func newListPrefetcher(ctx context.Context, store IndexStore, tokens, gids []int64,
+	parallelism int) *listPrefetcher {
+	ctx, cancel := context.WithCancel(ctx)
+	p := &listPrefetcher{
+		ctx:         ctx,
+		cancel:      cancel,
+		store:       store,
+		tokens:      tokens,
+		parallelism: parallelism,
+	}
+	if parallelism > 1 {
+		p.orderIndex = make(map[int]int)
+		p.pending = make(map[int]chan prefetchedList)
+		for i := 0; i < len(tokens); i, _ = nextDistinctList(tokens, gids, i) {
+			p.orderIndex[i] = len(p.order)
+			p.order = append(p.order, i)
+		}
+	}
+	return p
+}
+
+// Returns the posting list of the token at the query position, and starts
+// reading the following lists up to the parallelism, within the window of
+// distinct lists starting at the query position that may be read.
+func (p *listPrefetcher) get(queryPosition, window int) ([]ListEntry, error) {
+	if p.parallelism <= 1 {
+		return readInvertedList(p.ctx, p.store, p.tokens[queryPosition])
+	}
+	for p.started < len(p.order) &&
+		p.started < p.orderIndex[queryPosition]+min(p.parallelism, window) {
+		p.start(p.order[p.started])
+		p.started++
+	}
+	c, exists := p.pending[queryPosition]
+	if !exists {
+		// Not a distinct list, or a list already returned
+		return readInvertedList(p.ctx, p.store, p.tokens[queryPosition])
+	}
+	delete(p.pending, queryPosition)
+	l := <-c
+	return l.entries, l.err
+}
+
+func (p *listPrefetcher) start(queryPosition int) {
+	c := make(chan prefetchedList, 1)
+	p.pending[queryPosition] = c
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		entries, err := readInvertedList(p.ctx, p.store, p.tokens[queryPosition])
+		c <- prefetchedList{entries, err}
+	}()
+}
+
+// Cancels the reads of the lists not used, and waits for them to return.
+func (p *listPrefetcher) stop() {
+	p.cancel()
+	p.wg.Wait()
+}
+
+type prefetchedSet struct {
+	tokens []int64
+	err    error
+}
+
+// setPrefetcher reads the suffixes of candidate sets with up to parallelism
+// reads running concurrently, so the next qualified candidates are read
+// while the current one is waited for.
+type setPrefetcher struct {
+	ctx         context.Context
+	cancel      context.CancelFunc
+	store       IndexStore
+	parallelism int
+	started     []*candidateEntry // the candidates whose reads are pending
+	pending     map[*candidateEntry]chan prefetchedSet
+	wg          sync.WaitGroup
+}
+
+// Creates a prefetcher of candidate sets, the sets are read one at a time
+// on get if parallelism is at most 1.
+func newSetPrefetcher(ctx context.Context, store IndexStore,
+	parallelism int) *setPrefetcher {
+	ctx, cancel := context.WithCancel(ctx)
+	return &setPrefetcher{
+		ctx:         ctx,
+		cancel:      cancel,
+		store:       store,
+		parallelism: parallelism,
+		pending:     make(map[*candidateEntry]chan prefetchedSet),
+	}
+}
+
+// Reports whether the read of the candidate is started and not yet returned.
+func (p *setPrefetcher) isPending(ce *candidateEntry) bool {
+	_, exists := p.pending[ce]
+	return exists
+}
+
+// Returns the number and the total estimated cost of the pending reads.
+func (p *setPrefetcher) pendingReads() (int, float64) {
+	var cost float64
+	for _, ce := range p.started {
+		cost += ce.estimatedCost
+	}
+	return len(p.started), cost
+}
+
+// Starts reading the suffix of the candidate after its latest match
+// position, returns false if parallelism reads are already pending.
+func (p *setPrefetcher) tryStart(ce *candidateEntry) bool {
+	if p.parallelism <= 1 || len(p.pending) >= p.parallelism {
+		return false
+	}
+	c := make(chan prefetchedSet, 1)
+	p.pending[ce] = c
+	p.started = append(p.started, ce)
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		s, err := readSetTokensSuffix(p.ctx, p.store, ce.id, ce.latestMatchPosition+1)
+		c <- prefetchedSet{s, err}
+	}()
+	return true
+}
+
+// Returns the suffix of the candidate after its latest match position,
+// waiting for the pending read or reading it now if not started.
+func (p *setPrefetcher) get(ce *candidateEntry) ([]int64, error) {
+	c, exists := p.pending[ce]
+	if !exists {
+		return readSetTokensSuffix(p.ctx, p.store, ce.id, ce.latestMatchPosition+1)
+	}
+	delete(p.pending, ce)
+	for j := range p.started {
+		if p.started[j] == ce {
+			p.started = append(p.started[:j], p.started[j+1:]...)
+			break
+		}
+	}
+	s := <-c
+	return s.tokens, s.err
+}
+
+// Returns the candidates whose reads are pending, in the order started.
+func (p *setPrefetcher) pendingCandidates() []*candidateEntry {
+	return append([]*candidateEntry(nil), p.started...)
+}
+
+// Cancels the pending reads, and waits for them to return.
+func (p *setPrefetcher) stop() {
+	p.cancel()
+	p.wg.Wait()
+}
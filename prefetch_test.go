@@ -0,0 +1,136 @@
+package joise
+
+import (
+	"context"
+	"math/rand"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// slowListStore delays posting list reads, and records the maximum number of
+// concurrent reads
+type slowListStore struct {
+	IndexStore
+	delay         time.Duration
+	numReading    int32
+	maxNumReading int32
+}
+
+func (s *slowListStore) InvertedList(token int64) ([]ListEntry, error) {
+	n := atomic.AddInt32(&s.numReading, 1)
+	defer atomic.AddInt32(&s.numReading, -1)
+	for {
+		m := atomic.LoadInt32(&s.maxNumReading)
+		if n <= m || atomic.CompareAndSwapInt32(&s.maxNumReading, m, n) {
+			break
+		}
+	}
+	time.Sleep(s.delay)
+	return s.IndexStore.InvertedList(token)
+}
+
+func TestPrefetch(t *testing.T) {
+	defer func(size int) { batchSize = size }(batchSize)
+	batchSize = 3
+	r := rand.New(rand.NewSource(19))
+	sets := randomRawSets(r, 500, 400)
+	memStore := buildTestMemStore(t, sets)
+	tb, err := CreateTokenTableMem(memStore, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := &slowListStore{IndexStore: memStore, delay: 100 * time.Microsecond}
+	ctx := context.Background()
+	for q := 0; q < 20; q++ {
+		query := randomQuery(r, sets)
+		overlaps := bruteForceOverlaps(sets, query.RawTokens)
+		for _, prefetch := range []int{2, 4, 8} {
+			searcher := NewSearcher(store, tb, DefaultCostParameters(), WithPrefetch(prefetch))
+			for _, k := range []int{1, 5, 20} {
+				store.maxNumReading = 0
+				var results []searchResult
+				_, err := searcher.StreamTopK(ctx, query, k, func(result Result) error {
+					results = append(results, searchResult{ID: result.ID, Overlap: result.Overlap})
+					return nil
+				})
+				if err != nil {
+					t.Fatal(err)
+				}
+				checkTopK(t, "JOSIE", results, overlaps, k)
+				if store.maxNumReading > int32(prefetch) {
+					t.Fatalf("%d concurrent reads with prefetch %d", store.maxNumReading, prefetch)
+				}
+			}
+		}
+	}
+}
+
+// slowSetStore delays set reads, and records the maximum number of
+// concurrent reads
+type slowSetStore struct {
+	IndexStore
+	delay         time.Duration
+	numReading    int32
+	maxNumReading int32
+}
+
+func (s *slowSetStore) SetTokensSuffix(setID int64, startPos int) ([]int64, error) {
+	n := atomic.AddInt32(&s.numReading, 1)
+	defer atomic.AddInt32(&s.numReading, -1)
+	for {
+		m := atomic.LoadInt32(&s.maxNumReading)
+		if n <= m || atomic.CompareAndSwapInt32(&s.maxNumReading, m, n) {
+			break
+		}
+	}
+	time.Sleep(s.delay)
+	return s.IndexStore.SetTokensSuffix(setID, startPos)
+}
+
+func TestParallelProbes(t *testing.T) {
+	defer func(size int) { batchSize = size }(batchSize)
+	batchSize = 3
+	r := rand.New(rand.NewSource(20))
+	sets := randomRawSets(r, 500, 400)
+	memStore := buildTestMemStore(t, sets)
+	tb, err := CreateTokenTableMem(memStore, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := &slowSetStore{IndexStore: memStore, delay: 100 * time.Microsecond}
+	ctx := context.Background()
+	for q := 0; q < 20; q++ {
+		query := randomQuery(r, sets)
+		overlaps := bruteForceOverlaps(sets, query.RawTokens)
+		for _, probes := range []int{2, 4, 8} {
+			searcher := NewSearcher(store, tb, DefaultCostParameters(), WithParallelProbes(probes),
+				WithPrefetch(probes))
+			for _, k := range []int{1, 5, 20} {
+				store.maxNumReading = 0
+				var results []searchResult
+				_, err := searcher.StreamTopK(ctx, query, k, func(result Result) error {
+					results = append(results, searchResult{ID: result.ID, Overlap: result.Overlap})
+					return nil
+				})
+				if err != nil {
+					t.Fatal(err)
+				}
+				checkTopK(t, "JOSIE", results, overlaps, k)
+				if store.maxNumReading > int32(probes) {
+					t.Fatalf("%d concurrent reads with %d parallel probes", store.maxNumReading, probes)
+				}
+			}
+			// The budget limits the sets read with parallel probes
+			budgeted := NewSearcher(store, tb, DefaultCostParameters(), WithParallelProbes(probes),
+				WithBudget(Budget{MaxSetReads: 3}))
+			_, stats, err := budgeted.TopK(ctx, query, 10)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if stats.NumSetRead > 3 {
+				t.Fatalf("read %d sets with a budget of 3", stats.NumSetRead)
+			}
+		}
+	}
+}
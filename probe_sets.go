@@ -1,25 +1,28 @@
 package joise
 
 import (
-	"database/sql"
+	"context"
 	"time"
 )
 
 // the baseline ProbeSet algorithm that combines prefix filter and position filter
-func searchProbeSetSuffix(db *sql.DB, listTable, setTable string, tb tokenTable, query rawTokenSet, k int, ignoreSelf bool) ([]searchResult, experimentResult) {
+// If ctx is done before the search completes, the running top-k is returned
+// with Incomplete set in the experiment result.
+func searchProbeSetSuffix(ctx context.Context, store IndexStore, tb TokenTable, query RawTokenSet, k int, ignoreSelf bool) ([]searchResult, experimentResult, error) {
 	var expResult experimentResult
 	ac := newActionCollecter(len(query.RawTokens))
 
 	start := time.Now()
-	tokens, _, _ := tb.process(query)
+	tokens, _, _, err := tb.process(query)
+	if err != nil {
+		return nil, expResult, err
+	}
 	expResult.PreprocDuration = int(time.Now().Sub(start) / time.Millisecond)
 	start = time.Now()
 
-	var ignores map[int64]bool
-	if ignoreSelf {
-		ignores = map[int64]bool{query.ID: true}
-	} else {
-		ignores = make(map[int64]bool)
+	ignores, err := newIgnores(store, query, ignoreSelf)
+	if err != nil {
+		return nil, expResult, err
 	}
 	h := &searchResultHeap{}
 	ac.start()
@@ -27,7 +30,16 @@ func searchProbeSetSuffix(db *sql.DB, listTable, setTable string, tb tokenTable,
 		if kthOverlap(h, k) >= len(tokens)-i {
 			break
 		}
-		entries := InvertedList(db, listTable, token)
+		entries, err := readInvertedList(ctx, store, token)
+		if ctx.Err() != nil {
+			// Stop with the results found so far
+			expResult.Incomplete = true
+			break
+		}
+		if err != nil {
+			ac.done()
+			return nil, expResult, err
+		}
 		expResult.MaxListSizeRead = max(expResult.MaxListSizeRead, len(entries))
 		expResult.NumListRead++
 		ac.addReadList(len(entries))
@@ -39,13 +51,24 @@ func searchProbeSetSuffix(db *sql.DB, listTable, setTable string, tb tokenTable,
 			if kthOverlap(h, k) >= min(len(tokens)-i, entry.Size-entry.MatchPosition) {
 				continue
 			}
-			s := setTokensSuffix(db, setTable, entry.ID, entry.MatchPosition)
+			s, err := readSetTokensSuffix(ctx, store, entry.ID, entry.MatchPosition)
+			if ctx.Err() != nil {
+				expResult.Incomplete = true
+				break
+			}
+			if err != nil {
+				ac.done()
+				return nil, expResult, err
+			}
 			expResult.NumSetRead++
 			expResult.MaxSetSizeRead = max(expResult.MaxSetSizeRead, len(s))
 			o := overlap(s, tokens[i:])
 			pushCandidate(h, k, entry.ID, o)
 			ac.addReadSet(len(s), o)
 		}
+		if expResult.Incomplete {
+			break
+		}
 	}
 	results := orderedResults(h)
 	ac.done()
@@ -58,24 +81,27 @@ func searchProbeSetSuffix(db *sql.DB, listTable, setTable string, tb tokenTable,
 	expResult.IgnoreSize = len(ignores)
 	expResult.QueryNumToken = len(tokens)
 	expResult.Actions = ac.collect()
-	return results, expResult
+	return results, expResult, nil
 }
 
 // The baseline ProbeSet-D algorithm optimized using distinct lists.
-func searchProbeSetOptimized(db *sql.DB, listTable, setTable string, tb tokenTable, query rawTokenSet, k int, ignoreSelf bool) ([]searchResult, experimentResult) {
+// If ctx is done before the search completes, the running top-k is returned
+// with Incomplete set in the experiment result.
+func searchProbeSetOptimized(ctx context.Context, store IndexStore, tb TokenTable, query RawTokenSet, k int, ignoreSelf bool) ([]searchResult, experimentResult, error) {
 	var expResult experimentResult
 	ac := newActionCollecter(len(query.RawTokens))
 
 	start := time.Now()
-	tokens, _, gids := tb.process(query)
+	tokens, _, gids, err := tb.process(query)
+	if err != nil {
+		return nil, expResult, err
+	}
 	expResult.PreprocDuration = int(time.Now().Sub(start) / time.Millisecond)
 	start = time.Now()
 
-	var ignores map[int64]bool
-	if ignoreSelf {
-		ignores = map[int64]bool{query.ID: true}
-	} else {
-		ignores = make(map[int64]bool)
+	ignores, err := newIgnores(store, query, ignoreSelf)
+	if err != nil {
+		return nil, expResult, err
 	}
 	h := &searchResultHeap{}
 	ac.start()
@@ -89,7 +115,16 @@ func searchProbeSetOptimized(db *sql.DB, listTable, setTable string, tb tokenTab
 		if kthOverlap(h, k) >= len(tokens)-i+skippedOverlap {
 			break
 		}
-		entries := InvertedList(db, listTable, token)
+		entries, err := readInvertedList(ctx, store, token)
+		if ctx.Err() != nil {
+			// Stop with the results found so far
+			expResult.Incomplete = true
+			break
+		}
+		if err != nil {
+			ac.done()
+			return nil, expResult, err
+		}
 		expResult.MaxListSizeRead = max(expResult.MaxListSizeRead, len(entries))
 		expResult.NumListRead++
 		ac.addReadList(len(entries))
@@ -101,7 +136,15 @@ func searchProbeSetOptimized(db *sql.DB, listTable, setTable string, tb tokenTab
 			if kthOverlap(h, k) >= min(len(tokens)-i+skippedOverlap, entry.Size-entry.MatchPosition+skippedOverlap) {
 				continue
 			}
-			s := setTokensSuffix(db, setTable, entry.ID, entry.MatchPosition)
+			s, err := readSetTokensSuffix(ctx, store, entry.ID, entry.MatchPosition)
+			if ctx.Err() != nil {
+				expResult.Incomplete = true
+				break
+			}
+			if err != nil {
+				ac.done()
+				return nil, expResult, err
+			}
 			expResult.NumSetRead++
 			expResult.MaxSetSizeRead = max(expResult.MaxSetSizeRead, len(s))
 			o := overlap(s, tokens[i:])
@@ -109,6 +152,9 @@ func searchProbeSetOptimized(db *sql.DB, listTable, setTable string, tb tokenTab
 			pushCandidate(h, k, entry.ID, o)
 			ac.addReadSet(len(s), o)
 		}
+		if expResult.Incomplete {
+			break
+		}
 	}
 	results := orderedResults(h)
 	ac.done()
@@ -121,5 +167,5 @@ func searchProbeSetOptimized(db *sql.DB, listTable, setTable string, tb tokenTab
 	expResult.IgnoreSize = len(ignores)
 	expResult.QueryNumToken = len(tokens)
 	expResult.Actions = ac.collect()
-	return results, expResult
+	return results, expResult, nil
 }
@@ -0,0 +1,150 @@
+package joise
+
+import (
+	"fmt"
+	"math"
+)
+
+// Scoring is the function ranking the sets found by a top-k search.
+type Scoring int
+
+const (
+	// OverlapScoring ranks sets by their overlaps with the query.
+	OverlapScoring Scoring = iota
+	// JaccardScoring ranks sets by the Jaccard similarity, which is the
+	// overlap divided by the size of the union of the query and the set.
+	JaccardScoring
+	// ContainmentScoring ranks sets by the containment of the set in the
+	// query, which is the overlap divided by the size of the set.
+	ContainmentScoring
+	// QueryContainmentScoring ranks sets by the containment of the query in
+	// the set, which is the overlap divided by the size of the query, so the
+	// ranking is the same as OverlapScoring.
+	QueryContainmentScoring
+)
+
+var scoringNames = map[Scoring]string{
+	OverlapScoring:          "overlap",
+	JaccardScoring:          "jaccard",
+	ContainmentScoring:      "containment",
+	QueryContainmentScoring: "query_containment",
+}
+
+func (s Scoring) String() string {
+	if name, exists := scoringNames[s]; exists {
+		return name
+	}
+	return fmt.Sprintf("Scoring(%d)", int(s))
+}
+
+// ParseScoring returns the scoring function with the given name.
+func ParseScoring(name string) (Scoring, error) {
+	for s, n := range scoringNames {
+		if n == name {
+			return s, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown scoring %q", name)
+}
+
+// scorer computes the scores of candidate sets for a query. The query size
+// is the number of distinct raw tokens of the query, including the tokens
+// not in the index, as they are part of the union.
+type scorer struct {
+	scoring   Scoring
+	querySize int
+}
+
+func newScorer(scoring Scoring, query RawTokenSet) scorer {
+	return scorer{
+		scoring:   scoring,
+		querySize: numDistinctRawTokens(query),
+	}
+}
+
+func numDistinctRawTokens(query RawTokenSet) int {
+	distinct := make(map[string]bool, len(query.RawTokens))
+	for _, rawToken := range query.RawTokens {
+		distinct[string(rawToken)] = true
+	}
+	return len(distinct)
+}
+
+// The score of a set with the overlap and the size. The score increases
+// with the overlap and does not increase with the size, so the score of an
+// upper bound overlap is an upper bound score.
+func (sc scorer) score(overlap, size int) float64 {
+	if overlap <= 0 {
+		return 0
+	}
+	switch sc.scoring {
+	case JaccardScoring:
+		return float64(overlap) / float64(sc.querySize+size-overlap)
+	case ContainmentScoring:
+		return float64(overlap) / float64(size)
+	case QueryContainmentScoring:
+		return float64(overlap) / float64(sc.querySize)
+	default:
+		return float64(overlap)
+	}
+}
+
+// The upper bound score of a set not seen yet, whose overlap is at most the
+// given overlap and whose size is unknown.
+func (sc scorer) unseenUpperbound(maxOverlap int) float64 {
+	if maxOverlap <= 0 {
+		return 0
+	}
+	switch sc.scoring {
+	case JaccardScoring, QueryContainmentScoring:
+		// The union is at least the query size
+		return float64(maxOverlap) / float64(sc.querySize)
+	case ContainmentScoring:
+		// A small set can be fully contained in the query
+		return 1
+	default:
+		return float64(maxOverlap)
+	}
+}
+
+// The minimum overlap that an unseen set must exceed to reach the score,
+// used to estimate the prefix length. This is a lower bound for
+// ContainmentScoring as the set size is unknown.
+func (sc scorer) unseenOverlapThreshold(score float64) int {
+	switch sc.scoring {
+	case JaccardScoring, QueryContainmentScoring:
+		return int(score * float64(sc.querySize))
+	case ContainmentScoring:
+		return 0
+	default:
+		return int(score)
+	}
+}
+
+// TokenWeightFunc returns the weight of a query token for weighted overlap
+// search, given the raw token and the number of sets containing it in the
+// index. Weights must be non-negative.
+type TokenWeightFunc func(rawToken []byte, frequency int) float64
+
+// IDFWeights weights tokens by their inverse set frequencies
+// log(numSets/frequency), where numSets is the number of sets in the index,
+// so matching rare tokens counts more than matching common tokens. numSets
+// excludes the deleted sets, such as MemStore.NumSets, while the token
+// frequencies still count them until the index is compacted.
+func IDFWeights(numSets int) TokenWeightFunc {
+	return func(rawToken []byte, frequency int) float64 {
+		// The frequency may exceed a stale number of sets
+		return math.Max(inverseSetFrequency(numSets, frequency), 0)
+	}
+}
+
+// UserWeights weights tokens by the given weights of their raw tokens, and
+// tokens without weights by defaultWeight.
+func UserWeights(weights map[string]float64, defaultWeight float64) TokenWeightFunc {
+	return func(rawToken []byte, frequency int) float64 {
+		if w, exists := weights[string(rawToken)]; exists {
+			return w
+		}
+		return defaultWeight
+	}
+}
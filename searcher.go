@@ -0,0 +1,435 @@
+package joise
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"time"
+)
+
+// ErrInvalidSearch is returned when the arguments of a search are invalid or
+// the search is not supported by the algorithm.
+var ErrInvalidSearch = errors.New("invalid search")
+
+// Algorithm is an overlap set similarity search algorithm.
+type Algorithm int
+
+const (
+	// JOSIE is the cost model based algorithm presented in the SIGMOD paper.
+	JOSIE Algorithm = iota
+	// MergeListD is the baseline that reads all distinct posting lists.
+	MergeListD
+	// ProbeSetD is the baseline that probes every candidate set found in
+	// the prefix of distinct posting lists.
+	ProbeSetD
+)
+
+var algorithmNames = map[Algorithm]string{
+	JOSIE:      "merge_probe_cost_model_greedy",
+	MergeListD: "merge_distinct_list",
+	ProbeSetD:  "probe_set_optimized",
+}
+
+func (a Algorithm) String() string {
+	if name, exists := algorithmNames[a]; exists {
+		return name
+	}
+	return fmt.Sprintf("Algorithm(%d)", int(a))
+}
+
+// ParseAlgorithm returns the algorithm with the given name, which is the
+// same name used for experiment results.
+func ParseAlgorithm(name string) (Algorithm, error) {
+	for a, n := range algorithmNames {
+		if n == name {
+			return a, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown algorithm %q", name)
+}
+
+// Result is a set found by a search, its overlap with the query, and its
+// score under the scoring function of the search.
+type Result struct {
+	ID      int64
+	Overlap int
+	Score   float64
+	// Partial is true if the overlap, and so the score, is only a lower
+	// bound, because an incomplete search has not read all tokens of the
+	// set.
+	Partial bool
+}
+
+// Stats are the statistics of running a single query.
+type Stats struct {
+	Duration        time.Duration
+	PreprocDuration time.Duration
+	QueryNumToken   int
+	NumListRead     int
+	NumSetRead      int
+	MaxListSizeRead int
+	MaxSetSizeRead  int
+	MaxCounterSize  int
+	// NumListShared is the number of the posting lists read that were
+	// shared with the previous queries of a batch instead of read from the
+	// store, which are included in NumListRead.
+	NumListShared int
+	// The cache hits and misses of the posting list and set reads of a
+	// search over a CachedStore
+	NumListCacheHit  int
+	NumListCacheMiss int
+	NumSetCacheHit   int
+	NumSetCacheMiss  int
+	// Incomplete is true if the context of the search was done or the
+	// budget ran out before the search completed, in which case the results
+	// are the best found so far.
+	Incomplete bool
+	// UnseenUpperbound is the upper bound score of the sets not in the
+	// results of an incomplete JOSIE top-k search ranked by overlap or query
+	// containment, no set missing from the results can score higher.
+	UnseenUpperbound float64
+}
+
+func newResult(r searchResult, sc scorer) Result {
+	// The set size is not needed by the overlap based scores
+	return Result{ID: r.ID, Overlap: r.Overlap, Score: sc.score(r.Overlap, 0),
+		Partial: r.Partial}
+}
+
+func newResults(results []searchResult, sc scorer) []Result {
+	rs := make([]Result, len(results))
+	for i, r := range results {
+		rs[i] = newResult(r, sc)
+	}
+	return rs
+}
+
+func newScoredResults(results []scoredResult) []Result {
+	rs := make([]Result, len(results))
+	for i, r := range results {
+		rs[i] = Result{ID: r.ID, Overlap: r.Overlap, Score: r.Score}
+	}
+	return rs
+}
+
+func newStats(expResult experimentResult) Stats {
+	return Stats{
+		Duration:         time.Duration(expResult.Duration) * time.Millisecond,
+		PreprocDuration:  time.Duration(expResult.PreprocDuration) * time.Millisecond,
+		QueryNumToken:    expResult.QueryNumToken,
+		NumListRead:      expResult.NumListRead,
+		NumSetRead:       expResult.NumSetRead,
+		MaxListSizeRead:  expResult.MaxListSizeRead,
+		MaxSetSizeRead:   expResult.MaxSetSizeRead,
+		MaxCounterSize:   expResult.MaxCounterSize,
+		NumListCacheHit:  expResult.NumListCacheHit,
+		NumListCacheMiss: expResult.NumListCacheMiss,
+		NumSetCacheHit:   expResult.NumSetCacheHit,
+		NumSetCacheMiss:  expResult.NumSetCacheMiss,
+		Incomplete:       expResult.Incomplete,
+	}
+}
+
+// Searcher runs top-k and threshold set similarity search queries against
+// an index. A Searcher is safe for concurrent use.
+//
+// The searches stop reading posting lists and sets once their context is
+// done, and return the best results found so far with Stats.Incomplete set
+// instead of an error, so a context deadline bounds the time of a search.
+// An incomplete search may miss sets with higher scores, and results whose
+// tokens are not all read have Result.Partial set.
+type Searcher struct {
+	store     IndexStore
+	tb        TokenTable
+	cost      CostParameters
+	algorithm Algorithm
+	scoring   Scoring
+	budget    Budget
+	prefetch  int
+	probe     int
+}
+
+// SearcherOption configures a Searcher.
+type SearcherOption func(s *Searcher)
+
+// WithAlgorithm sets the search algorithm, the default is JOSIE.
+func WithAlgorithm(a Algorithm) SearcherOption {
+	return func(s *Searcher) {
+		s.algorithm = a
+	}
+}
+
+// WithScoring sets the scoring function ranking the results of TopK, the
+// default is OverlapScoring. JaccardScoring and ContainmentScoring are only
+// supported by JOSIE.
+func WithScoring(scoring Scoring) SearcherOption {
+	return func(s *Searcher) {
+		s.scoring = scoring
+	}
+}
+
+// WithBudget limits the I/O of TopK, which returns the best results found
+// so far once the budget runs out, with Stats.UnseenUpperbound bounding the
+// scores of the sets missing from the results. Budgets are only supported by
+// TopK with JOSIE and OverlapScoring or QueryContainmentScoring.
+func WithBudget(b Budget) SearcherOption {
+	return func(s *Searcher) {
+		s.budget = b
+	}
+}
+
+// WithPrefetch sets the number of posting lists that TopK with JOSIE and
+// OverlapScoring or QueryContainmentScoring reads concurrently, prefetching
+// the next lists while merging the current one. The cost model takes the
+// overlapped reads into account when choosing between reading lists and
+// sets. The default 1 reads one list at a time. Only the lists the budget
+// allows are prefetched, and the budget is charged the full read costs of
+// the lists. Lists prefetched but not merged before the search ends are not
+// counted in the stats.
+func WithPrefetch(parallelism int) SearcherOption {
+	return func(s *Searcher) {
+		s.prefetch = parallelism
+	}
+}
+
+// WithParallelProbes sets the number of candidate sets that TopK with JOSIE
+// and OverlapScoring or QueryContainmentScoring reads concurrently. When the
+// cost model chooses to read a candidate, the next qualified candidates are
+// read along with it, and their exact overlaps are merged into the results
+// even if the cost model does not choose them afterwards. The default 1
+// reads one set at a time.
+func WithParallelProbes(parallelism int) SearcherOption {
+	return func(s *Searcher) {
+		s.probe = parallelism
+	}
+}
+
+// NewSearcher creates a Searcher over the index store, using the token table
+// to look up query tokens and the cost parameters to estimate read costs.
+// The read costs of the posting lists and sets cached by a CachedStore are
+// estimated to be near zero.
+func NewSearcher(store IndexStore, tb TokenTable, cost CostParameters, opts ...SearcherOption) *Searcher {
+	s := &Searcher{
+		store:     store,
+		tb:        tb,
+		cost:      cost,
+		algorithm: JOSIE,
+		scoring:   OverlapScoring,
+		prefetch:  1,
+		probe:     1,
+	}
+	if c, ok := store.(*CachedStore); ok {
+		s.cost.cache = c
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
+}
+
+// TopK finds the k sets with the highest scores, which are the overlaps
+// with the query by default, ordered by decreasing score.
+func (s *Searcher) TopK(ctx context.Context, query RawTokenSet, k int) ([]Result, Stats, error) {
+	return s.topK(ctx, query, k, nil)
+}
+
+// StreamTopK runs TopK and calls fn with every result as soon as it is
+// final, in decreasing score order, so the first results can be used before
+// the search completes. JOSIE streams the results of OverlapScoring and
+// QueryContainmentScoring early, and fn is called with all results at the
+// end of the search otherwise. The search stops at the first error returned
+// by fn.
+func (s *Searcher) StreamTopK(ctx context.Context, query RawTokenSet, k int, fn func(Result) error) (Stats, error) {
+	_, stats, err := s.topK(ctx, query, k, fn)
+	return stats, err
+}
+
+func (s *Searcher) topK(ctx context.Context, query RawTokenSet, k int, fn func(Result) error) ([]Result, Stats, error) {
+	if k < 1 {
+		return nil, Stats{}, fmt.Errorf("%w: k must be positive, got %d", ErrInvalidSearch, k)
+	}
+	if !s.budget.unlimited() && (s.algorithm != JOSIE ||
+		s.scoring == JaccardScoring || s.scoring == ContainmentScoring) {
+		return nil, Stats{}, fmt.Errorf("%w: budget is not supported by algorithm %v with scoring %v", ErrInvalidSearch, s.algorithm, s.scoring)
+	}
+	ctx, cache := withCacheStats(ctx)
+	sc := newScorer(s.scoring, query)
+	var rs []Result
+	var expResult experimentResult
+	var unseenUpperbound float64
+	var emit func(searchResult) error
+	if s.scoring == JaccardScoring || s.scoring == ContainmentScoring {
+		if s.algorithm != JOSIE {
+			return nil, Stats{}, fmt.Errorf("%w: scoring %v is not supported by algorithm %v", ErrInvalidSearch, s.scoring, s.algorithm)
+		}
+		results, r, err := searchMergeProbeCostModelGreedyScore(ctx, s.store, s.tb,
+			s.cost, query, k, sc, false)
+		if err != nil {
+			return nil, newStats(r), err
+		}
+		rs, expResult = newScoredResults(results), r
+	} else {
+		if fn != nil && s.algorithm == JOSIE {
+			emit = func(r searchResult) error { return fn(newResult(r, sc)) }
+		}
+		var results []searchResult
+		var err error
+		switch s.algorithm {
+		case JOSIE:
+			results, expResult, err = searchMergeProbeCostModelGreedy(ctx, s.store, s.tb,
+				s.cost, query, k, s.budget, s.prefetch, s.probe, false, emit)
+		case MergeListD:
+			results, expResult, err = searchMergeDistinctList(ctx, s.store, s.tb,
+				query, k, false)
+		case ProbeSetD:
+			results, expResult, err = searchProbeSetOptimized(ctx, s.store, s.tb,
+				query, k, false)
+		default:
+			return nil, Stats{}, fmt.Errorf("%w: unsupported algorithm %v", ErrInvalidSearch, s.algorithm)
+		}
+		if err != nil {
+			return nil, newStats(expResult), err
+		}
+		rs = newResults(results, sc)
+		if expResult.Incomplete && s.algorithm == JOSIE {
+			unseenUpperbound = sc.score(expResult.UnseenUpperbound, 0)
+		}
+	}
+	cache.record(&expResult)
+	stats := newStats(expResult)
+	stats.UnseenUpperbound = unseenUpperbound
+	if fn != nil && emit == nil {
+		for _, r := range rs {
+			if err := fn(r); err != nil {
+				return nil, stats, err
+			}
+		}
+	}
+	return rs, stats, nil
+}
+
+// BatchTopK runs TopK for every query, one after another, and reads every
+// posting list needed by several queries from the store once. The posting
+// lists are kept in memory until the last query needing them is done. The
+// results and stats are in the order of the queries, and Stats.NumListShared
+// counts the lists a query did not read from the store.
+func (s *Searcher) BatchTopK(ctx context.Context, queries []RawTokenSet, k int) ([][]Result, []Stats, error) {
+	results := make([][]Result, len(queries))
+	stats := make([]Stats, len(queries))
+	err := s.StreamBatchTopK(ctx, queries, k, func(i int, r Result) error {
+		results[i] = append(results[i], r)
+		return nil
+	}, func(i int, st Stats) error {
+		stats[i] = st
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return results, stats, nil
+}
+
+// StreamBatchTopK runs BatchTopK and calls fn with the index of a query and
+// every result of the query as soon as it is final, like StreamTopK, then
+// done with the index and the stats of the query once its search is done.
+// The batch stops at the first error returned by fn or done.
+func (s *Searcher) StreamBatchTopK(ctx context.Context, queries []RawTokenSet, k int,
+	fn func(i int, r Result) error, done func(i int, stats Stats) error) error {
+	shared, err := newSharedListStore(s.store, s.tb, queries)
+	if err != nil {
+		return err
+	}
+	bs := *s
+	bs.store = shared
+	for i, query := range queries {
+		stats, err := bs.StreamTopK(ctx, query, k, func(r Result) error { return fn(i, r) })
+		stats.NumListShared = shared.done(i)
+		if err != nil {
+			return err
+		}
+		if err := done(i, stats); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// WeightedTopK finds the k sets with the highest weighted overlaps with the
+// query, which are the sums of the weights of the overlapping tokens given
+// by weights, such as IDFWeights. The scores of the results are their
+// weighted overlaps, and sets with zero weighted overlaps are not returned.
+// Only the JOSIE algorithm supports weighted search.
+func (s *Searcher) WeightedTopK(ctx context.Context, query RawTokenSet, k int, weights TokenWeightFunc) ([]Result, Stats, error) {
+	if k < 1 {
+		return nil, Stats{}, fmt.Errorf("%w: k must be positive, got %d", ErrInvalidSearch, k)
+	}
+	if s.algorithm != JOSIE {
+		return nil, Stats{}, fmt.Errorf("%w: weighted search is not supported by algorithm %v", ErrInvalidSearch, s.algorithm)
+	}
+	if !s.budget.unlimited() {
+		return nil, Stats{}, fmt.Errorf("%w: budget is not supported by weighted search", ErrInvalidSearch)
+	}
+	ctx, cache := withCacheStats(ctx)
+	results, expResult, err := searchMergeProbeCostModelGreedyWeighted(ctx, s.store, s.tb,
+		s.cost, query, k, weights, false)
+	if err != nil {
+		return nil, newStats(expResult), err
+	}
+	cache.record(&expResult)
+	return newScoredResults(results), newStats(expResult), nil
+}
+
+// ThresholdSearch finds all sets with overlaps of at least minOverlap with
+// the query, ordered by decreasing overlap. The scores of the results are
+// their overlaps. Only the JOSIE algorithm supports threshold search.
+func (s *Searcher) ThresholdSearch(ctx context.Context, query RawTokenSet, minOverlap int) ([]Result, Stats, error) {
+	return s.thresholdSearch(ctx, query, minOverlap, nil)
+}
+
+// StreamThresholdSearch runs ThresholdSearch and calls fn with every result
+// as soon as it is found. The results are not in overlap order. The search
+// stops at the first error returned by fn.
+func (s *Searcher) StreamThresholdSearch(ctx context.Context, query RawTokenSet, minOverlap int, fn func(Result) error) (Stats, error) {
+	_, stats, err := s.thresholdSearch(ctx, query, minOverlap, fn)
+	return stats, err
+}
+
+func (s *Searcher) thresholdSearch(ctx context.Context, query RawTokenSet, minOverlap int, fn func(Result) error) ([]Result, Stats, error) {
+	if minOverlap < 1 {
+		return nil, Stats{}, fmt.Errorf("%w: minimum overlap must be positive, got %d", ErrInvalidSearch, minOverlap)
+	}
+	if s.algorithm != JOSIE {
+		return nil, Stats{}, fmt.Errorf("%w: threshold search is not supported by algorithm %v", ErrInvalidSearch, s.algorithm)
+	}
+	if !s.budget.unlimited() {
+		return nil, Stats{}, fmt.Errorf("%w: budget is not supported by threshold search", ErrInvalidSearch)
+	}
+	sc := scorer{scoring: OverlapScoring}
+	var emit func(searchResult) error
+	if fn != nil {
+		emit = func(r searchResult) error { return fn(newResult(r, sc)) }
+	}
+	ctx, cache := withCacheStats(ctx)
+	results, expResult, err := searchMergeProbeCostModelGreedyThreshold(ctx, s.store, s.tb,
+		s.cost, query, minOverlap, false, emit)
+	if err != nil {
+		return nil, newStats(expResult), err
+	}
+	cache.record(&expResult)
+	return newResults(results, sc), newStats(expResult), nil
+}
+
+// ContainmentThreshold returns the minimum overlap for sets to contain at
+// least the given fraction of the distinct raw tokens of the query, for use
+// with ThresholdSearch.
+func ContainmentThreshold(query RawTokenSet, containment float64) int {
+	// The product is rounded up, after subtracting the floating point error
+	// that makes 0.7 * 10 slightly more than 7
+	overlap := containment*float64(numDistinctRawTokens(query)) - containmentEpsilon
+	return max(int(math.Ceil(overlap)), 1)
+}
+
+// The largest floating point error of the product of a containment and a
+// number of raw tokens, for queries of up to millions of raw tokens
+const containmentEpsilon = 1e-6
@@ -0,0 +1,186 @@
+package joise
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"testing"
+)
+
+func TestSearcherInvalidSearch(t *testing.T) {
+	r := rand.New(rand.NewSource(15))
+	sets := randomRawSets(r, 50, 100)
+	store := buildTestMemStore(t, sets)
+	tb, err := CreateTokenTableMem(store, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	query := randomQuery(r, sets)
+	josie := NewSearcher(store, tb, DefaultCostParameters())
+	mergeList := NewSearcher(store, tb, DefaultCostParameters(), WithAlgorithm(MergeListD))
+	negative := func(rawToken []byte, frequency int) float64 { return -1 }
+	for name, search := range map[string]func() error{
+		"k of 0": func() error {
+			_, _, err := josie.TopK(ctx, query, 0)
+			return err
+		},
+		"unknown algorithm": func() error {
+			_, _, err := NewSearcher(store, tb, DefaultCostParameters(), WithAlgorithm(Algorithm(100))).TopK(ctx, query, 5)
+			return err
+		},
+		"Jaccard scoring with MergeList-D": func() error {
+			_, _, err := NewSearcher(store, tb, DefaultCostParameters(), WithAlgorithm(MergeListD),
+				WithScoring(JaccardScoring)).TopK(ctx, query, 5)
+			return err
+		},
+		"weighted search with MergeList-D": func() error {
+			_, _, err := mergeList.WeightedTopK(ctx, query, 5, IDFWeights(store.NumSets()))
+			return err
+		},
+		"negative weights": func() error {
+			_, _, err := josie.WeightedTopK(ctx, query, 5, negative)
+			return err
+		},
+		"minimum overlap of 0": func() error {
+			_, _, err := josie.ThresholdSearch(ctx, query, 0)
+			return err
+		},
+		"threshold search with MergeList-D": func() error {
+			_, _, err := mergeList.ThresholdSearch(ctx, query, 5)
+			return err
+		},
+	} {
+		if err := search(); !errors.Is(err, ErrInvalidSearch) {
+			t.Errorf("%s: got error %v, want %v", name, err, ErrInvalidSearch)
+		}
+	}
+	// Valid searches and canceled contexts are not invalid searches
+	if _, _, err := josie.TopK(ctx, query, 5); err != nil {
+		t.Fatal(err)
+	}
+	canceled, cancel := context.WithCancel(ctx)
+	cancel()
+	if _, _, err := josie.TopK(canceled, query, 5); errors.Is(err, ErrInvalidSearch) {
+		t.Fatalf("canceled search: got error %v", err)
+	}
+}
+
+// cancelingStore cancels the context of a search after a number of posting
+// list and set reads
+type cancelingStore struct {
+	IndexStore
+	numRead     int
+	cancelAfter int
+	cancel      context.CancelFunc
+}
+
+func (s *cancelingStore) read() {
+	s.numRead++
+	if s.numRead == s.cancelAfter {
+		s.cancel()
+	}
+}
+
+func (s *cancelingStore) InvertedList(token int64) ([]ListEntry, error) {
+	s.read()
+	return s.IndexStore.InvertedList(token)
+}
+
+func (s *cancelingStore) SetTokensSuffix(setID int64, startPos int) ([]int64, error) {
+	s.read()
+	return s.IndexStore.SetTokensSuffix(setID, startPos)
+}
+
+func (s *cancelingStore) SetTokensSubset(setID int64, startPos, endPos int) ([]int64, error) {
+	s.read()
+	return s.IndexStore.SetTokensSubset(setID, startPos, endPos)
+}
+
+func TestSearchCancellation(t *testing.T) {
+	r := rand.New(rand.NewSource(17))
+	sets := randomRawSets(r, 500, 400)
+	memStore := buildTestMemStore(t, sets)
+	tb, err := CreateTokenTableMem(memStore, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var numIncomplete int
+	for q := 0; q < 10; q++ {
+		query := randomQuery(r, sets)
+		overlaps := bruteForceOverlaps(sets, query.RawTokens)
+		for _, algorithm := range []Algorithm{JOSIE, MergeListD, ProbeSetD} {
+			for _, cancelAfter := range []int{1, 3, 10, 30} {
+				ctx, cancel := context.WithCancel(context.Background())
+				store := &cancelingStore{IndexStore: memStore, cancelAfter: cancelAfter, cancel: cancel}
+				searcher := NewSearcher(store, tb, DefaultCostParameters(), WithAlgorithm(algorithm))
+				results, stats, err := searcher.TopK(ctx, query, 10)
+				cancel()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if store.numRead > cancelAfter {
+					t.Fatalf("%v: %d reads after canceling at %d", algorithm, store.numRead, cancelAfter)
+				}
+				if (store.numRead == cancelAfter) != stats.Incomplete {
+					t.Fatalf("%v: incomplete is %v after %d reads", algorithm, stats.Incomplete, store.numRead)
+				}
+				if stats.Incomplete {
+					numIncomplete++
+				}
+				for i, result := range results {
+					if i > 0 && result.Overlap > results[i-1].Overlap {
+						t.Fatalf("%v: results %v are not in decreasing overlap order", algorithm, results)
+					}
+					// The overlaps of partial results are lower bounds
+					if result.Overlap != overlaps[result.ID] &&
+						(!result.Partial || result.Overlap > overlaps[result.ID]) {
+						t.Fatalf("%v: set %d with overlap %d (exact %d)", algorithm, result.ID,
+							result.Overlap, overlaps[result.ID])
+					}
+				}
+			}
+		}
+	}
+	if numIncomplete == 0 {
+		t.Fatal("no search is incomplete")
+	}
+
+	// A search with a done context finds nothing
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	results, stats, err := NewSearcher(memStore, tb, DefaultCostParameters()).TopK(ctx, randomQuery(r, sets), 10)
+	if err != nil || len(results) != 0 || !stats.Incomplete {
+		t.Fatalf("got %v, %v, %v", results, stats, err)
+	}
+}
+
+func TestContainmentThreshold(t *testing.T) {
+	for _, c := range []struct {
+		numRawTokens int
+		containment  float64
+		want         int
+	}{
+		{10, 0.7, 7},
+		{10, 0.3, 3},
+		{10, 0.71, 8},
+		{5, 0.6, 3},
+		{3, 1.0 / 3, 1},
+		{100, 0.29, 29},
+		{100000, 0.7, 70000},
+		{10, 0, 1},
+		{10, 1, 10},
+	} {
+		var query RawTokenSet
+		for i := 0; i < c.numRawTokens; i++ {
+			query.RawTokens = append(query.RawTokens, []byte(fmt.Sprint(i)))
+		}
+		// Duplicate raw tokens are counted once
+		query.RawTokens = append(query.RawTokens, []byte("0"))
+		if got := ContainmentThreshold(query, c.containment); got != c.want {
+			t.Errorf("%d raw tokens, containment %v: got %d, want %d",
+				c.numRawTokens, c.containment, got, c.want)
+		}
+	}
+}
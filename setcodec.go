@@ -0,0 +1,123 @@
+package joise
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// The encodings of the sets in the sets file of an embedded index
+const (
+	// Fixed-width tokens
+	setEncodingFixed = 0
+	// Blocks of delta and varint encoded tokens, see appendEncodedSet
+	setEncodingBlocks = 1
+)
+
+// The number of tokens in a block of an encoded set
+const setBlockSize = 128
+
+// errCorruptEncodedSet is returned when an encoded set is truncated or has
+// invalid varints
+var errCorruptEncodedSet = errors.New("corrupt encoded set")
+
+// WithCompressedSets stores the sets compressed in blocks of delta and
+// varint encoded tokens, with a skip pointer to every block, so a suffix or
+// a subset of a set is decoded from the block containing its start position
+// without reading the blocks before it. MemStore keeps the sets compressed
+// in memory, the embedded index writes them compressed to the sets file,
+// and the Postgres index writer adds an encoded_tokens bytea column stored
+// uncompressed by Postgres, which PostgresStore reads by byte ranges instead
+// of the tokens array column.
+func WithCompressedSets() StoreOption {
+	return func(o *storeOptions) {
+		o.compressSets = true
+	}
+}
+
+// Returns the number of blocks of an encoded set of n tokens
+func numSetBlocks(n int) int {
+	return (n + setBlockSize - 1) / setBlockSize
+}
+
+// Returns the size in bytes of the number of tokens and the skip pointers
+// of an encoded set of n tokens
+func encodedSetHeaderSize(n int) int {
+	return 4 + 4*numSetBlocks(n)
+}
+
+// Appends the encoded set to dst: the number of tokens (uint32), the byte
+// offset of every block from the end of the offsets (uint32), then the
+// blocks. A block starts with its first token and continues with the
+// differences of every following token from the previous one, all as
+// varints. The tokens of a set are sorted in increasing order, so the
+// differences are small.
+func appendEncodedSet(dst []byte, tokens []int64) []byte {
+	dst = binary.LittleEndian.AppendUint32(dst, uint32(len(tokens)))
+	offsets := len(dst)
+	for b := 0; b < numSetBlocks(len(tokens)); b++ {
+		dst = binary.LittleEndian.AppendUint32(dst, 0)
+	}
+	blocks := len(dst)
+	var prev int64
+	for i, token := range tokens {
+		if i%setBlockSize == 0 {
+			binary.LittleEndian.PutUint32(dst[offsets+4*(i/setBlockSize):], uint32(len(dst)-blocks))
+			prev = 0
+		}
+		dst = binary.AppendUvarint(dst, uint64(token-prev))
+		prev = token
+	}
+	return dst
+}
+
+// Decodes the tokens from startPos (inclusive) to endPos (non-inclusive) of
+// a set encoded by appendEncodedSet, which starts at b.
+func decodeSetTokens(b []byte, startPos, endPos int) ([]int64, error) {
+	if len(b) < 4 {
+		return nil, errCorruptEncodedSet
+	}
+	n := int(binary.LittleEndian.Uint32(b))
+	header := encodedSetHeaderSize(n)
+	if n > len(b) || header > len(b) {
+		return nil, errCorruptEncodedSet
+	}
+	endPos = min(endPos, n)
+	startPos = min(startPos, endPos)
+	if startPos == endPos {
+		return []int64{}, nil
+	}
+	block := startPos / setBlockSize
+	offset := header + int(binary.LittleEndian.Uint32(b[4+4*block:]))
+	if offset > len(b) {
+		return nil, errCorruptEncodedSet
+	}
+	return decodeSetBlocks(b[offset:], block*setBlockSize, startPos, endPos)
+}
+
+// Decodes the tokens from startPos to endPos of an encoded set from its
+// blocks starting at b, where the first block starts at blockPos.
+func decodeSetBlocks(b []byte, blockPos, startPos, endPos int) ([]int64, error) {
+	if blockPos%setBlockSize != 0 || blockPos > startPos {
+		return nil, fmt.Errorf("%w: position %d is not the start of a block before %d",
+			errCorruptEncodedSet, blockPos, startPos)
+	}
+	tokens := make([]int64, 0, max(endPos-startPos, 0))
+	var prev int64
+	var i int
+	for pos := blockPos; pos < endPos; pos++ {
+		if pos%setBlockSize == 0 {
+			prev = 0
+		}
+		delta, k := binary.Uvarint(b[i:])
+		if k <= 0 {
+			return nil, errCorruptEncodedSet
+		}
+		i += k
+		prev += int64(delta)
+		if pos >= startPos {
+			tokens = append(tokens, prev)
+		}
+	}
+	return tokens, nil
+}
@@ -0,0 +1,51 @@
+package joise
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestEncodedSetRoundTrip(t *testing.T) {
+	for _, n := range []int{0, 1, 127, 128, 129, 256, 300} {
+		tokens := make([]int64, n)
+		for i := range tokens {
+			tokens[i] = int64(i*i + 7)
+		}
+		b := appendEncodedSet(nil, tokens)
+		if numSetBlocks(n) != (n+127)/128 {
+			t.Fatalf("%d tokens: %d blocks", n, numSetBlocks(n))
+		}
+		// Positions at, before and after the block boundaries
+		positions := []int{0, 1, 126, 127, 128, 129, 255, 256, 257, n - 1, n, n + 1}
+		for _, start := range positions {
+			for _, end := range positions {
+				if start < 0 || end < 0 {
+					continue
+				}
+				got, err := decodeSetTokens(b, start, end)
+				if err != nil {
+					t.Fatalf("%d tokens [%d, %d): %v", n, start, end, err)
+				}
+				end = min(end, n)
+				want := tokens[min(start, end):end]
+				if fmt.Sprint(got) != fmt.Sprint(want) {
+					t.Fatalf("%d tokens [%d, %d): got %v, want %v", n, start, end, got, want)
+				}
+			}
+		}
+	}
+}
+
+func TestEncodedSetCorrupt(t *testing.T) {
+	tokens := make([]int64, 200)
+	for i := range tokens {
+		tokens[i] = int64(1000 * i)
+	}
+	b := appendEncodedSet(nil, tokens)
+	for _, corrupt := range [][]byte{nil, b[:3], b[:8], b[:len(b)-1]} {
+		if _, err := decodeSetTokens(corrupt, 0, len(tokens)); !errors.Is(err, errCorruptEncodedSet) {
+			t.Fatalf("%d of %d bytes: got error %v", len(corrupt), len(b), err)
+		}
+	}
+}
@@ -0,0 +1,516 @@
+package joise
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"math"
+	"sync"
+
+	"github.com/lib/pq"
+)
+
+// TokenEntry is the metadata of a token in the index
+type TokenEntry struct {
+	Token     int64
+	RawToken  []byte
+	Frequency int   // the number of sets containing the token
+	GroupID   int64 // the duplicate group id, tokens with identical posting lists share a group
+}
+
+// IndexStore provides the posting lists, sets and token metadata of an
+// index to the search algorithms.
+// All positions are 0-starting indexes.
+type IndexStore interface {
+	// InvertedList reads the posting list of a token.
+	InvertedList(token int64) ([]ListEntry, error)
+	// SetTokens reads all tokens of a set.
+	SetTokens(setID int64) ([]int64, error)
+	// SetTokensSuffix reads the tokens of a set starting from startPos.
+	SetTokensSuffix(setID int64, startPos int) ([]int64, error)
+	// SetTokensSubset reads the tokens of a set from startPos (inclusive)
+	// to endPos (non-inclusive).
+	SetTokensSubset(setID int64, startPos, endPos int) ([]int64, error)
+	// TokenEntries reads the metadata of the given tokens in increasing
+	// token order, tokens not in the index are skipped.
+	TokenEntries(tokens []int64) ([]TokenEntry, error)
+	// ScanTokenEntries calls fn with the metadata of every token in the
+	// index, and stops at the first error returned by fn.
+	ScanTokenEntries(fn func(entry TokenEntry) error) error
+	// NumTokens returns the number of tokens in the index.
+	NumTokens() (int, error)
+	// MaxGroupID returns the maximum duplicate group id in the index.
+	MaxGroupID() (int64, error)
+	// DeletedSets returns the sets that are deleted but not yet removed from
+	// the posting lists, which the search algorithms skip.
+	DeletedSets() ([]int64, error)
+}
+
+// ContextIndexStore is an IndexStore whose reads of posting lists and sets
+// can be canceled, which the search algorithms use to stop a slow read when
+// the context of the search is done. PostgresStore supports cancellation,
+// while the reads of the other stores are not canceled once started.
+type ContextIndexStore interface {
+	IndexStore
+	// InvertedListContext reads the posting list of a token.
+	InvertedListContext(ctx context.Context, token int64) ([]ListEntry, error)
+	// SetTokensContext reads all tokens of a set.
+	SetTokensContext(ctx context.Context, setID int64) ([]int64, error)
+	// SetTokensSuffixContext reads the tokens of a set starting from
+	// startPos.
+	SetTokensSuffixContext(ctx context.Context, setID int64, startPos int) ([]int64, error)
+}
+
+// Reads the posting list of a token, or returns the error of ctx if it is
+// done
+func readInvertedList(ctx context.Context, store IndexStore, token int64) ([]ListEntry, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if s, ok := store.(ContextIndexStore); ok {
+		return s.InvertedListContext(ctx, token)
+	}
+	return store.InvertedList(token)
+}
+
+// Reads all tokens of a set, or returns the error of ctx if it is done
+func readSetTokens(ctx context.Context, store IndexStore, setID int64) ([]int64, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if s, ok := store.(ContextIndexStore); ok {
+		return s.SetTokensContext(ctx, setID)
+	}
+	return store.SetTokens(setID)
+}
+
+// Reads the tokens of a set starting from startPos, or returns the error of
+// ctx if it is done
+func readSetTokensSuffix(ctx context.Context, store IndexStore, setID int64, startPos int) ([]int64, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if s, ok := store.(ContextIndexStore); ok {
+		return s.SetTokensSuffixContext(ctx, setID, startPos)
+	}
+	return store.SetTokensSuffix(setID, startPos)
+}
+
+// MutableIndexStore is an IndexStore that supports adding and deleting sets
+// through an IndexUpdater. MemStore and PostgresStore are mutable, while FileStore is
+// read-only and must be rebuilt.
+type MutableIndexStore interface {
+	IndexStore
+	// rawTokenEntries reads the metadata of the given raw tokens, raw tokens
+	// not in the index are skipped.
+	rawTokenEntries(rawTokens [][]byte) ([]TokenEntry, error)
+	// nextToken returns the token following the maximum token in the index,
+	// which is 0 if the index is empty.
+	nextToken() (int64, error)
+	// deleteSets marks the sets as deleted.
+	deleteSets(setIDs []int64) error
+	// applyUpdate atomically writes the posting lists and sets of an update,
+	// replacing the existing ones, and removes the deleted posting lists and
+	// sets.
+	applyUpdate(u *indexUpdate) error
+}
+
+// PostgresStore is an IndexStore backed by a posting list table and a set
+// table in Postgres, with tokens stored in integer array columns.
+type PostgresStore struct {
+	opts      storeOptions
+	db        *sql.DB
+	listTable string
+	setTable  string
+	// the sets deleted but not yet compacted, read from the table of deleted
+	// sets on first use and kept up to date by deleteSets and applyUpdate
+	deletedLock sync.Mutex
+	deleted     map[int64]bool
+}
+
+// NewPostgresStore creates an IndexStore using the posting list table and the
+// set table. With WithCompressedLists or WithCompressedSets, the posting
+// lists or the sets are read from the encoded_list or the encoded_tokens
+// column written by a PostgresIndexWriter with the same option, and updates
+// write both the compressed and the array columns. The deleted sets are read
+// once and kept in memory, so sets deleted by another process are not seen
+// until the store is created again, see DeletedSets.
+func NewPostgresStore(db *sql.DB, listTable, setTable string, opts ...StoreOption) *PostgresStore {
+	return &PostgresStore{
+		opts:      newStoreOptions(opts),
+		db:        db,
+		listTable: listTable,
+		setTable:  setTable,
+	}
+}
+
+// InvertedList reads the posting list of a token.
+func (s *PostgresStore) InvertedList(token int64) ([]ListEntry, error) {
+	return s.InvertedListContext(context.Background(), token)
+}
+
+// InvertedListContext reads the posting list of a token, the query is
+// canceled when ctx is done.
+func (s *PostgresStore) InvertedListContext(ctx context.Context, token int64) ([]ListEntry, error) {
+	if s.opts.compressLists {
+		return encodedInvertedList(ctx, s.db, s.listTable, token)
+	}
+	return InvertedListContext(ctx, s.db, s.listTable, token)
+}
+
+// SetTokens reads all tokens of a set.
+func (s *PostgresStore) SetTokens(setID int64) ([]int64, error) {
+	return s.SetTokensContext(context.Background(), setID)
+}
+
+// SetTokensContext reads all tokens of a set, the query is canceled when ctx
+// is done.
+func (s *PostgresStore) SetTokensContext(ctx context.Context, setID int64) ([]int64, error) {
+	if s.opts.compressSets {
+		return encodedSetTokens(ctx, s.db, s.setTable, setID, 0, math.MaxInt32)
+	}
+	return SetTokensContext(ctx, s.db, s.setTable, setID)
+}
+
+// SetTokensSuffix reads the tokens of a set starting from startPos.
+func (s *PostgresStore) SetTokensSuffix(setID int64, startPos int) ([]int64, error) {
+	return s.SetTokensSuffixContext(context.Background(), setID, startPos)
+}
+
+// SetTokensSuffixContext reads the tokens of a set starting from startPos,
+// the query is canceled when ctx is done.
+func (s *PostgresStore) SetTokensSuffixContext(ctx context.Context, setID int64, startPos int) ([]int64, error) {
+	if s.opts.compressSets {
+		return encodedSetTokens(ctx, s.db, s.setTable, setID, startPos, math.MaxInt32)
+	}
+	return setTokensSuffix(ctx, s.db, s.setTable, setID, startPos)
+}
+
+// SetTokensSubset reads the tokens of a set from startPos to endPos.
+func (s *PostgresStore) SetTokensSubset(setID int64, startPos, endPos int) ([]int64, error) {
+	if s.opts.compressSets {
+		return encodedSetTokens(context.Background(), s.db, s.setTable, setID, startPos, endPos)
+	}
+	return setTokensSubset(context.Background(), s.db, s.setTable, setID, startPos, endPos)
+}
+
+// TokenEntries reads the metadata of the given tokens.
+func (s *PostgresStore) TokenEntries(tokens []int64) ([]TokenEntry, error) {
+	rows, err := s.db.Query(fmt.Sprintf(`
+		SELECT token, raw_token, frequency, duplicate_group_id FROM %s
+		WHERE token = ANY($1)
+		ORDER BY token ASC;`, pq.QuoteIdentifier(s.listTable)), pq.Array(tokens))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	entries := make([]TokenEntry, 0, len(tokens))
+	for rows.Next() {
+		var entry TokenEntry
+		if err := rows.Scan(&entry.Token, &entry.RawToken, &entry.Frequency, &entry.GroupID); err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+	return entries, rows.Err()
+}
+
+// ScanTokenEntries calls fn with the metadata of every token.
+func (s *PostgresStore) ScanTokenEntries(fn func(entry TokenEntry) error) error {
+	rows, err := s.db.Query(fmt.Sprintf(`
+		SELECT raw_token, token, frequency, duplicate_group_id FROM %s;`,
+		pq.QuoteIdentifier(s.listTable)))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var entry TokenEntry
+		if err := rows.Scan(&entry.RawToken, &entry.Token, &entry.Frequency, &entry.GroupID); err != nil {
+			return err
+		}
+		if err := fn(entry); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// NumTokens returns the number of rows in the posting list table.
+func (s *PostgresStore) NumTokens() (int, error) {
+	var count int
+	err := s.db.QueryRow(fmt.Sprintf(`
+		SELECT count(*) FROM %s;`, pq.QuoteIdentifier(s.listTable))).Scan(&count)
+	return count, err
+}
+
+// MaxGroupID returns the maximum duplicate group id in the posting list table.
+func (s *PostgresStore) MaxGroupID() (int64, error) {
+	var maxGid int64
+	err := s.db.QueryRow(fmt.Sprintf(`
+		SELECT max(duplicate_group_id) FROM %s;`, pq.QuoteIdentifier(s.listTable))).Scan(&maxGid)
+	return maxGid, err
+}
+
+// Sums the hashes of the metadata and the raw token of every token in the
+// posting list table, which Postgres computes without returning the tokens
+func (s *PostgresStore) tokenChecksum() (uint64, error) {
+	var sum int64
+	err := s.db.QueryRow(fmt.Sprintf(`
+		SELECT coalesce(sum(hashtext(concat_ws(':', token, frequency, duplicate_group_id,
+			raw_token))), 0)
+		FROM %s;`, pq.QuoteIdentifier(s.listTable))).Scan(&sum)
+	return uint64(sum), err
+}
+
+// The table of deleted sets, created by the first deletion
+func (s *PostgresStore) deletedTable() string {
+	return pq.QuoteIdentifier(s.setTable + "_deleted")
+}
+
+// DeletedSets returns the sets that are deleted but not yet compacted. The
+// table of deleted sets is read once, then the sets deleted and compacted
+// through the store are kept in memory, so searches do not query the table.
+// Sets deleted through another PostgresStore of the same index, such as one
+// in another process, are only seen by a new PostgresStore.
+func (s *PostgresStore) DeletedSets() ([]int64, error) {
+	s.deletedLock.Lock()
+	defer s.deletedLock.Unlock()
+	if err := s.loadDeletedSets(); err != nil {
+		return nil, err
+	}
+	setIDs := make([]int64, 0, len(s.deleted))
+	for setID := range s.deleted {
+		setIDs = append(setIDs, setID)
+	}
+	return setIDs, nil
+}
+
+// Reads the table of deleted sets if it is not read yet
+func (s *PostgresStore) loadDeletedSets() error {
+	if s.deleted != nil {
+		return nil
+	}
+	setIDs, err := s.readDeletedSets()
+	if err != nil {
+		return err
+	}
+	s.deleted = make(map[int64]bool, len(setIDs))
+	for _, setID := range setIDs {
+		s.deleted[setID] = true
+	}
+	return nil
+}
+
+func (s *PostgresStore) readDeletedSets() ([]int64, error) {
+	rows, err := s.db.Query(fmt.Sprintf(`SELECT id FROM %s;`, s.deletedTable()))
+	if err != nil {
+		var pqErr *pq.Error
+		if errors.As(err, &pqErr) && pqErr.Code == "42P01" {
+			// No set has been deleted
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer rows.Close()
+	var setIDs []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		setIDs = append(setIDs, id)
+	}
+	return setIDs, rows.Err()
+}
+
+func (s *PostgresStore) deleteSets(setIDs []int64) error {
+	s.deletedLock.Lock()
+	defer s.deletedLock.Unlock()
+	if err := s.loadDeletedSets(); err != nil {
+		return err
+	}
+	if _, err := s.db.Exec(fmt.Sprintf(`
+		CREATE TABLE IF NOT EXISTS %s (id integer PRIMARY KEY);`, s.deletedTable())); err != nil {
+		return err
+	}
+	if _, err := s.db.Exec(fmt.Sprintf(`
+		INSERT INTO %s SELECT unnest($1::integer[]) ON CONFLICT DO NOTHING;`,
+		s.deletedTable()), pq.Array(setIDs)); err != nil {
+		return err
+	}
+	for _, setID := range setIDs {
+		s.deleted[setID] = true
+	}
+	return nil
+}
+
+func (s *PostgresStore) rawTokenEntries(rawTokens [][]byte) ([]TokenEntry, error) {
+	rows, err := s.db.Query(fmt.Sprintf(`
+		SELECT token, raw_token, frequency, duplicate_group_id FROM %s
+		WHERE raw_token = ANY($1);`, pq.QuoteIdentifier(s.listTable)), pq.Array(rawTokens))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	entries := make([]TokenEntry, 0, len(rawTokens))
+	for rows.Next() {
+		var entry TokenEntry
+		if err := rows.Scan(&entry.Token, &entry.RawToken, &entry.Frequency, &entry.GroupID); err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+	return entries, rows.Err()
+}
+
+func (s *PostgresStore) nextToken() (int64, error) {
+	var next int64
+	err := s.db.QueryRow(fmt.Sprintf(`
+		SELECT coalesce(max(token), -1) + 1 FROM %s;`, pq.QuoteIdentifier(s.listTable))).Scan(&next)
+	return next, err
+}
+
+// Writes the update in a transaction. The number of non-singular tokens of
+// a set is kept up to date for the existing sets that contain tokens whose
+// frequencies cross 1.
+func (s *PostgresStore) applyUpdate(u *indexUpdate) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	if err := s.writeUpdate(tx, u); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if len(u.deletedSets) == 0 {
+		return tx.Commit()
+	}
+	s.deletedLock.Lock()
+	defer s.deletedLock.Unlock()
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	for _, setID := range u.deletedSets {
+		delete(s.deleted, setID)
+	}
+	return nil
+}
+
+func (s *PostgresStore) writeUpdate(tx *sql.Tx, u *indexUpdate) error {
+	newSets := make(map[int64]bool, len(u.setIDs))
+	for _, setID := range u.setIDs {
+		newSets[setID] = true
+	}
+	frequencies := make(map[int64]int, len(u.tokens))
+	nonSingularCounts := make(map[int64]int)
+	for i, entry := range u.tokens {
+		list := u.lists[i]
+		setIDs := make([]int64, len(list))
+		sizes := make([]int64, len(list))
+		matchPositions := make([]int64, len(list))
+		for j, e := range list {
+			setIDs[j] = e.ID
+			sizes[j] = int64(e.Size)
+			matchPositions[j] = int64(e.MatchPosition)
+		}
+		frequencies[entry.Token] = entry.Frequency
+		var change int
+		if prev := u.prevFrequencies[i]; prev <= 1 && entry.Frequency > 1 {
+			change = 1
+		} else if prev > 1 && entry.Frequency <= 1 {
+			change = -1
+		}
+		if change != 0 {
+			for _, e := range list {
+				if !newSets[e.ID] {
+					nonSingularCounts[e.ID] += change
+				}
+			}
+		}
+		res, err := tx.Exec(fmt.Sprintf(`
+			UPDATE %s SET frequency = $2, duplicate_group_id = $3,
+			set_ids = $4, set_sizes = $5, match_positions = $6
+			WHERE token = $1;`, pq.QuoteIdentifier(s.listTable)),
+			entry.Token, entry.Frequency, entry.GroupID,
+			pq.Array(setIDs), pq.Array(sizes), pq.Array(matchPositions))
+		if err != nil {
+			return err
+		}
+		if n, err := res.RowsAffected(); err != nil {
+			return err
+		} else if n == 0 {
+			if _, err := tx.Exec(fmt.Sprintf(`
+				INSERT INTO %s (token, frequency, duplicate_group_id, raw_token,
+				set_ids, set_sizes, match_positions)
+				VALUES ($1, $2, $3, $4, $5, $6, $7);`, pq.QuoteIdentifier(s.listTable)),
+				entry.Token, entry.Frequency, entry.GroupID, entry.RawToken,
+				pq.Array(setIDs), pq.Array(sizes), pq.Array(matchPositions)); err != nil {
+				return err
+			}
+		}
+		if s.opts.compressLists {
+			if _, err := tx.Exec(fmt.Sprintf(`
+				UPDATE %s SET encoded_list = $2 WHERE token = $1;`,
+				pq.QuoteIdentifier(s.listTable)),
+				entry.Token, appendEncodedList(nil, list)); err != nil {
+				return err
+			}
+		}
+	}
+	for setID, count := range nonSingularCounts {
+		if count == 0 {
+			continue
+		}
+		if _, err := tx.Exec(fmt.Sprintf(`
+			UPDATE %s SET num_non_singular_token = num_non_singular_token + $2
+			WHERE id = $1;`, pq.QuoteIdentifier(s.setTable)), setID, count); err != nil {
+			return err
+		}
+	}
+	for i, setID := range u.setIDs {
+		var numNonSingular int
+		for _, token := range u.sets[i] {
+			if frequencies[token] > 1 {
+				numNonSingular++
+			}
+		}
+		if s.opts.compressSets {
+			if _, err := tx.Exec(fmt.Sprintf(`
+				INSERT INTO %s (id, size, num_non_singular_token, tokens, encoded_tokens)
+				VALUES ($1, $2, $3, $4, $5);`, pq.QuoteIdentifier(s.setTable)),
+				setID, len(u.sets[i]), numNonSingular, pq.Array(u.sets[i]),
+				appendEncodedSet(nil, u.sets[i])); err != nil {
+				return err
+			}
+			continue
+		}
+		if _, err := tx.Exec(fmt.Sprintf(`
+			INSERT INTO %s (id, size, num_non_singular_token, tokens)
+			VALUES ($1, $2, $3, $4);`, pq.QuoteIdentifier(s.setTable)),
+			setID, len(u.sets[i]), numNonSingular, pq.Array(u.sets[i])); err != nil {
+			return err
+		}
+	}
+	if len(u.deletedTokens) > 0 {
+		if _, err := tx.Exec(fmt.Sprintf(`
+			DELETE FROM %s WHERE token = ANY($1);`, pq.QuoteIdentifier(s.listTable)),
+			pq.Array(u.deletedTokens)); err != nil {
+			return err
+		}
+	}
+	if len(u.deletedSets) > 0 {
+		if _, err := tx.Exec(fmt.Sprintf(`
+			DELETE FROM %s WHERE id = ANY($1);`, pq.QuoteIdentifier(s.setTable)),
+			pq.Array(u.deletedSets)); err != nil {
+			return err
+		}
+		if _, err := tx.Exec(fmt.Sprintf(`
+			DELETE FROM %s WHERE id = ANY($1);`, s.deletedTable()),
+			pq.Array(u.deletedSets)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,159 @@
+package joise
+
+import (
+	"database/sql"
+	"fmt"
+	"math/rand"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/lib/pq"
+)
+
+// Opens the Postgres database given by the JOSIE_TEST_POSTGRES connection
+// string, the test is skipped if it is not set
+func openTestPostgres(t *testing.T) *sql.DB {
+	t.Helper()
+	conn := os.Getenv("JOSIE_TEST_POSTGRES")
+	if conn == "" {
+		t.Skip("JOSIE_TEST_POSTGRES is not set")
+	}
+	db, err := sql.Open("postgres", conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+// Builds a Postgres index of the raw sets with BuildIndex in new tables,
+// which are dropped when the test ends
+func buildTestPostgresIndex(t *testing.T, db *sql.DB, sets map[int64][]string, opts ...StoreOption) (listTable, setTable string) {
+	t.Helper()
+	prefix := fmt.Sprintf("josie_test_%d", rand.Int63())
+	listTable, setTable = prefix+"_lists", prefix+"_sets"
+	t.Cleanup(func() {
+		for _, table := range []string{listTable, setTable, setTable + "_deleted"} {
+			db.Exec(fmt.Sprintf(`DROP TABLE IF EXISTS %s;`, pq.QuoteIdentifier(table)))
+		}
+	})
+	w, err := NewPostgresIndexWriter(db, listTable, setTable, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var input strings.Builder
+	for id, tokens := range sets {
+		fmt.Fprintf(&input, "%d %s\n", id, strings.Join(tokens, " "))
+	}
+	buildOpts := DefaultBuildOptions()
+	buildOpts.TempDir = t.TempDir()
+	if err := BuildIndex(strings.NewReader(input.String()), w, buildOpts); err != nil {
+		w.Close()
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return listTable, setTable
+}
+
+func TestPostgresStore(t *testing.T) {
+	db := openTestPostgres(t)
+	r := rand.New(rand.NewSource(5))
+	sets := randomRawSets(r, 200, 300)
+	// A set spanning several blocks when compressed
+	var large []string
+	for i := 0; i < 300; i++ {
+		large = append(large, fmt.Sprintf("t%d", i))
+	}
+	sets[1000] = large
+	mem := buildTestMemStore(t, sets)
+	for _, opts := range [][]StoreOption{nil, {WithCompressedLists(), WithCompressedSets()}} {
+		listTable, setTable := buildTestPostgresIndex(t, db, sets, opts...)
+		store := NewPostgresStore(db, listTable, setTable, opts...)
+		for id := range sets {
+			want, _ := mem.SetTokens(id)
+			got, err := store.SetTokens(id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Fatalf("set %d: got %v, want %v", id, got, want)
+			}
+			for _, pos := range [][2]int{{0, 1}, {1, 3}, {127, 129}, {128, len(want)}, {len(want), len(want)}} {
+				if pos[0] > len(want) {
+					continue
+				}
+				got, err := store.SetTokensSubset(id, pos[0], pos[1])
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !reflect.DeepEqual(got, want[pos[0]:min(pos[1], len(want))]) {
+					t.Fatalf("set %d [%d, %d): got %v", id, pos[0], pos[1], got)
+				}
+				got, err = store.SetTokensSuffix(id, pos[0])
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !reflect.DeepEqual(got, want[pos[0]:]) {
+					t.Fatalf("set %d from %d: got %v", id, pos[0], got)
+				}
+			}
+		}
+		tb, err := CreateTokenTableMem(store, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkSearchAlgorithms(t, r, store, tb, sets)
+
+		// The token checksum changes with a raw token
+		checksum, err := store.tokenChecksum()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := db.Exec(fmt.Sprintf(`UPDATE %s SET raw_token = 'renamed' WHERE token = 0;`,
+			pq.QuoteIdentifier(listTable))); err != nil {
+			t.Fatal(err)
+		}
+		if changed, err := store.tokenChecksum(); err != nil || changed == checksum {
+			t.Fatalf("token checksum %d after renaming a raw token: %v", changed, err)
+		}
+	}
+}
+
+func TestPostgresStoreDeletedSets(t *testing.T) {
+	db := openTestPostgres(t)
+	r := rand.New(rand.NewSource(10))
+	sets := randomRawSets(r, 100, 200)
+	listTable, setTable := buildTestPostgresIndex(t, db, sets)
+	store := NewPostgresStore(db, listTable, setTable)
+	if deleted, err := store.DeletedSets(); err != nil || len(deleted) != 0 {
+		t.Fatalf("got deleted sets %v, %v", deleted, err)
+	}
+	tb, err := CreateTokenTableMem(store, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	updater := NewIndexUpdater(store, tb)
+	if err := updater.DeleteSets([]int64{1, 2, 3}); err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []int64{1, 2, 3} {
+		delete(sets, id)
+	}
+	checkSearchAlgorithms(t, r, store, tb, sets)
+	// A new store reads the deleted sets from the table
+	deleted, err := NewPostgresStore(db, listTable, setTable).DeletedSets()
+	if err != nil || len(deleted) != 3 {
+		t.Fatalf("got deleted sets %v, %v", deleted, err)
+	}
+	if err := updater.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	if deleted, err := store.DeletedSets(); err != nil || len(deleted) != 0 {
+		t.Fatalf("got deleted sets %v after compaction, %v", deleted, err)
+	}
+	checkSearchAlgorithms(t, r, store, tb, sets)
+}
@@ -0,0 +1,68 @@
+package joise
+
+import "sort"
+
+// resultStream emits the results of a top-k search as soon as they are
+// final, in decreasing overlap order.
+//
+// A result in the running top-k is final once its overlap is at least the
+// upper bound overlap of every set not in the running top-k: such sets
+// replace a result only if their overlaps are strictly greater than the kth
+// overlap, so the result is never replaced. Later results have overlaps at
+// most the upper bound, so the results are emitted in order.
+type resultStream struct {
+	emit    func(searchResult) error
+	emitted map[int64]bool
+}
+
+func newResultStream(emit func(searchResult) error) *resultStream {
+	if emit == nil {
+		return nil
+	}
+	return &resultStream{
+		emit:    emit,
+		emitted: make(map[int64]bool),
+	}
+}
+
+// Emits the results in the running top-k that cannot be replaced by the
+// sets not seen yet, whose overlaps are at most unseenUpperbound, and the
+// candidates in the counter, whose tokens up to queryCurrentPosition in the
+// query have been read.
+func (rs *resultStream) flush(h *searchResultHeap, unseenUpperbound int,
+	counter map[int64]*candidateEntry, querySize, queryCurrentPosition int) error {
+	if rs == nil {
+		return nil
+	}
+	var pending []searchResult
+	for _, r := range *h {
+		if !rs.emitted[r.ID] && r.Overlap >= unseenUpperbound {
+			pending = append(pending, r)
+		}
+	}
+	if len(pending) == 0 {
+		return nil
+	}
+	// Find the upper bound of the counter only when some results may be
+	// final
+	upperbound := unseenUpperbound
+	for _, ce := range counter {
+		upperbound = max(upperbound, ce.upperboundOverlap(querySize, queryCurrentPosition))
+	}
+	sort.Slice(pending, func(i, j int) bool {
+		if pending[i].Overlap == pending[j].Overlap {
+			return pending[i].ID < pending[j].ID
+		}
+		return pending[i].Overlap > pending[j].Overlap
+	})
+	for _, r := range pending {
+		if r.Overlap < upperbound {
+			break
+		}
+		if err := rs.emit(r); err != nil {
+			return err
+		}
+		rs.emitted[r.ID] = true
+	}
+	return nil
+}
@@ -0,0 +1,90 @@
+package joise
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"testing"
+)
+
+// listCountingStore counts the posting lists read
+type listCountingStore struct {
+	IndexStore
+	numListRead int
+}
+
+func (s *listCountingStore) InvertedList(token int64) ([]ListEntry, error) {
+	s.numListRead++
+	return s.IndexStore.InvertedList(token)
+}
+
+func TestStreamTopK(t *testing.T) {
+	defer func(size int) { batchSize = size }(batchSize)
+	batchSize = 3
+	r := rand.New(rand.NewSource(16))
+	sets := randomRawSets(r, 500, 400)
+	memStore := buildTestMemStore(t, sets)
+	tb, err := CreateTokenTableMem(memStore, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := &listCountingStore{IndexStore: memStore}
+	searcher := NewSearcher(store, tb, DefaultCostParameters())
+	ctx := context.Background()
+	var numEarly int
+	for q := 0; q < 20; q++ {
+		query := randomQuery(r, sets)
+		overlaps := bruteForceOverlaps(sets, query.RawTokens)
+		for _, k := range []int{1, 5, 20} {
+			store.numListRead = 0
+			var results []searchResult
+			var numListRead []int
+			stats, err := searcher.StreamTopK(ctx, query, k, func(result Result) error {
+				results = append(results, searchResult{ID: result.ID, Overlap: result.Overlap})
+				numListRead = append(numListRead, store.numListRead)
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			checkTopK(t, "StreamTopK", results, overlaps, k)
+			for _, n := range numListRead {
+				if n < stats.NumListRead {
+					numEarly++
+				}
+			}
+		}
+
+		// Threshold search results are streamed in any order
+		var numResults int
+		_, err := searcher.StreamThresholdSearch(ctx, query, 5, func(result Result) error {
+			if result.Overlap != overlaps[result.ID] || result.Overlap < 5 {
+				t.Fatalf("set %d with overlap %d (exact %d)", result.ID, result.Overlap, overlaps[result.ID])
+			}
+			numResults++
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := 0
+		for _, overlap := range overlaps {
+			if overlap >= 5 {
+				want++
+			}
+		}
+		if numResults != want {
+			t.Fatalf("got %d threshold search results, want %d", numResults, want)
+		}
+	}
+	if numEarly == 0 {
+		t.Fatal("no results are streamed before the search completes")
+	}
+
+	// The search stops at the first error of the callback
+	errStop := errors.New("stop")
+	_, err = searcher.StreamTopK(ctx, randomQuery(r, sets), 20, func(Result) error { return errStop })
+	if !errors.Is(err, errStop) {
+		t.Fatalf("got error %v, want %v", err, errStop)
+	}
+}
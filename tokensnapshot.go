@@ -0,0 +1,328 @@
+package joise
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// A token table snapshot is a single file with the same header as the files
+// of an embedded index, whose payload is:
+//
+//	fingerprint  the number of tokens, the maximum duplicate group id and
+//	             the token checksum of the index, each an int64
+//	counts       the number of token map entries, colliding raw tokens and
+//	             frequencies, each an int64
+//	entries      token map entries sorted by hash value: hash value and
+//	             check hash value (uint64), token and duplicate group id
+//	             (uint32)
+//	colliding    colliding raw tokens: hash value (uint64), token, duplicate
+//	             group id and raw token length (uint32), raw token
+//	frequencies  the frequency of every duplicate group (uint32)
+//
+// A snapshot is stale when the fingerprint of the index differs from the
+// one it was written with.
+
+const (
+	tokenSnapshotKind       = 6
+	tokenSnapshotPrefixSize = 6 * 8
+)
+
+var (
+	// ErrStaleTokenTableSnapshot is returned when loading a token table
+	// snapshot written before the index was changed.
+	ErrStaleTokenTableSnapshot = errors.New("stale token table snapshot")
+	// ErrCorruptTokenTableSnapshot is returned when a token table snapshot
+	// is truncated, has an unexpected header or fails checksum
+	// verification.
+	ErrCorruptTokenTableSnapshot = errors.New("corrupt token table snapshot")
+)
+
+// tokenChecksumStore is an IndexStore that computes a checksum of the
+// metadata and the raw tokens of all tokens without reading them into
+// memory, which detects stale token table snapshots.
+type tokenChecksumStore interface {
+	tokenChecksum() (uint64, error)
+}
+
+// tokenTableFingerprint identifies the tokens of an index
+type tokenTableFingerprint struct {
+	numTokens  int64
+	maxGroupID int64
+	checksum   uint64
+}
+
+// Computes the fingerprint of the tokens in the index, the checksum is 0 if
+// the store cannot compute it
+func fingerprintTokens(store IndexStore) (tokenTableFingerprint, error) {
+	var fp tokenTableFingerprint
+	if c, ok := store.(*CachedStore); ok {
+		store = c.IndexStore
+	}
+	numTokens, err := store.NumTokens()
+	if err != nil {
+		return fp, err
+	}
+	fp.numTokens = int64(numTokens)
+	if fp.maxGroupID, err = store.MaxGroupID(); err != nil {
+		return fp, err
+	}
+	if s, ok := store.(tokenChecksumStore); ok {
+		if fp.checksum, err = s.tokenChecksum(); err != nil {
+			return fp, err
+		}
+	}
+	return fp, nil
+}
+
+// WriteTokenTableSnapshot writes a token table created by
+// CreateTokenTableMem or CreateTokenTableCompact to a snapshot file, which
+// LoadTokenTableSnapshot or LoadTokenTableCompactSnapshot loads much faster
+// than reading all tokens from the index. The index must not be updated
+// while the snapshot is written.
+func WriteTokenTableSnapshot(path string, tb TokenTable, store IndexStore) error {
+	table, ok := tb.(*tokenTableMem)
+	if !ok {
+		return fmt.Errorf("token table of type %T cannot be written to a snapshot", tb)
+	}
+	fp, err := fingerprintTokens(store)
+	if err != nil {
+		return err
+	}
+	// Write to a temporary file renamed after it is complete, so a snapshot
+	// being written is never loaded
+	dir, name := filepath.Split(path)
+	tmpName := name + ".tmp"
+	fw, err := createFileWriter(dir, tmpName)
+	if err != nil {
+		return err
+	}
+	fw.header.Kind = tokenSnapshotKind
+	if err := table.writeSnapshot(fw, fp); err != nil {
+		fw.f.Close()
+		os.Remove(filepath.Join(dir, tmpName))
+		return err
+	}
+	if err := fw.close(); err != nil {
+		os.Remove(filepath.Join(dir, tmpName))
+		return err
+	}
+	return os.Rename(filepath.Join(dir, tmpName), path)
+}
+
+func (tb *tokenTableMem) writeSnapshot(fw *fileWriter, fp tokenTableFingerprint) error {
+	tb.lock.RLock()
+	defer tb.lock.RUnlock()
+	entries := make([]tokenTableEntry, 0, len(tb.tokenMap)+len(tb.sorted))
+	for hashValue, entry := range tb.tokenMap {
+		entries = append(entries, tokenTableEntry{hash: hashValue, tokenMapEntry: entry})
+	}
+	for _, e := range tb.sorted {
+		if e.Token != removedToken {
+			entries = append(entries, e)
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].hash < entries[j].hash })
+	var numColliding int
+	for _, colliding := range tb.collisions {
+		numColliding += len(colliding)
+	}
+	for _, v := range []int64{fp.numTokens, fp.maxGroupID, int64(fp.checksum),
+		int64(len(entries)), int64(numColliding), int64(len(tb.frequencies))} {
+		if err := fw.writeInt64(v); err != nil {
+			return err
+		}
+	}
+	for _, e := range entries {
+		if err := fw.writeInt64(int64(e.hash)); err != nil {
+			return err
+		}
+		if err := fw.writeInt64(int64(e.Check)); err != nil {
+			return err
+		}
+		if err := fw.writeUint32(uint32(e.Token)); err != nil {
+			return err
+		}
+		if err := fw.writeUint32(uint32(e.GroupID)); err != nil {
+			return err
+		}
+	}
+	for hashValue, colliding := range tb.collisions {
+		for _, c := range colliding {
+			if err := fw.writeInt64(int64(hashValue)); err != nil {
+				return err
+			}
+			for _, v := range []uint32{uint32(c.entry.Token), uint32(c.entry.GroupID),
+				uint32(len(c.rawToken))} {
+				if err := fw.writeUint32(v); err != nil {
+					return err
+				}
+			}
+			if _, err := fw.Write(c.rawToken); err != nil {
+				return err
+			}
+		}
+	}
+	for _, frequency := range tb.frequencies {
+		if err := fw.writeUint32(uint32(frequency)); err != nil {
+			return err
+		}
+	}
+	fw.header.Count = uint64(len(entries) + numColliding)
+	return nil
+}
+
+// LoadTokenTableSnapshot loads a token table from a snapshot file written
+// by WriteTokenTableSnapshot. Returns ErrStaleTokenTableSnapshot if the
+// tokens of the index have changed since the snapshot was written, which
+// is detected by the number of tokens, the maximum duplicate group id and
+// a checksum of the token metadata and raw tokens computed by the index
+// store.
+func LoadTokenTableSnapshot(path string, store IndexStore, ignoreSelf bool) (TokenTable, error) {
+	return loadTokenTableSnapshot(path, store, ignoreSelf, false)
+}
+
+// LoadTokenTableCompactSnapshot loads a token table in the memory-efficient
+// form of CreateTokenTableCompact from a snapshot file, see
+// LoadTokenTableSnapshot.
+func LoadTokenTableCompactSnapshot(path string, store IndexStore, ignoreSelf bool) (TokenTable, error) {
+	return loadTokenTableSnapshot(path, store, ignoreSelf, true)
+}
+
+func loadTokenTableSnapshot(path string, store IndexStore, ignoreSelf, compact bool) (TokenTable, error) {
+	data, err := mmapFile(path)
+	if err != nil {
+		return nil, err
+	}
+	defer munmapFile(data)
+	var header fileHeader
+	if len(data) < fileHeaderSize+tokenSnapshotPrefixSize {
+		return nil, fmt.Errorf("%w: %s is truncated", ErrCorruptTokenTableSnapshot, path)
+	}
+	if err := binary.Read(bytes.NewReader(data[:fileHeaderSize]), binary.LittleEndian, &header); err != nil {
+		return nil, err
+	}
+	if header.Magic != fileStoreMagic || header.Kind != tokenSnapshotKind ||
+		header.Version != fileStoreVersion {
+		return nil, fmt.Errorf("%w: %s has an unexpected header", ErrCorruptTokenTableSnapshot, path)
+	}
+	payload := data[fileHeaderSize:]
+	if crc32.Checksum(payload, crc32c) != header.Checksum {
+		return nil, fmt.Errorf("%w: checksum mismatch in %s", ErrCorruptTokenTableSnapshot, path)
+	}
+	fp, err := fingerprintTokens(store)
+	if err != nil {
+		return nil, err
+	}
+	if getInt64(payload, 0) != fp.numTokens || getInt64(payload, 1) != fp.maxGroupID ||
+		uint64(getInt64(payload, 2)) != fp.checksum {
+		return nil, fmt.Errorf("%w: %s", ErrStaleTokenTableSnapshot, path)
+	}
+	numEntries, numColliding, numFrequencies := getInt64(payload, 3), getInt64(payload, 4),
+		getInt64(payload, 5)
+	size := int64(len(payload) - tokenSnapshotPrefixSize)
+	if numEntries < 0 || numColliding < 0 || numFrequencies < 0 || numEntries > size/24 ||
+		numColliding > size/20 || numFrequencies > size/4 ||
+		numEntries*24+numColliding*20+numFrequencies*4 > size {
+		return nil, fmt.Errorf("%w: %s is truncated", ErrCorruptTokenTableSnapshot, path)
+	}
+	table := &tokenTableMem{
+		store:       store,
+		collisions:  make(map[uint64][]collidingToken),
+		frequencies: make([]int32, numFrequencies),
+		ignoreSelf:  ignoreSelf,
+	}
+	if compact {
+		table.sorted = make([]tokenTableEntry, 0, numEntries)
+		table.tokenMap = make(map[uint64]tokenMapEntry)
+	} else {
+		table.tokenMap = make(map[uint64]tokenMapEntry, numEntries)
+	}
+	b := payload[tokenSnapshotPrefixSize:]
+	for i := int64(0); i < numEntries; i++ {
+		hashValue := binary.LittleEndian.Uint64(b)
+		entry := tokenMapEntry{
+			Token:   int32(binary.LittleEndian.Uint32(b[16:])),
+			GroupID: int32(binary.LittleEndian.Uint32(b[20:])),
+			Check:   binary.LittleEndian.Uint64(b[8:]),
+		}
+		b = b[24:]
+		if !compact {
+			table.tokenMap[hashValue] = entry
+			continue
+		}
+		if n := len(table.sorted); n > 0 && table.sorted[n-1].hash >= hashValue {
+			return nil, fmt.Errorf("%w: %s has unsorted entries", ErrCorruptTokenTableSnapshot, path)
+		}
+		table.sorted = append(table.sorted, tokenTableEntry{hash: hashValue, tokenMapEntry: entry})
+	}
+	for i := int64(0); i < numColliding; i++ {
+		if len(b) < 20 || len(b)-20 < int(binary.LittleEndian.Uint32(b[16:])) {
+			return nil, fmt.Errorf("%w: %s is truncated", ErrCorruptTokenTableSnapshot, path)
+		}
+		hashValue := binary.LittleEndian.Uint64(b)
+		n := int(binary.LittleEndian.Uint32(b[16:]))
+		rawToken := append([]byte(nil), b[20:20+n]...)
+		table.collisions[hashValue] = append(table.collisions[hashValue], collidingToken{
+			rawToken: rawToken,
+			entry: tokenMapEntry{
+				Token:   int32(binary.LittleEndian.Uint32(b[8:])),
+				GroupID: int32(binary.LittleEndian.Uint32(b[12:])),
+				Check:   checkHash(rawToken),
+			},
+		})
+		b = b[20+n:]
+	}
+	if int64(len(b)) != numFrequencies*4 {
+		return nil, fmt.Errorf("%w: %s has an unexpected size", ErrCorruptTokenTableSnapshot, path)
+	}
+	for i := range table.frequencies {
+		table.frequencies[i] = int32(binary.LittleEndian.Uint32(b[i*4:]))
+	}
+	return table, nil
+}
+
+// CreateTokenTableMemSnapshot loads a token table from the snapshot file,
+// or creates it with CreateTokenTableMem and writes the snapshot file if the
+// file does not exist, is stale or is corrupt.
+func CreateTokenTableMemSnapshot(path string, store IndexStore, ignoreSelf bool) (TokenTable, error) {
+	return createTokenTableSnapshot(path, store, ignoreSelf, false)
+}
+
+// CreateTokenTableCompactSnapshot is CreateTokenTableMemSnapshot for the
+// memory-efficient token table of CreateTokenTableCompact.
+func CreateTokenTableCompactSnapshot(path string, store IndexStore, ignoreSelf bool) (TokenTable, error) {
+	return createTokenTableSnapshot(path, store, ignoreSelf, true)
+}
+
+func createTokenTableSnapshot(path string, store IndexStore, ignoreSelf, compact bool) (TokenTable, error) {
+	tb, err := loadTokenTableSnapshot(path, store, ignoreSelf, compact)
+	if err == nil {
+		log.Printf("Loaded token table snapshot %s", path)
+		return tb, nil
+	}
+	if !errors.Is(err, os.ErrNotExist) && !errors.Is(err, ErrStaleTokenTableSnapshot) &&
+		!errors.Is(err, ErrCorruptTokenTableSnapshot) {
+		return nil, err
+	}
+	log.Printf("Cannot load token table snapshot: %v", err)
+	if compact {
+		tb, err = CreateTokenTableCompact(store, ignoreSelf)
+	} else {
+		tb, err = CreateTokenTableMem(store, ignoreSelf)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := WriteTokenTableSnapshot(path, tb, store); err != nil {
+		return nil, err
+	}
+	log.Printf("Wrote token table snapshot %s", path)
+	return tb, nil
+}
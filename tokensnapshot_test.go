@@ -0,0 +1,87 @@
+package joise
+
+import (
+	"errors"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestTokenTableSnapshot(t *testing.T) {
+	r := rand.New(rand.NewSource(9))
+	sets := randomRawSets(r, 200, 300)
+	store := buildTestMemStore(t, sets)
+	path := filepath.Join(t.TempDir(), "tokens.snapshot")
+	for _, compact := range []bool{false, true} {
+		os.Remove(path)
+		tb, err := createTokenTableSnapshot(path, store, false, compact)
+		if err != nil {
+			t.Fatal(err)
+		}
+		loaded, err := loadTokenTableSnapshot(path, store, false, compact)
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkSearchAlgorithms(t, r, store, loaded, sets)
+		a, b := tb.(*tokenTableMem), loaded.(*tokenTableMem)
+		if !reflect.DeepEqual(a.tokenMap, b.tokenMap) || !reflect.DeepEqual(a.sorted, b.sorted) ||
+			!reflect.DeepEqual(a.frequencies, b.frequencies) {
+			t.Fatal("loaded token table differs from the written one")
+		}
+	}
+
+	// The snapshot is stale once the index is updated
+	updater := NewIndexUpdater(store)
+	if err := updater.AddSet(RawTokenSet{ID: 1000, RawTokens: [][]byte{[]byte("t1")}}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadTokenTableSnapshot(path, store, false); !errors.Is(err, ErrStaleTokenTableSnapshot) {
+		t.Fatalf("got error %v, want %v", err, ErrStaleTokenTableSnapshot)
+	}
+	if _, err := CreateTokenTableMemSnapshot(path, store, false); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadTokenTableSnapshot(path, store, false); err != nil {
+		t.Fatal(err)
+	}
+
+	// A changed raw token with the same token metadata also makes it stale
+	entry := store.tokens[0]
+	delete(store.rawTokens, string(entry.RawToken))
+	entry.RawToken = []byte("renamed")
+	store.tokens[0] = entry
+	store.rawTokens[string(entry.RawToken)] = entry.Token
+	if _, err := LoadTokenTableSnapshot(path, store, false); !errors.Is(err, ErrStaleTokenTableSnapshot) {
+		t.Fatalf("got error %v, want %v", err, ErrStaleTokenTableSnapshot)
+	}
+
+	// A corrupt snapshot is detected and replaced
+	if _, err := CreateTokenTableMemSnapshot(path, store, false); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[len(data)-1]++
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadTokenTableSnapshot(path, store, false); !errors.Is(err, ErrCorruptTokenTableSnapshot) {
+		t.Fatalf("got error %v, want %v", err, ErrCorruptTokenTableSnapshot)
+	}
+	if _, err := CreateTokenTableMemSnapshot(path, store, false); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadTokenTableSnapshot(path, store, false); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, data[:len(data)/2], 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadTokenTableSnapshot(path, store, false); !errors.Is(err, ErrCorruptTokenTableSnapshot) {
+		t.Fatalf("truncated snapshot: got error %v, want %v", err, ErrCorruptTokenTableSnapshot)
+	}
+}
@@ -1,30 +1,67 @@
 package joise
 
 import (
-	"database/sql"
-	"fmt"
+	"bytes"
+	"hash/crc64"
 	"hash/fnv"
 	"log"
 	"sort"
+	"sync"
 
 	"github.com/ekzhu/lshensemble"
-	"github.com/lib/pq"
 )
 
+// The number of token entries read between the progress messages logged
+// while creating a token table
+const tokenProgressInterval = 1000000
+
 // tokenMapEntry is used to map hash value to token
 type tokenMapEntry struct {
 	Token   int32
 	GroupID int32
+	// Check is a second hash value of the raw token, independent of the
+	// hash value mapped to the entry, so a raw token not in the index is not
+	// mistaken for the token of another raw token with the same hash value
+	Check uint64
+}
+
+var checkTable = crc64.MakeTable(crc64.ECMA)
+
+// Returns the check hash value of a raw token, see tokenMapEntry
+func checkHash(rawToken []byte) uint64 {
+	return crc64.Checksum(rawToken, checkTable)
+}
+
+// TokenTable maps a hash value of a raw token into token, frequencies, and group id
+// Use CreateTokenTableMem or CreateTokenTableDisk to create one.
+type TokenTable interface {
+	process(set RawTokenSet) (tokens []int64, counts []int, gids []int64, err error)
+	// processWithRawTokens is process that also returns the raw token of
+	// every token
+	processWithRawTokens(set RawTokenSet) (tokens []int64, counts []int, gids []int64, rawTokens [][]byte, err error)
+	processAndMinhashSignature(set RawTokenSet) (tokens []int64, sig []uint64, err error)
+	// update replaces the metadata of the given tokens after the index changes,
+	// tokens with zero frequency are removed
+	update(entries []TokenEntry)
 }
 
-// tokenTable maps a hash value of a raw token into token, frequencies, and group id
-type tokenTable interface {
-	process(set rawTokenSet) (tokens []int64, counts []int, gids []int64)
-	processAndMinhashSignature(set rawTokenSet) (tokens []int64, sig []uint64)
+// collidingToken is a raw token whose hash value is shared with other raw
+// tokens in the index
+type collidingToken struct {
+	rawToken []byte
+	entry    tokenMapEntry
 }
 
 type tokenTableMem struct {
-	tokenMap    map[uint64]tokenMapEntry
+	lock  sync.RWMutex
+	store IndexStore
+	// the tokens of a compact token table sorted by hash value, see
+	// CreateTokenTableCompact
+	sorted   []tokenTableEntry
+	tokenMap map[uint64]tokenMapEntry
+	// maps the hash values shared by several raw tokens to the raw tokens,
+	// which are not in tokenMap
+	collisions  map[uint64][]collidingToken
 	frequencies []int32 // maps duplicate group ID which is the index to the frequency
 	ignoreSelf  bool    // whether to ignore potential matching of query set to itself in the index
 	// this is only to be true when running experiment using 100% of sets and you know the
@@ -32,74 +69,178 @@ type tokenTableMem struct {
 }
 
 type tokenTableDisk struct {
-	listTable  string
-	db         *sql.DB
+	store      IndexStore
 	ignoreSelf bool // whether to ignore potential matching of query set to itself in the index
 	// this is only to be true when running experiment using 100% of sets and you know the
 	// query sets must be in the index
 }
 
-func createTokenTableMem(db *sql.DB, pgTableLists string, ignoreSelf bool) tokenTable {
-	var table tokenTableMem
+// CreateTokenTableMem loads all tokens in the index into memory. Tokens are
+// looked up by the hash values of their raw tokens, and the raw tokens
+// sharing a hash value with other raw tokens in the index are kept to tell
+// them apart. Every token also keeps a second, independent hash value of its
+// raw token, which is checked on every lookup, so a raw token not in the
+// index is not mistaken for the token of another raw token unless both hash
+// values are equal.
+func CreateTokenTableMem(store IndexStore, ignoreSelf bool) (TokenTable, error) {
+	heapBefore := heapAlloc()
+	table := &tokenTableMem{
+		store:      store,
+		collisions: make(map[uint64][]collidingToken),
+	}
 	table.ignoreSelf = ignoreSelf
 	// First find out how many entries do we have, and initialize the map with capacity
 	log.Println("Initializing token map...")
-	var count int
-	err := db.QueryRow(fmt.Sprintf(`
-		SELECT count(*) FROM %s;`, pq.QuoteIdentifier(pgTableLists))).Scan(&count)
+	count, err := store.NumTokens()
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
 	table.tokenMap = make(map[uint64]tokenMapEntry, count)
 	log.Printf("Initalized token map, %d entries", count)
 	// Then find out what is the maximum duplicate group id, so we can initialize the
 	// frequencies array
 	log.Println("Initializing frequency table...")
-	var maxGid int
-	err = db.QueryRow(fmt.Sprintf(`
-		SELECT max(duplicate_group_id) FROM %s;`, pq.QuoteIdentifier(pgTableLists))).Scan(&maxGid)
+	maxGid, err := store.MaxGroupID()
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
 	table.frequencies = make([]int32, maxGid+1)
 	log.Printf("Initialized frequency table, %d entries", len(table.frequencies))
 
 	// Load all tokens and duplicate group ids
 	log.Println("Filling token table entries...")
-	rows, err := db.Query(fmt.Sprintf(`
-		SELECT raw_token, token, frequency, duplicate_group_id FROM %s;`,
-		pq.QuoteIdentifier(pgTableLists)))
-	if err != nil {
-		panic(err)
-	}
 	count = 0
-	for rows.Next() {
-		var entry tokenMapEntry
-		var rawToken []byte
-		var frequency int32
-		if err := rows.Scan(&rawToken, &entry.Token, &frequency, &entry.GroupID); err != nil {
-			panic(err)
+	h := fnv.New64a()
+	collided := make(map[uint64][]collidingToken)
+	err = store.ScanTokenEntries(func(e TokenEntry) error {
+		entry := tokenMapEntry{
+			Token:   int32(e.Token),
+			GroupID: int32(e.GroupID),
+			Check:   checkHash(e.RawToken),
 		}
 		// Hash
-		h := fnv.New64a()
-		h.Write(rawToken)
+		h.Reset()
+		h.Write(e.RawToken)
 		hashValue := h.Sum64()
 		// Assign the frequency to frequencies table
-		table.frequencies[entry.GroupID] = frequency
-		// Assign the token entry to map
-		// NOTE: no collision has been observed for open data and webtable datasets
-		table.tokenMap[hashValue] = entry
+		table.frequencies[entry.GroupID] = int32(e.Frequency)
+		// Assign the token entry to map, the raw tokens colliding with the
+		// token already in the map are resolved after the scan
+		if existing, exists := table.tokenMap[hashValue]; exists && existing.Token != entry.Token {
+			collided[hashValue] = append(collided[hashValue], collidingToken{
+				rawToken: append([]byte(nil), e.RawToken...),
+				entry:    entry,
+			})
+		} else {
+			table.tokenMap[hashValue] = entry
+		}
 		count++
-		if count%1000 == 0 {
-			fmt.Printf("\r%d read", count)
+		if count%tokenProgressInterval == 0 {
+			log.Printf("Read %d token entries", count)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := table.addCollisions(collided); err != nil {
+		return nil, err
+	}
+	log.Printf("Found %d raw tokens colliding on %d hash values", table.numColliding(), len(table.collisions))
+	heapSize := heapAlloc() - heapBefore
+	log.Printf("Finished creating token map and frequency table, the heap grew by %d bytes (%.1f bytes per token)",
+		heapSize, float64(heapSize)/float64(max(len(table.tokenMap), 1)))
+	return table, nil
+}
+
+// Moves the tokens in the token map sharing hash values with the colliding
+// raw tokens to the collisions, with their raw tokens read from the store
+func (tb *tokenTableMem) addCollisions(collided map[uint64][]collidingToken) error {
+	if len(collided) == 0 {
+		return nil
+	}
+	tokens := make([]int64, 0, len(collided))
+	for hashValue := range collided {
+		tokens = append(tokens, int64(tb.tokenMap[hashValue].Token))
+	}
+	entries, err := tb.store.TokenEntries(tokens)
+	if err != nil {
+		return err
+	}
+	h := fnv.New64a()
+	for _, e := range entries {
+		h.Reset()
+		h.Write(e.RawToken)
+		hashValue := h.Sum64()
+		if _, exists := collided[hashValue]; !exists {
+			continue
 		}
+		tb.collisions[hashValue] = append([]collidingToken{{
+			rawToken: append([]byte(nil), e.RawToken...),
+			entry:    tb.tokenMap[hashValue],
+		}}, collided[hashValue]...)
+		delete(tb.tokenMap, hashValue)
+		delete(collided, hashValue)
+	}
+	// The tokens no longer in the store are replaced by the colliding raw
+	// tokens
+	for hashValue, colliding := range collided {
+		delete(tb.tokenMap, hashValue)
+		if len(colliding) == 1 {
+			tb.tokenMap[hashValue] = colliding[0].entry
+		} else {
+			tb.collisions[hashValue] = colliding
+		}
+	}
+	return nil
+}
+
+// Returns the number of raw tokens sharing their hash values with other raw
+// tokens in the index
+func (tb *tokenTableMem) numColliding() int {
+	var n int
+	for _, colliding := range tb.collisions {
+		n += len(colliding)
 	}
-	fmt.Println()
-	if err := rows.Err(); err != nil {
-		panic(err)
+	return n
+}
+
+// TokenTableCollisions returns the number of raw tokens in the index
+// sharing their hash values with other raw tokens, which are told apart by
+// comparing the raw tokens, in a token table created by CreateTokenTableMem
+// or CreateTokenTableCompact. It is 0 for the disk token table.
+func TokenTableCollisions(tb TokenTable) int {
+	if table, ok := tb.(*tokenTableMem); ok {
+		table.lock.RLock()
+		defer table.lock.RUnlock()
+		return table.numColliding()
 	}
-	log.Printf("Finished creating token map and frequency table")
-	return table
+	return 0
+}
+
+// Returns the token map entry of a raw token with the hash value
+func (tb *tokenTableMem) lookup(hashValue uint64, rawToken []byte) (tokenMapEntry, bool) {
+	if colliding, exists := tb.collisions[hashValue]; exists {
+		for _, c := range colliding {
+			if bytes.Equal(c.rawToken, rawToken) {
+				return c.entry, true
+			}
+		}
+		return tokenMapEntry{}, false
+	}
+	entry, exists := tb.tokenMap[hashValue]
+	if !exists {
+		i := tb.sortedIndex(hashValue)
+		if i < 0 {
+			return tokenMapEntry{}, false
+		}
+		entry = tb.sorted[i].tokenMapEntry
+	}
+	// A raw token not in the index with the hash value of the token
+	if entry.Check != checkHash(rawToken) {
+		return tokenMapEntry{}, false
+	}
+	return entry, true
 }
 
 type byTokenOrder struct {
@@ -116,6 +257,16 @@ func (b byTokenOrder) Swap(i, j int) {
 func (b byTokenOrder) Less(i, j int) bool { return b.tokens[i] < b.tokens[j] }
 func (b byTokenOrder) Len() int           { return len(b.tokens) }
 
+type byTokenOrderWithRawTokens struct {
+	byTokenOrder
+	rawTokens [][]byte
+}
+
+func (b byTokenOrderWithRawTokens) Swap(i, j int) {
+	b.byTokenOrder.Swap(i, j)
+	b.rawTokens[i], b.rawTokens[j] = b.rawTokens[j], b.rawTokens[i]
+}
+
 type byTokenOrderSingular []int64
 
 func (b byTokenOrderSingular) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
@@ -123,16 +274,24 @@ func (b byTokenOrderSingular) Less(i, j int) bool { return b[i] < b[j] }
 func (b byTokenOrderSingular) Len() int           { return len(b) }
 
 // Takes the raw tokens and returns the matching tokens in the database
-func (tb tokenTableMem) process(set rawTokenSet) (tokens []int64, counts []int, gids []int64) {
+func (tb *tokenTableMem) process(set RawTokenSet) (tokens []int64, counts []int, gids []int64, err error) {
+	tokens, counts, gids, _, err = tb.processWithRawTokens(set)
+	return
+}
+
+func (tb *tokenTableMem) processWithRawTokens(set RawTokenSet) (tokens []int64, counts []int, gids []int64, rawTokens [][]byte, err error) {
+	tb.lock.RLock()
+	defer tb.lock.RUnlock()
 	tokens = make([]int64, 0)
 	counts = make([]int, 0)
 	gids = make([]int64, 0)
+	rawTokens = make([][]byte, 0)
 	h := fnv.New64a()
 	for _, rawToken := range set.RawTokens {
 		h.Reset()
 		h.Write(rawToken)
 		hashValue := h.Sum64()
-		if entry, exists := tb.tokenMap[hashValue]; exists {
+		if entry, exists := tb.lookup(hashValue, rawToken); exists {
 			frequency := tb.frequencies[entry.GroupID]
 			// NOTE: since all tokens are originally from the database, if frequency is 1
 			// it means the token only exists in the query set
@@ -142,14 +301,27 @@ func (tb tokenTableMem) process(set rawTokenSet) (tokens []int64, counts []int,
 			tokens = append(tokens, int64(entry.Token))
 			counts = append(counts, int(frequency-1))
 			gids = append(gids, int64(entry.GroupID))
+			rawTokens = append(rawTokens, rawToken)
 		}
 	}
-	b := byTokenOrder{tokens, counts, gids}
+	b := byTokenOrderWithRawTokens{byTokenOrder{tokens, counts, gids}, rawTokens}
 	sort.Sort(b)
-	return
+	// Remove the tokens of duplicate raw tokens in the query, so they are
+	// not counted twice in overlaps
+	n := 0
+	for i := range tokens {
+		if n > 0 && tokens[i] == tokens[n-1] {
+			continue
+		}
+		tokens[n], counts[n], gids[n], rawTokens[n] = tokens[i], counts[i], gids[i], rawTokens[i]
+		n++
+	}
+	return tokens[:n], counts[:n], gids[:n], rawTokens[:n], nil
 }
 
-func (tb tokenTableMem) processAndMinhashSignature(set rawTokenSet) (tokens []int64, sig []uint64) {
+func (tb *tokenTableMem) processAndMinhashSignature(set RawTokenSet) (tokens []int64, sig []uint64, err error) {
+	tb.lock.RLock()
+	defer tb.lock.RUnlock()
 	tokens = make([]int64, 0)
 	mh := lshensemble.NewMinhash(MinhashSeed, MinhashSize)
 	h := fnv.New64a()
@@ -157,7 +329,7 @@ func (tb tokenTableMem) processAndMinhashSignature(set rawTokenSet) (tokens []in
 		h.Reset()
 		h.Write(rawToken)
 		hashValue := h.Sum64()
-		if entry, exists := tb.tokenMap[hashValue]; exists {
+		if entry, exists := tb.lookup(hashValue, rawToken); exists {
 			frequency := tb.frequencies[entry.GroupID]
 			// NOTE: since all tokens are originally from the database, if frequency is 1
 			// it means the token only exists in the query set
@@ -169,84 +341,161 @@ func (tb tokenTableMem) processAndMinhashSignature(set rawTokenSet) (tokens []in
 		}
 	}
 	sort.Sort(byTokenOrderSingular(tokens))
-	return tokens, mh.Signature()
+	return tokens, mh.Signature(), nil
+}
+
+// Adds or replaces the token map entries, and the frequencies of their
+// duplicate groups. A new raw token colliding with a token in the map moves
+// both to the collisions.
+func (tb *tokenTableMem) update(entries []TokenEntry) {
+	tb.lock.Lock()
+	defer tb.lock.Unlock()
+	h := fnv.New64a()
+	collided := make(map[uint64][]collidingToken)
+	for _, e := range entries {
+		h.Reset()
+		h.Write(e.RawToken)
+		hashValue := h.Sum64()
+		entry := tokenMapEntry{
+			Token:   int32(e.Token),
+			GroupID: int32(e.GroupID),
+			Check:   checkHash(e.RawToken),
+		}
+		if e.Frequency > 0 {
+			for int64(len(tb.frequencies)) <= e.GroupID {
+				tb.frequencies = append(tb.frequencies, 0)
+			}
+			tb.frequencies[e.GroupID] = int32(e.Frequency)
+		}
+		if colliding, exists := tb.collisions[hashValue]; exists {
+			tb.updateCollision(hashValue, colliding, e, entry)
+			continue
+		}
+		if i := tb.sortedIndex(hashValue); i >= 0 {
+			if tb.sorted[i].Token == entry.Token {
+				if e.Frequency == 0 {
+					tb.sorted[i].Token = removedToken
+				} else {
+					tb.sorted[i].tokenMapEntry = entry
+				}
+				continue
+			}
+			// Move the sorted entry to the token map, so the collision is
+			// resolved in the same way
+			tb.tokenMap[hashValue] = tb.sorted[i].tokenMapEntry
+			tb.sorted[i].Token = removedToken
+		}
+		existing, exists := tb.tokenMap[hashValue]
+		if e.Frequency == 0 {
+			if exists && existing.Token == entry.Token {
+				delete(tb.tokenMap, hashValue)
+			}
+			continue
+		}
+		if exists && existing.Token != entry.Token {
+			collided[hashValue] = append(collided[hashValue], collidingToken{
+				rawToken: append([]byte(nil), e.RawToken...),
+				entry:    entry,
+			})
+			continue
+		}
+		tb.tokenMap[hashValue] = entry
+	}
+	if err := tb.addCollisions(collided); err != nil {
+		log.Printf("Failed to resolve %d colliding raw tokens: %v", len(collided), err)
+	}
+}
+
+// Replaces or removes the entry of a raw token among the raw tokens sharing
+// its hash value, or adds it
+func (tb *tokenTableMem) updateCollision(hashValue uint64, colliding []collidingToken,
+	e TokenEntry, entry tokenMapEntry) {
+	for i, c := range colliding {
+		if c.entry.Token != entry.Token {
+			continue
+		}
+		if e.Frequency == 0 {
+			colliding = append(colliding[:i], colliding[i+1:]...)
+		} else {
+			colliding[i].entry = entry
+		}
+		if len(colliding) == 0 {
+			delete(tb.collisions, hashValue)
+		} else {
+			tb.collisions[hashValue] = colliding
+		}
+		return
+	}
+	if e.Frequency > 0 {
+		tb.collisions[hashValue] = append(colliding, collidingToken{
+			rawToken: append([]byte(nil), e.RawToken...),
+			entry:    entry,
+		})
+	}
 }
 
-func createTokenTableDisk(db *sql.DB, listTable string, ignoreSelf bool) tokenTable {
+// CreateTokenTableDisk creates a token table that looks up tokens in the
+// index for every query.
+func CreateTokenTableDisk(store IndexStore, ignoreSelf bool) TokenTable {
 	return tokenTableDisk{
-		listTable:  listTable,
-		db:         db,
+		store:      store,
 		ignoreSelf: ignoreSelf,
 	}
 }
 
-func (tb tokenTableDisk) process(set rawTokenSet) (tokens []int64, counts []int, gids []int64) {
-	var q string
-	if tb.ignoreSelf {
-		q = fmt.Sprintf(`
-		SELECT token, frequency-1 AS count, duplicate_group_id FROM %s
-		WHERE token = ANY($1) AND frequency > 1
-		ORDER BY token ASC;`, pq.QuoteIdentifier(tb.listTable))
-	} else {
-		q = fmt.Sprintf(`
-		SELECT token, frequency-1 AS count, duplicate_group_id FROM %s
-		WHERE token = ANY($1)
-		ORDER BY token ASC;`, pq.QuoteIdentifier(tb.listTable))
+// Reads the metadata of the query tokens from the index, optionally
+// skipping tokens that only exist in the query set
+func (tb tokenTableDisk) entries(set RawTokenSet) ([]TokenEntry, error) {
+	entries, err := tb.store.TokenEntries(set.Tokens)
+	if err != nil || !tb.ignoreSelf {
+		return entries, err
 	}
-	rows, err := tb.db.Query(q, pq.Array(set.Tokens))
-	if err != nil {
-		panic(err)
-	}
-	tokens = make([]int64, 0)
-	counts = make([]int, 0)
-	gids = make([]int64, 0)
-	for rows.Next() {
-		var token int64
-		var count int64
-		var gid int64
-		if err := rows.Scan(&token, &count, &gid); err != nil {
-			panic(err)
+	filtered := entries[:0]
+	for _, entry := range entries {
+		if entry.Frequency > 1 {
+			filtered = append(filtered, entry)
 		}
-		tokens = append(tokens, token)
-		counts = append(counts, int(count))
-		gids = append(gids, gid)
-	}
-	if err := rows.Err(); err != nil {
-		panic(err)
 	}
+	return filtered, nil
+}
+
+func (tb tokenTableDisk) process(set RawTokenSet) (tokens []int64, counts []int, gids []int64, err error) {
+	tokens, counts, gids, _, err = tb.processWithRawTokens(set)
 	return
 }
 
-func (tb tokenTableDisk) processAndMinhashSignature(set rawTokenSet) (tokens []int64, sig []uint64) {
-	tokens = make([]int64, 0)
-	mh := lshensemble.NewMinhash(MinhashSeed, MinhashSize)
-	var q string
-	if tb.ignoreSelf {
-		q = fmt.Sprintf(`
-		SELECT token, raw_token FROM %s
-		WHERE token = ANY($1) AND frequency > 1
-		ORDER BY token ASC;`, pq.QuoteIdentifier(tb.listTable))
-	} else {
-		q = fmt.Sprintf(`
-		SELECT token, raw_token FROM %s
-		WHERE token = ANY($1)
-		ORDER BY token ASC;`, pq.QuoteIdentifier(tb.listTable))
-	}
-	rows, err := tb.db.Query(q, pq.Array(set.Tokens))
+func (tb tokenTableDisk) processWithRawTokens(set RawTokenSet) (tokens []int64, counts []int, gids []int64, rawTokens [][]byte, err error) {
+	entries, err := tb.entries(set)
 	if err != nil {
-		panic(err)
+		return nil, nil, nil, nil, err
 	}
-	for rows.Next() {
-		var rawToken []byte
-		var token int64
-		if err := rows.Scan(&token, &rawToken); err != nil {
-			panic(err)
-		}
-		tokens = append(tokens, token)
-		mh.Push(rawToken)
+	tokens = make([]int64, len(entries))
+	counts = make([]int, len(entries))
+	gids = make([]int64, len(entries))
+	rawTokens = make([][]byte, len(entries))
+	for i, entry := range entries {
+		tokens[i] = entry.Token
+		counts[i] = entry.Frequency - 1
+		gids[i] = entry.GroupID
+		rawTokens[i] = entry.RawToken
 	}
-	if err := rows.Err(); err != nil {
-		panic(err)
+	return tokens, counts, gids, rawTokens, nil
+}
+
+// The disk token table reads the token metadata from the index for every
+// query, so there is nothing to update
+func (tb tokenTableDisk) update(entries []TokenEntry) {}
+
+func (tb tokenTableDisk) processAndMinhashSignature(set RawTokenSet) (tokens []int64, sig []uint64, err error) {
+	entries, err := tb.entries(set)
+	if err != nil {
+		return nil, nil, err
+	}
+	tokens = make([]int64, len(entries))
+	mh := lshensemble.NewMinhash(MinhashSeed, MinhashSize)
+	for i, entry := range entries {
+		tokens[i] = entry.Token
+		mh.Push(entry.RawToken)
 	}
-	return tokens, mh.Signature()
+	return tokens, mh.Signature(), nil
 }
@@ -0,0 +1,224 @@
+package joise
+
+import (
+	"hash/fnv"
+	"log"
+	"runtime"
+	"sort"
+	"unsafe"
+)
+
+// tokenTableEntry is a token map entry with the hash value of its raw token
+type tokenTableEntry struct {
+	hash uint64
+	tokenMapEntry
+}
+
+// The token of a sorted entry removed by an index update
+const removedToken = -1
+
+// CreateTokenTableCompact loads all tokens in the index into a
+// memory-efficient token table for indexes with hundreds of millions of
+// tokens. Instead of a map, the tokens are kept in a single slice sorted by
+// the hash values of their raw tokens and looked up by binary search, which
+// takes 24 bytes per token and is allocated once instead of growing while
+// the tokens are read. A map takes more per token, how much depends on how
+// full the map is and on the Go map implementation, so the heap growth of
+// creating the table is logged next to the heap size of a token map
+// measured on a sample of the tokens.
+// Tokens added by index updates are kept in a map, and removed tokens are
+// marked in the slice. Lookups are slower than CreateTokenTableMem by a
+// binary search per query token.
+func CreateTokenTableCompact(store IndexStore, ignoreSelf bool) (TokenTable, error) {
+	heapBefore := heapAlloc()
+	count, err := store.NumTokens()
+	if err != nil {
+		return nil, err
+	}
+	maxGid, err := store.MaxGroupID()
+	if err != nil {
+		return nil, err
+	}
+	table := &tokenTableMem{
+		store:       store,
+		sorted:      make([]tokenTableEntry, 0, count),
+		tokenMap:    make(map[uint64]tokenMapEntry),
+		collisions:  make(map[uint64][]collidingToken),
+		frequencies: make([]int32, maxGid+1),
+		ignoreSelf:  ignoreSelf,
+	}
+	log.Printf("Filling compact token table with %d entries...", count)
+	h := fnv.New64a()
+	err = store.ScanTokenEntries(func(e TokenEntry) error {
+		h.Reset()
+		h.Write(e.RawToken)
+		table.frequencies[e.GroupID] = int32(e.Frequency)
+		table.sorted = append(table.sorted, tokenTableEntry{
+			hash: h.Sum64(),
+			tokenMapEntry: tokenMapEntry{
+				Token:   int32(e.Token),
+				GroupID: int32(e.GroupID),
+				Check:   checkHash(e.RawToken),
+			},
+		})
+		if len(table.sorted)%tokenProgressInterval == 0 {
+			log.Printf("Read %d token entries", len(table.sorted))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(table.sorted, func(i, j int) bool {
+		return table.sorted[i].hash < table.sorted[j].hash
+	})
+	// Move the runs of entries sharing a hash value to the collisions, the
+	// first entry of a run goes through the token map
+	collided := make(map[uint64][]collidingToken)
+	n := 0
+	for i := 0; i < len(table.sorted); {
+		j := i + 1
+		for j < len(table.sorted) && table.sorted[j].hash == table.sorted[i].hash {
+			j++
+		}
+		if j-i == 1 {
+			table.sorted[n] = table.sorted[i]
+			n++
+			i = j
+			continue
+		}
+		hashValue := table.sorted[i].hash
+		table.tokenMap[hashValue] = table.sorted[i].tokenMapEntry
+		for _, e := range table.sorted[i+1 : j] {
+			collided[hashValue] = append(collided[hashValue], collidingToken{
+				entry: e.tokenMapEntry,
+			})
+		}
+		i = j
+	}
+	table.sorted = table.sorted[:n]
+	if len(collided) > 0 {
+		if err := table.readCollidingRawTokens(collided); err != nil {
+			return nil, err
+		}
+		if err := table.addCollisions(collided); err != nil {
+			return nil, err
+		}
+	}
+	log.Printf("Found %d hash values shared by several raw tokens", len(table.collisions))
+	heapSize := heapAlloc() - heapBefore
+	log.Printf("Finished creating compact token table, the heap grew by %d bytes (%.1f bytes per token)",
+		heapSize, float64(heapSize)/float64(max(len(table.sorted), 1)))
+	if n, perToken := measureTokenMap(table.sorted); n > 0 {
+		log.Printf("A token map takes %.1f bytes per token on the heap, measured on %d tokens",
+			perToken, n)
+	}
+	return table, nil
+}
+
+// The maximum number of tokens in the token map measured by
+// measureTokenMap
+const tokenMapSampleSize = 1 << 20
+
+// Returns the heap bytes in use after a garbage collection
+func heapAlloc() int64 {
+	runtime.GC()
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+	return int64(m.HeapAlloc)
+}
+
+// Measures the heap bytes per token of a token map created like
+// CreateTokenTableMem does, and returns the number of entries measured. The
+// map is created with a sample of the entries, whose size is the number of
+// entries halved until it is at most tokenMapSampleSize, so the sample map
+// is about as full as a map of all entries.
+func measureTokenMap(entries []tokenTableEntry) (int, float64) {
+	n := len(entries)
+	for n > tokenMapSampleSize {
+		n /= 2
+	}
+	if n == 0 {
+		return 0, 0
+	}
+	before := heapAlloc()
+	tokenMap := make(map[uint64]tokenMapEntry, n)
+	for _, e := range entries[:n] {
+		tokenMap[e.hash] = e.tokenMapEntry
+	}
+	size := heapAlloc() - before
+	runtime.KeepAlive(tokenMap)
+	return n, float64(size) / float64(n)
+}
+
+// Reads the raw tokens of the colliding tokens from the store
+func (tb *tokenTableMem) readCollidingRawTokens(collided map[uint64][]collidingToken) error {
+	var tokens []int64
+	for _, colliding := range collided {
+		for _, c := range colliding {
+			tokens = append(tokens, int64(c.entry.Token))
+		}
+	}
+	entries, err := tb.store.TokenEntries(tokens)
+	if err != nil {
+		return err
+	}
+	rawTokens := make(map[int32][]byte, len(entries))
+	for _, e := range entries {
+		rawTokens[int32(e.Token)] = append([]byte(nil), e.RawToken...)
+	}
+	for _, colliding := range collided {
+		for i := range colliding {
+			colliding[i].rawToken = rawTokens[colliding[i].entry.Token]
+		}
+	}
+	return nil
+}
+
+// Returns the index of the sorted entry of the hash value, or -1 if there
+// is none
+func (tb *tokenTableMem) sortedIndex(hashValue uint64) int {
+	i := sort.Search(len(tb.sorted), func(i int) bool {
+		return tb.sorted[i].hash >= hashValue
+	})
+	if i == len(tb.sorted) || tb.sorted[i].hash != hashValue || tb.sorted[i].Token == removedToken {
+		return -1
+	}
+	return i
+}
+
+// Estimated memory size in bytes of a token map entry, including its share
+// of the empty slots and the control bytes of the map, which varies with
+// how full the map is and with the Go map implementation
+const tokenMapEntryBytes = 45
+
+// Returns an estimate of the memory size in bytes of the token table, from
+// the capacities of its slices and the estimated size of a map entry
+func (tb *tokenTableMem) memoryUsage() int64 {
+	size := int64(cap(tb.sorted))*int64(unsafe.Sizeof(tokenTableEntry{})) +
+		int64(len(tb.tokenMap))*tokenMapEntryBytes +
+		int64(cap(tb.frequencies))*int64(unsafe.Sizeof(int32(0)))
+	for _, colliding := range tb.collisions {
+		for _, c := range colliding {
+			size += tokenMapEntryBytes + int64(len(c.rawToken))
+		}
+	}
+	return size
+}
+
+// TokenTableMemoryUsage returns an estimate of the memory size in bytes of a
+// token table created by CreateTokenTableMem or CreateTokenTableCompact,
+// which is 0 for the disk token table. The estimate is not measured: it is
+// computed from the lengths of the slices and maps of the table, with an
+// estimated size of a map entry, and it may differ from the actual memory
+// use by the overhead of the Go map implementation. CreateTokenTableMem and
+// CreateTokenTableCompact log the heap growth measured while they create
+// the table.
+func TokenTableMemoryUsage(tb TokenTable) int64 {
+	if table, ok := tb.(*tokenTableMem); ok {
+		table.lock.RLock()
+		defer table.lock.RUnlock()
+		return table.memoryUsage()
+	}
+	return 0
+}
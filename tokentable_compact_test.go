@@ -0,0 +1,76 @@
+package joise
+
+import (
+	"fmt"
+	"math/rand"
+	"reflect"
+	"testing"
+)
+
+func TestTokenTableCompact(t *testing.T) {
+	r := rand.New(rand.NewSource(8))
+	sets := randomRawSets(r, 200, 300)
+	store := buildTestMemStore(t, sets)
+	tb, err := CreateTokenTableMem(store, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	compact, err := CreateTokenTableCompact(store, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if TokenTableMemoryUsage(compact) >= TokenTableMemoryUsage(tb) {
+		t.Fatalf("compact token table of %d bytes is not smaller than %d bytes",
+			TokenTableMemoryUsage(compact), TokenTableMemoryUsage(tb))
+	}
+	// Both token tables find the same tokens as the index is updated
+	check := func() {
+		t.Helper()
+		err := store.ScanTokenEntries(func(e TokenEntry) error {
+			query := RawTokenSet{RawTokens: [][]byte{e.RawToken}}
+			tokens, counts, gids, _ := tb.process(query)
+			compactTokens, compactCounts, compactGids, _ := compact.process(query)
+			if !reflect.DeepEqual(tokens, []int64{e.Token}) || !reflect.DeepEqual(compactTokens, tokens) ||
+				!reflect.DeepEqual(compactCounts, counts) || !reflect.DeepEqual(compactGids, gids) {
+				t.Fatalf("raw token %s: got %v %v %v, want %v %v %v", e.RawToken,
+					compactTokens, compactCounts, compactGids, tokens, counts, gids)
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	updater := NewIndexUpdater(store, tb, compact)
+	var added []RawTokenSet
+	for i := 0; i < 30; i++ {
+		tokens := []string{fmt.Sprintf("new%d", r.Intn(20)), fmt.Sprintf("t%d", r.Intn(300))}
+		added = append(added, RawTokenSet{ID: int64(1000 + i), RawTokens: distinctRawTokens(tokens)})
+	}
+	if err := updater.AddSets(added); err != nil {
+		t.Fatal(err)
+	}
+	check()
+	var deleted []int64
+	for id := int64(0); id < 100; id++ {
+		deleted = append(deleted, id)
+	}
+	if err := updater.DeleteSets(deleted); err != nil {
+		t.Fatal(err)
+	}
+	if err := updater.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	check()
+	for _, id := range deleted {
+		delete(sets, id)
+	}
+	for _, set := range added {
+		var tokens []string
+		for _, token := range set.RawTokens {
+			tokens = append(tokens, string(token))
+		}
+		sets[set.ID] = tokens
+	}
+	checkSearchAlgorithms(t, r, store, compact, sets)
+}
@@ -0,0 +1,105 @@
+package joise
+
+import (
+	"hash/fnv"
+	"math/rand"
+	"reflect"
+	"testing"
+)
+
+func fnvHash(rawToken []byte) uint64 {
+	h := fnv.New64a()
+	h.Write(rawToken)
+	return h.Sum64()
+}
+
+func TestTokenTableLookup(t *testing.T) {
+	r := rand.New(rand.NewSource(6))
+	sets := randomRawSets(r, 100, 200)
+	store := buildTestMemStore(t, sets)
+	for _, create := range []func(IndexStore, bool) (TokenTable, error){
+		CreateTokenTableMem, CreateTokenTableCompact} {
+		tb, err := create(store, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n := TokenTableCollisions(tb); n != 0 {
+			t.Fatalf("got %d colliding raw tokens", n)
+		}
+		err = store.ScanTokenEntries(func(e TokenEntry) error {
+			tokens, counts, gids, err := tb.process(RawTokenSet{RawTokens: [][]byte{e.RawToken}})
+			if err != nil {
+				return err
+			}
+			if !reflect.DeepEqual(tokens, []int64{e.Token}) || !reflect.DeepEqual(counts, []int{e.Frequency - 1}) ||
+				!reflect.DeepEqual(gids, []int64{e.GroupID}) {
+				t.Fatalf("raw token %s: got %v %v %v, want %v", e.RawToken, tokens, counts, gids, e)
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestTokenTableHashCollision(t *testing.T) {
+	r := rand.New(rand.NewSource(7))
+	store := buildTestMemStore(t, randomRawSets(r, 100, 200))
+	indexed, absent := []byte("t1"), []byte("not-indexed")
+	tb, err := CreateTokenTableMem(store, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	table := tb.(*tokenTableMem)
+	entry, exists := table.tokenMap[fnvHash(indexed)]
+	if !exists {
+		t.Fatalf("raw token %s is not in the index", indexed)
+	}
+
+	// The entry of an indexed raw token under the hash value of a raw token
+	// not in the index, as if both raw tokens had the same hash value
+	table.tokenMap[fnvHash(absent)] = entry
+	if tokens, _, _, _ := tb.process(RawTokenSet{RawTokens: [][]byte{absent}}); len(tokens) != 0 {
+		t.Fatalf("raw token not in the index found as %v", tokens)
+	}
+	delete(table.tokenMap, fnvHash(absent))
+
+	// Another raw token with the same hash value moves the token in the map
+	// to the collisions, and the raw tokens are told apart
+	other := tokenMapEntry{Token: entry.Token + 1, GroupID: entry.GroupID, Check: checkHash([]byte("other"))}
+	err = table.addCollisions(map[uint64][]collidingToken{
+		fnvHash(indexed): {{rawToken: []byte("other"), entry: other}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, exists := table.tokenMap[fnvHash(indexed)]; exists {
+		t.Fatalf("colliding raw token %s is still in the token map", indexed)
+	}
+	if n := TokenTableCollisions(tb); n != 2 {
+		t.Fatalf("got %d colliding raw tokens, want 2", n)
+	}
+	tokens, _, _, _ := tb.process(RawTokenSet{RawTokens: [][]byte{indexed}})
+	if !reflect.DeepEqual(tokens, []int64{int64(entry.Token)}) {
+		t.Fatalf("raw token %s: got %v, want %d", indexed, tokens, entry.Token)
+	}
+	if got, _ := table.lookup(fnvHash(indexed), []byte("other")); got != other {
+		t.Fatalf("raw token other: got %v, want %v", got, other)
+	}
+	if _, exists := table.lookup(fnvHash(indexed), []byte("absent")); exists {
+		t.Fatal("raw token not among the colliding raw tokens found")
+	}
+	if tokens, _, _, _ := tb.process(RawTokenSet{RawTokens: [][]byte{[]byte("t2")}}); len(tokens) != 1 {
+		t.Fatalf("raw token t2: got %v", tokens)
+	}
+
+	// Removing a colliding raw token keeps the other one
+	table.update([]TokenEntry{{Token: int64(entry.Token), GroupID: int64(entry.GroupID), RawToken: indexed}})
+	if tokens, _, _, _ := tb.process(RawTokenSet{RawTokens: [][]byte{indexed}}); len(tokens) != 0 {
+		t.Fatalf("removed raw token %s found as %v", indexed, tokens)
+	}
+	if got, _ := table.lookup(fnvHash(indexed), []byte("other")); got != other {
+		t.Fatalf("raw token other after removal: got %v, want %v", got, other)
+	}
+}
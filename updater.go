@@ -0,0 +1,382 @@
+package joise
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrSetExists is returned when adding a set whose ID is already in the index.
+var ErrSetExists = errors.New("set already exists")
+
+// indexUpdate is a batch of posting lists and sets written to an index store
+// together. The posting lists are complete and replace the existing ones.
+type indexUpdate struct {
+	tokens          []TokenEntry
+	lists           [][]ListEntry
+	prevFrequencies []int // the frequencies of the tokens before the update
+	setIDs          []int64
+	sets            [][]int64
+	deletedTokens   []int64
+	deletedSets     []int64
+}
+
+// IndexUpdater adds new sets of raw tokens to an existing index and deletes
+// sets from it, and keeps the token tables used for searching the index in
+// sync.
+// Updates are serialized by the updater, so there must be only one updater
+// for an index.
+//
+// The global token order of an index is created once by BuildIndex, and it
+// drifts as sets are added: tokens not in the index are assigned new tokens
+// at the end of the order regardless of their frequencies, and the
+// frequencies of existing tokens grow without moving them in the order.
+// Search results stay exact, since the search algorithms only require that
+// the tokens of every set are sorted in the same order as the query tokens,
+// and that tokens sharing a duplicate group have identical posting lists.
+// Duplicate groups are split when only some of their tokens appear in a new
+// set. The drift makes the prefix filter and the cost model less effective,
+// so indexes receiving many updates should be rebuilt periodically.
+type IndexUpdater struct {
+	lock   sync.Mutex
+	store  MutableIndexStore
+	tables []TokenTable
+}
+
+// NewIndexUpdater creates an updater for the index store, which updates the
+// given token tables after every change to the index.
+func NewIndexUpdater(store MutableIndexStore, tables ...TokenTable) *IndexUpdater {
+	return &IndexUpdater{
+		store:  store,
+		tables: tables,
+	}
+}
+
+// AddSet adds a new set of raw tokens to the index, using set.ID as its
+// set ID.
+func (u *IndexUpdater) AddSet(set RawTokenSet) error {
+	return u.AddSets([]RawTokenSet{set})
+}
+
+// AddSets adds a batch of new sets of raw tokens to the index, using the
+// ID of every set as its set ID. Duplicate raw tokens in a set are counted
+// once. The batch is written to the index store atomically.
+// The ID of a deleted set cannot be reused until the index is compacted.
+// A set becomes visible to queries once AddSets returns; queries running
+// concurrently may only see some tokens of the new sets.
+func (u *IndexUpdater) AddSets(sets []RawTokenSet) error {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+
+	// Check the set IDs and collect the distinct raw tokens of each set
+	rawSets := make([][]string, len(sets))
+	setIndexes := make(map[int64]bool, len(sets))
+	batchFrequencies := make(map[string]int)
+	for i, set := range sets {
+		if setIndexes[set.ID] {
+			return fmt.Errorf("%w: set %d added twice", ErrSetExists, set.ID)
+		}
+		setIndexes[set.ID] = true
+		if _, err := u.store.SetTokens(set.ID); err == nil {
+			return fmt.Errorf("%w: set %d", ErrSetExists, set.ID)
+		} else if !errors.Is(err, ErrSetNotFound) {
+			return err
+		}
+		seen := make(map[string]bool, len(set.RawTokens))
+		for _, rawToken := range set.RawTokens {
+			if seen[string(rawToken)] {
+				continue
+			}
+			seen[string(rawToken)] = true
+			rawSets[i] = append(rawSets[i], string(rawToken))
+			batchFrequencies[string(rawToken)]++
+		}
+		if len(rawSets[i]) == 0 {
+			return fmt.Errorf("set %d has no tokens", set.ID)
+		}
+	}
+
+	// Find the existing tokens
+	rawTokens := make([][]byte, 0, len(batchFrequencies))
+	for rawToken := range batchFrequencies {
+		rawTokens = append(rawTokens, []byte(rawToken))
+	}
+	existing, err := u.store.rawTokenEntries(rawTokens)
+	if err != nil {
+		return err
+	}
+	entries := make(map[string]TokenEntry, len(batchFrequencies))
+	for _, e := range existing {
+		entries[string(e.RawToken)] = e
+	}
+
+	// Assign new tokens at the end of the global order, following the
+	// frequencies in this batch
+	var newRawTokens []string
+	for rawToken := range batchFrequencies {
+		if _, exists := entries[rawToken]; !exists {
+			newRawTokens = append(newRawTokens, rawToken)
+		}
+	}
+	sort.Slice(newRawTokens, func(i, j int) bool {
+		fi, fj := batchFrequencies[newRawTokens[i]], batchFrequencies[newRawTokens[j]]
+		if fi != fj {
+			return fi < fj
+		}
+		return newRawTokens[i] < newRawTokens[j]
+	})
+	nextToken, err := u.store.nextToken()
+	if err != nil {
+		return err
+	}
+	for i, rawToken := range newRawTokens {
+		entries[rawToken] = TokenEntry{
+			Token:    nextToken + int64(i),
+			RawToken: []byte(rawToken),
+			GroupID:  -1,
+		}
+	}
+
+	// Create the integer sets and the new posting list entries
+	update := &indexUpdate{
+		setIDs: make([]int64, len(sets)),
+		sets:   make([][]int64, len(sets)),
+	}
+	newEntries := make(map[int64][]ListEntry)
+	for i, set := range sets {
+		tokens := make([]int64, len(rawSets[i]))
+		for j, rawToken := range rawSets[i] {
+			tokens[j] = entries[rawToken].Token
+		}
+		sort.Sort(byTokenOrderSingular(tokens))
+		for pos, token := range tokens {
+			newEntries[token] = append(newEntries[token], ListEntry{
+				ID:            set.ID,
+				Size:          len(tokens),
+				MatchPosition: pos,
+			})
+		}
+		update.setIDs[i] = set.ID
+		update.sets[i] = tokens
+	}
+
+	// Split the duplicate groups: tokens from the same group stay in the
+	// same group only if they are added to the same new sets
+	maxGid, err := u.store.MaxGroupID()
+	if err != nil {
+		return err
+	}
+	groups := make(map[string]int64)
+	var splits []TokenEntry
+	touched := make([]TokenEntry, 0, len(entries))
+	for _, e := range entries {
+		touched = append(touched, e)
+	}
+	sort.Slice(touched, func(i, j int) bool { return touched[i].Token < touched[j].Token })
+	for _, e := range touched {
+		list := newEntries[e.Token]
+		sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+		var key strings.Builder
+		key.WriteString(strconv.FormatInt(e.GroupID, 10))
+		for _, entry := range list {
+			key.WriteByte(' ')
+			key.WriteString(strconv.FormatInt(entry.ID, 10))
+		}
+		gid, exists := groups[key.String()]
+		if !exists {
+			maxGid++
+			gid = maxGid
+			groups[key.String()] = gid
+		}
+		if e.GroupID >= 0 {
+			// Split the existing group before the index is updated, this is
+			// safe as the tokens still have identical posting lists
+			splits = append(splits, TokenEntry{
+				Token:     e.Token,
+				RawToken:  e.RawToken,
+				Frequency: e.Frequency,
+				GroupID:   gid,
+			})
+		}
+		update.prevFrequencies = append(update.prevFrequencies, e.Frequency)
+		e.GroupID = gid
+		e.Frequency += len(list)
+		update.tokens = append(update.tokens, e)
+	}
+	for _, tb := range u.tables {
+		tb.update(splits)
+	}
+
+	// Merge the new entries into the posting lists, the existing lists are
+	// copied as they may be shared with running queries
+	update.lists = make([][]ListEntry, len(update.tokens))
+	for i, e := range update.tokens {
+		added := newEntries[e.Token]
+		var list []ListEntry
+		if len(added) < e.Frequency {
+			if list, err = u.store.InvertedList(e.Token); err != nil {
+				return err
+			}
+		}
+		update.lists[i] = mergeListEntries(list, added)
+	}
+	if err := u.store.applyUpdate(update); err != nil {
+		return err
+	}
+	for _, tb := range u.tables {
+		tb.update(update.tokens)
+	}
+	return nil
+}
+
+// DeleteSet deletes a set from the index, see DeleteSets.
+func (u *IndexUpdater) DeleteSet(setID int64) error {
+	return u.DeleteSets([]int64{setID})
+}
+
+// DeleteSets marks sets as deleted, so they stop appearing in the results
+// of queries started after DeleteSets returns. The deleted sets stay in the
+// posting lists and are skipped by the search algorithms until Compact
+// removes them.
+func (u *IndexUpdater) DeleteSets(setIDs []int64) error {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	for _, setID := range setIDs {
+		if _, err := u.store.SetTokens(setID); err != nil {
+			return err
+		}
+	}
+	return u.store.deleteSets(setIDs)
+}
+
+// Compact removes the deleted sets from the posting lists and the set
+// table. The frequencies of their tokens are decreased, tokens that are no
+// longer in any set are removed, and duplicate groups whose posting lists
+// become identical are merged.
+func (u *IndexUpdater) Compact() error {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+
+	deletedSets, err := u.store.DeletedSets()
+	if err != nil || len(deletedSets) == 0 {
+		return err
+	}
+	deleted := make(map[int64]bool, len(deletedSets))
+	var tokens []int64
+	seen := make(map[int64]bool)
+	for _, setID := range deletedSets {
+		deleted[setID] = true
+		setTokens, err := u.store.SetTokens(setID)
+		if errors.Is(err, ErrSetNotFound) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		for _, token := range setTokens {
+			if !seen[token] {
+				seen[token] = true
+				tokens = append(tokens, token)
+			}
+		}
+	}
+	sort.Sort(byTokenOrderSingular(tokens))
+	entries, err := u.store.TokenEntries(tokens)
+	if err != nil {
+		return err
+	}
+
+	// Remove the deleted sets from the posting lists, a new list is created
+	// as the existing one may be shared with running queries
+	update := &indexUpdate{deletedSets: deletedSets}
+	var removed []TokenEntry
+	var keys []string
+	groups := make(map[string]int64)
+	for _, e := range entries {
+		list, err := u.store.InvertedList(e.Token)
+		if err != nil {
+			return err
+		}
+		compacted := make([]ListEntry, 0, len(list))
+		var key strings.Builder
+		for _, entry := range list {
+			if !deleted[entry.ID] {
+				compacted = append(compacted, entry)
+				key.WriteString(strconv.FormatInt(entry.ID, 10))
+				key.WriteByte(' ')
+			}
+		}
+		if len(compacted) == 0 {
+			update.deletedTokens = append(update.deletedTokens, e.Token)
+			e.Frequency = 0
+			removed = append(removed, e)
+			continue
+		}
+		// All tokens of a duplicate group contain the same deleted sets, so
+		// groups can be merged without affecting other tokens
+		if gid, exists := groups[key.String()]; !exists || e.GroupID < gid {
+			groups[key.String()] = e.GroupID
+		}
+		keys = append(keys, key.String())
+		update.prevFrequencies = append(update.prevFrequencies, e.Frequency)
+		e.Frequency = len(compacted)
+		update.tokens = append(update.tokens, e)
+		update.lists = append(update.lists, compacted)
+	}
+	for i := range update.tokens {
+		update.tokens[i].GroupID = groups[keys[i]]
+	}
+
+	// Tokens without sets are removed from the token tables first, they only
+	// match deleted sets which queries skip anyway
+	for _, tb := range u.tables {
+		tb.update(removed)
+	}
+	if err := u.store.applyUpdate(update); err != nil {
+		return err
+	}
+	for _, tb := range u.tables {
+		tb.update(update.tokens)
+	}
+	return nil
+}
+
+// RunCompaction compacts the index at every interval until the context is
+// done. Compaction errors are logged and retried at the next interval.
+func (u *IndexUpdater) RunCompaction(ctx context.Context, interval time.Duration) error {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+			if err := u.Compact(); err != nil {
+				log.Printf("Compaction failed: %v", err)
+			}
+		}
+	}
+}
+
+// Merges two posting lists sorted by set ID into a new list
+func mergeListEntries(a, b []ListEntry) []ListEntry {
+	merged := make([]ListEntry, 0, len(a)+len(b))
+	var i, j int
+	for i < len(a) && j < len(b) {
+		if a[i].ID < b[j].ID {
+			merged = append(merged, a[i])
+			i++
+		} else {
+			merged = append(merged, b[j])
+			j++
+		}
+	}
+	merged = append(merged, a[i:]...)
+	return append(merged, b[j:]...)
+}
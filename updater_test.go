@@ -0,0 +1,74 @@
+package joise
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"sort"
+	"testing"
+)
+
+func TestIndexUpdater(t *testing.T) {
+	r := rand.New(rand.NewSource(4))
+	sets := randomRawSets(r, 200, 300)
+	for _, opts := range [][]StoreOption{nil, {WithCompressedLists(), WithCompressedSets()}} {
+		store := buildTestMemStore(t, sets, opts...)
+		tb, err := CreateTokenTableMem(store, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		updater := NewIndexUpdater(store, tb)
+		current := make(map[int64][]string, len(sets))
+		for id, tokens := range sets {
+			current[id] = tokens
+		}
+
+		// New sets of new and existing raw tokens, which splits duplicate
+		// groups and appends tokens to the global order
+		var added []RawTokenSet
+		for i := 0; i < 50; i++ {
+			id := int64(1000 + i)
+			tokens := []string{fmt.Sprintf("new%d", r.Intn(40))}
+			for _, token := range sets[int64(r.Intn(len(sets)))] {
+				if r.Intn(2) == 0 {
+					tokens = append(tokens, token)
+				}
+			}
+			added = append(added, RawTokenSet{ID: id, RawTokens: distinctRawTokens(tokens)})
+			current[id] = tokens
+		}
+		if err := updater.AddSets(added); err != nil {
+			t.Fatal(err)
+		}
+		if err := updater.AddSet(added[0]); !errors.Is(err, ErrSetExists) {
+			t.Fatalf("adding an existing set: got error %v", err)
+		}
+		checkSearchAlgorithms(t, r, store, tb, current)
+
+		// Deleted sets are skipped before and after compaction
+		var ids []int64
+		for id := range current {
+			ids = append(ids, id)
+		}
+		sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+		r.Shuffle(len(ids), func(i, j int) { ids[i], ids[j] = ids[j], ids[i] })
+		deleted := ids[:100]
+		if err := updater.DeleteSets(deleted); err != nil {
+			t.Fatal(err)
+		}
+		for _, id := range deleted {
+			delete(current, id)
+		}
+		if store.NumSets() != len(current) {
+			t.Fatalf("got %d sets before compaction, want %d", store.NumSets(), len(current))
+		}
+		checkSearchAlgorithms(t, r, store, tb, current)
+		if err := updater.Compact(); err != nil {
+			t.Fatal(err)
+		}
+		if store.NumSets() != len(current) {
+			t.Fatalf("got %d sets after compaction, want %d", store.NumSets(), len(current))
+		}
+		checkSearchAlgorithms(t, r, store, tb, current)
+	}
+}